@@ -17,18 +17,72 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// UpdateStrategy is how the digest of an instance follows the verified tags
+// of its bundle
+// +kubebuilder:validation:Enum=Pinned;Patch;Minor;LatestVerified
+type UpdateStrategy string
+
+const (
+	// UpdateStrategyPinned never moves the digest
+	UpdateStrategyPinned UpdateStrategy = "Pinned"
+	// UpdateStrategyPatch moves to the highest patch of the minor version
+	UpdateStrategyPatch UpdateStrategy = "Patch"
+	// UpdateStrategyMinor moves to the highest minor of the major version
+	UpdateStrategyMinor UpdateStrategy = "Minor"
+	// UpdateStrategyLatestVerified moves to the highest verified version
+	UpdateStrategyLatestVerified UpdateStrategy = "LatestVerified"
+)
+
+// WeekDay is a day of the week of a maintenance window
+// +kubebuilder:validation:Enum=Mon;Tue;Wed;Thu;Fri;Sat;Sun
+type WeekDay string
+
+// MaintenanceWindow is a recurring window the upgrades are applied in
+type MaintenanceWindow struct {
+	// Days are the days the window starts, every day when empty
+	Days []WeekDay `json:"days,omitempty"`
+	// Start is the time the window starts, HH:MM
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	Start string `json:"start"`
+	// Duration is the duration of the window
+	Duration metav1.Duration `json:"duration"`
+	// TimeZone is the IANA time zone of Start, UTC by default
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// UpdatePolicy moves the digest of an instance to the newer verified tags of
+// its bundle
+type UpdatePolicy struct {
+	// Strategy is Pinned, the default, Patch, Minor or LatestVerified
+	Strategy UpdateStrategy `json:"strategy,omitempty"`
+	// MaintenanceWindows are the windows the upgrades are applied in, any
+	// time when empty
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+}
+
 // EntandoBundleInstanceV2Spec defines the desired state of EntandoBundleInstanceV2
 type EntandoBundleInstanceV2Spec struct {
 	Tag        string `json:"tag,omitempty"`
 	Digest     string `json:"digest,omitempty"`
 	Repository string `json:"repository,omitempty"`
+	// BundleRef is the name of the EntandoBundleV2, in the namespace of the
+	// instance, the instance is installed from. The repository is the one of
+	// the bundle.
+	BundleRef string `json:"bundleRef,omitempty"`
+	// UpdatePolicy moves the digest to the newer verified tags of the
+	// bundle of BundleRef
+	UpdatePolicy *UpdatePolicy `json:"updatePolicy,omitempty"`
 	// FIXME vanno inserite in annotations Dependencies  []string `json:"dependencies,omitempty"`
 	// FIXME vanno inserite in annotations Components    []string `json:"components,omitempty"`
 	DesiredStatus string `json:"desiredStatus,omitempty"`
 	Configuration string `json:"configuration,omitempty"`
+	// ImagePullSecrets are the secrets used to pull the bundle and the images
+	// of its plugins, in addition to the ones of the bundle
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 }
 
 // EntandoBundleInstanceV2Status defines the observed state of EntandoBundleInstanceV2
@@ -38,6 +92,115 @@ type EntandoBundleInstanceV2Status struct {
 	// +listType=map
 	// +listMapKey=type
 	Conditions []metav1.Condition `json:"conditions"`
+	// InstalledDigest is the digest of the bundle the instance was last
+	// completely installed or upgraded to
+	InstalledDigest string `json:"installedDigest,omitempty"`
+	// ResolvedRef is the reference the bundle was last pulled from, after
+	// the mirror rules of the operator
+	ResolvedRef string `json:"resolvedRef,omitempty"`
+	// Jobs records the executions of the JOB components of the bundle
+	Jobs []JobStatus `json:"jobs,omitempty"`
+	// Components is the state of the components of the bundle
+	Components []ComponentStatus `json:"components,omitempty"`
+	// PendingUpgrade is the upgrade waiting for a maintenance window
+	PendingUpgrade *PendingUpgrade `json:"pendingUpgrade,omitempty"`
+	// Upgrades are the last upgrades of the digest, the latest last
+	Upgrades []UpgradeRecord `json:"upgrades,omitempty"`
+}
+
+// PendingUpgrade is an upgrade selected by the update policy
+type PendingUpgrade struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+	// NotBefore is the start of the next maintenance window
+	NotBefore metav1.Time `json:"notBefore"`
+}
+
+// UpgradeRecord records an upgrade of the digest of the instance
+type UpgradeRecord struct {
+	FromTag    string      `json:"fromTag,omitempty"`
+	FromDigest string      `json:"fromDigest,omitempty"`
+	ToTag      string      `json:"toTag,omitempty"`
+	ToDigest   string      `json:"toDigest"`
+	Time       metav1.Time `json:"time"`
+	// TriggeredBy is who moved the digest, the update policy or the
+	// manager of the change of the instance
+	TriggeredBy string `json:"triggeredBy"`
+}
+
+// ComponentState is the state of a component of the bundle in the instance
+// +kubebuilder:validation:Enum=Pending;Installing;Ready;Failed
+type ComponentState string
+
+const (
+	// ComponentStatePending is the state of a component waiting for its dependencies
+	ComponentStatePending    ComponentState = "Pending"
+	ComponentStateInstalling ComponentState = "Installing"
+	ComponentStateReady      ComponentState = "Ready"
+	ComponentStateFailed     ComponentState = "Failed"
+)
+
+// ComponentStatus is the state of a component of the bundle
+type ComponentStatus struct {
+	Name  string         `json:"name"`
+	Type  string         `json:"type"`
+	State ComponentState `json:"state"`
+	// +optional
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Image is the verification of the image of a PLUGIN component
+	// +optional
+	Image *ImageStatus `json:"image,omitempty"`
+}
+
+// ImageStatus is the verification of the image of a plugin
+type ImageStatus struct {
+	Image string `json:"image"`
+	// Pinned tells if the image is pinned by digest
+	Pinned bool `json:"pinned"`
+	// Digest is the digest of the image deployed, the one of its tag when
+	// the image is not pinned
+	// +optional
+	Digest string `json:"digest,omitempty"`
+	// Verified tells if the signature of the image is verified
+	Verified bool `json:"verified"`
+	// Signers are the verifications of the image by each signer
+	Signers []SignerStatus `json:"signers,omitempty"`
+	// Message tells why the image is not verified
+	Message string `json:"message,omitempty"`
+	// PolicyHash is the hash of the policy and the signers the image was
+	// verified with, the image is verified again when they change
+	// +optional
+	PolicyHash string `json:"policyHash,omitempty"`
+}
+
+// JobState is the state of the execution of a JOB component
+// +kubebuilder:validation:Enum=Running;Succeeded;Failed
+type JobState string
+
+const (
+	JobStateRunning   JobState = "Running"
+	JobStateSucceeded JobState = "Succeeded"
+	JobStateFailed    JobState = "Failed"
+)
+
+// JobStatus records the execution of a JOB component for a bundle digest
+type JobStatus struct {
+	Component string   `json:"component"`
+	Phase     string   `json:"phase"`
+	Digest    string   `json:"digest"`
+	JobName   string   `json:"jobName"`
+	State     JobState `json:"state"`
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+	// LogsHint tells where to find the logs of the job
+	// +optional
+	LogsHint string `json:"logsHint,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -31,11 +32,152 @@ const (
 	SignatureKeyLess SignatureType = "KEY_LESS"
 )
 
+// SignaturePolicy is what happens to the digests of a bundle whose
+// signatures are not verified
+// +kubebuilder:validation:Enum=Off;Warn;Enforce
+type SignaturePolicy string
+
+const (
+	// SignaturePolicyOff doesn't verify the signatures
+	SignaturePolicyOff SignaturePolicy = "Off"
+	// SignaturePolicyWarn installs the digests not verified with a warning
+	SignaturePolicyWarn SignaturePolicy = "Warn"
+	// SignaturePolicyEnforce refuses to install the digests not verified
+	SignaturePolicyEnforce SignaturePolicy = "Enforce"
+)
+
+// SignerRequirement is how many signers must verify a digest
+// +kubebuilder:validation:Enum=AllOf;AnyOf;Threshold
+type SignerRequirement string
+
+const (
+	// SignerRequirementAllOf requires every signer
+	SignerRequirementAllOf SignerRequirement = "AllOf"
+	// SignerRequirementAnyOf requires one signer
+	SignerRequirementAnyOf SignerRequirement = "AnyOf"
+	// SignerRequirementThreshold requires Threshold signers
+	SignerRequirementThreshold SignerRequirement = "Threshold"
+)
+
 type SignatureInfo struct {
+	// Name identifies the signer in the status, by default its type and
+	// its position
+	Name string        `json:"name,omitempty"`
 	Type SignatureType `json:"type,omitempty"`
 	//Image        string        `json:"image,omitempty"`
-	PubKey       string `json:"pubKey,omitempty"`
+
+	// PubKey is the PEM encoded cosign public key
+	PubKey string `json:"pubKey,omitempty"`
+	// PubKeySecret is the secret, in the namespace of the bundle, with the
+	// PEM encoded cosign public key
 	PubKeySecret string `json:"pubKeySecret,omitempty"`
+	// PubKeySecretKey is the key of the public key in PubKeySecret, by
+	// default cosign.pub
+	PubKeySecretKey string `json:"pubKeySecretKey,omitempty"`
+
+	// CertificateIdentity is the identity, a subject alternative name, of
+	// the Fulcio certificate of a KEY_LESS signature
+	CertificateIdentity string `json:"certificateIdentity,omitempty"`
+	// CertificateIdentityRegexp is a regular expression matching the
+	// identity of the Fulcio certificate of a KEY_LESS signature
+	CertificateIdentityRegexp string `json:"certificateIdentityRegexp,omitempty"`
+	// CertificateOidcIssuer is the OIDC issuer of the Fulcio certificate of
+	// a KEY_LESS signature
+	CertificateOidcIssuer string `json:"certificateOidcIssuer,omitempty"`
+	// CertificateOidcIssuerRegexp is a regular expression matching the OIDC
+	// issuer of the Fulcio certificate of a KEY_LESS signature
+	CertificateOidcIssuerRegexp string `json:"certificateOidcIssuerRegexp,omitempty"`
+}
+
+// SignerPolicy are the signers that must verify the digests of a bundle,
+// the ones of the tag and the ones of the signer groups. The signers with
+// the same public key or Fulcio identity count once.
+type SignerPolicy struct {
+	// Require is AllOf, the default, AnyOf or Threshold
+	Require SignerRequirement `json:"require,omitempty"`
+	// Threshold is the number of signers required by Threshold
+	// +kubebuilder:validation:Minimum=1
+	Threshold int `json:"threshold,omitempty"`
+	// SignerGroups are the names of the EntandoSignerGroups whose signers
+	// are added to the ones of each tag
+	SignerGroups []string `json:"signerGroups,omitempty"`
+}
+
+// SBOMFormat is the format of an SBOM attestation
+// +kubebuilder:validation:Enum=spdx;cyclonedx
+type SBOMFormat string
+
+const (
+	// SBOMFormatSPDX is an SPDX document
+	SBOMFormatSPDX SBOMFormat = "spdx"
+	// SBOMFormatCycloneDX is a CycloneDX BOM
+	SBOMFormatCycloneDX SBOMFormat = "cyclonedx"
+)
+
+// ProvenancePolicy are the rules of the SLSA provenance attestation
+type ProvenancePolicy struct {
+	// BuilderIDRegexp is a regular expression matching the id of the
+	// builder
+	BuilderIDRegexp string `json:"builderIdRegexp,omitempty"`
+	// SourceRepoRegexp is a regular expression matching the uri of the
+	// source repository
+	SourceRepoRegexp string `json:"sourceRepoRegexp,omitempty"`
+}
+
+// SBOMPolicy are the rules of the SBOM attestation
+type SBOMPolicy struct {
+	// Formats are the accepted formats, by default spdx and cyclonedx
+	Formats []SBOMFormat `json:"formats,omitempty"`
+}
+
+// AttestationPolicy are the cosign attestations required on the digests of
+// a bundle, signed by the signers of the tags
+type AttestationPolicy struct {
+	// Provenance requires a SLSA provenance attestation
+	Provenance *ProvenancePolicy `json:"provenance,omitempty"`
+	// SBOM requires an SBOM attestation
+	SBOM *SBOMPolicy `json:"sbom,omitempty"`
+}
+
+// PluginSigner are the signers of the image of a plugin of the bundle
+type PluginSigner struct {
+	// Name is the name of the plugin component
+	Name          string          `json:"name"`
+	SignatureInfo []SignatureInfo `json:"signatureInfo,omitempty"`
+}
+
+// PluginImagePolicy is the verification of the images of the plugins of a
+// bundle before they are deployed
+type PluginImagePolicy struct {
+	// Verify verifies the signatures of the plugin images under the
+	// signature policy of the bundle, with the signers of the tag or the
+	// ones of the plugin
+	Verify bool `json:"verify,omitempty"`
+	// Strict rejects the plugin images not pinned by digest, otherwise they
+	// are deployed by the digest of their tag
+	Strict bool `json:"strict,omitempty"`
+	// Plugins are the signers of single plugins, in place of the signers of
+	// the tag
+	Plugins []PluginSigner `json:"plugins,omitempty"`
+}
+
+// TagDiscovery lists the tags of the repository of a bundle and keeps the
+// matching ones in the discovered versions of the status
+type TagDiscovery struct {
+	// SemverRange keeps the tags that are semantic versions in the range,
+	// like ">=1.2.0 <2.0.0"
+	SemverRange string `json:"semverRange,omitempty"`
+	// TagRegexp keeps the tags matching the regular expression
+	TagRegexp string `json:"tagRegexp,omitempty"`
+	// Interval is the interval the tags are listed, 10m by default. After a
+	// failure the interval backs off.
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// MaxVersions is the number of the highest versions kept, 10 by default
+	// +kubebuilder:validation:Minimum=1
+	MaxVersions int `json:"maxVersions,omitempty"`
+	// SignatureInfo are the signers of the discovered versions, the ones of
+	// the signer groups of the signer policy are added
+	SignatureInfo []SignatureInfo `json:"signatureInfo,omitempty"`
 }
 
 type EntandoBundleTag struct {
@@ -46,11 +188,32 @@ type EntandoBundleTag struct {
 
 // EntandoBundleV2Spec defines the desired state of EntandoBundleV2
 type EntandoBundleV2Spec struct {
-	Title         string             `json:"title,omitempty"`
-	Icon          string             `json:"icon,omitempty"`
-	SignatureInfo string             `json:"signatureInfo,omitempty"`
-	Repository    string             `json:"repository,omitempty"`
-	TagList       []EntandoBundleTag `json:"tagList,omitempty"`
+	Title         string `json:"title,omitempty"`
+	Icon          string `json:"icon,omitempty"`
+	SignatureInfo string `json:"signatureInfo,omitempty"`
+	// Repository is the registry repository of the bundle or, for the air
+	// gapped installations, an OCI image layout directory oci-layout://<path>
+	// or a tarball tarball://<path> in the local bundle roots of the operator
+	Repository string             `json:"repository,omitempty"`
+	TagList    []EntandoBundleTag `json:"tagList,omitempty"`
+	// ImagePullSecrets are the secrets used to pull the bundle from a
+	// private registry
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// SignaturePolicy applies to the instances of the bundle, when empty or
+	// less strict the policy of the operator applies
+	SignaturePolicy SignaturePolicy `json:"signaturePolicy,omitempty"`
+	// SignerPolicy are the signers required to verify a digest, when nil
+	// every signature of the tag is required
+	SignerPolicy *SignerPolicy `json:"signerPolicy,omitempty"`
+	// AttestationPolicy are the attestations required on the digests, the
+	// digests not compliant are not verified
+	AttestationPolicy *AttestationPolicy `json:"attestationPolicy,omitempty"`
+	// PluginImagePolicy is the verification of the images of the plugins,
+	// when nil they are not verified
+	PluginImagePolicy *PluginImagePolicy `json:"pluginImagePolicy,omitempty"`
+	// TagDiscovery lists the tags of the repository, when nil only the tags
+	// of the tag list are known
+	TagDiscovery *TagDiscovery `json:"tagDiscovery,omitempty"`
 }
 
 // EntandoBundleV2Status defines the observed state of EntandoBundleV2
@@ -60,6 +223,88 @@ type EntandoBundleV2Status struct {
 	// +listType=map
 	// +listMapKey=type
 	Conditions []metav1.Condition `json:"conditions"`
+	// Tags is the state of the tags of the bundle
+	Tags []EntandoBundleTagStatus `json:"tags,omitempty"`
+	// Discovery is the state of the tag discovery
+	Discovery *TagDiscoveryStatus `json:"discovery,omitempty"`
+}
+
+// TagDiscoveryStatus is the state of the tag discovery of the bundle
+type TagDiscoveryStatus struct {
+	// Versions are the discovered versions, the highest first
+	Versions []DiscoveredVersion `json:"versions,omitempty"`
+	// LastTime is the time the tags were last listed
+	LastTime *metav1.Time `json:"lastTime,omitempty"`
+	// NextTime is the time the tags are listed again
+	NextTime *metav1.Time `json:"nextTime,omitempty"`
+	// ObservedGeneration is the generation of the bundle the tags were
+	// listed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Failures is the number of consecutive failures listing the tags
+	Failures int `json:"failures,omitempty"`
+	// Message tells why the last listing failed
+	Message string `json:"message,omitempty"`
+}
+
+// DiscoveredVersion is a tag found by the tag discovery
+type DiscoveredVersion struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+	// Verified tells if the digest is verified under the signer policy
+	Verified bool `json:"verified,omitempty"`
+	// Signers are the verifications of the digest by each signer
+	Signers []SignerStatus `json:"signers,omitempty"`
+	// Message tells why the digest is not verified
+	Message string `json:"message,omitempty"`
+}
+
+// EntandoBundleTagStatus is the state of a tag of the bundle
+type EntandoBundleTagStatus struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+	// ResolvedRef is the reference the tag is pulled from, after the mirror
+	// rules of the operator
+	ResolvedRef string `json:"resolvedRef,omitempty"`
+	// Verified tells if the digest is verified under the signer policy
+	Verified bool `json:"verified,omitempty"`
+	// Signers are the verifications of the digest by each signer
+	Signers []SignerStatus `json:"signers,omitempty"`
+	// Attestations is the summary of the attestations of the digest
+	Attestations *AttestationStatus `json:"attestations,omitempty"`
+}
+
+// SignerStatus is the verification of a digest by a signer
+type SignerStatus struct {
+	Name string `json:"name"`
+	// Group is the EntandoSignerGroup of the signer, empty for the signers
+	// of the tag
+	Group    string `json:"group,omitempty"`
+	Verified bool   `json:"verified"`
+	// Message tells why the signer didn't verify the digest
+	Message string `json:"message,omitempty"`
+}
+
+// AttestationStatus is the summary of the verified attestations of a digest
+type AttestationStatus struct {
+	// Compliant tells if the attestations satisfy the attestation policy
+	Compliant bool `json:"compliant"`
+	// Message tells why the attestations are not compliant
+	Message string `json:"message,omitempty"`
+	// Attestations are the verified provenance and SBOM attestations
+	Attestations []AttestationSummary `json:"attestations,omitempty"`
+}
+
+// AttestationSummary is a verified attestation of a digest
+type AttestationSummary struct {
+	PredicateType string `json:"predicateType"`
+	// Signer is the signer that verified the attestation
+	Signer string `json:"signer"`
+	// BuilderID is the builder of a provenance
+	BuilderID string `json:"builderId,omitempty"`
+	// SourceRepo is the source repository of a provenance
+	SourceRepo string `json:"sourceRepo,omitempty"`
+	// SBOMFormat is the format of an SBOM
+	SBOMFormat SBOMFormat `json:"sbomFormat,omitempty"`
 }
 
 //+kubebuilder:object:root=true
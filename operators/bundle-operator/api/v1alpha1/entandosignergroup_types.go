@@ -0,0 +1,53 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EntandoSignerGroupSpec defines the trusted signers of the group
+type EntandoSignerGroupSpec struct {
+	// Signers are the trusted signers, the secrets of their public keys are
+	// read in the namespace of the operator
+	Signers []SignatureInfo `json:"signers,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// EntandoSignerGroup is the Schema for the entandosignergroups API, a named
+// group of trusted signers shared by the bundles of the cluster
+type EntandoSignerGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec EntandoSignerGroupSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// EntandoSignerGroupList contains a list of EntandoSignerGroup
+type EntandoSignerGroupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EntandoSignerGroup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EntandoSignerGroup{}, &EntandoSignerGroupList{})
+}
@@ -0,0 +1,123 @@
+package bundles
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types of the bundles published as OCI artifacts, for example with
+// oras push --artifact-type. The descriptor is a plain yaml layer and the
+// other files of the bundle are in tar layers.
+const (
+	BundleArtifactType         = "application/vnd.entando.bundle.v1"
+	BundleConfigMediaType      = "application/vnd.entando.bundle.config.v1+json"
+	BundleDescriptorMediaType  = "application/vnd.entando.bundle.descriptor.v1+yaml"
+	BundleContentMediaType     = "application/vnd.entando.bundle.content.v1.tar"
+	BundleContentGzipMediaType = "application/vnd.entando.bundle.content.v1.tar+gzip"
+)
+
+// IsBundleArtifact reports whether the image is a bundle artifact rather
+// than a container image, from the artifactType of the manifest or, for the
+// tools that don't set it, from the media type of the config
+func IsBundleArtifact(img v1.Image) (bool, error) {
+	raw, err := img.RawManifest()
+	if err != nil {
+		return false, err
+	}
+	manifest := struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+	}{}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return false, err
+	}
+	switch {
+	case manifest.ArtifactType == BundleArtifactType:
+		return true, nil
+	case manifest.Config.MediaType == BundleArtifactType, manifest.Config.MediaType == BundleConfigMediaType:
+		return true, nil
+	}
+	return false, nil
+}
+
+// bundleLayers returns the layers of the bundle as tars, the descriptor layer
+// of an artifact is converted to a tar with the descriptor file, so that both
+// the formats are read the same way
+func bundleLayers(img v1.Image) ([]v1.Layer, bool, error) {
+	artifact, err := IsBundleArtifact(img)
+	if err != nil {
+		return nil, false, err
+	}
+	if !artifact {
+		layers, err := img.Layers()
+		return layers, false, err
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, true, err
+	}
+	layers := []v1.Layer{}
+	descriptors := 0
+	for _, desc := range manifest.Layers {
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, true, err
+		}
+		switch desc.MediaType {
+		case BundleDescriptorMediaType:
+			descriptors++
+			if layer, err = descriptorLayer(layer, desc.Size); err != nil {
+				return nil, true, err
+			}
+		case BundleContentMediaType, BundleContentGzipMediaType:
+		default:
+			return nil, true, fmt.Errorf("unsupported bundle layer media type %s", desc.MediaType)
+		}
+		layers = append(layers, layer)
+	}
+	if descriptors != 1 {
+		return nil, true, fmt.Errorf("expected a layer of type %s, found %d", BundleDescriptorMediaType, descriptors)
+	}
+	return layers, true, nil
+}
+
+// descriptorLayer returns a tar layer with the content of the descriptor
+// layer as descriptor file
+func descriptorLayer(layer v1.Layer, size int64) (v1.Layer, error) {
+	if DefaultExtractLimits.MaxSize > 0 && size > DefaultExtractLimits.MaxSize {
+		return nil, fmt.Errorf("%w: descriptor of %d bytes", ErrSizeLimit, size)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, size))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	header := &tar.Header{Name: DescriptorFileName, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return static.NewLayer(buf.Bytes(), types.OCIUncompressedLayer), nil
+}
@@ -0,0 +1,147 @@
+package bundles
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// buildArtifact returns a bundle artifact with the descriptor and a gzipped
+// tar layer of the entries
+func buildArtifact(t *testing.T, descriptor string, entries []tarEntry) v1.Image {
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	if _, err := io.Copy(gw, buildTar(t, entries)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(gzipped.Bytes())), nil
+	}, tarball.WithMediaType(BundleContentGzipMediaType))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, BundleConfigMediaType)
+	img, err = mutate.Append(img,
+		mutate.Addendum{Layer: static.NewLayer([]byte(descriptor), BundleDescriptorMediaType), MediaType: BundleDescriptorMediaType},
+		mutate.Addendum{Layer: content, MediaType: BundleContentGzipMediaType},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return img
+}
+
+func TestBundleArtifact(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	ref := strings.TrimPrefix(server.URL, "http://") + "/entando/bundle:v1.0.0"
+
+	artifact := buildArtifact(t, legacyDescriptor, []tarEntry{
+		{name: "manifests/", typeflag: tar.TypeDir},
+		{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+	})
+	if err := crane.Push(artifact, ref); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	img, err := crane.Pull(ref)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok, err := IsBundleArtifact(img); err != nil || !ok {
+		t.Fatalf("Expected a bundle artifact, got %v error %v", ok, err)
+	}
+
+	fsys, err := OpenImageFS(ref)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	descriptor, err := ReadBundleDescriptor(fsys)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if descriptor.Name != "example" {
+		t.Fatalf("Expected descriptor example, got %s", descriptor.Name)
+	}
+	if data, err := fs.ReadFile(fsys, "manifests/service.yaml"); err != nil || string(data) != "kind: Service" {
+		t.Fatalf("Invalid manifest read from the artifact %q error %v", data, err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "bundle")
+	if err := ExtractFiles(fsys, dir, []string{"descriptor.yaml", "manifests", "manifests/service.yaml"}, DefaultExtractLimits); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"descriptor.yaml":        legacyDescriptor,
+		"manifests/service.yaml": "kind: Service",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != content {
+			t.Fatalf("Invalid content of %s. Expected %q, got %q", name, content, data)
+		}
+	}
+}
+
+func TestBundleArtifactInvalid(t *testing.T) {
+	img, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte(legacyDescriptor)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok, err := IsBundleArtifact(img); err != nil || ok {
+		t.Fatalf("Expected a container image, got %v error %v", ok, err)
+	}
+
+	// an artifact without descriptor
+	img = mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, BundleConfigMediaType)
+	if _, err := NewImageFS(img); err == nil {
+		t.Fatalf("Expected missing descriptor error")
+	}
+
+	img, err = mutate.Append(buildArtifact(t, legacyDescriptor, nil),
+		mutate.Addendum{Layer: static.NewLayer([]byte("{}"), "application/json"), MediaType: "application/json"},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := NewImageFS(img); err == nil {
+		t.Fatalf("Expected unsupported media type error")
+	}
+
+	// the limits apply to all the layers of the artifact
+	img = buildArtifact(t, legacyDescriptor, []tarEntry{{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"}})
+	fsys, err := NewImageFS(img)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	limits := ExtractLimits{MaxSize: int64(len(legacyDescriptor)) + 4}
+	if err := ExtractFiles(fsys, filepath.Join(t.TempDir(), "bundle"), []string{"descriptor.yaml", "manifests/service.yaml"}, limits); !errors.Is(err, ErrSizeLimit) {
+		t.Fatalf("Expected %q, got %v", ErrSizeLimit, err)
+	}
+}
@@ -0,0 +1,279 @@
+package bundles
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const cacheTempPrefix = ".tmp-"
+
+var (
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bundle_cache_hits_total",
+		Help: "Number of bundles read from the local cache",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bundle_cache_misses_total",
+		Help: "Number of bundles pulled because missing from the local cache",
+	})
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bundle_cache_evictions_total",
+		Help: "Number of bundles evicted from the local cache",
+	})
+	cacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bundle_cache_size_bytes",
+		Help: "Total size of the bundles in the local cache",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(cacheHits, cacheMisses, cacheEvictions, cacheSize)
+}
+
+// Cache stores the extracted bundles in a directory per digest. A bundle is
+// extracted in a temporary directory renamed when complete, so a directory of
+// the cache is always a complete bundle, and concurrent requests of the same
+// digest wait for a single extraction. When the cache exceeds its size the
+// least recently used bundles not in use are evicted.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	pending map[string]*cacheFill
+}
+
+type cacheEntry struct {
+	size     int64
+	lastUsed time.Time
+	refs     int
+}
+
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+// NewCache opens the cache in dir, the bundles already there, for example on
+// a persistent volume, are kept. A maxSize of zero disables the eviction.
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: map[string]*cacheEntry{},
+		pending: map[string]*cacheFill{},
+	}
+
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		itemPath := filepath.Join(dir, item.Name())
+		if strings.HasPrefix(item.Name(), cacheTempPrefix) {
+			// left by an extraction interrupted by a restart
+			if err := os.RemoveAll(itemPath); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			return nil, err
+		}
+		size, err := dirSize(itemPath)
+		if err != nil {
+			return nil, err
+		}
+		c.entries[item.Name()] = &cacheEntry{size: size, lastUsed: info.ModTime()}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictLocked("")
+	return c, nil
+}
+
+// Get returns the directory of the bundle with the digest, calling fill to
+// extract it into an empty directory when missing. The directory is not
+// evicted until release is called.
+func (c *Cache) Get(digest string, fill func(dir string) error) (string, func(), error) {
+	hash, err := v1.NewHash(digest)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid bundle digest %q: %w", digest, err)
+	}
+	key := hash.Algorithm + "-" + hash.Hex
+	entryDir := filepath.Join(c.dir, key)
+
+	for {
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok {
+			entry.refs++
+			entry.lastUsed = time.Now()
+			c.mu.Unlock()
+			cacheHits.Inc()
+			// the modification time keeps the order of use across restarts
+			os.Chtimes(entryDir, entry.lastUsed, entry.lastUsed)
+			return entryDir, c.releaseFunc(key), nil
+		}
+		if pending, ok := c.pending[key]; ok {
+			c.mu.Unlock()
+			<-pending.done
+			if pending.err != nil {
+				return "", nil, pending.err
+			}
+			continue
+		}
+		pending := &cacheFill{done: make(chan struct{})}
+		c.pending[key] = pending
+		c.mu.Unlock()
+
+		cacheMisses.Inc()
+		size, err := c.fill(entryDir, fill)
+
+		c.mu.Lock()
+		delete(c.pending, key)
+		if err == nil {
+			c.entries[key] = &cacheEntry{size: size, lastUsed: time.Now(), refs: 1}
+			c.evictLocked(key)
+		}
+		pending.err = err
+		close(pending.done)
+		c.mu.Unlock()
+
+		if err != nil {
+			return "", nil, err
+		}
+		return entryDir, c.releaseFunc(key), nil
+	}
+}
+
+// Lookup returns the directory of the bundle with the digest when already
+// extracted, the bundle is never extracted. The directory is not evicted
+// until release is called.
+func (c *Cache) Lookup(digest string) (string, func(), bool) {
+	hash, err := v1.NewHash(digest)
+	if err != nil {
+		return "", nil, false
+	}
+	key := hash.Algorithm + "-" + hash.Hex
+
+	entryDir := filepath.Join(c.dir, key)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return "", nil, false
+	}
+	entry.refs++
+	lastUsed := time.Now()
+	entry.lastUsed = lastUsed
+	c.mu.Unlock()
+	// a bundle read by lookup is used like one read by Get
+	os.Chtimes(entryDir, lastUsed, lastUsed)
+	return entryDir, c.releaseFunc(key), true
+}
+
+// fill extracts the bundle in a temporary directory of the cache, renamed to
+// entryDir when complete
+func (c *Cache) fill(entryDir string, fill func(dir string) error) (int64, error) {
+	tmpDir, err := os.MkdirTemp(c.dir, cacheTempPrefix)
+	if err != nil {
+		return 0, err
+	}
+	if err := fill(tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return 0, err
+	}
+	size, err := dirSize(tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return 0, err
+	}
+	if err := os.Rename(tmpDir, entryDir); err != nil {
+		os.RemoveAll(tmpDir)
+		// another operator sharing the volume completed it first
+		if info, statErr := os.Stat(entryDir); statErr == nil && info.IsDir() {
+			return dirSize(entryDir)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+func (c *Cache) releaseFunc(key string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if entry, ok := c.entries[key]; ok {
+				entry.refs--
+			}
+			c.evictLocked("")
+		})
+	}
+}
+
+// evictLocked removes the least recently used bundles not in use until the
+// cache fits its size, keep is never evicted
+func (c *Cache) evictLocked(keep string) {
+	var total int64
+	for _, entry := range c.entries {
+		total += entry.size
+	}
+	for c.maxSize > 0 && total > c.maxSize {
+		victim := ""
+		for key, entry := range c.entries {
+			if key == keep || entry.refs > 0 {
+				continue
+			}
+			if victim == "" || entry.lastUsed.Before(c.entries[victim].lastUsed) {
+				victim = key
+			}
+		}
+		if victim == "" {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, victim)); err != nil {
+			bundleLog.Error(err, "error evicting bundle from cache", "entry", victim)
+			break
+		}
+		total -= c.entries[victim].size
+		delete(c.entries, victim)
+		cacheEvictions.Inc()
+	}
+	cacheSize.Set(float64(total))
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,221 @@
+package bundles
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testDigest(c byte) string {
+	return "sha256:" + strings.Repeat(string(c), 64)
+}
+
+// fillWith returns a fill writing a descriptor of size bytes
+func fillWith(size int, calls *int32) func(dir string) error {
+	return func(dir string) error {
+		atomic.AddInt32(calls, 1)
+		return os.WriteFile(filepath.Join(dir, "descriptor.yaml"), make([]byte, size), 0644)
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hits := testutil.ToFloat64(cacheHits)
+	misses := testutil.ToFloat64(cacheMisses)
+
+	var calls int32
+	var wg sync.WaitGroup
+	dirs := make([]string, 8)
+	for i := range dirs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir, release, err := cache.Get(testDigest('a'), fillWith(10, &calls))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			defer release()
+			dirs[i] = dir
+		}(i)
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Expected a single extraction, got %d", calls)
+	}
+	for _, dir := range dirs {
+		if dir != dirs[0] {
+			t.Fatalf("Expected the same directory, got %s and %s", dirs[0], dir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dirs[0], "descriptor.yaml")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if delta := testutil.ToFloat64(cacheMisses) - misses; delta != 1 {
+		t.Fatalf("Expected 1 miss, got %v", delta)
+	}
+	if delta := testutil.ToFloat64(cacheHits) - hits; delta != 7 {
+		t.Fatalf("Expected 7 hits, got %v", delta)
+	}
+}
+
+func TestCacheLookup(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 25)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, ok := cache.Lookup(testDigest('a')); ok {
+		t.Fatal("Expected a bundle not extracted")
+	}
+	var calls int32
+	dir, release, err := cache.Get(testDigest('a'), fillWith(10, &calls))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	release()
+
+	_, release, err = cache.Get(testDigest('b'), fillWith(10, &calls))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	release()
+
+	// the lookup makes a the most recently used, also across restarts
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir, past, past); err != nil {
+		t.Fatal(err.Error())
+	}
+	lookupDir, lookupRelease, ok := cache.Lookup(testDigest('a'))
+	if !ok || lookupDir != dir {
+		t.Fatalf("Expected the directory %s, got %s", dir, lookupDir)
+	}
+	lookupRelease()
+	if info, err := os.Stat(dir); err != nil || !info.ModTime().After(past) {
+		t.Fatalf("Expected the modification time of %s updated, got %v", dir, err)
+	}
+	if _, _, err := cache.Get(testDigest('c'), fillWith(10, &calls)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("Expected a kept once looked up, got %v", err)
+	}
+	if _, _, ok := cache.Lookup(testDigest('b')); ok {
+		t.Fatal("Expected b evicted")
+	}
+	if _, _, ok := cache.Lookup("not a digest"); ok {
+		t.Fatal("Expected an invalid digest not found")
+	}
+}
+
+func TestCacheFillError(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pullErr := errors.New("pull failed")
+	_, _, err = cache.Get(testDigest('a'), func(dir string) error {
+		os.WriteFile(filepath.Join(dir, "partial"), []byte("partial"), 0644)
+		return pullErr
+	})
+	if !errors.Is(err, pullErr) {
+		t.Fatalf("Expected the fill error, got %v", err)
+	}
+	items, _ := os.ReadDir(dir)
+	if len(items) != 0 {
+		t.Fatalf("Expected no partial bundle in the cache, got %d entries", len(items))
+	}
+
+	var calls int32
+	if _, _, err := cache.Get(testDigest('a'), fillWith(1, &calls)); err != nil || calls != 1 {
+		t.Fatalf("Expected the bundle to be extracted again, got %d calls error %v", calls, err)
+	}
+	if _, _, err := cache.Get("latest", fillWith(1, &calls)); err == nil {
+		t.Fatalf("Expected invalid digest error")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 25)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var calls int32
+
+	_, releaseA, err := cache.Get(testDigest('a'), fillWith(10, &calls))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	releaseA()
+	dirB, releaseB, err := cache.Get(testDigest('b'), fillWith(10, &calls))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// a is used again, b becomes the least recently used
+	_, releaseA, _ = cache.Get(testDigest('a'), fillWith(10, &calls))
+	releaseA()
+
+	// b is in use and can't be evicted, a is evicted instead
+	if _, _, err := cache.Get(testDigest('c'), fillWith(10, &calls)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sha256-"+strings.Repeat("a", 64))); !os.IsNotExist(err) {
+		t.Fatalf("Expected a evicted, got %v", err)
+	}
+	if _, err := os.Stat(dirB); err != nil {
+		t.Fatalf("Expected b kept while in use, got %v", err)
+	}
+
+	// all the bundles are in use, the cache exceeds its size
+	if _, _, err := cache.Get(testDigest('d'), fillWith(10, &calls)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(dirB); err != nil {
+		t.Fatalf("Expected b kept while in use, got %v", err)
+	}
+	releaseB()
+	if _, err := os.Stat(dirB); !os.IsNotExist(err) {
+		t.Fatalf("Expected b evicted once released, got %v", err)
+	}
+	if calls != 4 {
+		t.Fatalf("Expected 4 extractions, got %d", calls)
+	}
+}
+
+func TestCacheReopen(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var calls int32
+	if _, _, err := cache.Get(testDigest('a'), fillWith(10, &calls)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Mkdir(filepath.Join(dir, cacheTempPrefix+"interrupted"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	reopened, err := NewCache(dir, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, err := reopened.Get(testDigest('a'), fillWith(10, &calls)); err != nil || calls != 1 {
+		t.Fatalf("Expected the bundle read from the reopened cache, got %d calls error %v", calls, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, cacheTempPrefix+"interrupted")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the interrupted extraction removed, got %v", err)
+	}
+}
@@ -2,43 +2,173 @@ package bundles
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 
 	"gopkg.in/yaml.v3"
 )
 
+// DescriptorFileName is the name of the descriptor at the root of a bundle
+const DescriptorFileName = "descriptor.yaml"
+
 type ComponentType string
 
 const (
-	ManifestComponentType ComponentType = "MANIFEST"
-	PluginComponentType   ComponentType = "PLUGIN"
+	ManifestComponentType  ComponentType = "MANIFEST"
+	PluginComponentType    ComponentType = "PLUGIN"
+	HelmComponentType      ComponentType = "HELM"
+	KustomizeComponentType ComponentType = "KUSTOMIZE"
+	JobComponentType       ComponentType = "JOB"
+)
+
+// JobPhase is the moment of the instance lifecycle a JOB component runs at
+type JobPhase string
+
+const (
+	JobPhasePreInstall  JobPhase = "pre-install"
+	JobPhasePostInstall JobPhase = "post-install"
+	JobPhasePreUpgrade  JobPhase = "pre-upgrade"
+	JobPhasePreDelete   JobPhase = "pre-delete"
 )
 
+// JobPhases are the supported job phases in the order they run
+var JobPhases = []JobPhase{JobPhasePreInstall, JobPhasePreUpgrade, JobPhasePostInstall, JobPhasePreDelete}
+
 type Component struct {
 	Name string        `json:"name,omitempty"`
 	Type ComponentType `json:"type,omitempty"`
-	Spec interface{}   `yaml:"-"`
+	// DependsOn lists the components of the bundle that have to be ready
+	// before this component is applied
+	DependsOn []string    `yaml:"dependsOn,omitempty"`
+	Spec      interface{} `yaml:"-"`
 }
 
 type Plugin struct {
-	IngressName     string `yaml:"ingressName,omitempty"`
-	IngressHost     string `yaml:"ingressHost,omitempty"`
-	IngressPath     string `yaml:"ingressPath,omitempty"`
-	Repository      string `yaml:"repository,omitempty"`
-	Tag             string `yaml:"tag,omitempty"`
-	Digest          string `yaml:"digest,omitempty"`
-	HealthCheckPath string `yaml:"healthCheckPath,omitempty"`
-	Port            int    `yaml:"port,omitempty"`
+	IngressName     string         `yaml:"ingressName,omitempty"`
+	IngressHost     string         `yaml:"ingressHost,omitempty"`
+	IngressPath     string         `yaml:"ingressPath,omitempty" jsonschema:"pattern=^/"`
+	Repository      string         `yaml:"repository,omitempty"`
+	Tag             string         `yaml:"tag,omitempty"`
+	Digest          string         `yaml:"digest,omitempty"`
+	HealthCheckPath string         `yaml:"healthCheckPath,omitempty"`
+	Port            int            `yaml:"port,omitempty" jsonschema:"minimum=1;maximum=65535"`
+	Replicas        int32          `yaml:"replicas,omitempty" jsonschema:"minimum=0"`
+	Database        string         `yaml:"database,omitempty"`
+	Env             []EnvVar       `yaml:"env,omitempty"`
+	Secrets         []PluginSecret `yaml:"secrets,omitempty"`
+	Volumes         []PluginVolume `yaml:"volumes,omitempty"`
+	// Parameters declares the fields whose value depends on the cluster, they
+	// are set from the configuration of the instance
+	Parameters []Parameter `yaml:"parameters,omitempty"`
+}
+
+// PluginSecretType is how a secret is exposed to the plugin
+type PluginSecretType string
+
+const (
+	PluginSecretTypeEnv  PluginSecretType = "ENV"
+	PluginSecretTypeFile PluginSecretType = "FILE"
+)
+
+// PluginSecretTypes are the supported plugin secret types
+var PluginSecretTypes = []PluginSecretType{PluginSecretTypeEnv, PluginSecretTypeFile}
+
+// PluginSecret exposes a secret to the plugin as env vars, with an optional
+// name prefix, or as files mounted at a path
+type PluginSecret struct {
+	Type      PluginSecretType `yaml:"type"`
+	Name      string           `yaml:"name"`
+	Prefix    string           `yaml:"prefix,omitempty"`
+	MountPath string           `yaml:"mountPath,omitempty" jsonschema:"pattern=^/"`
+}
+
+// PluginVolume is a persistent volume mounted in the plugin
+type PluginVolume struct {
+	StorageClass string `yaml:"storageClass,omitempty"`
+	Size         string `yaml:"size"`
+	MountPath    string `yaml:"mountPath" jsonschema:"pattern=^/"`
+}
+
+// Parameter is a field of a component spec set from the instance
+// configuration. Field is the path of the field in the spec, like
+// ingressHost or volumes[0].storageClass.
+type Parameter struct {
+	Name        string `yaml:"name"`
+	Field       string `yaml:"field"`
+	Description string `yaml:"description,omitempty"`
+	Required    bool   `yaml:"required,omitempty"`
+	Default     string `yaml:"default,omitempty"`
 }
 
 type Manifest struct {
 	FilePath string `yaml:"filePath,omitempty"`
 }
 
+// Helm describes a chart shipped inside the bundle, values files are applied
+// in order and inline values take precedence over them
+type Helm struct {
+	ChartPath   string                 `yaml:"chartPath,omitempty"`
+	ReleaseName string                 `yaml:"releaseName,omitempty"`
+	ValuesFiles []string               `yaml:"valuesFiles,omitempty"`
+	Values      map[string]interface{} `yaml:"values,omitempty"`
+}
+
+// Kustomize describes a kustomization directory inside the bundle, the
+// instance namespace, common labels and name prefix are optionally applied
+// on top of its output
+type Kustomize struct {
+	Path            string            `yaml:"path,omitempty"`
+	InjectNamespace bool              `yaml:"injectNamespace,omitempty"`
+	CommonLabels    map[string]string `yaml:"commonLabels,omitempty"`
+	NamePrefix      string            `yaml:"namePrefix,omitempty"`
+}
+
+// Job describes a one-off task, like a schema migration or seed data, run to
+// completion at a phase of the instance lifecycle
+type Job struct {
+	Phase   JobPhase `yaml:"phase,omitempty"`
+	Image   string   `yaml:"image,omitempty"`
+	Command []string `yaml:"command,omitempty"`
+	Env     []EnvVar `yaml:"env,omitempty"`
+	// BackoffLimit is the number of retries before the job fails
+	BackoffLimit *int32 `yaml:"backoffLimit,omitempty" jsonschema:"minimum=0"`
+	// ActiveDeadlineSeconds is the time the job has to complete
+	ActiveDeadlineSeconds *int64 `yaml:"activeDeadlineSeconds,omitempty" jsonschema:"minimum=1"`
+}
+
+type EnvVar struct {
+	Name      string        `yaml:"name"`
+	Value     string        `yaml:"value,omitempty"`
+	ValueFrom *EnvVarSource `yaml:"valueFrom,omitempty"`
+}
+
+// EnvVarSource reads the value of an env var from a key of a secret or of a
+// config map
+type EnvVarSource struct {
+	SecretKeyRef    *KeySelector `yaml:"secretKeyRef,omitempty"`
+	ConfigMapKeyRef *KeySelector `yaml:"configMapKeyRef,omitempty"`
+}
+
+type KeySelector struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+// componentSpecs maps each component type to the constructor of its spec
+var componentSpecs = map[ComponentType]func() interface{}{
+	ManifestComponentType:  func() interface{} { return new(Manifest) },
+	PluginComponentType:    func() interface{} { return new(Plugin) },
+	HelmComponentType:      func() interface{} { return new(Helm) },
+	KustomizeComponentType: func() interface{} { return new(Kustomize) },
+	JobComponentType:       func() interface{} { return new(Job) },
+}
+
+// BundleDescriptor is the format independent representation of a
+// descriptor, every supported format is converted to it
 type BundleDescriptor struct {
+	APIVersion   string      `yaml:"apiVersion,omitempty"`
 	Version      string      `yaml:"version"`
 	Name         string      `yaml:"name"`
-	Descriptor   string      `yaml:"descriptor"`
+	Description  string      `yaml:"description,omitempty"`
 	Dependencies []string    `yaml:"dependencies"`
 	Components   []Component `yaml:"components"`
 }
@@ -55,17 +185,35 @@ func (s *Component) UnmarshalYAML(n *yaml.Node) error {
 		return err
 	}
 
-	switch s.Type {
-	case ManifestComponentType:
-		s.Spec = new(Manifest)
-	case PluginComponentType:
-		s.Spec = new(Plugin)
-	default:
-		panic(fmt.Sprintf("kind unknown %s", s.Type))
+	if s.Type == "" {
+		return fmt.Errorf("component type is required")
+	}
+	newSpec, ok := componentSpecs[s.Type]
+	if !ok {
+		return fmt.Errorf("unknown component type %q", s.Type)
 	}
+	s.Spec = newSpec()
 	return obj.Spec.Decode(s.Spec)
 }
 
+func (s Component) MarshalYAML() (interface{}, error) {
+	return struct {
+		Name      string        `yaml:"name,omitempty"`
+		Type      ComponentType `yaml:"type,omitempty"`
+		DependsOn []string      `yaml:"dependsOn,omitempty"`
+		Spec      interface{}   `yaml:"spec,omitempty"`
+	}{s.Name, s.Type, s.DependsOn, s.Spec}, nil
+}
+
+// ImageRef returns the image reference of the plugin, pinned by digest when
+// available
+func (p *Plugin) ImageRef() string {
+	if p.Digest != "" {
+		return p.Repository + "@" + p.Digest
+	}
+	return p.Repository + ":" + p.Tag
+}
+
 func (s *Component) GetIfIsPlugin() (bool, *Plugin) {
 	plugin, isPlugin := s.Spec.(*Plugin)
 	return isPlugin, plugin
@@ -76,13 +224,42 @@ func (s *Component) GetIfIsManifest() (bool, *Manifest) {
 	return isManifest, manifest
 }
 
-func ReadBundleDescriptor(fileDescriptorPath string) (*BundleDescriptor, error) {
-	yfile, err := ioutil.ReadFile(fileDescriptorPath)
+func (s *Component) GetIfIsHelm() (bool, *Helm) {
+	helm, isHelm := s.Spec.(*Helm)
+	return isHelm, helm
+}
+
+// GetReleaseName returns the name of the helm release, the component name when
+// not set
+func (s *Component) GetReleaseName() string {
+	if isHelm, helm := s.GetIfIsHelm(); isHelm && helm.ReleaseName != "" {
+		return helm.ReleaseName
+	}
+	return s.Name
+}
+
+func (s *Component) GetIfIsKustomize() (bool, *Kustomize) {
+	kustomize, isKustomize := s.Spec.(*Kustomize)
+	return isKustomize, kustomize
+}
+
+func (s *Component) GetIfIsJob() (bool, *Job) {
+	job, isJob := s.Spec.(*Job)
+	return isJob, job
+}
+
+// ReadBundleDescriptor reads and validates the descriptor file at the root of
+// the bundle, referenced files are resolved in the bundle. When the
+// descriptor is not valid the returned error is a ValidationErrors.
+func ReadBundleDescriptor(bundle fs.FS) (*BundleDescriptor, error) {
+	yfile, err := fs.ReadFile(bundle, DescriptorFileName)
 	if err != nil {
 		return nil, err
 	}
 
-	data := &BundleDescriptor{}
-	err = yaml.Unmarshal(yfile, &data)
-	return data, err
+	data, errs := parseBundleDescriptor(yfile, bundle)
+	if errs != nil {
+		return nil, errs
+	}
+	return data, nil
 }
@@ -49,7 +49,7 @@ func TestUnmarshalling(t *testing.T) {
 	plugin, actualTypeIsPlugin := data.Components[0].Spec.(*Plugin)
 	fmt.Println(reflect.TypeOf(data.Components[0].Spec))
 	if !actualTypeIsPlugin {
-		t.Fatalf("Invalid type for %q. Actual type is plugin %t, got %q", data, actualTypeIsPlugin, plugin)
+		t.Fatalf("Invalid type for %q. Actual type is plugin %t, got %v", data, actualTypeIsPlugin, plugin)
 	}
 
 	manifest, actualTypeIsPlugin2 := data.Components[1].Spec.(*Manifest)
@@ -64,7 +64,7 @@ func TestUnmarshalling(t *testing.T) {
 		t.Fatalf("Invalid repo for %q. Expected %q, got %q", data, expectedRepository, actualRepository)
 	}
 
-	expectedFilePath := "/manifests/db-service.yaml"
+	expectedFilePath := "manifests/db-service.yaml"
 	actualFilePath := manifest.FilePath
 	if actualFilePath != expectedFilePath {
 		t.Fatalf("Invalid filePath for %q. Expected %q, got %q", data, expectedFilePath, actualFilePath)
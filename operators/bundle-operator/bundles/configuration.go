@@ -0,0 +1,265 @@
+package bundles
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pinnedPluginFields identify the image of a plugin, they come from the
+// bundle and can't be changed by the instance configuration
+var pinnedPluginFields = []string{"repository", "tag", "digest", "parameters"}
+
+var fieldSegmentRegexp = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9]*)(?:\[([0-9]+)\])?$`)
+
+// Configuration is the instance specific configuration of the components of
+// a bundle, read from the configuration of the instance. For example:
+//
+//	components:
+//	  web:
+//	    parameters:
+//	      host: web.example.com
+//	    spec:
+//	      replicas: 3
+type Configuration struct {
+	Components map[string]ComponentConfiguration `yaml:"components,omitempty"`
+}
+
+type ComponentConfiguration struct {
+	// Parameters are the values of the parameters declared by the component
+	Parameters map[string]string `yaml:"parameters,omitempty"`
+	// Spec overrides the fields of the component spec
+	Spec yaml.Node `yaml:"spec,omitempty"`
+}
+
+// ParseConfiguration reads the configuration of an instance, an empty
+// configuration is valid
+func ParseConfiguration(data string) (*Configuration, error) {
+	configuration := &Configuration{}
+	if strings.TrimSpace(data) == "" {
+		return configuration, nil
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(configuration); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return configuration, nil
+}
+
+// Apply returns a copy of the components with the configuration applied to
+// their spec. Only the spec of PLUGIN components can be configured.
+func (c *Configuration) Apply(components []Component) ([]Component, error) {
+	byName := map[string]*Component{}
+	for i := range components {
+		byName[components[i].Name] = &components[i]
+	}
+	names := make([]string, 0, len(c.Components))
+	for name := range c.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		component, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("configuration of unknown component %q", name)
+		}
+		if isPlugin, _ := component.GetIfIsPlugin(); !isPlugin {
+			return nil, fmt.Errorf("component %q of type %s can't be configured", name, component.Type)
+		}
+	}
+
+	configured := make([]Component, len(components))
+	copy(configured, components)
+	for i := range configured {
+		isPlugin, plugin := configured[i].GetIfIsPlugin()
+		if !isPlugin {
+			continue
+		}
+		resolved, err := c.resolvePlugin(configured[i].Name, plugin)
+		if err != nil {
+			return nil, fmt.Errorf("component %q: %w", configured[i].Name, err)
+		}
+		configured[i].Spec = resolved
+	}
+	return configured, nil
+}
+
+// resolvePlugin applies the spec overrides and then the parameters to a copy
+// of the plugin
+func (c *Configuration) resolvePlugin(name string, plugin *Plugin) (*Plugin, error) {
+	node := &yaml.Node{}
+	if err := node.Encode(plugin); err != nil {
+		return nil, err
+	}
+
+	componentConfiguration := c.Components[name]
+	if override := &componentConfiguration.Spec; override.Kind != 0 {
+		if override.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("spec overrides must be a mapping")
+		}
+		for i := 0; i+1 < len(override.Content); i += 2 {
+			key := override.Content[i].Value
+			for _, pinned := range pinnedPluginFields {
+				if key == pinned {
+					return nil, fmt.Errorf("field %q is set by the bundle and can't be overridden", key)
+				}
+			}
+			setMappingValue(node, key, override.Content[i+1])
+		}
+	}
+
+	for _, parameter := range plugin.Parameters {
+		value, ok := componentConfiguration.Parameters[parameter.Name]
+		if !ok {
+			if parameter.Required {
+				return nil, fmt.Errorf("missing value of required parameter %q", parameter.Name)
+			}
+			if parameter.Default == "" {
+				continue
+			}
+			value = parameter.Default
+		}
+		if err := setFieldValue(node, parameter.Field, value); err != nil {
+			return nil, fmt.Errorf("parameter %q: %w", parameter.Name, err)
+		}
+	}
+	for parameterName := range componentConfiguration.Parameters {
+		if !hasParameter(plugin, parameterName) {
+			return nil, fmt.Errorf("unknown parameter %q", parameterName)
+		}
+	}
+
+	// the resolved spec is decoded strictly, to report overrides of unknown
+	// fields and values of the wrong type
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	resolved := &Plugin{}
+	if err := decoder.Decode(resolved); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+func hasParameter(plugin *Plugin, name string) bool {
+	for _, parameter := range plugin.Parameters {
+		if parameter.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setFieldValue sets the scalar at the field path of a spec node, missing
+// fields are added while list items must exist
+func setFieldValue(node *yaml.Node, field string, value string) error {
+	segments := strings.Split(field, ".")
+	for i, segment := range segments {
+		match := fieldSegmentRegexp.FindStringSubmatch(segment)
+		if match == nil {
+			return fmt.Errorf("invalid field path %q", field)
+		}
+		last := i == len(segments)-1
+		if last && match[2] == "" {
+			// the tag is resolved again on decoding, to match the field type
+			setMappingValue(node, match[1], &yaml.Node{Kind: yaml.ScalarNode, Value: value})
+			return nil
+		}
+
+		child := mappingValue(node, match[1])
+		if child == nil {
+			if match[2] != "" {
+				return fmt.Errorf("field %q not found", field)
+			}
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setMappingValue(node, match[1], child)
+		}
+		if match[2] != "" {
+			index, _ := strconv.Atoi(match[2])
+			if child.Kind != yaml.SequenceNode || index >= len(child.Content) {
+				return fmt.Errorf("field %q not found", field)
+			}
+			child = child.Content[index]
+			if last {
+				*child = yaml.Node{Kind: yaml.ScalarNode, Value: value}
+				return nil
+			}
+		}
+		node = child
+	}
+	return nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// lookupFieldPath checks that a field path points to a scalar field of v, the
+// items of lists must exist in v
+func lookupFieldPath(v reflect.Value, field string) error {
+	for _, segment := range strings.Split(field, ".") {
+		match := fieldSegmentRegexp.FindStringSubmatch(segment)
+		if match == nil {
+			return fmt.Errorf("invalid field path %q", field)
+		}
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v = reflect.New(v.Type().Elem())
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("field %q not found", field)
+		}
+		index := -1
+		for i := 0; i < v.NumField(); i++ {
+			if name, _ := yamlTag(v.Type().Field(i)); name == match[1] {
+				index = i
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("field %q not found", field)
+		}
+		v = v.Field(index)
+		if match[2] != "" {
+			item, _ := strconv.Atoi(match[2])
+			if v.Kind() != reflect.Slice || item >= v.Len() {
+				return fmt.Errorf("field %q not found", field)
+			}
+			v = v.Index(item)
+		}
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64:
+		return nil
+	}
+	return fmt.Errorf("field %q is not a scalar", field)
+}
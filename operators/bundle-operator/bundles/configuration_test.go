@@ -0,0 +1,106 @@
+package bundles
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testConfigurationComponents() []Component {
+	return []Component{
+		{Name: "web", Type: PluginComponentType, Spec: &Plugin{
+			Repository: "docker.io/nginx",
+			Digest:     "sha256:0123",
+			Replicas:   1,
+			Env:        []EnvVar{{Name: "MODE", Value: "base"}},
+			Volumes:    []PluginVolume{{Size: "1Gi", MountPath: "/data"}},
+			Parameters: []Parameter{
+				{Name: "host", Field: "ingressHost", Required: true},
+				{Name: "storageClass", Field: "volumes[0].storageClass", Default: "standard"},
+				{Name: "replicas", Field: "replicas"},
+			},
+		}},
+		{Name: "db-service", Type: ManifestComponentType, Spec: &Manifest{FilePath: "manifests/db-service.yaml"}},
+	}
+}
+
+func TestConfigurationApply(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration string
+		expected      func(plugin *Plugin)
+		err           string
+	}{
+		{
+			name:          "parameters and defaults",
+			configuration: "components:\n  web:\n    parameters:\n      host: web.example.com\n",
+			expected: func(plugin *Plugin) {
+				plugin.IngressHost = "web.example.com"
+				plugin.Volumes[0].StorageClass = "standard"
+			},
+		},
+		{
+			name: "typed parameter and overrides",
+			configuration: `components:
+  web:
+    parameters:
+      host: web.example.com
+      storageClass: fast
+      replicas: "3"
+    spec:
+      database: postgresql
+      env:
+        - name: MODE
+          value: production
+`,
+			expected: func(plugin *Plugin) {
+				plugin.IngressHost = "web.example.com"
+				plugin.Volumes[0].StorageClass = "fast"
+				plugin.Replicas = 3
+				plugin.Database = "postgresql"
+				plugin.Env = []EnvVar{{Name: "MODE", Value: "production"}}
+			},
+		},
+		{name: "missing required parameter", configuration: "", err: `missing value of required parameter "host"`},
+		{name: "unknown parameter", configuration: "components:\n  web:\n    parameters:\n      host: a\n      port: \"80\"\n", err: `unknown parameter "port"`},
+		{name: "unknown component", configuration: "components:\n  api: {}\n", err: `unknown component "api"`},
+		{name: "not a plugin", configuration: "components:\n  db-service: {}\n", err: "can't be configured"},
+		{name: "pinned field", configuration: "components:\n  web:\n    spec:\n      digest: sha256:4567\n", err: `field "digest" is set by the bundle`},
+		{name: "unknown field", configuration: "components:\n  web:\n    parameters:\n      host: a\n    spec:\n      replica: 2\n", err: "field replica not found"},
+		{name: "wrong type", configuration: "components:\n  web:\n    parameters:\n      host: a\n    spec:\n      replicas: many\n", err: "cannot unmarshal"},
+		{name: "invalid yaml", configuration: "components: [", err: "invalid configuration"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			components := testConfigurationComponents()
+			configuration, err := ParseConfiguration(test.configuration)
+			var configured []Component
+			if err == nil {
+				configured, err = configuration.Apply(components)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			expected := testConfigurationComponents()
+			_, expectedPlugin := expected[0].GetIfIsPlugin()
+			test.expected(expectedPlugin)
+			if _, plugin := configured[0].GetIfIsPlugin(); !reflect.DeepEqual(plugin, expectedPlugin) {
+				t.Fatalf("Expected %+v, got %+v", expectedPlugin, plugin)
+			}
+			if !reflect.DeepEqual(components, testConfigurationComponents()) {
+				t.Fatal("The descriptor components must not be modified")
+			}
+			if configured[1].Spec != components[1].Spec {
+				t.Fatal("Expected components that are not plugins unchanged")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package bundles
+
+// ComponentGraph is the dependency graph of the components of a bundle built
+// from their dependsOn, JOB components run at their lifecycle phase and are
+// not part of it
+type ComponentGraph struct {
+	components []*Component
+	byName     map[string]*Component
+}
+
+func NewComponentGraph(components []Component) *ComponentGraph {
+	g := &ComponentGraph{byName: map[string]*Component{}}
+	for i := range components {
+		if isJob, _ := components[i].GetIfIsJob(); isJob {
+			continue
+		}
+		g.components = append(g.components, &components[i])
+		g.byName[components[i].Name] = &components[i]
+	}
+	return g
+}
+
+// Components returns the components of the graph in descriptor order
+func (g *ComponentGraph) Components() []*Component {
+	return g.components
+}
+
+// Ready returns, in descriptor order, the components not started yet whose
+// dependencies are all done
+func (g *ComponentGraph) Ready(started map[string]bool, done map[string]bool) []*Component {
+	ready := []*Component{}
+	for _, component := range g.components {
+		if started[component.Name] || done[component.Name] {
+			continue
+		}
+		satisfied := true
+		for _, dependency := range component.DependsOn {
+			if !done[dependency] {
+				satisfied = false
+				break
+			}
+		}
+		if satisfied {
+			ready = append(ready, component)
+		}
+	}
+	return ready
+}
+
+// FindCycle returns the names of the components forming a dependency cycle,
+// starting and ending with the same component, nil when the graph is acyclic.
+// Dependencies on components missing from the graph are ignored.
+func (g *ComponentGraph) FindCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	stack := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dependency := range g.byName[name].DependsOn {
+			if _, ok := g.byName[dependency]; !ok {
+				continue
+			}
+			switch state[dependency] {
+			case visiting:
+				for i := range stack {
+					if stack[i] == dependency {
+						cycle := append([]string{}, stack[i:]...)
+						return append(cycle, dependency)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dependency); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, component := range g.components {
+		if state[component.Name] == unvisited {
+			if cycle := visit(component.Name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package bundles
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testGraphComponents() []Component {
+	return []Component{
+		{Name: "migrate", Type: JobComponentType, Spec: &Job{Phase: JobPhasePreInstall, Image: "flyway"}},
+		{Name: "api", Type: PluginComponentType, DependsOn: []string{"db", "cache"}},
+		{Name: "db", Type: HelmComponentType},
+		{Name: "cache", Type: ManifestComponentType},
+		{Name: "ui", Type: PluginComponentType, DependsOn: []string{"api"}},
+	}
+}
+
+func componentNames(components []*Component) []string {
+	names := []string{}
+	for _, component := range components {
+		names = append(names, component.Name)
+	}
+	return names
+}
+
+func TestComponentGraphReady(t *testing.T) {
+	graph := NewComponentGraph(testGraphComponents())
+	if names := componentNames(graph.Components()); !reflect.DeepEqual(names, []string{"api", "db", "cache", "ui"}) {
+		t.Fatalf("Expected JOB components excluded from the graph, got %v", names)
+	}
+
+	started := map[string]bool{}
+	done := map[string]bool{}
+	if names := componentNames(graph.Ready(started, done)); !reflect.DeepEqual(names, []string{"db", "cache"}) {
+		t.Fatalf("Expected db and cache ready, got %v", names)
+	}
+
+	started["db"] = true
+	done["cache"] = true
+	if names := componentNames(graph.Ready(started, done)); len(names) != 0 {
+		t.Fatalf("Expected no component ready while db is applied, got %v", names)
+	}
+
+	done["db"] = true
+	if names := componentNames(graph.Ready(started, done)); !reflect.DeepEqual(names, []string{"api"}) {
+		t.Fatalf("Expected api ready, got %v", names)
+	}
+}
+
+func TestComponentGraphFindCycle(t *testing.T) {
+	components := testGraphComponents()
+	if cycle := NewComponentGraph(components).FindCycle(); cycle != nil {
+		t.Fatalf("Expected no cycle, got %v", cycle)
+	}
+
+	components[2].DependsOn = []string{"ui"}
+	cycle := NewComponentGraph(components).FindCycle()
+	if !reflect.DeepEqual(cycle, []string{"api", "db", "ui", "api"}) {
+		t.Fatalf("Expected cycle api -> db -> ui -> api, got %v", cycle)
+	}
+}
@@ -0,0 +1,226 @@
+package bundles
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DescriptorAPIGroup = "descriptor.entando.org"
+	// DescriptorV1Alpha1 is the original format, assumed when a descriptor
+	// doesn't declare an apiVersion
+	DescriptorV1Alpha1 = DescriptorAPIGroup + "/v1alpha1"
+	// DescriptorV1 is the current format, unknown fields are rejected
+	DescriptorV1 = DescriptorAPIGroup + "/v1"
+
+	LatestDescriptorAPIVersion = DescriptorV1
+)
+
+// BundleDescriptorV1Alpha1 is the descriptor format used before apiVersion
+// was introduced, the description was read from the descriptor field
+type BundleDescriptorV1Alpha1 struct {
+	APIVersion   string      `yaml:"apiVersion,omitempty"`
+	Version      string      `yaml:"version"`
+	Name         string      `yaml:"name"`
+	Description  string      `yaml:"description,omitempty"`
+	Descriptor   string      `yaml:"descriptor,omitempty"`
+	Dependencies []string    `yaml:"dependencies,omitempty"`
+	Components   []Component `yaml:"components,omitempty"`
+}
+
+func (d *BundleDescriptorV1Alpha1) ConvertToHub() *BundleDescriptor {
+	description := d.Description
+	if description == "" {
+		description = d.Descriptor
+	}
+	return &BundleDescriptor{
+		APIVersion:   DescriptorV1Alpha1,
+		Version:      d.Version,
+		Name:         d.Name,
+		Description:  description,
+		Dependencies: d.Dependencies,
+		Components:   d.Components,
+	}
+}
+
+func (d *BundleDescriptorV1Alpha1) ConvertFromHub(hub *BundleDescriptor) {
+	d.APIVersion = DescriptorV1Alpha1
+	d.Version = hub.Version
+	d.Name = hub.Name
+	d.Description = hub.Description
+	d.Dependencies = hub.Dependencies
+	d.Components = hub.Components
+}
+
+// BundleDescriptorV1 is the current descriptor format, Version is the version
+// of the bundle while APIVersion is the version of the descriptor format
+type BundleDescriptorV1 struct {
+	APIVersion   string      `yaml:"apiVersion"`
+	Name         string      `yaml:"name"`
+	Version      string      `yaml:"version"`
+	Description  string      `yaml:"description,omitempty"`
+	Dependencies []string    `yaml:"dependencies,omitempty"`
+	Components   []Component `yaml:"components,omitempty"`
+}
+
+func (d *BundleDescriptorV1) ConvertToHub() *BundleDescriptor {
+	return &BundleDescriptor{
+		APIVersion:   DescriptorV1,
+		Version:      d.Version,
+		Name:         d.Name,
+		Description:  d.Description,
+		Dependencies: d.Dependencies,
+		Components:   d.Components,
+	}
+}
+
+func (d *BundleDescriptorV1) ConvertFromHub(hub *BundleDescriptor) {
+	d.APIVersion = DescriptorV1
+	d.Version = hub.Version
+	d.Name = hub.Name
+	d.Description = hub.Description
+	d.Dependencies = hub.Dependencies
+	d.Components = hub.Components
+}
+
+// VersionedDescriptor is implemented by every supported descriptor format
+type VersionedDescriptor interface {
+	ConvertToHub() *BundleDescriptor
+	ConvertFromHub(hub *BundleDescriptor)
+}
+
+type descriptorVersion struct {
+	// strict rejects fields that are not part of the format
+	strict bool
+	new    func() VersionedDescriptor
+}
+
+var descriptorVersions = map[string]descriptorVersion{
+	DescriptorV1Alpha1: {strict: false, new: func() VersionedDescriptor { return &BundleDescriptorV1Alpha1{} }},
+	DescriptorV1:       {strict: true, new: func() VersionedDescriptor { return &BundleDescriptorV1{} }},
+}
+
+// SupportedDescriptorAPIVersions returns the sorted list of the descriptor formats
+func SupportedDescriptorAPIVersions() []string {
+	versions := make([]string, 0, len(descriptorVersions))
+	for version := range descriptorVersions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func lookupDescriptorVersion(apiVersion string) (descriptorVersion, error) {
+	if apiVersion == "" {
+		apiVersion = DescriptorV1Alpha1
+	}
+	version, ok := descriptorVersions[apiVersion]
+	if !ok {
+		return descriptorVersion{}, fmt.Errorf("unsupported descriptor apiVersion %q, supported versions are %s",
+			apiVersion, strings.Join(SupportedDescriptorAPIVersions(), ", "))
+	}
+	return version, nil
+}
+
+// MarshalBundleDescriptor serializes the descriptor using the requested
+// format, it can be used to convert descriptors written in older formats
+func MarshalBundleDescriptor(descriptor *BundleDescriptor, apiVersion string) ([]byte, error) {
+	version, err := lookupDescriptorVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	versioned := version.new()
+	versioned.ConvertFromHub(descriptor)
+	return yaml.Marshal(versioned)
+}
+
+// checkKnownFields reports the mapping keys that don't match a yaml field of t,
+// component specs are checked against the type registered for the component
+func (v *validator) checkKnownFields(node *yaml.Node, t reflect.Type, field string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		if t == reflect.TypeOf(Component{}) {
+			// unknown types are already reported, their spec is not checked
+			fields["spec"] = reflect.TypeOf((*interface{})(nil)).Elem()
+			componentType := lookupNode(node, "type").Value
+			if factory, ok := componentSpecs[ComponentType(componentType)]; ok {
+				fields["spec"] = reflect.TypeOf(factory())
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			fieldType, ok := fields[key]
+			if !ok {
+				v.addAt(node.Content[i], joinField(field, key), fmt.Sprintf("unknown field %q", key))
+				continue
+			}
+			v.checkKnownFields(node.Content[i+1], fieldType, joinField(field, key))
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			v.checkKnownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", field, i))
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			v.checkKnownFields(node.Content[i+1], t.Elem(), joinField(field, key))
+		}
+	}
+}
+
+// yamlFields returns the yaml name of the fields of a struct with their type
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, options := yamlTag(f)
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && strings.Contains(options, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func yamlTag(f reflect.StructField) (string, string) {
+	tag := f.Tag.Get("yaml")
+	name, options := tag, ""
+	if i := strings.Index(tag, ","); i >= 0 {
+		name, options = tag[:i], tag[i+1:]
+	}
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name, options
+}
+
+func joinField(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
@@ -0,0 +1,141 @@
+package bundles
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const legacyDescriptor = `version: v1.0.0
+name: example
+descriptor: Example bundle
+dependencies:
+  - other-bundle
+components:
+  - name: web
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      tag: 1.23.3
+      port: 80
+  - name: service
+    type: MANIFEST
+    spec:
+      filePath: manifests/service.yaml
+`
+
+func TestDescriptorRoundTrip(t *testing.T) {
+	legacy, errs := parseBundleDescriptor([]byte(legacyDescriptor), nil)
+	if errs != nil {
+		t.Fatalf("Unexpected errors: %s", errs)
+	}
+	if legacy.APIVersion != DescriptorV1Alpha1 {
+		t.Fatalf("Invalid apiVersion. Expected %q, got %q", DescriptorV1Alpha1, legacy.APIVersion)
+	}
+	if legacy.Description != "Example bundle" {
+		t.Fatalf("Invalid description converted from descriptor field, got %q", legacy.Description)
+	}
+
+	for _, apiVersion := range SupportedDescriptorAPIVersions() {
+		t.Run(apiVersion, func(t *testing.T) {
+			data, err := MarshalBundleDescriptor(legacy, apiVersion)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !strings.HasPrefix(string(data), "apiVersion: "+apiVersion+"\n") {
+				t.Fatalf("Expected apiVersion %q in:\n%s", apiVersion, data)
+			}
+
+			actual, errs := parseBundleDescriptor(data, nil)
+			if errs != nil {
+				t.Fatalf("Unexpected errors: %s\n%s", errs, data)
+			}
+
+			expected := *legacy
+			expected.APIVersion = apiVersion
+			if !reflect.DeepEqual(&expected, actual) {
+				t.Fatalf("Invalid round trip for %s. Expected %+v, got %+v", apiVersion, expected, *actual)
+			}
+
+			again, err := MarshalBundleDescriptor(actual, apiVersion)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !bytes.Equal(data, again) {
+				t.Fatalf("Unstable serialization for %s:\n%s\n%s", apiVersion, data, again)
+			}
+		})
+	}
+}
+
+func TestDescriptorUnknownAPIVersion(t *testing.T) {
+	errs := Validate([]byte("apiVersion: descriptor.entando.org/v9\nname: example\nversion: v1.0.0\n"), nil)
+	if len(errs) != 1 {
+		t.Fatalf("Expected one error, got %s", errs)
+	}
+	if errs[0].Field != "apiVersion" || errs[0].Line != 1 || errs[0].Column != 13 {
+		t.Fatalf("Invalid error position %+v", errs[0])
+	}
+	if !strings.Contains(errs[0].Message, `unsupported descriptor apiVersion "descriptor.entando.org/v9"`) ||
+		!strings.Contains(errs[0].Message, DescriptorV1) {
+		t.Fatalf("Invalid error message %q", errs[0].Message)
+	}
+
+	if _, err := MarshalBundleDescriptor(&BundleDescriptor{}, "descriptor.entando.org/v9"); err == nil {
+		t.Fatal("Expected error marshalling unknown apiVersion")
+	}
+}
+
+func TestDescriptorV1UnknownFields(t *testing.T) {
+	descriptor := `apiVersion: descriptor.entando.org/v1
+name: example
+version: v1.0.0
+descriptor: Example bundle
+components:
+  - name: web
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      tag: latest
+      replica: 2
+`
+	errs := Validate([]byte(descriptor), nil)
+	if len(errs) != 2 {
+		t.Fatalf("Expected two errors, got %s", errs)
+	}
+	if errs[0].Field != "descriptor" || errs[0].Line != 4 {
+		t.Fatalf("Invalid error %+v", errs[0])
+	}
+	if errs[1].Field != "components[0].spec.replica" || errs[1].Line != 11 || errs[1].Column != 7 {
+		t.Fatalf("Invalid error %+v", errs[1])
+	}
+
+	// the legacy format ignores unknown fields
+	if errs := Validate([]byte(legacyDescriptor+"extra: true\n"), nil); errs != nil {
+		t.Fatalf("Unexpected errors for legacy descriptor: %s", errs)
+	}
+}
+
+func TestDescriptorJSONSchemaPublished(t *testing.T) {
+	for _, apiVersion := range SupportedDescriptorAPIVersions() {
+		expected, err := DescriptorJSONSchema(apiVersion)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		fileName := filepath.Join("../config/bundle-spec/schema", DescriptorJSONSchemaFileName(apiVersion))
+		actual, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("Schema %s is out of date, run make descriptor-schema", fileName)
+		}
+	}
+
+	if _, err := DescriptorJSONSchema("descriptor.entando.org/v9"); err == nil {
+		t.Fatal("Expected error generating schema for unknown apiVersion")
+	}
+}
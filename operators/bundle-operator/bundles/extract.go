@@ -0,0 +1,404 @@
+package bundles
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrAbsolutePath     = errors.New("absolute path")
+	ErrPathTraversal    = errors.New("path outside the extraction directory")
+	ErrUnsafeLink       = errors.New("link outside the extraction directory")
+	ErrUnsafeParent     = errors.New("parent directory is a symlink or a file")
+	ErrInvalidHardlink  = errors.New("hardlink to a missing or non regular file")
+	ErrSizeLimit        = errors.New("total size limit exceeded")
+	ErrFileCountLimit   = errors.New("file count limit exceeded")
+	ErrInvalidEntrySize = errors.New("invalid entry size")
+)
+
+// ExtractLimits bound the content extracted from a bundle image, to protect
+// the operator from decompression bombs
+type ExtractLimits struct {
+	// MaxSize is the maximum total size in bytes of the extracted files
+	MaxSize int64
+	// MaxFiles is the maximum number of entries of the image
+	MaxFiles int
+}
+
+// DefaultExtractLimits are the limits used to extract the bundle images, they
+// can be changed with the flags of the operator
+var DefaultExtractLimits = ExtractLimits{
+	MaxSize:  1 << 30,
+	MaxFiles: 10000,
+}
+
+// ExtractError reports the entry of the tar that can't be extracted
+type ExtractError struct {
+	Entry string
+	Err   error
+}
+
+func (e *ExtractError) Error() string {
+	return fmt.Sprintf("tar entry %q: %s", e.Entry, e.Err)
+}
+
+func (e *ExtractError) Unwrap() error {
+	return e.Err
+}
+
+// extractTarReader extracts the tar into root. The entries can't be written
+// outside root, neither by their name nor through symlinks, and the symlinks
+// and the hardlinks must point inside root.
+func extractTarReader(root string, r io.Reader, limits ExtractLimits) error {
+	extractor, err := newTarExtractor(root, limits)
+	if err != nil {
+		return err
+	}
+	if err := extractor.extract(r); err != nil {
+		return err
+	}
+	return extractor.checkSymlinks()
+}
+
+// tarExtractor extracts one or more tars into the same root, the limits apply
+// to the total of the tars
+type tarExtractor struct {
+	root      string
+	limits    ExtractLimits
+	totalSize int64
+	files     int
+	symlinks  []string
+}
+
+func newTarExtractor(root string, limits ExtractLimits) (*tarExtractor, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &tarExtractor{root: root, limits: limits}, nil
+}
+
+func (e *tarExtractor) extract(r io.Reader) error {
+	root, limits := e.root, e.limits
+	tarBallReader := tar.NewReader(r)
+	for {
+		header, err := tarBallReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		e.files++
+		if limits.MaxFiles > 0 && e.files > limits.MaxFiles {
+			return &ExtractError{Entry: header.Name, Err: fmt.Errorf("%w: more than %d entries", ErrFileCountLimit, limits.MaxFiles)}
+		}
+
+		name, err := entryPath(header.Name)
+		if err != nil {
+			return &ExtractError{Entry: header.Name, Err: err}
+		}
+		if name == "." {
+			continue
+		}
+		target := filepath.Join(root, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = mkdirInRoot(root, name, header.FileInfo().Mode().Perm()|0700)
+
+		case tar.TypeReg, tar.TypeRegA:
+			if header.Size < 0 {
+				err = ErrInvalidEntrySize
+				break
+			}
+			if limits.MaxSize > 0 && e.totalSize+header.Size > limits.MaxSize {
+				err = fmt.Errorf("%w: more than %d bytes", ErrSizeLimit, limits.MaxSize)
+				break
+			}
+			var written int64
+			written, err = writeFile(root, name, tarBallReader, header.Size, header.FileInfo().Mode().Perm()|0600)
+			e.totalSize += written
+
+		case tar.TypeSymlink:
+			if err = checkSymlink(name, header.Linkname); err != nil {
+				break
+			}
+			if err = prepareEntry(root, name); err != nil {
+				break
+			}
+			err = os.Symlink(header.Linkname, target)
+			e.symlinks = append(e.symlinks, name)
+
+		case tar.TypeLink:
+			var linkname string
+			if linkname, err = entryPath(header.Linkname); err != nil {
+				err = fmt.Errorf("%w: %s", ErrUnsafeLink, err)
+				break
+			}
+			if err = checkHardlink(root, linkname); err != nil {
+				break
+			}
+			if err = prepareEntry(root, name); err != nil {
+				break
+			}
+			err = os.Link(filepath.Join(root, filepath.FromSlash(linkname)), target)
+
+		default:
+			bundleLog.Info(fmt.Sprintf("Unable to untar type : %c in file %s", header.Typeflag, target))
+		}
+		if err != nil {
+			return &ExtractError{Entry: header.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// ExtractFiles copies the files and the directories of fsys with the names to
+// root, the directories are created without their content. The files are
+// read following their symlinks, so only regular files and directories are
+// written and nothing can point outside root.
+func ExtractFiles(fsys fs.FS, root string, names []string, limits ExtractLimits) error {
+	extractor, err := newTarExtractor(root, limits)
+	if err != nil {
+		return err
+	}
+	for _, entry := range names {
+		if err := extractor.extractFile(fsys, entry); err != nil {
+			return &ExtractError{Entry: entry, Err: err}
+		}
+	}
+	return nil
+}
+
+func (e *tarExtractor) extractFile(fsys fs.FS, entry string) error {
+	name, err := entryPath(entry)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return nil
+	}
+	e.files++
+	if e.limits.MaxFiles > 0 && e.files > e.limits.MaxFiles {
+		return fmt.Errorf("%w: more than %d entries", ErrFileCountLimit, e.limits.MaxFiles)
+	}
+
+	file, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return mkdirInRoot(e.root, name, info.Mode().Perm()|0700)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("unsupported file mode %s", info.Mode())
+	}
+	if e.limits.MaxSize > 0 && e.totalSize+info.Size() > e.limits.MaxSize {
+		return fmt.Errorf("%w: more than %d bytes", ErrSizeLimit, e.limits.MaxSize)
+	}
+	written, err := writeFile(e.root, name, file, info.Size(), info.Mode().Perm()|0600)
+	e.totalSize += written
+	return err
+}
+
+// checkSymlinks checks the symlinks once all the tars are extracted: a
+// symlink checked when created can resolve outside root through the symlinks
+// created after it
+func (e *tarExtractor) checkSymlinks() error {
+	for _, name := range e.symlinks {
+		if err := checkResolvedSymlink(e.root, name); err != nil {
+			return &ExtractError{Entry: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// entryPath returns the cleaned slash separated path of an entry relative to
+// the extraction directory
+func entryPath(name string) (string, error) {
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", ErrAbsolutePath
+	}
+	cleaned := path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrPathTraversal
+	}
+	return cleaned, nil
+}
+
+// mkdirInRoot creates the directories of the relative path, failing if one of
+// them exists and is not a directory
+func mkdirInRoot(root string, name string, perm os.FileMode) error {
+	current := root
+	for _, segment := range strings.Split(name, "/") {
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(current, perm); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%w: %s", ErrUnsafeParent, segment)
+		}
+	}
+	return nil
+}
+
+// prepareEntry creates the parent directories of an entry and removes the
+// file it replaces, so that it is never written through an existing symlink
+func prepareEntry(root string, name string) error {
+	if parent := path.Dir(name); parent != "." {
+		if err := mkdirInRoot(root, parent, 0755); err != nil {
+			return err
+		}
+	}
+	target := filepath.Join(root, filepath.FromSlash(name))
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	return os.Remove(target)
+}
+
+// writeFile copies size bytes of r to a new file, it fails if the entry is
+// shorter than its declared size
+func writeFile(root string, name string, r io.Reader, size int64, perm os.FileMode) (int64, error) {
+	if err := prepareEntry(root, name); err != nil {
+		return 0, err
+	}
+	writer, err := os.OpenFile(filepath.Join(root, filepath.FromSlash(name)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.CopyN(writer, r, size)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// checkSymlink checks that the target of a symlink, resolved from the
+// directory of the link, stays in the extraction directory
+func checkSymlink(name string, linkname string) error {
+	if linkname == "" {
+		return fmt.Errorf("%w: empty target", ErrUnsafeLink)
+	}
+	if strings.HasPrefix(linkname, "/") || filepath.IsAbs(linkname) {
+		return fmt.Errorf("%w: absolute target %s", ErrUnsafeLink, linkname)
+	}
+	if _, err := entryPath(path.Join(path.Dir(name), linkname)); err != nil {
+		return fmt.Errorf("%w: target %s", ErrUnsafeLink, linkname)
+	}
+	return nil
+}
+
+// checkHardlink checks that a hardlink points to a regular file already
+// extracted
+func checkHardlink(root string, linkname string) error {
+	if parent := path.Dir(linkname); parent != "." {
+		if err := checkParents(root, parent); err != nil {
+			return err
+		}
+	}
+	info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(linkname)))
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s", ErrInvalidHardlink, linkname)
+	}
+	return nil
+}
+
+// checkParents checks that the directories of the relative path are real
+// directories and not symlinks
+func checkParents(root string, name string) error {
+	current := root
+	for _, segment := range strings.Split(name, "/") {
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%w: %s", ErrUnsafeParent, segment)
+		}
+	}
+	return nil
+}
+
+// checkResolvedSymlink follows a symlink of the extracted tree, component by
+// component like the kernel does, and checks that it never leaves root. The
+// resolution stops at the first missing component, that can't be followed.
+func checkResolvedSymlink(root string, name string) error {
+	current := []string{}
+	if dir := path.Dir(name); dir != "." {
+		current = strings.Split(dir, "/")
+	}
+	pending := []string{path.Base(name)}
+	for hops := 0; len(pending) > 0; {
+		segment := pending[0]
+		pending = pending[1:]
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			if len(current) == 0 {
+				return fmt.Errorf("%w: %s resolves outside", ErrUnsafeLink, name)
+			}
+			current = current[:len(current)-1]
+			continue
+		}
+
+		candidate := filepath.Join(root, filepath.Join(current...), segment)
+		info, err := os.Lstat(candidate)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = append(current, segment)
+			continue
+		}
+
+		hops++
+		if hops > 255 {
+			return fmt.Errorf("%w: too many levels of symlinks in %s", ErrUnsafeLink, name)
+		}
+		linkname, err := os.Readlink(candidate)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(linkname) {
+			return fmt.Errorf("%w: absolute target %s", ErrUnsafeLink, linkname)
+		}
+		pending = append(strings.Split(filepath.ToSlash(linkname), "/"), pending...)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package bundles
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	size     int64
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0644}
+		if entry.typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.body))
+			if entry.size > 0 {
+				header.Size = entry.size
+			}
+		}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err.Error())
+		}
+		if entry.body != "" {
+			if _, err := tw.Write([]byte(entry.body)); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+	// the declared size of a bomb isn't written, the tar is left unterminated
+	tw.Flush()
+	return buf
+}
+
+func TestExtractTar(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "bundle")
+	entries := []tarEntry{
+		{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+		{name: "./descriptor.yaml", typeflag: tar.TypeReg, body: "name: example"},
+		{name: "charts/", typeflag: tar.TypeDir},
+		{name: "charts/db/../values.yaml", typeflag: tar.TypeReg, body: "replicas: 1"},
+		{name: "manifests/current.yaml", typeflag: tar.TypeSymlink, linkname: "service.yaml"},
+		{name: "descriptor-link.yaml", typeflag: tar.TypeLink, linkname: "descriptor.yaml"},
+		{name: "manifests/dangling.yaml", typeflag: tar.TypeSymlink, linkname: "../missing.yaml"},
+	}
+	if err := extractTarReader(root, buildTar(t, entries), DefaultExtractLimits); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := map[string]string{
+		"manifests/service.yaml": "kind: Service",
+		"descriptor.yaml":        "name: example",
+		"charts/values.yaml":     "replicas: 1",
+		"manifests/current.yaml": "kind: Service",
+		"descriptor-link.yaml":   "name: example",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != content {
+			t.Fatalf("Invalid content of %s. Expected %q, got %q", name, content, data)
+		}
+	}
+}
+
+func TestExtractTarMalicious(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []tarEntry
+		limits   ExtractLimits
+		expected error
+	}{
+		{
+			name:     "path traversal",
+			entries:  []tarEntry{{name: "../../etc/cron.d/evil", typeflag: tar.TypeReg, body: "evil"}},
+			expected: ErrPathTraversal,
+		},
+		{
+			name:     "nested path traversal",
+			entries:  []tarEntry{{name: "manifests/../../evil", typeflag: tar.TypeReg, body: "evil"}},
+			expected: ErrPathTraversal,
+		},
+		{
+			name:     "absolute path",
+			entries:  []tarEntry{{name: "/etc/passwd", typeflag: tar.TypeReg, body: "evil"}},
+			expected: ErrAbsolutePath,
+		},
+		{
+			name:     "absolute symlink",
+			entries:  []tarEntry{{name: "passwd", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+			expected: ErrUnsafeLink,
+		},
+		{
+			name:     "relative symlink outside",
+			entries:  []tarEntry{{name: "manifests/passwd", typeflag: tar.TypeSymlink, linkname: "../../etc/passwd"}},
+			expected: ErrUnsafeLink,
+		},
+		{
+			name: "write through symlink",
+			entries: []tarEntry{
+				{name: "escape", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "escape/file", typeflag: tar.TypeReg, body: "evil"},
+			},
+			expected: ErrUnsafeParent,
+		},
+		{
+			name: "symlink chain outside",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeDir},
+				{name: "d/up", typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: "chain", typeflag: tar.TypeSymlink, linkname: "d/up/.."},
+			},
+			expected: ErrUnsafeLink,
+		},
+		{
+			name: "symlink resolved through later symlink",
+			entries: []tarEntry{
+				{name: "d", typeflag: tar.TypeDir},
+				{name: "up", typeflag: tar.TypeSymlink, linkname: "d/sub/../missing"},
+				{name: "d/sub", typeflag: tar.TypeSymlink, linkname: ".."},
+			},
+			expected: ErrUnsafeLink,
+		},
+		{
+			name: "symlink loop",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "b"},
+				{name: "b", typeflag: tar.TypeSymlink, linkname: "a"},
+			},
+			expected: ErrUnsafeLink,
+		},
+		{
+			name: "hardlink outside",
+			entries: []tarEntry{
+				{name: "passwd", typeflag: tar.TypeLink, linkname: "../../etc/passwd"},
+			},
+			expected: ErrUnsafeLink,
+		},
+		{
+			name: "hardlink to symlink",
+			entries: []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "missing"},
+				{name: "hard", typeflag: tar.TypeLink, linkname: "link"},
+			},
+			expected: ErrInvalidHardlink,
+		},
+		{
+			name: "overwrite symlink",
+			entries: []tarEntry{
+				{name: "file", typeflag: tar.TypeReg, body: "content"},
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "file"},
+				{name: "link", typeflag: tar.TypeReg, body: "replaced"},
+			},
+		},
+		{
+			name:     "size limit",
+			entries:  []tarEntry{{name: "a", typeflag: tar.TypeReg, body: "12345"}, {name: "b", typeflag: tar.TypeReg, body: "67890"}},
+			limits:   ExtractLimits{MaxSize: 8},
+			expected: ErrSizeLimit,
+		},
+		{
+			name:     "declared size bomb",
+			entries:  []tarEntry{{name: "bomb", typeflag: tar.TypeReg, size: 1 << 40}},
+			limits:   ExtractLimits{MaxSize: 1 << 20},
+			expected: ErrSizeLimit,
+		},
+		{
+			name:     "file count limit",
+			entries:  []tarEntry{{name: "a", typeflag: tar.TypeDir}, {name: "a/b", typeflag: tar.TypeReg, body: "b"}, {name: "a/c", typeflag: tar.TypeReg, body: "c"}},
+			limits:   ExtractLimits{MaxFiles: 2},
+			expected: ErrFileCountLimit,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+			root := filepath.Join(base, "bundle")
+			limits := test.limits
+			if limits == (ExtractLimits{}) {
+				limits = DefaultExtractLimits
+			}
+			err := extractTarReader(root, buildTar(t, test.entries), limits)
+			if test.expected == nil {
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+			} else {
+				var extractError *ExtractError
+				if !errors.Is(err, test.expected) || !errors.As(err, &extractError) {
+					t.Fatalf("Expected %q, got %v", test.expected, err)
+				}
+			}
+
+			// nothing may be written next to the extraction directory
+			entries, err := os.ReadDir(base)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(entries) != 1 {
+				t.Fatalf("Expected only the extraction directory in %s, got %d entries", base, len(entries))
+			}
+		})
+	}
+}
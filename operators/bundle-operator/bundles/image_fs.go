@@ -0,0 +1,468 @@
+package bundles
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+
+	maxSymlinkHops = 255
+
+	// maxIndexedFileSize is the size of the largest file whose content is
+	// kept by the indexing, maxIndexedContentSize bounds the total
+	maxIndexedFileSize    = 1 << 20
+	maxIndexedContentSize = 64 << 20
+
+	// maxHeadersPerFile bounds the entries of all the layers, whiteouts and
+	// overridden files included, to a multiple of the indexed files
+	maxHeadersPerFile = 4
+)
+
+// ImageFS is a read only file system over the layers of an image, as seen
+// by a container: upper layers override the files of the lower ones and their
+// whiteouts delete them. The headers of the layers and the content of the
+// small files are kept in memory by the indexing, opening a larger file
+// streams the layer that holds it, so reading a few files of a large image
+// doesn't need to extract it. The tar layers of a bundle
+// artifact are read the same way, with its descriptor layer as descriptor file.
+type ImageFS struct {
+	layers []v1.Layer
+	files  map[string]*imageFile
+	// children are the sorted names of the entries of each directory
+	children map[string][]string
+}
+
+type imageFile struct {
+	name     string
+	typeflag byte
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	linkname string
+	// layer is the index of the layer holding the content, content is the
+	// name of the entry in the layer, different for hardlinks
+	layer   int
+	content string
+	// implicit is set for the parent directories missing from the layers
+	implicit bool
+	// data is the content read by the indexing, nil when the file is too
+	// large and is streamed from its layer
+	data []byte
+}
+
+// NewImageFS indexes the layers of the image, a container image or a bundle
+// artifact, up to the number of entries of DefaultExtractLimits
+func NewImageFS(img v1.Image) (*ImageFS, error) {
+	layers, _, err := bundleLayers(img)
+	if err != nil {
+		return nil, err
+	}
+	f := &ImageFS{
+		layers: layers,
+		files: map[string]*imageFile{
+			".": {name: ".", typeflag: tar.TypeDir, mode: fs.ModeDir | 0755, implicit: true},
+		},
+	}
+
+	// the whiteouts of a layer apply to the layers below it
+	whiteouts := map[string]bool{}
+	opaques := map[string]bool{}
+	var indexedSize int64
+	maxFiles := DefaultExtractLimits.MaxFiles
+	headers := 0
+	for i := len(layers) - 1; i >= 0; i-- {
+		layerWhiteouts := map[string]bool{}
+		layerOpaques := map[string]bool{}
+		err := walkLayer(layers[i], func(header *tar.Header, name string, r io.Reader) (bool, error) {
+			headers++
+			if maxFiles > 0 && headers > maxHeadersPerFile*maxFiles {
+				return false, &ExtractError{Entry: header.Name, Err: fmt.Errorf("%w: more than %d layer entries", ErrFileCountLimit, maxHeadersPerFile*maxFiles)}
+			}
+			dir, base := path.Dir(name), path.Base(name)
+			switch {
+			case base == whiteoutOpaque:
+				layerOpaques[dir] = true
+			case strings.HasPrefix(base, whiteoutPrefix):
+				layerWhiteouts[path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = true
+			case !f.hidden(name, whiteouts, opaques):
+				file := f.add(header, name, i)
+				if maxFiles > 0 && len(f.files)-1 > maxFiles {
+					return false, &ExtractError{Entry: header.Name, Err: fmt.Errorf("%w: more than %d entries", ErrFileCountLimit, maxFiles)}
+				}
+				if file == nil || file.data != nil || file.content != name || file.typeflag != tar.TypeReg ||
+					header.Size > maxIndexedFileSize || indexedSize+header.Size > maxIndexedContentSize {
+					break
+				}
+				// the layer is read anyway, the small files are not
+				// streamed again when opened
+				data, err := io.ReadAll(io.LimitReader(r, header.Size))
+				if err != nil {
+					return false, err
+				}
+				file.data = data
+				indexedSize += int64(len(data))
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading layer %d: %w", i, err)
+		}
+		for name := range layerWhiteouts {
+			whiteouts[name] = true
+		}
+		for name := range layerOpaques {
+			opaques[name] = true
+		}
+	}
+
+	f.children = map[string][]string{}
+	for name := range f.files {
+		if name != "." {
+			dir := path.Dir(name)
+			f.children[dir] = append(f.children[dir], name)
+		}
+	}
+	for _, names := range f.children {
+		sort.Strings(names)
+	}
+	return f, nil
+}
+
+// hidden reports whether an entry of a lower layer is deleted or overridden
+// by the upper layers
+func (f *ImageFS) hidden(name string, whiteouts map[string]bool, opaques map[string]bool) bool {
+	if existing, ok := f.files[name]; ok && !existing.implicit {
+		return true
+	}
+	for p := name; p != "."; p = path.Dir(p) {
+		if whiteouts[p] {
+			return true
+		}
+		if p != name {
+			if opaques[p] {
+				return true
+			}
+			// a file of an upper layer replaces the directory
+			if parent, ok := f.files[p]; ok && parent.typeflag != tar.TypeDir {
+				return true
+			}
+		}
+	}
+	return opaques["."] && name != "."
+}
+
+// add indexes the entry of the layer and returns it, nil when the entry is
+// skipped
+func (f *ImageFS) add(header *tar.Header, name string, layer int) *imageFile {
+	if name == "." {
+		return nil
+	}
+	if _, ok := f.files[name]; ok && header.Typeflag != tar.TypeDir {
+		// the upper layers have files in the directory
+		return nil
+	}
+	file := &imageFile{
+		name:     name,
+		typeflag: header.Typeflag,
+		mode:     header.FileInfo().Mode(),
+		size:     header.Size,
+		modTime:  header.ModTime,
+		linkname: header.Linkname,
+		layer:    layer,
+		content:  name,
+	}
+	switch header.Typeflag {
+	case tar.TypeRegA:
+		file.typeflag = tar.TypeReg
+	case tar.TypeLink:
+		// the content is the one of the linked entry of the same layer
+		linkname, err := entryPath(header.Linkname)
+		if err != nil {
+			return nil
+		}
+		file.typeflag = tar.TypeReg
+		file.mode = fs.FileMode(header.Mode).Perm()
+		file.content = linkname
+		if linked, ok := f.files[linkname]; ok && linked.layer == layer {
+			file.size = linked.size
+			file.data = linked.data
+		}
+	}
+	f.files[name] = file
+
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := f.files[dir]; ok {
+			break
+		}
+		f.files[dir] = &imageFile{name: dir, typeflag: tar.TypeDir, mode: fs.ModeDir | 0755, layer: layer, implicit: true}
+	}
+	return file
+}
+
+// Open opens the file following the symlinks, that can't leave the image
+func (f *ImageFS) Open(name string) (fs.File, error) {
+	file, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if file.typeflag == tar.TypeDir {
+		return &imageDir{fsys: f, file: file}, nil
+	}
+	if file.typeflag != tar.TypeReg {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("unsupported file type %c", file.typeflag)}
+	}
+	return f.openContent(name, file)
+}
+
+// Stat returns the info of the file without reading its layer
+func (f *ImageFS) Stat(name string) (fs.FileInfo, error) {
+	file, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return file.info(), nil
+}
+
+// Lstat returns the info of the file without following it when a symlink
+func (f *ImageFS) Lstat(name string) (fs.FileInfo, error) {
+	file, err := f.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return file.info(), nil
+}
+
+// ReadLink returns the target of the symlink
+func (f *ImageFS) ReadLink(name string) (string, error) {
+	file, err := f.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if file.typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return file.linkname, nil
+}
+
+func (f *ImageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if file.typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return f.dirEntries(file.name)
+}
+
+// resolve looks up a path following the symlinks of every component,
+// absolute targets are relative to the root of the image
+func (f *ImageFS) resolve(op string, name string) (*imageFile, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	current := "."
+	pending := strings.Split(name, "/")
+	for hops := 0; len(pending) > 0; {
+		segment := pending[0]
+		pending = pending[1:]
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			// like in a chroot, .. of the root is the root
+			current = path.Dir(current)
+			continue
+		}
+
+		candidate := path.Join(current, segment)
+		file, ok := f.files[candidate]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if file.typeflag != tar.TypeSymlink {
+			if len(pending) > 0 && file.typeflag != tar.TypeDir {
+				return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+			}
+			current = candidate
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symlinks")}
+		}
+		if strings.HasPrefix(file.linkname, "/") {
+			current = "."
+		}
+		pending = append(strings.Split(file.linkname, "/"), pending...)
+	}
+	return f.files[current], nil
+}
+
+// lookup resolves the parent directory of the path, the last component is
+// not followed
+func (f *ImageFS) lookup(op string, name string) (*imageFile, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return f.files["."], nil
+	}
+	dir, err := f.resolve(op, path.Dir(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	file, ok := f.files[path.Join(dir.name, path.Base(name))]
+	if dir.typeflag != tar.TypeDir || !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return file, nil
+}
+
+// openContent returns the content read by the indexing or streams the layer
+// of the file until its entry
+func (f *ImageFS) openContent(name string, file *imageFile) (fs.File, error) {
+	if file.data != nil {
+		return &imageFileReader{info: file.info(), reader: bytes.NewReader(file.data), closer: io.NopCloser(nil)}, nil
+	}
+	rc, err := f.layers[file.layer].Uncompressed()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			rc.Close()
+			if err == io.EOF {
+				err = fs.ErrNotExist
+			}
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		entryName, err := entryPath(header.Name)
+		if err == nil && entryName == file.content && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) {
+			info := file.info()
+			info.size = header.Size
+			return &imageFileReader{info: info, reader: tr, closer: rc}, nil
+		}
+	}
+}
+
+func (f *ImageFS) dirEntries(dir string) ([]fs.DirEntry, error) {
+	entries := make([]fs.DirEntry, 0, len(f.children[dir]))
+	for _, name := range f.children[dir] {
+		entries = append(entries, fs.FileInfoToDirEntry(f.files[name].info()))
+	}
+	return entries, nil
+}
+
+func (file *imageFile) info() *imageFileInfo {
+	return &imageFileInfo{name: path.Base(file.name), size: file.size, mode: file.mode, modTime: file.modTime}
+}
+
+// walkLayer calls fn with the valid entries of the layer until it returns
+// false
+func walkLayer(layer v1.Layer, fn func(header *tar.Header, name string, r io.Reader) (bool, error)) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name, err := entryPath(header.Name)
+		if err != nil {
+			return &ExtractError{Entry: header.Name, Err: err}
+		}
+		next, err := fn(header, name, tr)
+		if err != nil || !next {
+			return err
+		}
+	}
+}
+
+type imageFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *imageFileInfo) Name() string       { return i.name }
+func (i *imageFileInfo) Size() int64        { return i.size }
+func (i *imageFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *imageFileInfo) ModTime() time.Time { return i.modTime }
+func (i *imageFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *imageFileInfo) Sys() interface{}   { return nil }
+
+type imageFileReader struct {
+	info   *imageFileInfo
+	reader io.Reader
+	closer io.Closer
+}
+
+func (r *imageFileReader) Stat() (fs.FileInfo, error) { return r.info, nil }
+func (r *imageFileReader) Read(p []byte) (int, error) { return r.reader.Read(p) }
+func (r *imageFileReader) Close() error               { return r.closer.Close() }
+
+type imageDir struct {
+	fsys    *ImageFS
+	file    *imageFile
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *imageDir) Stat() (fs.FileInfo, error) { return d.file.info(), nil }
+
+func (d *imageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.file.name, Err: errors.New("is a directory")}
+}
+
+func (d *imageDir) Close() error { return nil }
+
+func (d *imageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.fsys.dirEntries(d.file.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+	}
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
@@ -0,0 +1,225 @@
+package bundles
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// buildImage returns an image with a layer per list of entries, from the
+// lowest to the uppermost
+func buildImage(t *testing.T, layers ...[]tarEntry) v1.Image {
+	img := empty.Image
+	for _, entries := range layers {
+		data := buildTar(t, entries).Bytes()
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if img, err = mutate.AppendLayers(img, layer); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return img
+}
+
+func TestImageFS(t *testing.T) {
+	img := buildImage(t,
+		[]tarEntry{
+			{name: "descriptor.yaml", typeflag: tar.TypeReg, body: "name: old"},
+			{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+			{name: "manifests/removed.yaml", typeflag: tar.TypeReg, body: "kind: Secret"},
+			{name: "manifests/hard.yaml", typeflag: tar.TypeLink, linkname: "manifests/service.yaml"},
+			{name: "charts/db/values.yaml", typeflag: tar.TypeReg, body: "replicas: 1"},
+			{name: "old/values.yaml", typeflag: tar.TypeReg, body: "replicas: 2"},
+		},
+		[]tarEntry{
+			{name: "descriptor.yaml", typeflag: tar.TypeReg, body: "name: example"},
+			{name: "manifests/.wh.removed.yaml", typeflag: tar.TypeReg},
+			{name: ".wh.old", typeflag: tar.TypeReg},
+			{name: "charts/.wh..wh..opq", typeflag: tar.TypeReg},
+			{name: "charts/web/values.yaml", typeflag: tar.TypeReg, body: "replicas: 3"},
+			{name: "current.yaml", typeflag: tar.TypeSymlink, linkname: "manifests/service.yaml"},
+			{name: "manifests/absolute.yaml", typeflag: tar.TypeSymlink, linkname: "/descriptor.yaml"},
+			{name: "manifests/escape.yaml", typeflag: tar.TypeSymlink, linkname: "../../../descriptor.yaml"},
+		},
+	)
+	fsys, err := NewImageFS(img)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := map[string]string{
+		"descriptor.yaml":         "name: example",
+		"manifests/service.yaml":  "kind: Service",
+		"manifests/hard.yaml":     "kind: Service",
+		"charts/web/values.yaml":  "replicas: 3",
+		"current.yaml":            "kind: Service",
+		"manifests/absolute.yaml": "name: example",
+		"manifests/escape.yaml":   "name: example",
+	}
+	for name, content := range expected {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != content {
+			t.Fatalf("Invalid content of %s. Expected %q, got %q", name, content, data)
+		}
+	}
+
+	for _, name := range []string{"manifests/removed.yaml", "old/values.yaml", "old", "charts/db/values.yaml", "charts/db"} {
+		if _, err := fsys.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Expected %s hidden by the upper layer, got %v", name, err)
+		}
+	}
+
+	if err := fstest.TestFS(fsys, "descriptor.yaml", "manifests/service.yaml", "manifests/hard.yaml", "charts/web/values.yaml", "current.yaml"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestImageFSIndexedContent(t *testing.T) {
+	large := strings.Repeat("x", maxIndexedFileSize+1)
+	data := buildTar(t, []tarEntry{
+		{name: "descriptor.yaml", typeflag: tar.TypeReg, body: "name: example"},
+		{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+		{name: "manifests/hard.yaml", typeflag: tar.TypeLink, linkname: "manifests/service.yaml"},
+		{name: "large.bin", typeflag: tar.TypeReg, body: large},
+	}).Bytes()
+	opened := 0
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		opened++
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fsys, err := NewImageFS(img)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the small files are read by the indexing
+	indexed := opened
+	for name, content := range map[string]string{
+		"descriptor.yaml":        "name: example",
+		"manifests/service.yaml": "kind: Service",
+		"manifests/hard.yaml":    "kind: Service",
+	} {
+		read, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(read) != content {
+			t.Fatalf("Invalid content of %s. Expected %q, got %q", name, content, read)
+		}
+	}
+	if opened != indexed {
+		t.Fatalf("Expected the small files read without opening the layer, opened %d times", opened-indexed)
+	}
+
+	// the large files are streamed from the layer
+	read, err := fs.ReadFile(fsys, "large.bin")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(read) != large || opened != indexed+1 {
+		t.Fatalf("Expected the large file streamed, got %d bytes and %d opens", len(read), opened-indexed)
+	}
+}
+
+func TestImageFSDescriptor(t *testing.T) {
+	img := buildImage(t, []tarEntry{
+		{name: "descriptor.yaml", typeflag: tar.TypeReg, body: legacyDescriptor},
+		{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+	})
+	fsys, err := NewImageFS(img)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	descriptor, err := ReadBundleDescriptor(fsys)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if descriptor.Name != "example" {
+		t.Fatalf("Expected descriptor example, got %s", descriptor.Name)
+	}
+
+	// the files referenced by the descriptor are checked in the image
+	img = buildImage(t, []tarEntry{{name: "descriptor.yaml", typeflag: tar.TypeReg, body: legacyDescriptor}})
+	if fsys, err = NewImageFS(img); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ReadBundleDescriptor(fsys); err == nil {
+		t.Fatalf("Expected missing manifest error")
+	}
+}
+
+func TestImageFSInvalid(t *testing.T) {
+	img := buildImage(t, []tarEntry{{name: "../../etc/passwd", typeflag: tar.TypeReg, body: "evil"}})
+	if _, err := NewImageFS(img); !errors.Is(err, ErrPathTraversal) {
+		t.Fatalf("Expected %q, got %v", ErrPathTraversal, err)
+	}
+
+	img = buildImage(t, []tarEntry{
+		{name: "a", typeflag: tar.TypeSymlink, linkname: "b"},
+		{name: "b", typeflag: tar.TypeSymlink, linkname: "a"},
+	})
+	fsys, err := NewImageFS(img)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := fsys.Open("a"); err == nil {
+		t.Fatalf("Expected symlink loop error")
+	}
+}
+
+func TestImageFSLimits(t *testing.T) {
+	defer func(limits ExtractLimits) { DefaultExtractLimits = limits }(DefaultExtractLimits)
+	DefaultExtractLimits.MaxFiles = 3
+
+	img := buildImage(t, []tarEntry{
+		{name: "descriptor.yaml", typeflag: tar.TypeReg, body: "name: example"},
+		{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+		{name: "manifests/secret.yaml", typeflag: tar.TypeReg, body: "kind: Secret"},
+	})
+	if _, err := NewImageFS(img); !errors.Is(err, ErrFileCountLimit) {
+		t.Fatalf("Expected %q, got %v", ErrFileCountLimit, err)
+	}
+
+	// the whiteouts are not indexed, but they are entries of the layers
+	whiteouts := []tarEntry{}
+	for i := 0; i < maxHeadersPerFile*DefaultExtractLimits.MaxFiles; i++ {
+		whiteouts = append(whiteouts, tarEntry{name: fmt.Sprintf(".wh.removed-%d", i), typeflag: tar.TypeReg})
+	}
+	img = buildImage(t, []tarEntry{{name: "descriptor.yaml", typeflag: tar.TypeReg, body: "name: example"}}, whiteouts)
+	if _, err := NewImageFS(img); !errors.Is(err, ErrFileCountLimit) {
+		t.Fatalf("Expected %q, got %v", ErrFileCountLimit, err)
+	}
+
+	img = buildImage(t, []tarEntry{
+		{name: "descriptor.yaml", typeflag: tar.TypeReg, body: "name: example"},
+		{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+	})
+	if _, err := NewImageFS(img); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,191 @@
+package bundles
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v3"
+)
+
+// MirrorRule redirects the pulls of the repositories under a prefix to
+// mirrors, like a pull through proxy
+type MirrorRule struct {
+	// Prefix is a registry, like docker.io, or a repository prefix, like
+	// docker.io/entando, it is replaced by the mirrors
+	Prefix string `yaml:"prefix"`
+	// Mirrors are tried in order, then the source unless Rewrite is set
+	Mirrors []string `yaml:"mirrors"`
+	// Rewrite never pulls from the source, only from the mirrors
+	Rewrite bool `yaml:"rewrite,omitempty"`
+}
+
+// MirrorConfig are the mirror rules of the operator, the rule with the
+// longest prefix matching a repository applies
+type MirrorConfig struct {
+	Rules []MirrorRule `yaml:"rules"`
+}
+
+// ParseMirrorConfig parses and validates the mirror rules
+func ParseMirrorConfig(data []byte) (*MirrorConfig, error) {
+	config := &MirrorConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for i, rule := range config.Rules {
+		prefix, err := normalizePrefix(rule.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d].prefix: %w", i, err)
+		}
+		if len(rule.Mirrors) == 0 {
+			return nil, fmt.Errorf("rules[%d].mirrors: at least a mirror is required", i)
+		}
+		for j, mirror := range rule.Mirrors {
+			if _, err := name.NewRepository(strings.TrimSuffix(mirror, "/") + "/mirrored"); err != nil {
+				return nil, fmt.Errorf("rules[%d].mirrors[%d]: %w", i, j, err)
+			}
+			config.Rules[i].Mirrors[j] = strings.TrimSuffix(mirror, "/")
+		}
+		config.Rules[i].Prefix = prefix
+	}
+	return config, nil
+}
+
+// normalizePrefix returns the prefix with the registry in the form of the
+// parsed references, for example docker.io becomes index.docker.io
+func normalizePrefix(prefix string) (string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	host, path, _ := strings.Cut(prefix, "/")
+	registry, err := name.NewRegistry(host)
+	if err != nil || host == "" {
+		return "", fmt.Errorf("invalid registry in %q", prefix)
+	}
+	if path == "" {
+		return registry.RegistryStr(), nil
+	}
+	return registry.RegistryStr() + "/" + path, nil
+}
+
+// Candidates returns the references to try to pull the image, the mirrors
+// in order followed by the image itself unless rewritten. The local sources
+// and the images without rule are returned as they are.
+func (c *MirrorConfig) Candidates(image string) ([]string, error) {
+	if c == nil || IsLocalSource(image) {
+		return []string{image}, nil
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	repository := ref.Context().Name()
+
+	rule := c.rule(repository)
+	if rule == nil {
+		return []string{image}, nil
+	}
+
+	separator := ":"
+	if _, ok := ref.(name.Digest); ok {
+		separator = "@"
+	}
+	candidates := []string{}
+	for _, mirror := range rule.Mirrors {
+		candidates = append(candidates, mirror+strings.TrimPrefix(repository, rule.Prefix)+separator+ref.Identifier())
+	}
+	if !rule.Rewrite {
+		candidates = append(candidates, image)
+	}
+	return candidates, nil
+}
+
+// RepositoryCandidates returns the repositories to try to list the tags of
+// the repository, like Candidates
+func (c *MirrorConfig) RepositoryCandidates(repository string) ([]string, error) {
+	if c == nil || IsLocalSource(repository) {
+		return []string{repository}, nil
+	}
+	repo, err := name.NewRepository(repository)
+	if err != nil {
+		return nil, err
+	}
+	rule := c.rule(repo.Name())
+	if rule == nil {
+		return []string{repository}, nil
+	}
+	candidates := []string{}
+	for _, mirror := range rule.Mirrors {
+		candidates = append(candidates, mirror+strings.TrimPrefix(repo.Name(), rule.Prefix))
+	}
+	if !rule.Rewrite {
+		candidates = append(candidates, repository)
+	}
+	return candidates, nil
+}
+
+// rule returns the rule with the longest prefix matching the repository,
+// nil when none
+func (c *MirrorConfig) rule(repository string) *MirrorRule {
+	var rule *MirrorRule
+	for i, candidate := range c.Rules {
+		if repository != candidate.Prefix && !strings.HasPrefix(repository, candidate.Prefix+"/") {
+			continue
+		}
+		if rule == nil || len(candidate.Prefix) > len(rule.Prefix) {
+			rule = &c.Rules[i]
+		}
+	}
+	return rule
+}
+
+// Resolve returns the first candidate of the image served by its registry,
+// without rules the image is returned without contacting the registry
+func (c *MirrorConfig) Resolve(image string, options ...crane.Option) (string, error) {
+	candidates, err := c.Candidates(image)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	failures := []string{}
+	for _, candidate := range candidates {
+		_, err := crane.Head(candidate, options...)
+		if err == nil {
+			return candidate, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", candidate, err))
+	}
+	return "", fmt.Errorf("no mirror of %s available: %s", image, strings.Join(failures, "; "))
+}
+
+// ListTags lists the tags of the first candidate of the repository that
+// lists them and returns it, the digests of the tags are resolved on the
+// same repository. The error of the last candidate is wrapped, so that the
+// rate limits of the source are recognized.
+func (c *MirrorConfig) ListTags(repository string, options ...crane.Option) (string, []string, error) {
+	candidates, err := c.RepositoryCandidates(repository)
+	if err != nil {
+		return "", nil, err
+	}
+	failures := []string{}
+	for i, candidate := range candidates {
+		tags, err := ListTags(candidate, options...)
+		if err == nil {
+			return candidate, tags, nil
+		}
+		if len(candidates) == 1 {
+			return "", nil, err
+		}
+		if i == len(candidates)-1 {
+			failures = append(failures, candidate)
+			return "", nil, fmt.Errorf("no mirror of %s available: %s: %w", repository, strings.Join(failures, "; "), err)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", candidate, err))
+	}
+	return "", nil, fmt.Errorf("no mirror of %s available", repository)
+}
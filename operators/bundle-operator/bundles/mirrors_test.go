@@ -0,0 +1,197 @@
+package bundles
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+func TestMirrorCandidates(t *testing.T) {
+	config, err := ParseMirrorConfig([]byte(`
+rules:
+- prefix: docker.io
+  mirrors: [mirror.example.com/dockerhub/]
+- prefix: docker.io/entando
+  mirrors: [mirror.example.com/entando, backup.example.com/entando]
+- prefix: registry.example.com/entando
+  mirrors: [airgap.example.com/entando]
+  rewrite: true
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		image    string
+		expected []string
+	}{
+		{
+			image:    "nginx:1.23.3",
+			expected: []string{"mirror.example.com/dockerhub/library/nginx:1.23.3", "nginx:1.23.3"},
+		},
+		{
+			image: "docker.io/entando/bundle@" + testDigest('a'),
+			expected: []string{
+				"mirror.example.com/entando/bundle@" + testDigest('a'),
+				"backup.example.com/entando/bundle@" + testDigest('a'),
+				"docker.io/entando/bundle@" + testDigest('a'),
+			},
+		},
+		{
+			// the prefix matches on a path boundary
+			image:    "docker.io/entandoother/bundle:v1",
+			expected: []string{"mirror.example.com/dockerhub/entandoother/bundle:v1", "docker.io/entandoother/bundle:v1"},
+		},
+		{
+			image:    "registry.example.com/entando/plugins/web:v1",
+			expected: []string{"airgap.example.com/entando/plugins/web:v1"},
+		},
+		{
+			image:    "registry.example.com/other/web:v1",
+			expected: []string{"registry.example.com/other/web:v1"},
+		},
+		{
+			image:    "oci-layout:///mnt/bundles/app:v1",
+			expected: []string{"oci-layout:///mnt/bundles/app:v1"},
+		},
+	}
+	for _, test := range tests {
+		candidates, err := config.Candidates(test.image)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(candidates, test.expected) {
+			t.Fatalf("Invalid candidates of %s. Expected %v, got %v", test.image, test.expected, candidates)
+		}
+	}
+
+	// the tags are listed on the repositories of the same candidates
+	for repository, expected := range map[string][]string{
+		"docker.io/entando/bundle":         {"mirror.example.com/entando/bundle", "backup.example.com/entando/bundle", "docker.io/entando/bundle"},
+		"registry.example.com/entando/web": {"airgap.example.com/entando/web"},
+		"registry.example.com/other/web":   {"registry.example.com/other/web"},
+		"oci-layout:///mnt/bundles/app":    {"oci-layout:///mnt/bundles/app"},
+	} {
+		candidates, err := config.RepositoryCandidates(repository)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(candidates, expected) {
+			t.Fatalf("Invalid candidates of %s. Expected %v, got %v", repository, expected, candidates)
+		}
+	}
+
+	// without rules the image is pulled from its registry
+	var none *MirrorConfig
+	if candidates, err := none.Candidates("nginx:1.23.3"); err != nil || !reflect.DeepEqual(candidates, []string{"nginx:1.23.3"}) {
+		t.Fatalf("Expected the image, got %v error %v", candidates, err)
+	}
+}
+
+func TestParseMirrorConfigInvalid(t *testing.T) {
+	for _, data := range []string{
+		"rules:\n- prefix: docker.io\n",
+		"rules:\n- prefix: ''\n  mirrors: [mirror.example.com]\n",
+		"rules:\n- prefix: docker.io\n  mirrors: ['Mirror Example']\n",
+		"rules:\n- prefix: docker.io\n  mirror: [mirror.example.com]\n",
+	} {
+		if _, err := ParseMirrorConfig([]byte(data)); err == nil {
+			t.Fatalf("Expected invalid rules %q", data)
+		}
+	}
+	if config, err := ParseMirrorConfig(nil); err != nil || len(config.Rules) != 0 {
+		t.Fatalf("Expected no rules, got %v error %v", config, err)
+	}
+}
+
+func TestMirrorResolve(t *testing.T) {
+	source := httptest.NewServer(registry.New())
+	defer source.Close()
+	mirror := httptest.NewServer(registry.New())
+	defer mirror.Close()
+	sourceHost := strings.TrimPrefix(source.URL, "http://")
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+
+	img, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte(legacyDescriptor)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, ref := range []string{sourceHost + "/entando/bundle:v1", mirrorHost + "/second/entando/bundle:v1", sourceHost + "/entando/only-source:v1"} {
+		if err := crane.Push(img, ref); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	config, err := ParseMirrorConfig([]byte("rules:\n" +
+		"- prefix: " + sourceHost + "\n" +
+		"  mirrors: [" + mirrorHost + "/first, " + mirrorHost + "/second]\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the missing mirror is skipped
+	resolved, err := config.Resolve(sourceHost + "/entando/bundle:v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resolved != mirrorHost+"/second/entando/bundle:v1" {
+		t.Fatalf("Expected the second mirror, got %s", resolved)
+	}
+
+	// the source is the last candidate
+	if resolved, err := config.Resolve(sourceHost + "/entando/only-source:v1"); err != nil || resolved != sourceHost+"/entando/only-source:v1" {
+		t.Fatalf("Expected the source, got %s error %v", resolved, err)
+	}
+
+	if _, err := config.Resolve(sourceHost + "/entando/missing:v1"); err == nil || !strings.Contains(err.Error(), "no mirror") {
+		t.Fatalf("Expected no mirror available error, got %v", err)
+	}
+}
+
+func TestMirrorListTags(t *testing.T) {
+	source := httptest.NewServer(registry.New())
+	defer source.Close()
+	mirror := httptest.NewServer(registry.New())
+	defer mirror.Close()
+	sourceHost := strings.TrimPrefix(source.URL, "http://")
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+
+	img, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte(legacyDescriptor)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, ref := range []string{sourceHost + "/entando/bundle:v1", mirrorHost + "/second/entando/bundle:v2", sourceHost + "/entando/only-source:v1"} {
+		if err := crane.Push(img, ref); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config, err := ParseMirrorConfig([]byte("rules:\n" +
+		"- prefix: " + sourceHost + "\n" +
+		"  mirrors: [" + mirrorHost + "/first, " + mirrorHost + "/second]\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the missing mirror is skipped, the tags are the ones of the mirror
+	repository, tags, err := config.ListTags(sourceHost + "/entando/bundle")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if repository != mirrorHost+"/second/entando/bundle" || !reflect.DeepEqual(tags, []string{"v2"}) {
+		t.Fatalf("Expected the tags of the second mirror, got %s %v", repository, tags)
+	}
+
+	// the source is the last candidate
+	repository, tags, err = config.ListTags(sourceHost + "/entando/only-source")
+	if err != nil || repository != sourceHost+"/entando/only-source" || !reflect.DeepEqual(tags, []string{"v1"}) {
+		t.Fatalf("Expected the tags of the source, got %s %v error %v", repository, tags, err)
+	}
+
+	if _, _, err := config.ListTags(sourceHost + "/entando/missing"); err == nil || !strings.Contains(err.Error(), "no mirror") {
+		t.Fatalf("Expected no mirror available error, got %v", err)
+	}
+}
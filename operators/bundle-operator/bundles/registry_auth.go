@@ -0,0 +1,112 @@
+package bundles
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const dockerHubRegistry = "index.docker.io"
+
+type dockerConfigJSON struct {
+	Auths map[string]authn.AuthConfig `json:"auths"`
+}
+
+type pullSecretCredential struct {
+	key    string
+	config authn.AuthConfig
+}
+
+// pullSecretsKeychain resolves the credentials of a registry from the entries
+// of Kubernetes image pull secrets, following the matching rules of the
+// kubelet: the longest entry matching the repository wins and, for entries
+// of the same length, the first secret wins
+type pullSecretsKeychain struct {
+	credentials []pullSecretCredential
+}
+
+// NewPullSecretsKeychain builds a keychain from secrets of type
+// kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg, the repositories
+// not matching any entry are pulled anonymously
+func NewPullSecretsKeychain(secrets []corev1.Secret) (authn.Keychain, error) {
+	keychain := &pullSecretsKeychain{}
+	for _, secret := range secrets {
+		var auths map[string]authn.AuthConfig
+		switch {
+		case len(secret.Data[corev1.DockerConfigJsonKey]) > 0:
+			config := dockerConfigJSON{}
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+				return nil, fmt.Errorf("invalid %s of secret %s: %w", corev1.DockerConfigJsonKey, secret.Name, err)
+			}
+			auths = config.Auths
+		case len(secret.Data[corev1.DockerConfigKey]) > 0:
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+				return nil, fmt.Errorf("invalid %s of secret %s: %w", corev1.DockerConfigKey, secret.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("secret %s has no %s or %s", secret.Name, corev1.DockerConfigJsonKey, corev1.DockerConfigKey)
+		}
+
+		keys := make([]string, 0, len(auths))
+		for key := range auths {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keychain.credentials = append(keychain.credentials, pullSecretCredential{
+				key:    normalizeRegistryKey(key),
+				config: auths[key],
+			})
+		}
+	}
+	return keychain, nil
+}
+
+func (k *pullSecretsKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	// go-containerregistry already names docker hub as index.docker.io
+	repository := target.String()
+	var match *pullSecretCredential
+	for i, credential := range k.credentials {
+		if !matchesRegistryKey(credential.key, repository) {
+			continue
+		}
+		if match == nil || len(credential.key) > len(match.key) {
+			match = &k.credentials[i]
+		}
+	}
+	if match == nil {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(match.config), nil
+}
+
+// normalizeRegistryKey turns a docker config key, that can be an URL of the
+// registry API, into the registry/path form of the repositories, docker hub
+// aliases are mapped to its registry
+func normalizeRegistryKey(key string) string {
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	key = strings.TrimSuffix(key, "/")
+	for _, suffix := range []string{"/v1", "/v2"} {
+		key = strings.TrimSuffix(key, suffix)
+	}
+	registry, path := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		registry, path = key[:i], key[i:]
+	}
+	switch registry {
+	case "docker.io", "registry-1.docker.io":
+		registry = dockerHubRegistry
+	}
+	return registry + path
+}
+
+// matchesRegistryKey reports whether a repository belongs to the registry or
+// to the repository path of a key
+func matchesRegistryKey(key string, repository string) bool {
+	return repository == key || strings.HasPrefix(repository, key+"/")
+}
@@ -0,0 +1,142 @@
+package bundles
+
+import (
+	"encoding/base64"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func dockerConfigSecret(name string, config string) corev1.Secret {
+	return corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(config)},
+	}
+}
+
+func TestPullSecretsKeychain(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("hub:hub-password"))
+	secrets := []corev1.Secret{
+		dockerConfigSecret("hub", `{"auths":{"https://index.docker.io/v1/":{"auth":"`+auth+`"}}}`),
+		dockerConfigSecret("quay", `{"auths":{
+			"quay.io":{"username":"quay","password":"quay-password"},
+			"quay.io/entando":{"username":"entando","password":"entando-password"}}}`),
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "legacy"},
+			Type:       corev1.SecretTypeDockercfg,
+			Data:       map[string][]byte{corev1.DockerConfigKey: []byte(`{"registry.example.com:5000":{"username":"legacy","password":"legacy-password"}}`)},
+		},
+		dockerConfigSecret("shadowed", `{"auths":{"docker.io":{"username":"other","password":"other-password"}}}`),
+	}
+	keychain, err := NewPullSecretsKeychain(secrets)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		repository string
+		username   string
+	}{
+		{repository: "nginx", username: "hub"},
+		{repository: "docker.io/entando/bundle", username: "hub"},
+		{repository: "quay.io/other/bundle", username: "quay"},
+		{repository: "quay.io/entando/bundle", username: "entando"},
+		{repository: "quay.io/entandoo/bundle", username: "quay"},
+		{repository: "registry.example.com:5000/bundle", username: "legacy"},
+		{repository: "registry.example.com/bundle", username: ""},
+		{repository: "ghcr.io/entando/bundle", username: ""},
+	}
+	for _, test := range tests {
+		repository, err := name.NewRepository(test.repository)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		authenticator, err := keychain.Resolve(repository)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		config, err := authenticator.Authorization()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if config.Username != test.username {
+			t.Fatalf("Invalid credentials for %s. Expected user %q, got %q", test.repository, test.username, config.Username)
+		}
+	}
+}
+
+func TestPullSecretsKeychainInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret corev1.Secret
+	}{
+		{name: "invalid json", secret: dockerConfigSecret("broken", `{"auths":`)},
+		{name: "no config", secret: corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "opaque"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewPullSecretsKeychain([]corev1.Secret{test.secret})
+			if err == nil || !strings.Contains(err.Error(), test.secret.Name) {
+				t.Fatalf("Expected error naming secret %s, got %v", test.secret.Name, err)
+			}
+		})
+	}
+}
+
+// basicAuthRegistry serves an in-process registry that requires the user
+// and password
+func basicAuthRegistry(username string, password string) *httptest.Server {
+	handler := registry.New()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func TestOpenImageFSPrivateRegistry(t *testing.T) {
+	server := basicAuthRegistry("entando", "secret")
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	auth := crane.WithAuth(&authn.Basic{Username: "entando", Password: "secret"})
+	img, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte("name: example\n")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ref := host + "/entando/bundle:v1.0.0"
+	if err := crane.Push(img, ref, auth); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := OpenImageFS(ref); err == nil {
+		t.Fatalf("Expected anonymous pull of %s to fail", ref)
+	}
+
+	keychain, err := NewPullSecretsKeychain([]corev1.Secret{
+		dockerConfigSecret("registry", `{"auths":{"http://`+host+`":{"username":"entando","password":"secret"}}}`),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fsys, err := OpenImageFS(ref, crane.WithAuthFromKeychain(keychain))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := fs.Stat(fsys, "descriptor.yaml"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
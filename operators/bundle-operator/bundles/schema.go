@@ -0,0 +1,207 @@
+package bundles
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// DescriptorJSONSchema generates the JSON Schema of a descriptor format from
+// its Go types, bundle authors can use it to get validation in their editor
+func DescriptorJSONSchema(apiVersion string) ([]byte, error) {
+	version, err := lookupDescriptorVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	if apiVersion == "" {
+		apiVersion = DescriptorV1Alpha1
+	}
+
+	g := &schemaGenerator{strict: version.strict}
+	schema := g.schemaFor(reflect.TypeOf(version.new()))
+	schema["$schema"] = jsonSchemaDraft
+	schema["title"] = "Entando bundle descriptor " + apiVersion
+	schema["properties"].(map[string]interface{})["apiVersion"] = map[string]interface{}{
+		"type":  "string",
+		"const": apiVersion,
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// DescriptorJSONSchemaFileName returns the name of the file where the schema of
+// a descriptor format is published
+func DescriptorJSONSchemaFileName(apiVersion string) string {
+	return "descriptor-" + path.Base(apiVersion) + ".schema.json"
+}
+
+type schemaGenerator struct {
+	// strict disallows properties that are not declared
+	strict bool
+}
+
+func (g *schemaGenerator) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(ComponentType("")) {
+		return map[string]interface{}{"type": "string", "enum": componentTypeNames()}
+	}
+	if t == reflect.TypeOf(JobPhase("")) {
+		return map[string]interface{}{"type": "string", "enum": jobPhaseNames()}
+	}
+	if t == reflect.TypeOf(PluginSecretType("")) {
+		return map[string]interface{}{"type": "string", "enum": pluginSecretTypeNames()}
+	}
+	if t == reflect.TypeOf(Component{}) {
+		return g.componentSchema()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		return g.structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	g.addStructFields(t, properties, &required)
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": !g.strict,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (g *schemaGenerator) addStructFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, options := yamlTag(f)
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if f.Anonymous && strings.Contains(options, "inline") {
+			g.addStructFields(f.Type, properties, required)
+			continue
+		}
+		property := g.schemaFor(f.Type)
+		for k, v := range parseSchemaTag(f.Tag.Get("jsonschema")) {
+			property[k] = v
+		}
+		properties[name] = property
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// componentSchema validates the spec of a component against the type
+// registered for the component type
+func (g *schemaGenerator) componentSchema() map[string]interface{} {
+	conditions := []interface{}{}
+	for _, name := range componentTypeNames() {
+		spec := reflect.TypeOf(componentSpecs[ComponentType(name)]())
+		conditions = append(conditions, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"type": map[string]interface{}{"const": name}},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{"spec": g.schemaFor(spec)},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string"},
+			"type": g.schemaFor(reflect.TypeOf(ComponentType(""))),
+			"dependsOn": map[string]interface{}{
+				"type":        "array",
+				"items":       map[string]interface{}{"type": "string"},
+				"uniqueItems": true,
+			},
+			"spec": map[string]interface{}{"type": "object"},
+		},
+		"required":             []string{"name", "type"},
+		"additionalProperties": !g.strict,
+		"allOf":                conditions,
+	}
+}
+
+func componentTypeNames() []string {
+	names := make([]string, 0, len(componentSpecs))
+	for componentType := range componentSpecs {
+		names = append(names, string(componentType))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func jobPhaseNames() []string {
+	names := make([]string, 0, len(JobPhases))
+	for _, phase := range JobPhases {
+		names = append(names, string(phase))
+	}
+	return names
+}
+
+func pluginSecretTypeNames() []string {
+	names := make([]string, 0, len(PluginSecretTypes))
+	for _, secretType := range PluginSecretTypes {
+		names = append(names, string(secretType))
+	}
+	return names
+}
+
+// parseSchemaTag reads the constraints declared in a jsonschema struct tag,
+// the format is key=value pairs separated by ';'
+func parseSchemaTag(tag string) map[string]interface{} {
+	constraints := map[string]interface{}{}
+	if tag == "" {
+		return constraints
+	}
+	for _, pair := range strings.Split(tag, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if number, err := strconv.Atoi(kv[1]); err == nil {
+			constraints[kv[0]] = number
+			continue
+		}
+		constraints[kv[0]] = kv[1]
+	}
+	return constraints
+}
@@ -0,0 +1,664 @@
+package bundles
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Schemes of the bundle repositories on the local file system, for the
+// installations without access to a registry
+const (
+	// OCILayoutScheme is an OCI image layout directory, as written by
+	// crane, skopeo or oras
+	OCILayoutScheme = "oci-layout://"
+	// TarballScheme is a tarball of an OCI image layout or a docker save
+	// tarball
+	TarballScheme = "tarball://"
+
+	// localRegistry is the registry of the references of the local sources,
+	// its requests are served by the transport of the source
+	localRegistry   = "local.bundles"
+	localRepository = localRegistry + "/bundle"
+
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// LocalSourceRoots are the directories the local sources must be in, the
+// local sources are rejected when empty. They can be changed with the flags
+// of the operator.
+var LocalSourceRoots []string
+
+var (
+	ErrLocalSourcesDisabled = errors.New("local sources are disabled, no local bundle root is set")
+	ErrOutsideLocalRoots    = errors.New("path outside the local bundle roots")
+)
+
+// Source is where a bundle is pulled from, a registry or a local source. The
+// local sources are read through an in-process registry transport, so that
+// the registry clients, crane and cosign, work with them unchanged.
+type Source struct {
+	// Repository is the repository to use with the registry clients
+	Repository string
+	// Ref is the reference to use with the registry clients
+	Ref string
+	// Transport serves the local source, nil for the registries
+	Transport http.RoundTripper
+}
+
+// IsLocalSource reports whether the repository is a local source
+func IsLocalSource(repository string) bool {
+	return strings.HasPrefix(repository, OCILayoutScheme) || strings.HasPrefix(repository, TarballScheme)
+}
+
+// SameRepository reports whether the repositories are the same once
+// normalized, as entando/app and index.docker.io/entando/app. The local sources
+// and the invalid references are compared as they are.
+func SameRepository(a string, b string) bool {
+	return a == b || normalizeRepository(a) == normalizeRepository(b)
+}
+
+func normalizeRepository(repository string) string {
+	if IsLocalSource(repository) {
+		return repository
+	}
+	ref, err := name.ParseReference(repository)
+	if err != nil {
+		return repository
+	}
+	return ref.Context().Name()
+}
+
+// ParseSource parses a registry reference or a local one, like
+// oci-layout:///mnt/bundles/app@sha256:... or tarball:///mnt/app.tar:v1.0.0.
+// A local source with a single image can be referenced without tag.
+func ParseSource(ref string) (*Source, error) {
+	if !IsLocalSource(ref) {
+		return &Source{Repository: ref, Ref: ref}, nil
+	}
+
+	scheme := OCILayoutScheme
+	if strings.HasPrefix(ref, TarballScheme) {
+		scheme = TarballScheme
+	}
+	sourcePath := strings.TrimPrefix(ref, scheme)
+	suffix := ""
+	if i := strings.LastIndex(sourcePath, "@"); i >= 0 {
+		sourcePath, suffix = sourcePath[:i], sourcePath[i:]
+		if _, err := v1.NewHash(suffix[1:]); err != nil {
+			return nil, fmt.Errorf("invalid digest in %s: %w", ref, err)
+		}
+	} else if i := strings.LastIndex(sourcePath, ":"); i > strings.LastIndex(sourcePath, "/") {
+		sourcePath, suffix = sourcePath[:i], sourcePath[i:]
+	}
+	if sourcePath == "" {
+		return nil, fmt.Errorf("missing path in %s", ref)
+	}
+	sourcePath, err := localSourcePath(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local source %s: %w", ref, err)
+	}
+
+	transport := &localTransport{}
+	if scheme == OCILayoutScheme {
+		transport.open = func() (localSource, error) { return openLayout(os.DirFS(sourcePath)) }
+	} else {
+		transport.open = func() (localSource, error) { return openCachedTarball(sourcePath) }
+	}
+	return &Source{Repository: localRepository, Ref: localRepository + suffix, Transport: transport}, nil
+}
+
+// localSourcePath returns the path of a local source with its symlinks
+// resolved, the path must be in one of the LocalSourceRoots
+func localSourcePath(sourcePath string) (string, error) {
+	if len(LocalSourceRoots) == 0 {
+		return "", ErrLocalSourcesDisabled
+	}
+	if !filepath.IsAbs(sourcePath) {
+		return "", fmt.Errorf("path %s is not absolute", sourcePath)
+	}
+	cleaned := filepath.Clean(sourcePath)
+	if !inLocalRoots(cleaned) {
+		return "", fmt.Errorf("%w: %s", ErrOutsideLocalRoots, cleaned)
+	}
+	// a symlink in the roots can point outside of them
+	resolved, err := filepath.EvalSymlinks(cleaned)
+	if err != nil {
+		return "", err
+	}
+	if !inLocalRoots(resolved) {
+		return "", fmt.Errorf("%w: %s resolves to %s", ErrOutsideLocalRoots, cleaned, resolved)
+	}
+	return resolved, nil
+}
+
+// inLocalRoots reports whether the cleaned path is in one of the roots, as
+// they are or with their symlinks resolved
+func inLocalRoots(sourcePath string) bool {
+	for _, root := range LocalSourceRoots {
+		if root == "" {
+			continue
+		}
+		roots := []string{filepath.Clean(root)}
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			roots = append(roots, resolved)
+		}
+		for _, root := range roots {
+			if rel, err := filepath.Rel(root, sourcePath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CraneOptions returns the options to use crane with the source
+func (s *Source) CraneOptions(options ...crane.Option) []crane.Option {
+	if s.Transport == nil {
+		return options
+	}
+	return append(options, crane.WithTransport(s.Transport))
+}
+
+// RemoteOptions returns the options to use the remote package, and the
+// clients built on it like cosign, with the source
+func (s *Source) RemoteOptions(options ...remote.Option) []remote.Option {
+	if s.Transport == nil {
+		return options
+	}
+	return append(options, remote.WithTransport(s.Transport))
+}
+
+// Pull pulls the image of a registry or a local source
+func Pull(ref string, options ...crane.Option) (v1.Image, error) {
+	source, err := ParseSource(ref)
+	if err != nil {
+		return nil, err
+	}
+	return crane.Pull(source.Ref, source.CraneOptions(options...)...)
+}
+
+// Digest returns the digest of the image of a registry or a local source,
+// the registries are asked with a HEAD request
+func Digest(ref string, options ...crane.Option) (string, error) {
+	source, err := ParseSource(ref)
+	if err != nil {
+		return "", err
+	}
+	return crane.Digest(source.Ref, source.CraneOptions(options...)...)
+}
+
+// ListTags lists the tags of a repository of a registry or a local source
+func ListTags(repository string, options ...crane.Option) ([]string, error) {
+	source, err := ParseSource(repository)
+	if err != nil {
+		return nil, err
+	}
+	return crane.ListTags(source.Repository, source.CraneOptions(options...)...)
+}
+
+// localSource is an image store on the local file system
+type localSource interface {
+	// manifests returns the manifests listed by the source
+	manifests() ([]localManifest, error)
+	// blob opens a blob, manifests included, and returns its size
+	blob(h v1.Hash) (io.ReadCloser, int64, error)
+}
+
+type localManifest struct {
+	descriptor v1.Descriptor
+	tags       []string
+}
+
+// layoutSource is an OCI image layout, in a directory or a tarball
+type layoutSource struct {
+	fsys fs.FS
+}
+
+func openLayout(fsys fs.FS) (localSource, error) {
+	if _, err := fs.Stat(fsys, "index.json"); err != nil {
+		return nil, fmt.Errorf("not an OCI image layout: %w", err)
+	}
+	return &layoutSource{fsys: fsys}, nil
+}
+
+func (s *layoutSource) manifests() ([]localManifest, error) {
+	data, err := fs.ReadFile(s.fsys, "index.json")
+	if err != nil {
+		return nil, err
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	manifests := make([]localManifest, 0, len(index.Manifests))
+	for _, descriptor := range index.Manifests {
+		manifest := localManifest{descriptor: descriptor}
+		if refName := descriptor.Annotations[refNameAnnotation]; refName != "" {
+			// some tools annotate the full reference instead of the tag
+			if i := strings.LastIndex(refName, ":"); i > strings.LastIndex(refName, "/") {
+				refName = refName[i+1:]
+			}
+			manifest.tags = append(manifest.tags, refName)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+func (s *layoutSource) blob(h v1.Hash) (io.ReadCloser, int64, error) {
+	file, err := s.fsys.Open("blobs/" + h.Algorithm + "/" + h.Hex)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// tarballCache keeps the opened tarballs by path, an entry is valid while the
+// tarball keeps its modification time and size
+var tarballCache = struct {
+	sync.Mutex
+	entries map[string]cachedTarball
+}{entries: map[string]cachedTarball{}}
+
+type cachedTarball struct {
+	modTime time.Time
+	size    int64
+	source  localSource
+}
+
+// openCachedTarball opens the tarball, reusing its index when it didn't
+// change since it was opened
+func openCachedTarball(tarballPath string) (localSource, error) {
+	info, err := os.Stat(tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	tarballCache.Lock()
+	cached, ok := tarballCache.entries[tarballPath]
+	tarballCache.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.source, nil
+	}
+
+	source, err := openTarball(tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	tarballCache.Lock()
+	tarballCache.entries[tarballPath] = cachedTarball{modTime: info.ModTime(), size: info.Size(), source: source}
+	tarballCache.Unlock()
+	return source, nil
+}
+
+// openTarball opens a tarball of an OCI image layout or, when it has no
+// index, a docker save tarball
+func openTarball(tarballPath string) (localSource, error) {
+	fsys, err := newTarFS(tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fsys.entries["index.json"]; ok {
+		return openLayout(fsys)
+	}
+	return openDockerArchive(tarballPath)
+}
+
+// dockerArchiveSource is a docker save tarball, its manifests are computed
+// from its content like docker load does, so their digests can differ from
+// the ones of the registry the images were saved from
+type dockerArchiveSource struct {
+	images []dockerArchiveImage
+}
+
+type dockerArchiveImage struct {
+	image v1.Image
+	tags  []string
+}
+
+func openDockerArchive(tarballPath string) (localSource, error) {
+	opener := func() (io.ReadCloser, error) { return os.Open(tarballPath) }
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, err
+	}
+	source := &dockerArchiveSource{}
+	for _, descriptor := range manifest {
+		var tag *name.Tag
+		tags := []string{}
+		for _, repoTag := range descriptor.RepoTags {
+			parsed, err := name.NewTag(repoTag)
+			if err != nil {
+				return nil, err
+			}
+			if tag == nil {
+				tag = &parsed
+			}
+			tags = append(tags, parsed.TagStr())
+		}
+		if tag == nil && len(manifest) > 1 {
+			// an untagged image can't be selected among the others
+			continue
+		}
+		img, err := tarball.Image(opener, tag)
+		if err != nil {
+			return nil, err
+		}
+		source.images = append(source.images, dockerArchiveImage{image: img, tags: tags})
+	}
+	return source, nil
+}
+
+func (s *dockerArchiveSource) manifests() ([]localManifest, error) {
+	manifests := make([]localManifest, 0, len(s.images))
+	for _, image := range s.images {
+		descriptor, err := imageDescriptor(image.image)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, localManifest{descriptor: *descriptor, tags: image.tags})
+	}
+	return manifests, nil
+}
+
+func (s *dockerArchiveSource) blob(h v1.Hash) (io.ReadCloser, int64, error) {
+	for _, image := range s.images {
+		if digest, err := image.image.Digest(); err == nil && digest == h {
+			raw, err := image.image.RawManifest()
+			return io.NopCloser(bytes.NewReader(raw)), int64(len(raw)), err
+		}
+		if config, err := image.image.ConfigName(); err == nil && config == h {
+			raw, err := image.image.RawConfigFile()
+			return io.NopCloser(bytes.NewReader(raw)), int64(len(raw)), err
+		}
+		if layer, err := image.image.LayerByDigest(h); err == nil {
+			size, err := layer.Size()
+			if err != nil {
+				return nil, 0, err
+			}
+			rc, err := layer.Compressed()
+			return rc, size, err
+		}
+	}
+	return nil, 0, fs.ErrNotExist
+}
+
+func imageDescriptor(img v1.Image) (*v1.Descriptor, error) {
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}, nil
+}
+
+// localTransport serves the read only registry API over a local source
+type localTransport struct {
+	open func() (localSource, error)
+
+	once   sync.Once
+	source localSource
+	err    error
+}
+
+func (t *localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return registryError(req, http.StatusMethodNotAllowed, "UNSUPPORTED", "local sources are read only"), nil
+	}
+	requestPath := req.URL.Path
+	if requestPath == "/v2/" || requestPath == "/v2" {
+		return registryResponse(req, http.StatusOK, http.Header{}, nil, 0), nil
+	}
+
+	t.once.Do(func() { t.source, t.err = t.open() })
+	if t.err != nil {
+		return registryError(req, http.StatusNotFound, "NAME_UNKNOWN", t.err.Error()), nil
+	}
+
+	switch {
+	case strings.HasSuffix(requestPath, "/tags/list"):
+		return t.tags(req, strings.TrimSuffix(strings.TrimPrefix(requestPath, "/v2/"), "/tags/list"))
+	case strings.Contains(requestPath, "/manifests/"):
+		return t.manifest(req, requestPath[strings.LastIndex(requestPath, "/manifests/")+len("/manifests/"):])
+	case strings.Contains(requestPath, "/blobs/"):
+		return t.blob(req, requestPath[strings.LastIndex(requestPath, "/blobs/")+len("/blobs/"):])
+	}
+	return registryError(req, http.StatusNotFound, "NOT_FOUND", requestPath), nil
+}
+
+func (t *localTransport) tags(req *http.Request, repository string) (*http.Response, error) {
+	manifests, err := t.source.manifests()
+	if err != nil {
+		return nil, err
+	}
+	unique := map[string]bool{}
+	for _, manifest := range manifests {
+		for _, tag := range manifest.tags {
+			unique[tag] = true
+		}
+	}
+	tags := make([]string, 0, len(unique))
+	for tag := range unique {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	body, err := json.Marshal(map[string]interface{}{"name": repository, "tags": tags})
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	return registryResponse(req, http.StatusOK, header, io.NopCloser(bytes.NewReader(body)), int64(len(body))), nil
+}
+
+func (t *localTransport) manifest(req *http.Request, reference string) (*http.Response, error) {
+	manifests, err := t.source.manifests()
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := findManifest(manifests, reference)
+	if err != nil {
+		return registryError(req, http.StatusNotFound, "MANIFEST_UNKNOWN", err.Error()), nil
+	}
+	rc, size, err := t.source.blob(descriptor.Digest)
+	if err != nil {
+		return registryError(req, http.StatusNotFound, "MANIFEST_UNKNOWN", err.Error()), nil
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	mediaType := descriptor.MediaType
+	if mediaType == "" {
+		// a manifest nested in an index, its media type is in its content
+		sniffed := struct {
+			MediaType types.MediaType `json:"mediaType"`
+		}{}
+		json.Unmarshal(raw, &sniffed)
+		mediaType = sniffed.MediaType
+	}
+
+	header := http.Header{
+		"Content-Type":          []string{string(mediaType)},
+		"Docker-Content-Digest": []string{descriptor.Digest.String()},
+	}
+	return registryResponse(req, http.StatusOK, header, io.NopCloser(bytes.NewReader(raw)), size), nil
+}
+
+// findManifest looks up a manifest by digest or by tag, latest matches the
+// manifest of a source with a single manifest
+func findManifest(manifests []localManifest, reference string) (*v1.Descriptor, error) {
+	if h, err := v1.NewHash(reference); err == nil {
+		for _, manifest := range manifests {
+			if manifest.descriptor.Digest == h {
+				return &manifest.descriptor, nil
+			}
+		}
+		return &v1.Descriptor{Digest: h}, nil
+	}
+	for _, manifest := range manifests {
+		for _, tag := range manifest.tags {
+			if tag == reference {
+				return &manifest.descriptor, nil
+			}
+		}
+	}
+	if reference == name.DefaultTag && len(manifests) == 1 {
+		return &manifests[0].descriptor, nil
+	}
+	return nil, fmt.Errorf("tag %s not found", reference)
+}
+
+func (t *localTransport) blob(req *http.Request, digest string) (*http.Response, error) {
+	h, err := v1.NewHash(digest)
+	if err != nil {
+		return registryError(req, http.StatusBadRequest, "DIGEST_INVALID", err.Error()), nil
+	}
+	rc, size, err := t.source.blob(h)
+	if err != nil {
+		return registryError(req, http.StatusNotFound, "BLOB_UNKNOWN", err.Error()), nil
+	}
+	header := http.Header{"Docker-Content-Digest": []string{h.String()}}
+	return registryResponse(req, http.StatusOK, header, rc, size), nil
+}
+
+func registryResponse(req *http.Request, status int, header http.Header, body io.ReadCloser, size int64) *http.Response {
+	if body == nil || req.Method == http.MethodHead {
+		if body != nil {
+			body.Close()
+		}
+		body = http.NoBody
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}
+}
+
+func registryError(req *http.Request, status int, code string, message string) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	return registryResponse(req, status, header, io.NopCloser(bytes.NewReader(body)), int64(len(body)))
+}
+
+// tarFS reads the regular files of a tarball, the offsets of the entries are
+// indexed once so that a file is read without scanning the tarball again
+type tarFS struct {
+	path    string
+	entries map[string]tarFSEntry
+}
+
+type tarFSEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+func newTarFS(tarballPath string) (*tarFS, error) {
+	file, err := os.Open(tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	tr := tar.NewReader(counter)
+	fsys := &tarFS{path: tarballPath, entries: map[string]tarFSEntry{}}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fsys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		entryName, err := entryPath(header.Name)
+		if err != nil {
+			return nil, &ExtractError{Entry: header.Name, Err: err}
+		}
+		// the reader is at the start of the content of the entry
+		fsys.entries[entryName] = tarFSEntry{header: header, offset: counter.count}
+	}
+}
+
+func (f *tarFS) Open(entryName string) (fs.File, error) {
+	if !fs.ValidPath(entryName) {
+		return nil, &fs.PathError{Op: "open", Path: entryName, Err: fs.ErrInvalid}
+	}
+	entry, ok := f.entries[entryName]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: entryName, Err: fs.ErrNotExist}
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &tarFSFile{
+		info:    entry.header.FileInfo(),
+		section: io.NewSectionReader(file, entry.offset, entry.header.Size),
+		file:    file,
+	}, nil
+}
+
+type tarFSFile struct {
+	info    fs.FileInfo
+	section *io.SectionReader
+	file    *os.File
+}
+
+func (f *tarFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFSFile) Read(p []byte) (int, error) { return f.section.Read(p) }
+func (f *tarFSFile) Close() error               { return f.file.Close() }
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,293 @@
+package bundles
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// writeLayout writes the images to an OCI image layout with their tags
+func writeLayout(t *testing.T, dir string, images map[string]v1.Image) {
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for tag, img := range images {
+		if err := path.AppendImage(img, layout.WithAnnotations(map[string]string{refNameAnnotation: tag})); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+// writeTarball writes the files of dir to a tarball
+func writeTarball(t *testing.T, dir string, tarballPath string) {
+	file, err := os.Create(tarballPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+	tw := tar.NewWriter(file)
+	err = filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(dir, filePath)
+		if err := tw.WriteHeader(&tar.Header{Name: filepath.ToSlash(relative), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func testBundleImages(t *testing.T) map[string]v1.Image {
+	v1Image, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte("name: example\nversion: v1.0.0\n")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	artifact := buildArtifact(t, "name: example\nversion: v1.1.0\n", []tarEntry{
+		{name: "manifests/service.yaml", typeflag: tar.TypeReg, body: "kind: Service"},
+	})
+	return map[string]v1.Image{"v1.0.0": v1Image, "v1.1.0": artifact}
+}
+
+func TestMain(m *testing.M) {
+	// the local sources of the tests are written in temporary directories
+	LocalSourceRoots = []string{os.TempDir()}
+	os.Exit(m.Run())
+}
+
+func TestParseSource(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"bundles/app", "bundles:v1"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, file := range []string{"bundles/app.tar", "bundles:v1/app.tar"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		ref      string
+		expected string
+		local    bool
+	}{
+		{ref: "docker.io/entando/bundle:v1.0.0", expected: "docker.io/entando/bundle:v1.0.0"},
+		{ref: "oci-layout://" + root + "/bundles/app:v1.0.0", expected: "local.bundles/bundle:v1.0.0", local: true},
+		{ref: "oci-layout://" + root + "/bundles/app@" + testDigest('a'), expected: "local.bundles/bundle@" + testDigest('a'), local: true},
+		{ref: "tarball://" + root + "/bundles/app.tar", expected: "local.bundles/bundle", local: true},
+		{ref: "tarball://" + root + "/bundles:v1/app.tar", expected: "local.bundles/bundle", local: true},
+	}
+	for _, test := range tests {
+		source, err := ParseSource(test.ref)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if source.Ref != test.expected || (source.Transport != nil) != test.local {
+			t.Fatalf("Invalid source of %s. Expected %s, got %s", test.ref, test.expected, source.Ref)
+		}
+	}
+
+	for _, ref := range []string{"oci-layout://", "oci-layout://" + root + "/bundles/app@latest", "oci-layout://bundles/app:v1.0.0"} {
+		if _, err := ParseSource(ref); err == nil {
+			t.Fatalf("Expected invalid source %s", ref)
+		}
+	}
+}
+
+func TestSameRepository(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		same bool
+	}{
+		{a: "entando/app", b: "docker.io/entando/app", same: true},
+		{a: "entando/app", b: "index.docker.io/entando/app", same: true},
+		{a: "registry.example.org/entando/app", b: "registry.example.org/entando/app", same: true},
+		{a: "entando/app", b: "entando/other"},
+		{a: "registry.example.org/entando/app", b: "entando/app"},
+		{a: "oci-layout:///mnt/app", b: "oci-layout:///mnt/app", same: true},
+		{a: "oci-layout:///mnt/app", b: "oci-layout:///mnt/other"},
+		{a: "Invalid/App", b: "invalid/app"},
+	}
+	for _, test := range tests {
+		if same := SameRepository(test.a, test.b); same != test.same {
+			t.Fatalf("%s and %s: expected same %t, got %t", test.a, test.b, test.same, same)
+		}
+	}
+}
+
+func TestParseSourceLocalRoots(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "app"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(roots []string) { LocalSourceRoots = roots }(LocalSourceRoots)
+	LocalSourceRoots = []string{root}
+
+	if _, err := ParseSource(OCILayoutScheme + filepath.Join(root, "app") + ":v1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, ref := range []string{
+		OCILayoutScheme + outside + ":v1",
+		OCILayoutScheme + root + "/app/../../outside:v1",
+		OCILayoutScheme + filepath.Join(root, "link") + ":v1",
+	} {
+		if _, err := ParseSource(ref); !errors.Is(err, ErrOutsideLocalRoots) {
+			t.Fatalf("Expected %q for %s, got %v", ErrOutsideLocalRoots, ref, err)
+		}
+	}
+
+	LocalSourceRoots = nil
+	if _, err := ParseSource(OCILayoutScheme + filepath.Join(root, "app") + ":v1"); !errors.Is(err, ErrLocalSourcesDisabled) {
+		t.Fatalf("Expected %q, got %v", ErrLocalSourcesDisabled, err)
+	}
+	// the registries are not affected by the roots
+	if _, err := ParseSource("docker.io/entando/bundle:v1.0.0"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestLocalSources(t *testing.T) {
+	images := testBundleImages(t)
+	dir := t.TempDir()
+	layoutDir := filepath.Join(dir, "layout")
+	writeLayout(t, layoutDir, images)
+	layoutTarball := filepath.Join(dir, "layout.tar")
+	writeTarball(t, layoutDir, layoutTarball)
+
+	for _, repository := range []string{OCILayoutScheme + layoutDir, TarballScheme + layoutTarball} {
+		t.Run(repository, func(t *testing.T) {
+			tags, err := ListTags(repository)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !reflect.DeepEqual(tags, []string{"v1.0.0", "v1.1.0"}) {
+				t.Fatalf("Invalid tags %v", tags)
+			}
+
+			// the digests are the ones of the registries
+			digest, err := images["v1.0.0"].Digest()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			fsys, err := OpenImageFS(repository + "@" + digest.String())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if data, err := fs.ReadFile(fsys, "descriptor.yaml"); err != nil || string(data) != "name: example\nversion: v1.0.0\n" {
+				t.Fatalf("Invalid descriptor %q error %v", data, err)
+			}
+
+			fsys, err = OpenImageFS(repository + ":v1.1.0")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if data, err := fs.ReadFile(fsys, "manifests/service.yaml"); err != nil || string(data) != "kind: Service" {
+				t.Fatalf("Invalid manifest %q error %v", data, err)
+			}
+
+			if _, err := Pull(repository + ":v2.0.0"); err == nil {
+				t.Fatalf("Expected missing tag error")
+			}
+		})
+	}
+}
+
+func TestOpenCachedTarball(t *testing.T) {
+	dir := t.TempDir()
+	layoutDir := filepath.Join(dir, "layout")
+	writeLayout(t, layoutDir, testBundleImages(t))
+	tarballPath := filepath.Join(dir, "layout.tar")
+	writeTarball(t, layoutDir, tarballPath)
+
+	first, err := openCachedTarball(tarballPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	second, err := openCachedTarball(tarballPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if first != second {
+		t.Fatal("Expected the index of the tarball reused")
+	}
+
+	// a tarball written again is indexed again
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tarballPath, modTime, modTime); err != nil {
+		t.Fatal(err.Error())
+	}
+	third, err := openCachedTarball(tarballPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if third == first {
+		t.Fatal("Expected the changed tarball indexed again")
+	}
+}
+
+func TestDockerArchiveSource(t *testing.T) {
+	images := testBundleImages(t)
+	tarballPath := filepath.Join(t.TempDir(), "bundle.tar")
+	tag, err := name.NewTag("registry.example.com/entando/bundle:v1.0.0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tarball.WriteToFile(tarballPath, tag, images["v1.0.0"]); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tags, err := ListTags(TarballScheme + tarballPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(tags, []string{"v1.0.0"}) {
+		t.Fatalf("Invalid tags %v", tags)
+	}
+	for _, ref := range []string{TarballScheme + tarballPath, TarballScheme + tarballPath + ":v1.0.0"} {
+		fsys, err := OpenImageFS(ref)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := fs.Stat(fsys, "descriptor.yaml"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if _, err := Pull(OCILayoutScheme + t.TempDir()); err == nil {
+		t.Fatalf("Expected invalid layout error")
+	}
+}
@@ -0,0 +1,542 @@
+package bundles
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	digestRegexp      = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+	ingressPathRegexp = regexp.MustCompile(`^/[A-Za-z0-9._~!$&'()*+,;=:@%/-]*$`)
+	releaseNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	namePrefixRegexp  = regexp.MustCompile(`^[a-z0-9][-.a-z0-9]*$`)
+	parameterRegexp   = regexp.MustCompile(`^[A-Za-z][-_.A-Za-z0-9]*$`)
+)
+
+// kustomizationFileNames are the names kustomize recognizes for a kustomization
+var kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// releaseNameMaxLength is the max length of a helm release name
+const releaseNameMaxLength = 53
+
+// ValidationError describes a single problem found in a bundle descriptor,
+// with the position of the offending node in the descriptor file.
+type ValidationError struct {
+	Field   string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s: %s", e.Line, e.Column, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors collects all the problems found in a bundle descriptor
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate parses the descriptor content and checks it against the rules a
+// bundle must respect to be installed. bundle holds the files of the bundle
+// and is used to check that referenced files exist; when nil the check is
+// skipped.
+func Validate(data []byte, bundle fs.FS) ValidationErrors {
+	_, errs := parseBundleDescriptor(data, bundle)
+	return errs
+}
+
+// parseBundleDescriptor decodes and validates a descriptor, returning every
+// problem found instead of stopping at the first one
+func parseBundleDescriptor(data []byte, bundle fs.FS) (*BundleDescriptor, ValidationErrors) {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(data, root); err != nil {
+		return nil, ValidationErrors{{Field: "descriptor", Message: err.Error()}}
+	}
+	if len(root.Content) == 0 {
+		return nil, ValidationErrors{{Field: "descriptor", Message: "descriptor is empty"}}
+	}
+
+	v := &validator{root: root.Content[0], bundle: bundle}
+	if v.root.Kind != yaml.MappingNode {
+		v.add("descriptor", "descriptor must be a mapping")
+		return nil, v.errs
+	}
+
+	apiVersion := ""
+	if node := lookupNode(v.root, "apiVersion"); node != v.root {
+		apiVersion = node.Value
+	}
+	version, err := lookupDescriptorVersion(apiVersion)
+	if err != nil {
+		v.add("apiVersion", err.Error(), "apiVersion")
+		return nil, v.errs
+	}
+	versioned := version.new()
+	if version.strict {
+		v.checkKnownFields(v.root, reflect.TypeOf(versioned), "")
+	}
+
+	// components are decoded one at a time to report all their errors
+	header := *v.root
+	header.Content = nil
+	var componentsNode *yaml.Node
+	for i := 0; i+1 < len(v.root.Content); i += 2 {
+		if v.root.Content[i].Value == "components" {
+			componentsNode = v.root.Content[i+1]
+			continue
+		}
+		header.Content = append(header.Content, v.root.Content[i], v.root.Content[i+1])
+	}
+	if err := header.Decode(versioned); err != nil {
+		v.addDecodeError(err, "descriptor")
+		return nil, v.errs
+	}
+	descriptor := versioned.ConvertToHub()
+
+	var rawComponents []yaml.Node
+	if componentsNode != nil {
+		if err := componentsNode.Decode(&rawComponents); err != nil {
+			v.addDecodeError(err, "components", "components")
+			return nil, v.errs
+		}
+	}
+
+	v.required(descriptor.Version, "version", "version")
+	v.required(descriptor.Name, "name", "name")
+
+	names := map[string]bool{}
+	indexes := []int{}
+	for i := range rawComponents {
+		field := fmt.Sprintf("components[%d]", i)
+		component := Component{}
+		if err := rawComponents[i].Decode(&component); err != nil {
+			v.addDecodeError(err, field, "components", i)
+			continue
+		}
+		descriptor.Components = append(descriptor.Components, component)
+		indexes = append(indexes, i)
+
+		if v.required(component.Name, field+".name", "components", i, "name") {
+			if names[component.Name] {
+				v.add(field+".name", fmt.Sprintf("duplicate component name %q", component.Name), "components", i, "name")
+			}
+			names[component.Name] = true
+		}
+
+		if isPlugin, plugin := component.GetIfIsPlugin(); isPlugin {
+			v.validatePlugin(plugin, field+".spec", "components", i, "spec")
+		}
+		if isManifest, manifest := component.GetIfIsManifest(); isManifest {
+			v.validateManifest(manifest, field+".spec", "components", i, "spec")
+		}
+		if isHelm, helm := component.GetIfIsHelm(); isHelm {
+			v.validateHelm(&component, helm, field+".spec", "components", i, "spec")
+		}
+		if isKustomize, kustomize := component.GetIfIsKustomize(); isKustomize {
+			v.validateKustomize(kustomize, field+".spec", "components", i, "spec")
+		}
+		if isJob, job := component.GetIfIsJob(); isJob {
+			v.validateJob(job, field+".spec", "components", i, "spec")
+		}
+	}
+	v.validateDependencies(descriptor.Components, indexes)
+
+	if len(v.errs) > 0 {
+		return descriptor, v.errs
+	}
+	return descriptor, nil
+}
+
+type validator struct {
+	root   *yaml.Node
+	bundle fs.FS
+	errs   ValidationErrors
+}
+
+func (v *validator) validatePlugin(plugin *Plugin, field string, path ...interface{}) {
+	v.required(plugin.Repository, field+".repository", append(path, "repository")...)
+
+	if plugin.Digest == "" && plugin.Tag == "" {
+		v.add(field, "one of digest or tag is required", path...)
+	}
+	if plugin.Digest != "" && !digestRegexp.MatchString(plugin.Digest) {
+		v.add(field+".digest", fmt.Sprintf("invalid digest %q, expected <algorithm>:<hex>", plugin.Digest), append(path, "digest")...)
+	}
+	if plugin.Port != 0 && (plugin.Port < 1 || plugin.Port > 65535) {
+		v.add(field+".port", fmt.Sprintf("port %d out of range 1-65535", plugin.Port), append(path, "port")...)
+	}
+	if plugin.IngressPath != "" && !ingressPathRegexp.MatchString(plugin.IngressPath) {
+		v.add(field+".ingressPath", fmt.Sprintf("invalid ingress path %q, it must start with / and contain only URL path characters", plugin.IngressPath), append(path, "ingressPath")...)
+	}
+	if plugin.Replicas < 0 {
+		v.add(field+".replicas", fmt.Sprintf("replicas %d must not be negative", plugin.Replicas), append(path, "replicas")...)
+	}
+	v.validateEnv(plugin.Env, field, path...)
+
+	for i, secret := range plugin.Secrets {
+		secretField := fmt.Sprintf("%s.secrets[%d]", field, i)
+		secretPath := append(path, "secrets", i)
+		if v.required(string(secret.Type), secretField+".type", append(secretPath, "type")...) &&
+			secret.Type != PluginSecretTypeEnv && secret.Type != PluginSecretTypeFile {
+			v.add(secretField+".type", fmt.Sprintf("unknown secret type %q, expected one of %s", secret.Type,
+				strings.Join(pluginSecretTypeNames(), ", ")), append(secretPath, "type")...)
+		}
+		if v.required(secret.Name, secretField+".name", append(secretPath, "name")...) {
+			for _, message := range validation.IsDNS1123Subdomain(secret.Name) {
+				v.add(secretField+".name", fmt.Sprintf("invalid secret name %q: %s", secret.Name, message), append(secretPath, "name")...)
+			}
+		}
+		if secret.Type == PluginSecretTypeFile && v.required(secret.MountPath, secretField+".mountPath", append(secretPath, "mountPath")...) {
+			v.validateMountPath(secret.MountPath, secretField+".mountPath", append(secretPath, "mountPath")...)
+		}
+		if secret.Type == PluginSecretTypeEnv && secret.Prefix != "" {
+			for _, message := range validation.IsEnvVarName(secret.Prefix) {
+				v.add(secretField+".prefix", fmt.Sprintf("invalid env var prefix %q: %s", secret.Prefix, message), append(secretPath, "prefix")...)
+			}
+		}
+	}
+
+	for i, volume := range plugin.Volumes {
+		volumeField := fmt.Sprintf("%s.volumes[%d]", field, i)
+		volumePath := append(path, "volumes", i)
+		if v.required(volume.Size, volumeField+".size", append(volumePath, "size")...) {
+			if _, err := resource.ParseQuantity(volume.Size); err != nil {
+				v.add(volumeField+".size", fmt.Sprintf("invalid size %q: %s", volume.Size, err), append(volumePath, "size")...)
+			}
+		}
+		if v.required(volume.MountPath, volumeField+".mountPath", append(volumePath, "mountPath")...) {
+			v.validateMountPath(volume.MountPath, volumeField+".mountPath", append(volumePath, "mountPath")...)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, parameter := range plugin.Parameters {
+		parameterField := fmt.Sprintf("%s.parameters[%d]", field, i)
+		parameterPath := append(path, "parameters", i)
+		if v.required(parameter.Name, parameterField+".name", append(parameterPath, "name")...) {
+			if !parameterRegexp.MatchString(parameter.Name) {
+				v.add(parameterField+".name", fmt.Sprintf("invalid parameter name %q, it must start with a letter and contain only letters, digits, '-', '_' or '.'",
+					parameter.Name), append(parameterPath, "name")...)
+			}
+			if names[parameter.Name] {
+				v.add(parameterField+".name", fmt.Sprintf("duplicate parameter %q", parameter.Name), append(parameterPath, "name")...)
+			}
+			names[parameter.Name] = true
+		}
+		if v.required(parameter.Field, parameterField+".field", append(parameterPath, "field")...) {
+			root := strings.SplitN(strings.SplitN(parameter.Field, ".", 2)[0], "[", 2)[0]
+			for _, pinned := range pinnedPluginFields {
+				if root == pinned {
+					v.add(parameterField+".field", fmt.Sprintf("field %q is set by the bundle and can't be a parameter", parameter.Field),
+						append(parameterPath, "field")...)
+				}
+			}
+			if err := lookupFieldPath(reflect.ValueOf(plugin), parameter.Field); err != nil {
+				v.add(parameterField+".field", err.Error(), append(parameterPath, "field")...)
+			}
+		}
+		if parameter.Required && parameter.Default != "" {
+			v.add(parameterField+".default", "a required parameter can't have a default", append(parameterPath, "default")...)
+		}
+	}
+}
+
+// validateMountPath checks that a mount path is absolute
+func (v *validator) validateMountPath(mountPath string, field string, path ...interface{}) {
+	if !filepath.IsAbs(mountPath) {
+		v.add(field, fmt.Sprintf("mount path %q must be absolute", mountPath), path...)
+	}
+}
+
+// validateEnv checks the env vars of a spec, field and path are the ones of
+// the spec
+func (v *validator) validateEnv(env []EnvVar, field string, path ...interface{}) {
+	names := map[string]bool{}
+	for i, envVar := range env {
+		envField := fmt.Sprintf("%s.env[%d]", field, i)
+		envPath := append(path, "env", i)
+		if v.required(envVar.Name, envField+".name", append(envPath, "name")...) {
+			for _, message := range validation.IsEnvVarName(envVar.Name) {
+				v.add(envField+".name", fmt.Sprintf("invalid env var name %q: %s", envVar.Name, message), append(envPath, "name")...)
+			}
+			if names[envVar.Name] {
+				v.add(envField+".name", fmt.Sprintf("duplicate env var %q", envVar.Name), append(envPath, "name")...)
+			}
+			names[envVar.Name] = true
+		}
+		if envVar.ValueFrom == nil {
+			continue
+		}
+		if envVar.Value != "" {
+			v.add(envField, "only one of value or valueFrom can be set", envPath...)
+		}
+		refs := map[string]*KeySelector{"secretKeyRef": envVar.ValueFrom.SecretKeyRef, "configMapKeyRef": envVar.ValueFrom.ConfigMapKeyRef}
+		if (refs["secretKeyRef"] == nil) == (refs["configMapKeyRef"] == nil) {
+			v.add(envField+".valueFrom", "exactly one of secretKeyRef or configMapKeyRef is required", append(envPath, "valueFrom")...)
+			continue
+		}
+		for _, refName := range []string{"secretKeyRef", "configMapKeyRef"} {
+			if ref := refs[refName]; ref != nil {
+				refField := envField + ".valueFrom." + refName
+				refPath := append(envPath, "valueFrom", refName)
+				v.required(ref.Name, refField+".name", append(refPath, "name")...)
+				v.required(ref.Key, refField+".key", append(refPath, "key")...)
+			}
+		}
+	}
+}
+
+func (v *validator) validateManifest(manifest *Manifest, field string, path ...interface{}) {
+	if !v.required(manifest.FilePath, field+".filePath", append(path, "filePath")...) {
+		return
+	}
+	v.validateBundlePath(manifest.FilePath, false, field+".filePath", append(path, "filePath")...)
+}
+
+func (v *validator) validateHelm(component *Component, helm *Helm, field string, path ...interface{}) {
+	if v.required(helm.ChartPath, field+".chartPath", append(path, "chartPath")...) {
+		if v.validateBundlePath(helm.ChartPath, true, field+".chartPath", append(path, "chartPath")...) {
+			v.validateBundlePath(filepath.Join(helm.ChartPath, "Chart.yaml"), false, field+".chartPath", append(path, "chartPath")...)
+		}
+	}
+	for i, valuesFile := range helm.ValuesFiles {
+		v.validateBundlePath(valuesFile, false, fmt.Sprintf("%s.valuesFiles[%d]", field, i), append(path, "valuesFiles", i)...)
+	}
+	releaseName := component.GetReleaseName()
+	if releaseName != "" && (len(releaseName) > releaseNameMaxLength || !releaseNameRegexp.MatchString(releaseName)) {
+		v.add(field+".releaseName", fmt.Sprintf("invalid release name %q, it must be a DNS-1123 label of at most %d characters",
+			releaseName, releaseNameMaxLength), append(path, "releaseName")...)
+	}
+}
+
+func (v *validator) validateKustomize(kustomize *Kustomize, field string, path ...interface{}) {
+	if v.required(kustomize.Path, field+".path", append(path, "path")...) &&
+		v.validateBundlePath(kustomize.Path, true, field+".path", append(path, "path")...) && v.bundle != nil {
+		found := false
+		for _, name := range kustomizationFileNames {
+			if _, err := fs.Stat(v.bundle, FilePath(filepath.Join(kustomize.Path, name))); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.add(field+".path", fmt.Sprintf("no kustomization file found in %q", kustomize.Path), append(path, "path")...)
+		}
+	}
+	keys := make([]string, 0, len(kustomize.CommonLabels))
+	for key := range kustomize.CommonLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := kustomize.CommonLabels[key]
+		for _, message := range validation.IsQualifiedName(key) {
+			v.add(field+".commonLabels", fmt.Sprintf("invalid label key %q: %s", key, message), append(path, "commonLabels")...)
+		}
+		for _, message := range validation.IsValidLabelValue(value) {
+			v.add(field+".commonLabels", fmt.Sprintf("invalid value of label %q: %s", key, message), append(path, "commonLabels")...)
+		}
+	}
+	if kustomize.NamePrefix != "" && !namePrefixRegexp.MatchString(kustomize.NamePrefix) {
+		v.add(field+".namePrefix", fmt.Sprintf("invalid name prefix %q, it must contain only lowercase alphanumeric characters, '-' or '.'",
+			kustomize.NamePrefix), append(path, "namePrefix")...)
+	}
+}
+
+func (v *validator) validateJob(job *Job, field string, path ...interface{}) {
+	if v.required(string(job.Phase), field+".phase", append(path, "phase")...) {
+		valid := false
+		for _, phase := range JobPhases {
+			valid = valid || job.Phase == phase
+		}
+		if !valid {
+			v.add(field+".phase", fmt.Sprintf("unknown phase %q, expected one of %s", job.Phase, strings.Join(jobPhaseNames(), ", ")),
+				append(path, "phase")...)
+		}
+	}
+	v.required(job.Image, field+".image", append(path, "image")...)
+	v.validateEnv(job.Env, field, path...)
+	if job.BackoffLimit != nil && *job.BackoffLimit < 0 {
+		v.add(field+".backoffLimit", fmt.Sprintf("invalid backoff limit %d, it must be zero or positive", *job.BackoffLimit),
+			append(path, "backoffLimit")...)
+	}
+	if job.ActiveDeadlineSeconds != nil && *job.ActiveDeadlineSeconds <= 0 {
+		v.add(field+".activeDeadlineSeconds", fmt.Sprintf("invalid active deadline %d, it must be positive", *job.ActiveDeadlineSeconds),
+			append(path, "activeDeadlineSeconds")...)
+	}
+}
+
+// validateDependencies checks that dependsOn references other non JOB
+// components of the bundle and that the dependencies have no cycles, indexes
+// are the positions of the components in the descriptor
+func (v *validator) validateDependencies(components []Component, indexes []int) {
+	types := map[string]ComponentType{}
+	for _, component := range components {
+		types[component.Name] = component.Type
+	}
+
+	valid := true
+	for c, component := range components {
+		i := indexes[c]
+		field := fmt.Sprintf("components[%d].dependsOn", i)
+		if component.Type == JobComponentType && len(component.DependsOn) > 0 {
+			v.add(field, "JOB components run at their phase and cannot declare dependsOn", "components", i, "dependsOn")
+			valid = false
+			continue
+		}
+		seen := map[string]bool{}
+		for d, dependency := range component.DependsOn {
+			dependencyField := fmt.Sprintf("%s[%d]", field, d)
+			dependencyType, exists := types[dependency]
+			switch {
+			case dependency == component.Name:
+				v.add(dependencyField, "a component cannot depend on itself", "components", i, "dependsOn", d)
+			case !exists:
+				v.add(dependencyField, fmt.Sprintf("unknown component %q", dependency), "components", i, "dependsOn", d)
+			case dependencyType == JobComponentType:
+				v.add(dependencyField, fmt.Sprintf("component %q is a JOB, it runs at its phase and cannot be a dependency", dependency),
+					"components", i, "dependsOn", d)
+			case seen[dependency]:
+				v.add(dependencyField, fmt.Sprintf("duplicate dependency %q", dependency), "components", i, "dependsOn", d)
+			default:
+				seen[dependency] = true
+				continue
+			}
+			valid = false
+		}
+	}
+	if !valid {
+		return
+	}
+
+	if cycle := NewComponentGraph(components).FindCycle(); cycle != nil {
+		for c, component := range components {
+			if component.Name == cycle[0] {
+				i := indexes[c]
+				v.add(fmt.Sprintf("components[%d].dependsOn", i),
+					fmt.Sprintf("dependency cycle %s", strings.Join(cycle, " -> ")), "components", i, "dependsOn")
+				break
+			}
+		}
+	}
+}
+
+// validateBundlePath checks that a path is relative to the bundle root, does
+// not escape it and, when the bundle directory is known, points to a file or
+// to a directory as requested. It reports whether the path is valid.
+func (v *validator) validateBundlePath(filePath string, isDir bool, field string, path ...interface{}) bool {
+	if filepath.IsAbs(filePath) {
+		v.add(field, fmt.Sprintf("path %q must be relative to the bundle root", filePath), path...)
+		return false
+	}
+	cleaned := filepath.Clean(filePath)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		v.add(field, fmt.Sprintf("path %q must not point outside the bundle", filePath), path...)
+		return false
+	}
+	if v.bundle == nil {
+		return true
+	}
+	info, err := fs.Stat(v.bundle, FilePath(cleaned))
+	if err != nil {
+		v.add(field, fmt.Sprintf("path %q not found in bundle", filePath), path...)
+		return false
+	}
+	if info.IsDir() && !isDir {
+		v.add(field, fmt.Sprintf("path %q is a directory", filePath), path...)
+		return false
+	}
+	if !info.IsDir() && isDir {
+		v.add(field, fmt.Sprintf("path %q is not a directory", filePath), path...)
+		return false
+	}
+	return true
+}
+
+// FilePath turns a path of the descriptor into a path of the bundle file
+// system
+func FilePath(filePath string) string {
+	return path.Clean(filepath.ToSlash(filePath))
+}
+
+// required adds an error when value is empty and reports whether it is set
+func (v *validator) required(value string, field string, path ...interface{}) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "field is required", path...)
+		return false
+	}
+	return true
+}
+
+func (v *validator) add(field string, message string, path ...interface{}) {
+	v.addAt(lookupNode(v.root, path...), field, message)
+}
+
+func (v *validator) addAt(node *yaml.Node, field string, message string) {
+	v.errs = append(v.errs, ValidationError{
+		Field:   field,
+		Line:    node.Line,
+		Column:  node.Column,
+		Message: message,
+	})
+}
+
+func (v *validator) addDecodeError(err error, field string, path ...interface{}) {
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, message := range typeErr.Errors {
+			v.add(field, message, path...)
+		}
+		return
+	}
+	v.add(field, err.Error(), path...)
+}
+
+// lookupNode follows path (mapping keys and sequence indexes) starting from
+// node and returns the deepest node found, so that missing fields are
+// reported at the position of their parent
+func lookupNode(node *yaml.Node, path ...interface{}) *yaml.Node {
+	current := node
+	for _, step := range path {
+		var next *yaml.Node
+		switch key := step.(type) {
+		case string:
+			if current.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(current.Content); i += 2 {
+					if current.Content[i].Value == key {
+						next = current.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if current.Kind == yaml.SequenceNode && key < len(current.Content) {
+				next = current.Content[key]
+			}
+		}
+		if next == nil {
+			return current
+		}
+		current = next
+	}
+	return current
+}
@@ -0,0 +1,412 @@
+package bundles
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSampleDescriptor(t *testing.T) {
+	data, err := os.ReadFile("../config/bundle-spec/spec/descriptor.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if errs := Validate(data, os.DirFS("../config/bundle-spec")); errs != nil {
+		t.Fatalf("Expected valid descriptor, got %s", errs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	bundleDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(bundleDir, "manifests"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, "manifests", "service.yaml"), []byte("kind: Service"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Join(bundleDir, "charts", "db"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, "charts", "db", "Chart.yaml"), []byte("name: db"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Join(bundleDir, "kustomize"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, "kustomize", "kustomization.yaml"), []byte("resources: []"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		name       string
+		descriptor string
+		expected   []ValidationError
+	}{
+		{
+			name: "valid",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: web
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      tag: 1.23.3
+      port: 80
+      ingressPath: /web
+  - name: service
+    type: MANIFEST
+    spec:
+      filePath: manifests/service.yaml
+`,
+		},
+		{
+			name: "missing required fields",
+			descriptor: `components:
+  - type: MANIFEST
+    spec:
+      filePath: manifests/service.yaml
+`,
+			expected: []ValidationError{
+				{Field: "version", Line: 1, Column: 1},
+				{Field: "name", Line: 1, Column: 1},
+				{Field: "components[0].name", Line: 2, Column: 5},
+			},
+		},
+		{
+			name: "unknown component type",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: web
+    type: WIDGET
+`,
+			expected: []ValidationError{
+				{Field: "components[0]", Line: 4, Column: 5},
+			},
+		},
+		{
+			name: "duplicate names",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: service
+    type: MANIFEST
+    spec:
+      filePath: manifests/service.yaml
+  - name: service
+    type: MANIFEST
+    spec:
+      filePath: manifests/service.yaml
+`,
+			expected: []ValidationError{
+				{Field: "components[1].name", Line: 8, Column: 11},
+			},
+		},
+		{
+			name: "invalid plugin",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: web
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      port: 70000
+      ingressPath: web path
+  - name: api
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      digest: latest
+`,
+			expected: []ValidationError{
+				{Field: "components[0].spec", Line: 7, Column: 7},
+				{Field: "components[0].spec.port", Line: 8, Column: 13},
+				{Field: "components[0].spec.ingressPath", Line: 9, Column: 20},
+				{Field: "components[1].spec.digest", Line: 14, Column: 15},
+			},
+		},
+		{
+			name: "invalid manifest paths",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: absolute
+    type: MANIFEST
+    spec:
+      filePath: /manifests/service.yaml
+  - name: outside
+    type: MANIFEST
+    spec:
+      filePath: manifests/../../etc/passwd
+  - name: missing
+    type: MANIFEST
+    spec:
+      filePath: manifests/missing.yaml
+  - name: directory
+    type: MANIFEST
+    spec:
+      filePath: manifests
+`,
+			expected: []ValidationError{
+				{Field: "components[0].spec.filePath", Line: 7, Column: 17},
+				{Field: "components[1].spec.filePath", Line: 11, Column: 17},
+				{Field: "components[2].spec.filePath", Line: 15, Column: 17},
+				{Field: "components[3].spec.filePath", Line: 19, Column: 17},
+			},
+		},
+		{
+			name: "invalid helm",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: db
+    type: HELM
+    spec:
+      chartPath: charts/db
+      valuesFiles:
+        - manifests/service.yaml
+      values:
+        replicas: 2
+  - name: no-chart
+    type: HELM
+    spec:
+      chartPath: manifests
+      releaseName: Invalid_Name
+  - name: chart-file
+    type: HELM
+    spec:
+      chartPath: charts/db/Chart.yaml
+      valuesFiles:
+        - values/missing.yaml
+  - name: no-path
+    type: HELM
+`,
+			expected: []ValidationError{
+				{Field: "components[1].spec.chartPath", Line: 15, Column: 18},
+				{Field: "components[1].spec.releaseName", Line: 16, Column: 20},
+				{Field: "components[2].spec.chartPath", Line: 20, Column: 18},
+				{Field: "components[2].spec.valuesFiles[0]", Line: 22, Column: 11},
+				{Field: "components[3].spec.chartPath", Line: 23, Column: 5},
+			},
+		},
+		{
+			name: "invalid kustomize",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: valid
+    type: KUSTOMIZE
+    spec:
+      path: kustomize
+      injectNamespace: true
+      commonLabels:
+        app.kubernetes.io/part-of: example
+      namePrefix: example-
+  - name: no-kustomization
+    type: KUSTOMIZE
+    spec:
+      path: manifests
+      commonLabels:
+        "invalid key!": value
+      namePrefix: Example_
+  - name: no-path
+    type: KUSTOMIZE
+`,
+			expected: []ValidationError{
+				{Field: "components[1].spec.path", Line: 15, Column: 13},
+				{Field: "components[1].spec.commonLabels", Line: 17, Column: 9},
+				{Field: "components[1].spec.namePrefix", Line: 18, Column: 19},
+				{Field: "components[2].spec.path", Line: 19, Column: 5},
+			},
+		},
+		{
+			name: "invalid job",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: migrate
+    type: JOB
+    spec:
+      phase: pre-install
+      image: flyway/flyway
+      command: [flyway, migrate]
+      env:
+        - name: DB_HOST
+          value: db
+  - name: seed
+    type: JOB
+    spec:
+      phase: post-upgrade
+      env:
+        - name: 1INVALID
+        - name: DB_HOST
+        - name: DB_HOST
+      backoffLimit: -1
+      activeDeadlineSeconds: 0
+`,
+			expected: []ValidationError{
+				{Field: "components[1].spec.phase", Line: 16, Column: 14},
+				{Field: "components[1].spec.image", Line: 16, Column: 7},
+				{Field: "components[1].spec.env[0].name", Line: 18, Column: 17},
+				{Field: "components[1].spec.env[2].name", Line: 20, Column: 17},
+				{Field: "components[1].spec.backoffLimit", Line: 21, Column: 21},
+				{Field: "components[1].spec.activeDeadlineSeconds", Line: 22, Column: 30},
+			},
+		},
+		{
+			name: "invalid plugin resources",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: web
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      tag: latest
+      replicas: -1
+      env:
+        - name: DB_PASSWORD
+          value: secret
+          valueFrom:
+            secretKeyRef:
+              name: db
+              key: password
+        - name: DB_USER
+          valueFrom: {}
+      secrets:
+        - type: FILE
+          name: Certs
+      volumes:
+        - size: lots
+          mountPath: data
+      parameters:
+        - name: host
+          field: ingressHost
+        - name: host
+          field: digest
+        - name: storageClass
+          field: volumes[1].storageClass
+          required: true
+          default: standard
+`,
+			expected: []ValidationError{
+				{Field: "components[0].spec.replicas", Line: 9, Column: 17},
+				{Field: "components[0].spec.env[0]", Line: 11, Column: 11},
+				{Field: "components[0].spec.env[1].valueFrom", Line: 18, Column: 22},
+				{Field: "components[0].spec.secrets[0].name", Line: 21, Column: 17},
+				{Field: "components[0].spec.secrets[0].mountPath", Line: 20, Column: 11},
+				{Field: "components[0].spec.volumes[0].size", Line: 23, Column: 17},
+				{Field: "components[0].spec.volumes[0].mountPath", Line: 24, Column: 22},
+				{Field: "components[0].spec.parameters[1].name", Line: 28, Column: 17},
+				{Field: "components[0].spec.parameters[1].field", Line: 29, Column: 18},
+				{Field: "components[0].spec.parameters[2].field", Line: 31, Column: 18},
+				{Field: "components[0].spec.parameters[2].default", Line: 33, Column: 20},
+			},
+		},
+		{
+			name: "invalid dependencies",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: db
+    type: MANIFEST
+    dependsOn: [db, cache, migrate]
+    spec:
+      filePath: manifests/service.yaml
+  - name: migrate
+    type: JOB
+    dependsOn: [db]
+    spec:
+      phase: pre-install
+      image: flyway/flyway
+`,
+			expected: []ValidationError{
+				{Field: "components[0].dependsOn[0]", Line: 6, Column: 17},
+				{Field: "components[0].dependsOn[1]", Line: 6, Column: 21},
+				{Field: "components[0].dependsOn[2]", Line: 6, Column: 28},
+				{Field: "components[1].dependsOn", Line: 11, Column: 16},
+			},
+		},
+		{
+			name: "dependency cycle",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: api
+    type: MANIFEST
+    dependsOn: [db]
+    spec:
+      filePath: manifests/service.yaml
+  - name: db
+    type: MANIFEST
+    dependsOn: [api]
+    spec:
+      filePath: manifests/service.yaml
+`,
+			expected: []ValidationError{
+				{Field: "components[0].dependsOn", Line: 6, Column: 16},
+			},
+		},
+		{
+			name: "wrong field type",
+			descriptor: `version: v1.0.0
+name: example
+components:
+  - name: web
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      tag: latest
+      port: eighty
+`,
+			expected: []ValidationError{
+				{Field: "components[0]", Line: 4, Column: 5},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := Validate([]byte(test.descriptor), os.DirFS(bundleDir))
+			if len(errs) != len(test.expected) {
+				t.Fatalf("Expected %d errors, got %d: %s", len(test.expected), len(errs), errs)
+			}
+			for i, expected := range test.expected {
+				actual := errs[i]
+				if actual.Field != expected.Field || actual.Line != expected.Line || actual.Column != expected.Column {
+					t.Fatalf("Invalid error %d. Expected %s at %d:%d, got %s at %d:%d (%s)", i,
+						expected.Field, expected.Line, expected.Column,
+						actual.Field, actual.Line, actual.Column, actual.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestReadBundleDescriptorInvalid(t *testing.T) {
+	bundleDir := t.TempDir()
+	descriptorPath := filepath.Join(bundleDir, "descriptor.yaml")
+	if err := os.WriteFile(descriptorPath, []byte("name: example\ncomponents:\n  - name: web\n    type: WIDGET\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err := ReadBundleDescriptor(os.DirFS(bundleDir))
+	var validationErrors ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		t.Fatalf("Expected validation errors, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `unknown component type "WIDGET"`) {
+		t.Fatalf("Expected unknown type error, got %s", err)
+	}
+	// the position is reported once, by the validation error
+	if !strings.Contains(err.Error(), `line 3, column 5: components[0]: unknown component type "WIDGET"`) {
+		t.Fatalf("Expected a single position, got %s", err)
+	}
+}
@@ -0,0 +1,205 @@
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+//+kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+const (
+	// DefaultReviewTTL is how long the token and the access reviews are
+	// kept when the authenticator has no TTL
+	DefaultReviewTTL = 30 * time.Second
+
+	// maxReviews is the number of reviews kept, the expired ones are
+	// dropped when exceeded
+	maxReviews = 10000
+)
+
+// catalogResources are the resources a user must be able to list to read
+// the catalog of a namespace, the bundles and their instances
+var catalogResources = []string{"entandobundlev2s", "entandobundleinstancev2s"}
+
+// AuthError is a request refused by the authentication or the authorization,
+// Status is the HTTP status of the response
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// Authenticator authenticates the bearer tokens of the requests with a
+// TokenReview and authorizes the users with a SubjectAccessReview, a user
+// reads the catalog of the namespaces where it can list the bundles and the
+// instances. The reviews are kept for the TTL, the token reviews by the hash
+// of the token.
+type Authenticator struct {
+	Client client.Client
+	// Audiences are the audiences the tokens must be issued for, the ones of
+	// the API server when empty
+	Audiences []string
+	// TTL is how long the reviews are kept, DefaultReviewTTL when zero
+	TTL time.Duration
+
+	mu      sync.Mutex
+	reviews map[string]review
+	// now returns the current time, time.Now when nil
+	now func() time.Time
+}
+
+// review is the result of a cached review, the user of a token review and
+// the refusal, nil when allowed
+type review struct {
+	user    *authenticationv1.UserInfo
+	err     error
+	expires time.Time
+}
+
+// Authenticate returns the user of the bearer token of the request, an
+// *AuthError when the token is missing or not valid
+func (a *Authenticator) Authenticate(ctx context.Context, r *http.Request) (*authenticationv1.UserInfo, error) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if !strings.HasPrefix(header, "Bearer ") || token == "" {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "bearer token required"}
+	}
+	key := "token/" + hash([]byte(token))
+	if cached, ok := a.cached(key); ok {
+		return cached.user, cached.err
+	}
+
+	tokenReview := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: a.Audiences}}
+	if err := a.Client.Create(ctx, tokenReview); err != nil {
+		return nil, fmt.Errorf("reviewing the token: %w", err)
+	}
+	if !tokenReview.Status.Authenticated {
+		message := "token not authenticated"
+		if tokenReview.Status.Error != "" {
+			message += ": " + tokenReview.Status.Error
+		}
+		err := &AuthError{Status: http.StatusUnauthorized, Message: message}
+		a.cache(key, review{err: err})
+		return nil, err
+	}
+	a.cache(key, review{user: &tokenReview.Status.User})
+	return &tokenReview.Status.User, nil
+}
+
+// Authorize returns an *AuthError when the user can't list the bundles or
+// the instances of the namespace, of every namespace when empty
+func (a *Authenticator) Authorize(ctx context.Context, user *authenticationv1.UserInfo, namespace string) error {
+	// the users come from the token reviews, a user stands for its tokens
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	for _, resource := range catalogResources {
+		if err := a.authorize(ctx, user, hash(data), namespace, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) authorize(ctx context.Context, user *authenticationv1.UserInfo, userHash string,
+	namespace string, resource string) error {
+	key := "access/" + userHash + "/" + namespace + "/" + resource
+	if cached, ok := a.cached(key); ok {
+		return cached.err
+	}
+
+	extra := map[string]authorizationv1.ExtraValue{}
+	for key, value := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	accessReview := &authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+		User:   user.Username,
+		UID:    user.UID,
+		Groups: user.Groups,
+		Extra:  extra,
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Namespace: namespace,
+			Verb:      "list",
+			Group:     v1alpha1.GroupVersion.Group,
+			Resource:  resource,
+		},
+	}}
+	if err := a.Client.Create(ctx, accessReview); err != nil {
+		return fmt.Errorf("reviewing the access of %s: %w", user.Username, err)
+	}
+	var refused error
+	if !accessReview.Status.Allowed {
+		scope := "every namespace"
+		if namespace != "" {
+			scope = "namespace " + namespace
+		}
+		refused = &AuthError{Status: http.StatusForbidden, Message: fmt.Sprintf("user %s can't list the %s of %s", user.Username, resource, scope)}
+	}
+	a.cache(key, review{err: refused})
+	return refused
+}
+
+// cached returns the review of the key when not expired
+func (a *Authenticator) cached(key string) (review, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cached, ok := a.reviews[key]
+	if !ok || !a.timeNow().Before(cached.expires) {
+		return review{}, false
+	}
+	return cached, true
+}
+
+// cache keeps the review for the TTL, the expired reviews are dropped when
+// the cache is full and every review when still full
+func (a *Authenticator) cache(key string, result review) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.timeNow()
+	if len(a.reviews) >= maxReviews {
+		for k, cached := range a.reviews {
+			if !now.Before(cached.expires) {
+				delete(a.reviews, k)
+			}
+		}
+	}
+	if a.reviews == nil || len(a.reviews) >= maxReviews {
+		a.reviews = map[string]review{}
+	}
+	ttl := a.TTL
+	if ttl <= 0 {
+		ttl = DefaultReviewTTL
+	}
+	result.expires = now.Add(ttl)
+	a.reviews[key] = result
+}
+
+func (a *Authenticator) timeNow() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// hash returns the hex sha256 of the data, the tokens are never kept
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
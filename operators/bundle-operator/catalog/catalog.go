@@ -0,0 +1,367 @@
+package catalog
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultLimit is the page size when the request has none
+	DefaultLimit = 50
+	// MaxLimit is the largest page size
+	MaxLimit = 500
+
+	// maxDescriptors is the number of parsed descriptors kept in memory,
+	// they are read again from the cache when exceeded
+	maxDescriptors = 1000
+)
+
+// Bundle is an EntandoBundleV2 of the catalog with its versions and
+// instances
+type Bundle struct {
+	Namespace  string     `json:"namespace"`
+	Name       string     `json:"name"`
+	Title      string     `json:"title,omitempty"`
+	Icon       string     `json:"icon,omitempty"`
+	Repository string     `json:"repository"`
+	Ready      bool       `json:"ready"`
+	Versions   []Version  `json:"versions"`
+	Instances  []Instance `json:"instances"`
+}
+
+// Version is a tag of the bundle, listed or discovered
+type Version struct {
+	Tag        string   `json:"tag"`
+	Digest     string   `json:"digest"`
+	Verified   bool     `json:"verified"`
+	Signers    []string `json:"signers,omitempty"`
+	Discovered bool     `json:"discovered,omitempty"`
+	// Descriptor is the metadata of the descriptor of the digest, nil when
+	// the digest is not in the extraction cache
+	Descriptor *Descriptor `json:"descriptor,omitempty"`
+}
+
+// Descriptor is the metadata of a bundle descriptor
+type Descriptor struct {
+	Name         string             `json:"name"`
+	Version      string             `json:"version"`
+	Description  string             `json:"description,omitempty"`
+	Dependencies []string           `json:"dependencies,omitempty"`
+	Components   []ComponentSummary `json:"components"`
+	// Error tells why the descriptor is not valid
+	Error string `json:"error,omitempty"`
+}
+
+// ComponentSummary is a component of a descriptor or of an instance
+type ComponentSummary struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// State is the state of the component in the instance
+	State string `json:"state,omitempty"`
+}
+
+// Instance is an EntandoBundleInstanceV2 of the bundle
+type Instance struct {
+	Name            string             `json:"name"`
+	Tag             string             `json:"tag,omitempty"`
+	Digest          string             `json:"digest,omitempty"`
+	InstalledDigest string             `json:"installedDigest,omitempty"`
+	Ready           bool               `json:"ready"`
+	UpdateStrategy  string             `json:"updateStrategy"`
+	Components      []ComponentSummary `json:"components,omitempty"`
+}
+
+// BundleList is a page of the catalog
+type BundleList struct {
+	Items []Bundle `json:"items"`
+	// Total is the number of bundles matching the query
+	Total int `json:"total"`
+	// Continue is the token of the next page, empty on the last page. It
+	// holds the last bundle of the page, so that the bundles created or
+	// deleted between the pages don't shift the next one.
+	Continue string `json:"continue,omitempty"`
+}
+
+// Query filters and paginates the catalog
+type Query struct {
+	// Namespace of the bundles, every namespace when empty
+	Namespace string
+	// Search matches the name, the title and the repository, case insensitive
+	Search string
+	// Verified keeps the bundles with at least a verified version when true
+	// and the ones without when false
+	Verified *bool
+	// Installed keeps the bundles with at least an instance when true and
+	// the ones without when false
+	Installed *bool
+	Limit     int
+	// Continue is the token of the page returned by the previous page
+	Continue string
+}
+
+// Catalog aggregates the bundles and the instances, the descriptors are read
+// from the extraction cache only, a bundle is never pulled by the catalog
+type Catalog struct {
+	Client client.Reader
+	Cache  *bundles.Cache
+
+	mu          sync.Mutex
+	descriptors map[string]*Descriptor
+}
+
+func NewCatalog(client client.Reader, cache *bundles.Cache) *Catalog {
+	return &Catalog{Client: client, Cache: cache, descriptors: map[string]*Descriptor{}}
+}
+
+// List returns the page of the bundles matching the query, sorted by
+// namespace and name. An invalid continue token is an *InvalidQueryError.
+func (c *Catalog) List(ctx context.Context, query Query) (*BundleList, error) {
+	var afterNamespace, afterName string
+	if query.Continue != "" {
+		var ok bool
+		if afterNamespace, afterName, ok = parseContinueToken(query.Continue); !ok {
+			return nil, &InvalidQueryError{Message: "invalid continue token " + strconv.Quote(query.Continue)}
+		}
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	bundleList := &v1alpha1.EntandoBundleV2List{}
+	if err := c.Client.List(ctx, bundleList, client.InNamespace(query.Namespace)); err != nil {
+		return nil, err
+	}
+	instanceList := &v1alpha1.EntandoBundleInstanceV2List{}
+	if err := c.Client.List(ctx, instanceList, client.InNamespace(query.Namespace)); err != nil {
+		return nil, err
+	}
+	sort.Slice(bundleList.Items, func(i, j int) bool {
+		a, b := bundleList.Items[i], bundleList.Items[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+
+	matching := []*v1alpha1.EntandoBundleV2{}
+	for i := range bundleList.Items {
+		if query.matches(&bundleList.Items[i], instanceList.Items) {
+			matching = append(matching, &bundleList.Items[i])
+		}
+	}
+	start := 0
+	if query.Continue != "" {
+		start = sort.Search(len(matching), func(i int) bool {
+			if matching[i].Namespace != afterNamespace {
+				return matching[i].Namespace > afterNamespace
+			}
+			return matching[i].Name > afterName
+		})
+	}
+	end := start + limit
+	if end > len(matching) {
+		end = len(matching)
+	}
+	list := &BundleList{Items: []Bundle{}, Total: len(matching)}
+	for i := start; i < end; i++ {
+		list.Items = append(list.Items, c.bundle(matching[i], instanceList.Items))
+	}
+	if end < len(matching) {
+		list.Continue = continueToken(matching[end-1].Namespace, matching[end-1].Name)
+	}
+	return list, nil
+}
+
+// continueToken returns the token of the page after the bundle
+func continueToken(namespace string, name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(namespace + "/" + name))
+}
+
+// parseContinueToken returns the bundle of the token, the last one of the
+// previous page
+func parseContinueToken(token string) (string, string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", false
+	}
+	namespace, name, ok := strings.Cut(string(data), "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", false
+	}
+	return namespace, name, true
+}
+
+// Get returns the bundle, nil when not found
+func (c *Catalog) Get(ctx context.Context, namespace string, name string) (*Bundle, error) {
+	cr := &v1alpha1.EntandoBundleV2{}
+	if err := c.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, cr); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	instanceList := &v1alpha1.EntandoBundleInstanceV2List{}
+	if err := c.Client.List(ctx, instanceList, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	bundle := c.bundle(cr, instanceList.Items)
+	return &bundle, nil
+}
+
+// InvalidQueryError is a query the catalog can't answer
+type InvalidQueryError struct {
+	Message string
+}
+
+func (e *InvalidQueryError) Error() string {
+	return e.Message
+}
+
+func (q Query) matches(cr *v1alpha1.EntandoBundleV2, instances []v1alpha1.EntandoBundleInstanceV2) bool {
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(cr.Name), search) && !strings.Contains(strings.ToLower(cr.Spec.Title), search) &&
+			!strings.Contains(strings.ToLower(cr.Spec.Repository), search) {
+			return false
+		}
+	}
+	if q.Verified != nil {
+		if verified := len(services.VerifiedVersions(cr)) > 0; verified != *q.Verified {
+			return false
+		}
+	}
+	if q.Installed != nil {
+		installed := false
+		for i := range instances {
+			installed = installed || (instances[i].Namespace == cr.Namespace && services.IsInstanceOf(&instances[i], cr))
+		}
+		if installed != *q.Installed {
+			return false
+		}
+	}
+	return true
+}
+
+// bundle aggregates the versions and the instances of the bundle
+func (c *Catalog) bundle(cr *v1alpha1.EntandoBundleV2, instances []v1alpha1.EntandoBundleInstanceV2) Bundle {
+	bundle := Bundle{
+		Namespace:  cr.Namespace,
+		Name:       cr.Name,
+		Title:      cr.Spec.Title,
+		Icon:       cr.Spec.Icon,
+		Repository: cr.Spec.Repository,
+		Ready:      meta.IsStatusConditionTrue(cr.Status.Conditions, services.CONDITION_BUNDLE_READY),
+		Versions:   []Version{},
+		Instances:  []Instance{},
+	}
+
+	seen := map[string]bool{}
+	for _, tag := range cr.Status.Tags {
+		seen[tag.Tag] = true
+		bundle.Versions = append(bundle.Versions, Version{Tag: tag.Tag, Digest: tag.Digest, Verified: tag.Verified,
+			Signers: verifiedSigners(tag.Signers), Descriptor: c.descriptor(tag.Digest)})
+	}
+	if cr.Spec.TagDiscovery != nil && cr.Status.Discovery != nil {
+		for _, version := range cr.Status.Discovery.Versions {
+			if seen[version.Tag] {
+				continue
+			}
+			bundle.Versions = append(bundle.Versions, Version{Tag: version.Tag, Digest: version.Digest, Verified: version.Verified,
+				Signers: verifiedSigners(version.Signers), Discovered: true, Descriptor: c.descriptor(version.Digest)})
+		}
+	}
+
+	for i := range instances {
+		instance := &instances[i]
+		if instance.Namespace != cr.Namespace || !services.IsInstanceOf(instance, cr) {
+			continue
+		}
+		item := Instance{
+			Name:            instance.Name,
+			Tag:             instance.Spec.Tag,
+			Digest:          instance.Spec.Digest,
+			InstalledDigest: instance.Status.InstalledDigest,
+			Ready:           meta.IsStatusConditionTrue(instance.Status.Conditions, services.CONDITION_INSTANCE_READY),
+			UpdateStrategy:  string(services.UpdateStrategyOrDefault(instance.Spec.UpdatePolicy)),
+		}
+		for _, component := range instance.Status.Components {
+			item.Components = append(item.Components, ComponentSummary{Name: component.Name, Type: component.Type,
+				DependsOn: component.DependsOn, State: string(component.State)})
+		}
+		bundle.Instances = append(bundle.Instances, item)
+	}
+	return bundle
+}
+
+// verifiedSigners returns the names of the signers that verified the digest
+func verifiedSigners(signers []v1alpha1.SignerStatus) []string {
+	names := []string{}
+	for _, signer := range signers {
+		if !signer.Verified {
+			continue
+		}
+		if signer.Group != "" {
+			names = append(names, signer.Group+"/"+signer.Name)
+		} else {
+			names = append(names, signer.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return names
+}
+
+// descriptor returns the metadata of the descriptor of the digest when the
+// bundle is in the extraction cache, the digests are immutable so the
+// parsed descriptors are kept
+func (c *Catalog) descriptor(digest string) *Descriptor {
+	if c.Cache == nil || digest == "" {
+		return nil
+	}
+	c.mu.Lock()
+	descriptor, ok := c.descriptors[digest]
+	c.mu.Unlock()
+	if ok {
+		return descriptor
+	}
+
+	dir, release, ok := c.Cache.Lookup(digest)
+	if !ok {
+		return nil
+	}
+	defer release()
+	parsed, err := bundles.ReadBundleDescriptor(os.DirFS(dir))
+	if err != nil {
+		descriptor = &Descriptor{Error: err.Error(), Components: []ComponentSummary{}}
+	} else {
+		descriptor = &Descriptor{Name: parsed.Name, Version: parsed.Version, Description: parsed.Description,
+			Dependencies: parsed.Dependencies, Components: []ComponentSummary{}}
+		for _, component := range parsed.Components {
+			descriptor.Components = append(descriptor.Components, ComponentSummary{Name: component.Name,
+				Type: string(component.Type), DependsOn: component.DependsOn})
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.descriptors == nil || len(c.descriptors) >= maxDescriptors {
+		c.descriptors = map[string]*Descriptor{}
+	}
+	c.descriptors[digest] = descriptor
+	return descriptor
+}
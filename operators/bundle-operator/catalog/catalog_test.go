@@ -0,0 +1,186 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testDescriptor = `version: v1.0.0
+name: example
+dependencies:
+  - other-bundle
+components:
+  - name: web
+    type: PLUGIN
+    spec:
+      repository: docker.io/nginx
+      tag: 1.23.3
+      port: 80
+`
+
+func testDigest(c byte) string {
+	return "sha256:" + strings.Repeat(string(c), 64)
+}
+
+// testClient returns a fake client with the bundles and the instances of the
+// tests, the bundle-a digest of v1.0.0 is verified and installed
+func testClient(t *testing.T, objs ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	bundle := func(namespace string, name string, title string, tags ...v1alpha1.EntandoBundleTagStatus) *v1alpha1.EntandoBundleV2 {
+		return &v1alpha1.EntandoBundleV2{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       v1alpha1.EntandoBundleV2Spec{Title: title, Icon: "data:image/png;base64,aWNvbg==", Repository: "registry.example.com/" + name},
+			Status: v1alpha1.EntandoBundleV2Status{
+				Conditions: []metav1.Condition{{Type: services.CONDITION_BUNDLE_READY, Status: metav1.ConditionTrue}},
+				Tags:       tags,
+			},
+		}
+	}
+	objs = append(objs,
+		bundle("test", "bundle-a", "Bundle A",
+			v1alpha1.EntandoBundleTagStatus{Tag: "v1.0.0", Digest: testDigest('a'), Verified: true,
+				Signers: []v1alpha1.SignerStatus{{Name: "release", Verified: true}, {Name: "qa", Group: "team"}}},
+			v1alpha1.EntandoBundleTagStatus{Tag: "v1.1.0", Digest: testDigest('b')}),
+		bundle("test", "bundle-b", "Bundle B", v1alpha1.EntandoBundleTagStatus{Tag: "v1.0.0", Digest: testDigest('c')}),
+		bundle("test", "bundle-c", "Other"),
+		bundle("other", "bundle-d", "Bundle D"),
+		&v1alpha1.EntandoBundleInstanceV2{
+			ObjectMeta: metav1.ObjectMeta{Name: "bundle-a-1234", Namespace: "test"},
+			Spec: v1alpha1.EntandoBundleInstanceV2Spec{BundleRef: "bundle-a", Tag: "v1.0.0", Digest: testDigest('a'),
+				UpdatePolicy: &v1alpha1.UpdatePolicy{Strategy: v1alpha1.UpdateStrategyPatch}},
+			Status: v1alpha1.EntandoBundleInstanceV2Status{
+				InstalledDigest: testDigest('a'),
+				Components:      []v1alpha1.ComponentStatus{{Name: "web", Type: "PLUGIN", State: v1alpha1.ComponentStateReady}},
+			},
+		},
+	)
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func TestCatalogList(t *testing.T) {
+	ctx := context.TODO()
+	catalog := NewCatalog(testClient(t), nil)
+	yes, no := true, false
+
+	tests := []struct {
+		name  string
+		query Query
+		names []string
+		total int
+		next  string
+	}{
+		{name: "every namespace", query: Query{}, names: []string{"bundle-d", "bundle-a", "bundle-b", "bundle-c"}, total: 4},
+		{name: "namespace", query: Query{Namespace: "test"}, names: []string{"bundle-a", "bundle-b", "bundle-c"}, total: 3},
+		{name: "search", query: Query{Search: "BUNDLE b"}, names: []string{"bundle-b"}, total: 1},
+		{name: "search repository", query: Query{Search: "example.com/bundle-c"}, names: []string{"bundle-c"}, total: 1},
+		{name: "verified", query: Query{Verified: &yes}, names: []string{"bundle-a"}, total: 1},
+		{name: "not installed", query: Query{Namespace: "test", Installed: &no}, names: []string{"bundle-b", "bundle-c"}, total: 2},
+		{name: "first page", query: Query{Limit: 3}, names: []string{"bundle-d", "bundle-a", "bundle-b"}, total: 4,
+			next: continueToken("test", "bundle-b")},
+		{name: "last page", query: Query{Limit: 3, Continue: continueToken("test", "bundle-b")}, names: []string{"bundle-c"}, total: 4},
+		// the bundles deleted between the pages don't shift the next one
+		{name: "deleted bundle", query: Query{Limit: 1, Continue: continueToken("test", "bundle-aa")}, names: []string{"bundle-b"}, total: 4,
+			next: continueToken("test", "bundle-b")},
+	}
+	for _, test := range tests {
+		list, err := catalog.List(ctx, test.query)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		names := []string{}
+		for _, bundle := range list.Items {
+			names = append(names, bundle.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.names, ",") || list.Total != test.total || list.Continue != test.next {
+			t.Fatalf("%s: expected %v total %d next %q, got %v total %d next %q", test.name, test.names, test.total, test.next,
+				names, list.Total, list.Continue)
+		}
+	}
+
+	var queryErr *InvalidQueryError
+	if _, err := catalog.List(ctx, Query{Continue: "page-2"}); !errors.As(err, &queryErr) {
+		t.Fatalf("Expected invalid continue token, got %v", err)
+	}
+}
+
+func TestCatalogGet(t *testing.T) {
+	ctx := context.TODO()
+	cache, err := bundles.NewCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for digest, descriptor := range map[string]string{testDigest('a'): testDescriptor, testDigest('b'): "name: invalid\n"} {
+		_, release, err := cache.Get(digest, func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, bundles.DescriptorFileName), []byte(descriptor), 0644)
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		release()
+	}
+	catalog := NewCatalog(testClient(t), cache)
+
+	bundle, err := catalog.Get(ctx, "test", "bundle-a")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bundle == nil || bundle.Title != "Bundle A" || !bundle.Ready || len(bundle.Versions) != 2 {
+		t.Fatalf("Unexpected bundle %+v", bundle)
+	}
+
+	// the descriptors of the digests in the cache
+	verified := bundle.Versions[0]
+	if !verified.Verified || strings.Join(verified.Signers, ",") != "release" || verified.Descriptor == nil {
+		t.Fatalf("Unexpected version %+v", verified)
+	}
+	descriptor := verified.Descriptor
+	if descriptor.Name != "example" || descriptor.Version != "v1.0.0" || len(descriptor.Components) != 1 ||
+		descriptor.Components[0].Type != string(bundles.PluginComponentType) || descriptor.Dependencies[0] != "other-bundle" {
+		t.Fatalf("Unexpected descriptor %+v", descriptor)
+	}
+	if bundle.Versions[1].Descriptor == nil || bundle.Versions[1].Descriptor.Error == "" {
+		t.Fatalf("Expected invalid descriptor, got %+v", bundle.Versions[1].Descriptor)
+	}
+
+	// the instances of the bundle
+	if len(bundle.Instances) != 1 {
+		t.Fatalf("Expected an instance, got %+v", bundle.Instances)
+	}
+	instance := bundle.Instances[0]
+	if instance.UpdateStrategy != string(v1alpha1.UpdateStrategyPatch) || instance.InstalledDigest != testDigest('a') ||
+		len(instance.Components) != 1 || instance.Components[0].State != string(v1alpha1.ComponentStateReady) {
+		t.Fatalf("Unexpected instance %+v", instance)
+	}
+
+	// a digest not in the cache has no descriptor
+	other, err := catalog.Get(ctx, "test", "bundle-b")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if other.Versions[0].Descriptor != nil || len(other.Instances) != 0 {
+		t.Fatalf("Unexpected bundle %+v", other)
+	}
+
+	missing, err := catalog.Get(ctx, "test", "missing")
+	if err != nil || missing != nil {
+		t.Fatalf("Expected bundle not found, got %+v %v", missing, err)
+	}
+}
@@ -0,0 +1,194 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// apiPrefix is the prefix of the paths of the catalog API
+	apiPrefix = "/api/v1/"
+
+	// shutdownTimeout is the time the requests in progress have to complete
+	// when the operator stops
+	shutdownTimeout = 10 * time.Second
+)
+
+// Server serves the read only JSON API of the catalog:
+//
+//	GET /api/v1/bundles?namespace=&search=&verified=&installed=&limit=&continue=
+//	GET /api/v1/namespaces/<namespace>/bundles/<name>
+//
+// The requests are authenticated by the bearer token.
+type Server struct {
+	Addr string
+	// CertFile and KeyFile are the TLS certificate and key, required unless
+	// Insecure is set
+	CertFile string
+	KeyFile  string
+	// Insecure serves the API over plain HTTP without certificate, the
+	// bearer tokens are sent in clear
+	Insecure bool
+	Catalog  *Catalog
+	Auth     *Authenticator
+	Log      logr.Logger
+}
+
+// Start serves the API until the context is done, the server is a Runnable
+// of the manager
+func (s *Server) Start(ctx context.Context) error {
+	if s.CertFile == "" && !s.Insecure {
+		return errors.New("the catalog API requires a TLS certificate unless served insecure")
+	}
+	server := &http.Server{Addr: s.Addr, Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		done <- server.Shutdown(shutdownCtx)
+	}()
+
+	s.Log.Info("serving the bundle catalog", "address", s.Addr, "tls", s.CertFile != "")
+	var err error
+	if s.CertFile != "" {
+		err = server.ListenAndServeTLS(s.CertFile, s.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-done
+}
+
+// NeedLeaderElection serves the catalog from every replica of the operator
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Handler returns the handler of the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix, s.serve)
+	return mux
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx := r.Context()
+	user, err := s.Auth.Authenticate(ctx, r)
+	if err != nil {
+		s.writeErr(w, err)
+		return
+	}
+
+	// bundles or namespaces/<namespace>/bundles/<name>
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "bundles":
+		query, err := parseQuery(r)
+		if err != nil {
+			s.writeErr(w, err)
+			return
+		}
+		if err := s.Auth.Authorize(ctx, user, query.Namespace); err != nil {
+			s.writeErr(w, err)
+			return
+		}
+		list, err := s.Catalog.List(ctx, query)
+		if err != nil {
+			s.writeErr(w, err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, list)
+	case len(path) == 4 && path[0] == "namespaces" && path[2] == "bundles" && path[1] != "" && path[3] != "":
+		if err := s.Auth.Authorize(ctx, user, path[1]); err != nil {
+			s.writeErr(w, err)
+			return
+		}
+		bundle, err := s.Catalog.Get(ctx, path[1], path[3])
+		if err != nil {
+			s.writeErr(w, err)
+			return
+		}
+		if bundle == nil {
+			s.writeError(w, http.StatusNotFound, "bundle "+path[1]+"/"+path[3]+" not found")
+			return
+		}
+		s.writeJSON(w, http.StatusOK, bundle)
+	default:
+		s.writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// parseQuery reads the filters and the pagination of the request, an
+// invalid parameter is an *InvalidQueryError
+func parseQuery(r *http.Request) (Query, error) {
+	values := r.URL.Query()
+	query := Query{
+		Namespace: values.Get("namespace"),
+		Search:    values.Get("search"),
+		Continue:  values.Get("continue"),
+	}
+	if limit := values.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return query, &InvalidQueryError{Message: "invalid limit " + strconv.Quote(limit)}
+		}
+	}
+	for name, filter := range map[string]**bool{"verified": &query.Verified, "installed": &query.Installed} {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, &InvalidQueryError{Message: "invalid " + name + " " + strconv.Quote(value)}
+		}
+		*filter = &parsed
+	}
+	return query, nil
+}
+
+// writeErr writes the response of the error, the unexpected errors are
+// logged and not returned to the client
+func (s *Server) writeErr(w http.ResponseWriter, err error) {
+	var authErr *AuthError
+	var queryErr *InvalidQueryError
+	switch {
+	case errors.As(err, &authErr):
+		if authErr.Status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		s.writeError(w, authErr.Status, authErr.Message)
+	case errors.As(err, &queryErr):
+		s.writeError(w, http.StatusBadRequest, queryErr.Message)
+	default:
+		s.Log.Error(err, "error serving the bundle catalog")
+		s.writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.Log.Error(err, "error writing the catalog response")
+	}
+}
@@ -0,0 +1,158 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reviewClient answers the token reviews and the access reviews, the token
+// "portal" authenticates the user portal that lists the bundles and the
+// instances of test only, the token "bundles" the user bundles that lists
+// the bundles of test but not their instances. Reviews counts the reviews.
+type reviewClient struct {
+	client.Client
+	Reviews int
+}
+
+func (c *reviewClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	switch review := obj.(type) {
+	case *authenticationv1.TokenReview:
+		c.Reviews++
+		if review.Spec.Token == "portal" || review.Spec.Token == "bundles" {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: review.Spec.Token}}
+		}
+		return nil
+	case *authorizationv1.SubjectAccessReview:
+		c.Reviews++
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = attributes.Namespace == "test" && attributes.Verb == "list" &&
+			(review.Spec.User == "portal" && (attributes.Resource == "entandobundlev2s" || attributes.Resource == "entandobundleinstancev2s") ||
+				review.Spec.User == "bundles" && attributes.Resource == "entandobundlev2s")
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestServer(t *testing.T) {
+	k8sClient := &reviewClient{Client: testClient(t)}
+	server := &Server{Catalog: NewCatalog(k8sClient, nil), Auth: &Authenticator{Client: k8sClient}, Log: logr.Discard()}
+	handler := server.Handler()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "no token", path: "/api/v1/bundles?namespace=test", status: http.StatusUnauthorized},
+		{name: "invalid token", path: "/api/v1/bundles?namespace=test", token: "invalid", status: http.StatusUnauthorized},
+		{name: "list", path: "/api/v1/bundles?namespace=test&limit=2", token: "portal", status: http.StatusOK},
+		{name: "instances forbidden", path: "/api/v1/bundles?namespace=test", token: "bundles", status: http.StatusForbidden},
+		{name: "every namespace forbidden", path: "/api/v1/bundles", token: "portal", status: http.StatusForbidden},
+		{name: "namespace forbidden", path: "/api/v1/namespaces/other/bundles/bundle-d", token: "portal", status: http.StatusForbidden},
+		{name: "invalid filter", path: "/api/v1/bundles?namespace=test&verified=maybe", token: "portal", status: http.StatusBadRequest},
+		{name: "invalid limit", path: "/api/v1/bundles?namespace=test&limit=-1", token: "portal", status: http.StatusBadRequest},
+		{name: "get", path: "/api/v1/namespaces/test/bundles/bundle-a", token: "portal", status: http.StatusOK},
+		{name: "not found", path: "/api/v1/namespaces/test/bundles/missing", token: "portal", status: http.StatusNotFound},
+		{name: "unknown path", path: "/api/v1/instances", token: "portal", status: http.StatusNotFound},
+		{name: "read only", method: http.MethodDelete, path: "/api/v1/namespaces/test/bundles/bundle-a", token: "portal",
+			status: http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		request := httptest.NewRequest(method, test.path, nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d %s", test.name, test.status, recorder.Code, recorder.Body.String())
+		}
+		if recorder.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: expected a JSON response", test.name)
+		}
+	}
+
+	// the page of the bundles
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/bundles?namespace=test&limit=2", nil)
+	request.Header.Set("Authorization", "Bearer portal")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	list := &BundleList{}
+	if err := json.NewDecoder(recorder.Body).Decode(list); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list.Items) != 2 || list.Total != 3 || list.Continue != continueToken("test", "bundle-b") || list.Items[0].Name != "bundle-a" {
+		t.Fatalf("Unexpected page %+v", list)
+	}
+}
+
+func TestAuthenticatorCache(t *testing.T) {
+	k8sClient := &reviewClient{Client: testClient(t)}
+	now := time.Now()
+	auth := &Authenticator{Client: k8sClient, TTL: time.Minute, now: func() time.Time { return now }}
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/bundles?namespace=test", nil)
+	request.Header.Set("Authorization", "Bearer portal")
+
+	review := func() {
+		user, err := auth.Authenticate(context.TODO(), request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := auth.Authorize(context.TODO(), user, "test"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// a token review and an access review for the bundles and the instances
+	review()
+	if k8sClient.Reviews != 3 {
+		t.Fatalf("Expected 3 reviews, got %d", k8sClient.Reviews)
+	}
+	review()
+	if k8sClient.Reviews != 3 {
+		t.Fatalf("Expected the cached reviews, got %d reviews", k8sClient.Reviews)
+	}
+	// the refused tokens are cached as well
+	invalid := httptest.NewRequest(http.MethodGet, "/api/v1/bundles?namespace=test", nil)
+	invalid.Header.Set("Authorization", "Bearer invalid")
+	for i := 0; i < 2; i++ {
+		if _, err := auth.Authenticate(context.TODO(), invalid); err == nil {
+			t.Fatal("Expected the invalid token refused")
+		}
+	}
+	if k8sClient.Reviews != 4 {
+		t.Fatalf("Expected the cached refusal, got %d reviews", k8sClient.Reviews)
+	}
+	now = now.Add(time.Minute)
+	review()
+	if k8sClient.Reviews != 7 {
+		t.Fatalf("Expected the expired reviews repeated, got %d reviews", k8sClient.Reviews)
+	}
+	for key := range auth.reviews {
+		if strings.Contains(key, "portal") {
+			t.Fatalf("Expected the token hashed in %s", key)
+		}
+	}
+}
+
+func TestServerTLSRequired(t *testing.T) {
+	server := &Server{Addr: "127.0.0.1:0", Catalog: NewCatalog(testClient(t), nil), Log: logr.Discard()}
+	if err := server.Start(context.TODO()); err == nil {
+		t.Fatal("Expected the catalog API refused without a TLS certificate")
+	}
+}
@@ -35,6 +35,9 @@ type applyOptions struct {
 	dynamicClient   dynamic.Interface
 	discoveryClient discovery.DiscoveryInterface
 	serverSide      bool
+	// lookupMapper is the mapper of the lookups, shared by the lookups of a
+	// rendering
+	lookupMapper meta.RESTMapper
 }
 
 func NewApplyOptions(dynamicClient dynamic.Interface, discoveryClient discovery.DiscoveryInterface) *applyOptions {
@@ -60,26 +63,143 @@ func (o *applyOptions) ToRESTMapper() (meta.RESTMapper, error) {
 }
 
 func (o *applyOptions) Apply(ctx context.Context, ns string, data []byte) error {
+	_, err := o.ApplyWithInventory(ctx, ns, data)
+	return err
+}
+
+// ApplyWithInventory applies the objects like Apply and returns the reference
+// of every applied object, on error the objects applied so far are returned
+func (o *applyOptions) ApplyWithInventory(ctx context.Context, ns string, data []byte) ([]ObjectReference, error) {
 	restmapper, err := o.ToRESTMapper()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	unstructList, err := Decode(data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	inventory := make([]ObjectReference, 0, len(unstructList))
 	for _, unstruct := range unstructList {
 		klog.V(5).Infof("Apply object: %#v", unstruct)
 		if _, err := ApplyUnstructured(ctx, ns, o.dynamicClient, restmapper, unstruct, o.serverSide); err != nil {
-			return err
+			return inventory, err
 		}
 		klog.V(2).Infof("%s/%s applyed", strings.ToLower(unstruct.GetKind()), unstruct.GetName())
+		inventory = append(inventory, newObjectReference(restmapper, unstruct))
+	}
+	return inventory, nil
+}
+
+// Delete removes the referenced objects, objects already deleted are ignored
+func (o *applyOptions) Delete(ctx context.Context, refs []ObjectReference) error {
+	restmapper, err := o.ToRESTMapper()
+	if err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	for _, ref := range refs {
+		gvk := ref.GroupVersionKind()
+		mapping, err := restmapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if meta.IsNoMatchError(err) {
+			// the resource type is gone, so are its objects
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var dri dynamic.ResourceInterface = o.dynamicClient.Resource(mapping.Resource)
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			dri = o.dynamicClient.Resource(mapping.Resource).Namespace(ref.Namespace)
+		}
+		err = dri.Delete(ctx, ref.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting %s: %w", ref, err)
+		}
+		klog.V(2).Infof("%s deleted", ref)
 	}
 	return nil
 }
 
+// ServerCapabilities returns the git version of the cluster and the group
+// versions it serves, with the group version kinds as apps/v1/Deployment
+func (o *applyOptions) ServerCapabilities() (string, []string, error) {
+	version, err := o.discoveryClient.ServerVersion()
+	if err != nil {
+		return "", nil, err
+	}
+	groups, resources, err := o.discoveryClient.ServerGroupsAndResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return "", nil, err
+	}
+	apiVersions := []string{}
+	for _, group := range groups {
+		for _, groupVersion := range group.Versions {
+			apiVersions = append(apiVersions, groupVersion.GroupVersion)
+		}
+	}
+	for _, resourceList := range resources {
+		for _, resource := range resourceList.APIResources {
+			if strings.Contains(resource.Name, "/") {
+				// a subresource
+				continue
+			}
+			apiVersions = append(apiVersions, resourceList.GroupVersion+"/"+resource.Kind)
+		}
+	}
+	return version.GitVersion, apiVersions, nil
+}
+
+// Lookup returns the object, or the list of the objects when name is empty,
+// as the lookup function of helm. A missing object or resource type is an
+// empty map.
+func (o *applyOptions) Lookup(ctx context.Context, apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+	if o.lookupMapper == nil {
+		restmapper, err := o.ToRESTMapper()
+		if err != nil {
+			return nil, err
+		}
+		o.lookupMapper = restmapper
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := o.lookupMapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: kind}, gv.Version)
+	if meta.IsNoMatchError(err) {
+		return map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dri dynamic.ResourceInterface = o.dynamicClient.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace && namespace != "" {
+		dri = o.dynamicClient.Resource(mapping.Resource).Namespace(namespace)
+	}
+	if name == "" {
+		list, err := dri.List(ctx, metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			return map[string]interface{}{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return list.UnstructuredContent(), nil
+	}
+	obj, err := dri.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj.UnstructuredContent(), nil
+}
+
 func Decode(data []byte) ([]unstructured.Unstructured, error) {
 	var lastErr error
 	var unstructList []unstructured.Unstructured
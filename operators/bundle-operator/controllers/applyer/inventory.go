@@ -0,0 +1,67 @@
+package applyer
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ObjectReference identifies an object applied from a manifest
+type ObjectReference struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+func (r ObjectReference) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: r.Group, Version: r.Version, Kind: r.Kind}
+}
+
+func (r ObjectReference) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s/%s", r.GroupVersionKind().GroupKind(), r.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", r.GroupVersionKind().GroupKind(), r.Namespace, r.Name)
+}
+
+func newObjectReference(restMapper meta.RESTMapper, obj unstructured.Unstructured) ObjectReference {
+	gvk := obj.GroupVersionKind()
+	ref := ObjectReference{
+		Group:     gvk.Group,
+		Version:   gvk.Version,
+		Kind:      gvk.Kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+	mapping, err := restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err == nil && mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		ref.Namespace = ""
+	}
+	return ref
+}
+
+// InventoryDiff returns the objects of previous that are not in current,
+// they have to be deleted after current was applied
+func InventoryDiff(previous []ObjectReference, current []ObjectReference) []ObjectReference {
+	applied := make(map[ObjectReference]bool, len(current))
+	for _, ref := range current {
+		applied[ref] = true
+	}
+	stale := []ObjectReference{}
+	for _, ref := range previous {
+		if !applied[ref] {
+			stale = append(stale, ref)
+		}
+	}
+	return stale
+}
+
+// InventoryUnion returns the objects of both inventories without duplicates
+func InventoryUnion(a []ObjectReference, b []ObjectReference) []ObjectReference {
+	union := append([]ObjectReference{}, a...)
+	return append(union, InventoryDiff(b, a)...)
+}
@@ -26,11 +26,16 @@ import (
 	common "github.com/gigiozzz/depiy/common-libs/commons"
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	bundlev1alpha1 "github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
 )
 
 const (
@@ -43,17 +48,26 @@ type EntandoBundleV2Reconciler struct {
 	Base     common.BaseK8sStructure
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// BundleCache stores the extracted bundles shared by the reconciles
+	BundleCache *bundles.Cache
 }
 
 //+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundlev2s,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundlev2s/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundlev2s/finalizers,verbs=update
-
-func NewEntandoBundleV2Reconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder) *EntandoBundleV2Reconciler {
+//+kubebuilder:rbac:groups=bundle.entando.org,resources=entandosignergroups,verbs=get;list;watch
+//+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundleinstancev2s,verbs=get;list;watch;update
+//+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundleinstancev2s/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;patch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func NewEntandoBundleV2Reconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder,
+	bundleCache *bundles.Cache) *EntandoBundleV2Reconciler {
 	return &EntandoBundleV2Reconciler{
-		Base:     common.BaseK8sStructure{Client: client, Log: log},
-		Scheme:   scheme,
-		Recorder: recorder,
+		Base:        common.BaseK8sStructure{Client: client, Log: log},
+		Scheme:      scheme,
+		Recorder:    recorder,
+		BundleCache: bundleCache,
 	}
 }
 
@@ -83,7 +97,7 @@ func (r *EntandoBundleV2Reconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		return ctrl.Result{}, err
 	}
 
-	recoBundleManager := NewReconcileBundleManager(r.Base.Client, r.Base.Log, r.Scheme, r.Recorder)
+	recoBundleManager := NewReconcileBundleManager(r.Base.Client, r.Base.Log, r.Scheme, r.Recorder, r.BundleCache)
 	res, err := recoBundleManager.MainReconcile(ctx, req, cr)
 
 	log.Info("Reconciled EntandoBundleV2 custom resources")
@@ -94,10 +108,21 @@ func (r *EntandoBundleV2Reconciler) Reconcile(ctx context.Context, req ctrl.Requ
 func (r *EntandoBundleV2Reconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&bundlev1alpha1.EntandoBundleV2{}).
+		// the instances referencing a bundle follow its update policy
+		Watches(&source.Kind{Type: &bundlev1alpha1.EntandoBundleInstanceV2{}}, handler.EnqueueRequestsFromMapFunc(bundleOfInstance)).
 		WithEventFilter(predicate.GenerationChangedPredicate{}). //solo modifiche a spec
 		Complete(r)
 }
 
+// bundleOfInstance maps an instance to the bundle it references
+func bundleOfInstance(obj client.Object) []reconcile.Request {
+	instance, ok := obj.(*bundlev1alpha1.EntandoBundleInstanceV2)
+	if !ok || instance.Spec.BundleRef == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: instance.Spec.BundleRef, Namespace: instance.GetNamespace()}}}
+}
+
 // =====================================================================
 // Add the cleanup steps that the operator
 // needs to do before the CR can be deleted. Examples
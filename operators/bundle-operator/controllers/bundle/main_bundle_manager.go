@@ -2,11 +2,16 @@ package bundle
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	common "github.com/gigiozzz/depiy/common-libs/commons"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
 	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -18,22 +23,26 @@ type ReconcileBundleManager struct {
 	Scheme    *runtime.Scheme
 	Recorder  record.EventRecorder
 	Condition *services.ConditionService
+	// BundleCache stores the extracted bundles, nil without cache
+	BundleCache *bundles.Cache
 }
 
-func NewReconcileBundleManager(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder) *ReconcileBundleManager {
+func NewReconcileBundleManager(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder,
+	bundleCache *bundles.Cache) *ReconcileBundleManager {
 	base := &common.BaseK8sStructure{Client: client, Log: log}
 	return &ReconcileBundleManager{
-		Base:      base,
-		Scheme:    scheme,
-		Recorder:  recorder,
-		Condition: services.NewConditionService(base),
+		Base:        base,
+		Scheme:      scheme,
+		Recorder:    recorder,
+		Condition:   services.NewConditionService(base),
+		BundleCache: bundleCache,
 	}
 }
 
 func (r *ReconcileBundleManager) MainReconcile(ctx context.Context, req ctrl.Request, cr *v1alpha1.EntandoBundleV2) (ctrl.Result, error) {
 
 	log := r.Base.Log
-	bundleService := services.NewBundleService()
+	bundleService := services.NewBundleService(r.BundleCache)
 
 	if err := r.Condition.SetConditionBundleReadyUnknow(ctx, cr); err != nil {
 		log.Info("error on set instance ready unknow")
@@ -47,15 +56,82 @@ func (r *ReconcileBundleManager) MainReconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, err
 	}
 
+	// registry credentials
+	keychain, err := services.NewRegistryAuthService(r.Base).Keychain(ctx, cr.GetNamespace(), cr.Spec.ImagePullSecrets)
+	if err != nil {
+		log.Info("error resolve image pull secrets reschedule reconcile", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "PullSecretsInvalid", "Invalid image pull secrets: %s", err)
+		r.Condition.SetConditionBundleReadyFalse(ctx, cr)
+		return ctrl.Result{}, err
+	}
+	bundleService.Keychain = keychain
+
+	// registry mirrors
+	mirrors, err := services.NewRegistryMirrorService(r.Base).Config(ctx)
+	if err != nil {
+		log.Info("error reading registry mirrors reschedule reconcile", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "MirrorsInvalid", "Invalid registry mirrors: %s", err)
+		r.Condition.SetConditionBundleReadyFalse(ctx, cr)
+		return ctrl.Result{}, err
+	}
+	bundleService.Mirrors = mirrors
+
+	if err := r.resolveBundleTags(ctx, cr, bundleService); err != nil {
+		log.Info("error resolveBundleTags reschedule reconcile", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "MirrorsUnavailable", "No registry serves the bundle: %s", err)
+		r.Condition.SetConditionBundleReadyFalse(ctx, cr)
+		return ctrl.Result{}, err
+	}
+
 	// verify signature
 	if err := r.verifyBundleSignatures(ctx, cr, bundleService); err != nil {
 		log.Info("error verifyBundleSignatures reschedule reconcile", "error", err)
+		var keyErr *services.SignatureKeyError
+		if errors.As(err, &keyErr) {
+			r.Recorder.Eventf(cr, "Warning", keyErr.Reason, "Invalid signature verification configuration: %s", keyErr.Err)
+			r.Condition.SetConditionBundleNotReady(ctx, cr, keyErr.Reason, keyErr.Error())
+		} else {
+			r.Condition.SetConditionBundleReadyFalse(ctx, cr)
+		}
+		return ctrl.Result{}, err
+	}
+
+	// discover tags
+	discoveryWait, err := r.discoverTags(ctx, cr, bundleService)
+	var discoveryErr *services.TagDiscoveryError
+	if errors.As(err, &discoveryErr) {
+		// retrying doesn't help, the tag discovery of the bundle has to change
+		log.Info("invalid tag discovery", "error", err)
+		r.Recorder.Eventf(cr, "Warning", services.CONDITION_BUNDLE_TAG_DISCOVERY_INVALID_REASON, "Invalid tag discovery: %s", err)
+		r.Condition.SetConditionBundleNotReady(ctx, cr, services.CONDITION_BUNDLE_TAG_DISCOVERY_INVALID_REASON, err.Error())
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		log.Info("error discoverTags reschedule reconcile", "error", err)
+		r.Condition.SetConditionBundleReadyFalse(ctx, cr)
+		return ctrl.Result{}, err
+	}
+
+	// move the instances to the verified tags allowed by their update policy
+	upgradeWait, err := r.upgradeInstances(ctx, cr)
+	if err != nil {
+		log.Info("error upgradeInstances reschedule reconcile", "error", err)
 		r.Condition.SetConditionBundleReadyFalse(ctx, cr)
 		return ctrl.Result{}, err
 	}
 
 	r.Condition.SetConditionBundleReadyTrue(ctx, cr)
-	return ctrl.Result{}, nil
+	// the keys may be revoked or removed without changing the bundle
+	requeue := minRequeue(services.SignatureReverifyInterval, discoveryWait)
+	return ctrl.Result{RequeueAfter: minRequeue(requeue, upgradeWait)}, nil
+}
+
+// minRequeue returns the shortest of the intervals, zero ones are ignored
+func minRequeue(a time.Duration, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
 }
 
 func (r *ReconcileBundleManager) generateAndSaveBundleCode(ctx context.Context,
@@ -74,20 +150,249 @@ func (r *ReconcileBundleManager) generateAndSaveBundleCode(ctx context.Context,
 	return err
 }
 
+// resolveBundleTags records in the status the reference each tag is pulled
+// from after the mirror rules, the verifications of the digests are kept
+func (r *ReconcileBundleManager) resolveBundleTags(ctx context.Context,
+	cr *v1alpha1.EntandoBundleV2,
+	bundleService *services.BundleService) error {
+	tags := []v1alpha1.EntandoBundleTagStatus{}
+	for _, tag := range cr.Spec.TagList {
+		resolvedRef, err := bundleService.ResolveImage(cr.Spec.Repository + "@" + tag.Digest)
+		if err != nil {
+			return err
+		}
+		tagStatus := v1alpha1.EntandoBundleTagStatus{Tag: tag.Tag, Digest: tag.Digest, ResolvedRef: resolvedRef}
+		for _, previous := range cr.Status.Tags {
+			if previous.Tag == tag.Tag && previous.Digest == tag.Digest {
+				tagStatus.Verified, tagStatus.Signers, tagStatus.Attestations = previous.Verified, previous.Signers, previous.Attestations
+			}
+		}
+		tags = append(tags, tagStatus)
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	if equality.Semantic.DeepEqual(cr.Status.Tags, tags) {
+		return nil
+	}
+	cr.Status.Tags = tags
+	return r.Base.Client.Status().Update(ctx, cr)
+}
+
+// verifyBundleSignatures verifies the digests of the tags, the digests no
+// longer verified lose their annotation and their instances are flagged
 func (r *ReconcileBundleManager) verifyBundleSignatures(ctx context.Context,
 	cr *v1alpha1.EntandoBundleV2,
 	bundleService *services.BundleService) error {
-	verifiedList, err := bundleService.CheckBundleSignature(ctx, cr, r.Base.Log)
-	if err == nil {
-		annotations := cr.GetAnnotations()
-		for k, v := range verifiedList {
-			annotations[k] = v
+	verifiedList, verifications, err := bundleService.CheckBundleSignature(ctx, cr, services.NewSignatureKeyService(r.Base), r.Base.Log)
+	var keyErr *services.SignatureKeyError
+	if err != nil && !errors.As(err, &keyErr) {
+		// the digests are not known to be verified or not, retried
+		return err
+	}
+	annotations := cr.GetAnnotations()
+	for _, tag := range cr.Spec.TagList {
+		delete(annotations, services.SignatureAnnotation(tag.Digest))
+	}
+	for k, v := range verifiedList {
+		annotations[k] = v
+	}
+	cr.SetAnnotations(annotations)
+	errSave := r.Base.Client.Update(ctx, cr)
+	if errSave != nil {
+		r.Base.Log.Error(errSave, "error saving verified sign")
+	} else if errSave := r.saveTagVerifications(ctx, cr, verifications); errSave != nil {
+		r.Base.Log.Error(errSave, "error saving signer statuses")
+	} else if errSave := r.flagUnverifiedInstances(ctx, cr, verifications); errSave != nil {
+		r.Base.Log.Error(errSave, "error flagging the instances of the digests not verified")
+	}
+	// the keys and the trust roots are configured by the user, the failure is reported
+	return err
+}
+
+// flagUnverifiedInstances flags the instances whose verified digest is no
+// longer verified, with the enforce policy their workloads can be scaled down
+func (r *ReconcileBundleManager) flagUnverifiedInstances(ctx context.Context,
+	cr *v1alpha1.EntandoBundleV2,
+	verifications []services.TagVerification) error {
+	revocation := services.NewRevocationService(r.Base)
+	instances, messages, err := revocation.UnverifiedInstances(ctx, cr, verifications)
+	if err != nil {
+		return err
+	}
+	enforce := services.BundlePolicy(cr) == v1alpha1.SignaturePolicyEnforce
+	for i := range instances {
+		instance := &instances[i]
+		if !r.Condition.IsSignatureVerified(ctx, instance) {
+			continue
+		}
+		message := messages[instance.Spec.Digest]
+		r.Base.Log.Info("installed digest no longer verified", "instance", instance.GetName(), "digest", instance.Spec.Digest, "message", message)
+		r.Recorder.Eventf(instance, "Warning", services.CONDITION_SIGNATURE_REVOKED_REASON,
+			"Signature of %s@%s no longer verified: %s", instance.Spec.Repository, instance.Spec.Digest, message)
+		if err := r.Condition.SetConditionSignatureNotVerified(ctx, instance, services.CONDITION_SIGNATURE_REVOKED_REASON, message); err != nil {
+			return err
+		}
+		if !enforce || !services.ScaleDownRevokedInstances {
+			continue
 		}
-		cr.SetAnnotations(annotations)
-		errSave := r.Base.Client.Update(ctx, cr)
-		if errSave != nil {
-			r.Base.Log.Error(errSave, "error saving verified sign")
+		if err := revocation.ScaleDownInstance(ctx, instance); err != nil {
+			return err
+		}
+		r.Recorder.Eventf(instance, "Warning", "InstanceScaledDown", "Workloads scaled down, the signature of %s is no longer verified", instance.Spec.Digest)
+		if err := r.Condition.SetConditionInstanceNotReady(ctx, instance, "Signature no longer verified: "+message); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// discoverTags lists the tags of the repository when due and records the
+// discovered versions, it returns when to list them again. A failure of the
+// registry is recorded and the next listing backs off.
+func (r *ReconcileBundleManager) discoverTags(ctx context.Context,
+	cr *v1alpha1.EntandoBundleV2,
+	bundleService *services.BundleService) (time.Duration, error) {
+	discovery := cr.Spec.TagDiscovery
+	if discovery == nil {
+		if cr.Status.Discovery == nil {
+			return 0, nil
+		}
+		cr.Status.Discovery = nil
+		return 0, r.Base.Client.Status().Update(ctx, cr)
+	}
+	now := time.Now()
+	if wait := services.DiscoveryWait(cr, now); wait > 0 {
+		return wait, nil
+	}
+
+	status := &v1alpha1.TagDiscoveryStatus{ObservedGeneration: cr.Generation, LastTime: &metav1.Time{Time: now}}
+	if cr.Status.Discovery != nil {
+		status.Versions, status.Failures = cr.Status.Discovery.Versions, cr.Status.Discovery.Failures
+	}
+	versions, err := bundleService.DiscoverTags(ctx, cr, services.NewSignatureKeyService(r.Base), r.Base.Log)
+	var discoveryErr *services.TagDiscoveryError
+	if errors.As(err, &discoveryErr) {
+		return 0, err
+	}
+	if err != nil {
+		r.Base.Log.Info("error listing the tags", "repository", cr.Spec.Repository, "error", err)
+		r.Recorder.Eventf(cr, "Warning", "TagDiscoveryFailed", "Tags of %s not listed: %s", cr.Spec.Repository, err)
+		status.Failures++
+		status.Message = err.Error()
+	} else {
+		status.Versions, status.Failures = versions, 0
+	}
+	next := services.DiscoveryInterval(discovery, status.Failures, services.IsRateLimited(err))
+	status.NextTime = &metav1.Time{Time: now.Add(next)}
+	cr.Status.Discovery = status
+	return next, r.Base.Client.Status().Update(ctx, cr)
+}
+
+// upgradeInstances sets the repository of the instances referencing the
+// bundle and moves their digest to the verified tag selected by their update
+// policy. Outside the maintenance windows the upgrade is pending, it returns
+// when the next window starts.
+func (r *ReconcileBundleManager) upgradeInstances(ctx context.Context, cr *v1alpha1.EntandoBundleV2) (time.Duration, error) {
+	instanceList := &v1alpha1.EntandoBundleInstanceV2List{}
+	if err := r.Base.Client.List(ctx, instanceList, client.InNamespace(cr.GetNamespace())); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var wait time.Duration
+	for i := range instanceList.Items {
+		instance := &instanceList.Items[i]
+		if instance.Spec.BundleRef != cr.GetName() {
+			continue
+		}
+		target := services.UpgradeTarget(instance, cr)
+		if target == nil {
+			if instance.Spec.Repository != cr.Spec.Repository {
+				instance.Spec.Repository = cr.Spec.Repository
+				if err := r.Base.Client.Update(ctx, instance); err != nil {
+					return 0, err
+				}
+			}
+			if instance.Status.PendingUpgrade != nil {
+				instance.Status.PendingUpgrade = nil
+				if err := r.Base.Client.Status().Update(ctx, instance); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+
+		// the first digest of the instance is not an upgrade
+		if instance.Spec.Digest != "" {
+			var policy v1alpha1.UpdatePolicy
+			if instance.Spec.UpdatePolicy != nil {
+				policy = *instance.Spec.UpdatePolicy
+			}
+			open, next, err := services.MaintenanceWindowAt(policy.MaintenanceWindows, now)
+			if err != nil {
+				r.Recorder.Eventf(instance, "Warning", "UpdatePolicyInvalid", "Invalid maintenance window: %s", err)
+				continue
+			}
+			if !open {
+				pending := &v1alpha1.PendingUpgrade{Tag: target.Tag, Digest: target.Digest, NotBefore: metav1.Time{Time: next}}
+				if !equality.Semantic.DeepEqual(instance.Status.PendingUpgrade, pending) {
+					r.Recorder.Eventf(instance, "Normal", "UpgradePending", "Upgrade to %s (%s) pending until %s",
+						target.Tag, target.Digest, next.Format(time.RFC3339))
+					instance.Status.PendingUpgrade = pending
+					if err := r.Base.Client.Status().Update(ctx, instance); err != nil {
+						return 0, err
+					}
+				}
+				wait = minRequeue(wait, next.Sub(now))
+				continue
+			}
+		}
+
+		record := v1alpha1.UpgradeRecord{
+			FromTag:     instance.Spec.Tag,
+			FromDigest:  instance.Spec.Digest,
+			ToTag:       target.Tag,
+			ToDigest:    target.Digest,
+			Time:        metav1.Time{Time: now},
+			TriggeredBy: "update policy " + string(services.UpdateStrategyOrDefault(instance.Spec.UpdatePolicy)),
+		}
+		instance.Spec.Repository, instance.Spec.Tag, instance.Spec.Digest = cr.Spec.Repository, target.Tag, target.Digest
+		if err := r.Base.Client.Update(ctx, instance); err != nil {
+			return 0, err
+		}
+		services.RecordUpgrade(instance, record)
+		instance.Status.PendingUpgrade = nil
+		if err := r.Base.Client.Status().Update(ctx, instance); err != nil {
+			return 0, err
+		}
+		r.Base.Log.Info("instance upgraded", "instance", instance.GetName(), "tag", target.Tag, "digest", target.Digest)
+		r.Recorder.Eventf(instance, "Normal", "InstanceUpgraded", "Digest moved from %s to %s (%s) by the %s",
+			record.FromDigest, target.Digest, target.Tag, record.TriggeredBy)
+		if err := r.Condition.SetConditionInstanceCrApplied(ctx, instance); err != nil {
+			return 0, err
+		}
+	}
+	return wait, nil
+}
+
+// saveTagVerifications records in the status of the tags which signers
+// verified their digests and the summary of their attestations
+func (r *ReconcileBundleManager) saveTagVerifications(ctx context.Context,
+	cr *v1alpha1.EntandoBundleV2,
+	verifications []services.TagVerification) error {
+	tags := make([]v1alpha1.EntandoBundleTagStatus, len(cr.Status.Tags))
+	copy(tags, cr.Status.Tags)
+	for i := range tags {
+		tags[i].Verified, tags[i].Signers, tags[i].Attestations = false, nil, nil
+		for _, verification := range verifications {
+			if verification.Tag == tags[i].Tag && verification.Digest == tags[i].Digest {
+				tags[i].Verified, tags[i].Signers, tags[i].Attestations = verification.Verified, verification.Signers, verification.Attestations
+			}
+		}
+	}
+	if equality.Semantic.DeepEqual(cr.Status.Tags, tags) {
+		return nil
+	}
+	cr.Status.Tags = tags
+	return r.Base.Client.Status().Update(ctx, cr)
+}
@@ -0,0 +1,130 @@
+package instance
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// componentApplyFunc applies a component and reports whether it is ready,
+// following the (doNext, result, error) convention of the managers
+type componentApplyFunc func(component *bundles.Component) (bool, ctrl.Result, error)
+
+type componentOutcome struct {
+	doNext bool
+	result ctrl.Result
+	err    error
+}
+
+// applyComponentGraph applies the components of the graph in waves: the
+// components whose dependencies are ready are applied in parallel, then the
+// ones depending on them, until no component can progress. It returns the
+// state of every component and the aggregated outcome, doNext is true only
+// when all the components are ready.
+func applyComponentGraph(graph *bundles.ComponentGraph, apply componentApplyFunc) ([]v1alpha1.ComponentStatus, bool, ctrl.Result, error) {
+	statuses := map[string]*v1alpha1.ComponentStatus{}
+	for _, component := range graph.Components() {
+		statuses[component.Name] = &v1alpha1.ComponentStatus{
+			Name:      component.Name,
+			Type:      string(component.Type),
+			State:     v1alpha1.ComponentStatePending,
+			DependsOn: component.DependsOn,
+		}
+	}
+
+	started := map[string]bool{}
+	done := map[string]bool{}
+	errs := []error{}
+	result := ctrl.Result{}
+	for wave := graph.Ready(started, done); len(wave) > 0; wave = graph.Ready(started, done) {
+		outcomes := make([]componentOutcome, len(wave))
+		var wg sync.WaitGroup
+		for i, component := range wave {
+			started[component.Name] = true
+			wg.Add(1)
+			go func(i int, component *bundles.Component) {
+				defer wg.Done()
+				outcomes[i].doNext, outcomes[i].result, outcomes[i].err = apply(component)
+			}(i, component)
+		}
+		wg.Wait()
+
+		for i, component := range wave {
+			status := statuses[component.Name]
+			outcome := outcomes[i]
+			switch {
+			case outcome.err != nil:
+				status.State = v1alpha1.ComponentStateFailed
+				status.Message = outcome.err.Error()
+				errs = append(errs, fmt.Errorf("component %s: %w", component.Name, outcome.err))
+			case outcome.doNext:
+				status.State = v1alpha1.ComponentStateReady
+				done[component.Name] = true
+			default:
+				status.State = v1alpha1.ComponentStateInstalling
+				status.Message = "waiting for the component to be ready"
+				result = mergeResult(result, outcome.result)
+			}
+		}
+	}
+
+	list := make([]v1alpha1.ComponentStatus, 0, len(statuses))
+	for _, component := range graph.Components() {
+		status := statuses[component.Name]
+		if status.State == v1alpha1.ComponentStatePending {
+			waiting := []string{}
+			for _, dependency := range component.DependsOn {
+				if !done[dependency] {
+					waiting = append(waiting, dependency)
+				}
+			}
+			status.Message = "waiting for " + strings.Join(waiting, ", ")
+		}
+		list = append(list, *status)
+	}
+
+	if len(errs) > 0 {
+		return list, false, ctrl.Result{}, utilerrors.NewAggregate(errs)
+	}
+	if len(done) < len(statuses) {
+		if !result.Requeue && result.RequeueAfter == 0 {
+			result.Requeue = true
+		}
+		return list, false, result, nil
+	}
+	return list, true, ctrl.Result{}, nil
+}
+
+// mergeResult returns a result that requeues as soon as the first of a or b
+func mergeResult(a ctrl.Result, b ctrl.Result) ctrl.Result {
+	merged := ctrl.Result{Requeue: a.Requeue || b.Requeue, RequeueAfter: a.RequeueAfter}
+	if merged.RequeueAfter == 0 || (b.RequeueAfter > 0 && b.RequeueAfter < merged.RequeueAfter) {
+		merged.RequeueAfter = b.RequeueAfter
+	}
+	return merged
+}
+
+// notReadyComponentsMessage lists the components that are not ready with
+// their state
+func notReadyComponentsMessage(statuses []v1alpha1.ComponentStatus) string {
+	notReady := []string{}
+	for _, status := range statuses {
+		if status.State == v1alpha1.ComponentStateReady {
+			continue
+		}
+		description := fmt.Sprintf("%s (%s", status.Name, status.State)
+		if status.Message != "" {
+			description += ": " + status.Message
+		}
+		notReady = append(notReady, description+")")
+	}
+	if len(notReady) == 0 {
+		return "Components not ready"
+	}
+	return "Components not ready: " + strings.Join(notReady, ", ")
+}
@@ -0,0 +1,132 @@
+package instance
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func testGraphComponents() []bundles.Component {
+	return []bundles.Component{
+		{Name: "db", Type: bundles.HelmComponentType},
+		{Name: "cache", Type: bundles.ManifestComponentType},
+		{Name: "api", Type: bundles.PluginComponentType, DependsOn: []string{"db", "cache"}},
+		{Name: "ui", Type: bundles.PluginComponentType, DependsOn: []string{"api"}},
+		{Name: "migrate", Type: bundles.JobComponentType, Spec: &bundles.Job{Phase: bundles.JobPhasePreInstall}},
+	}
+}
+
+func componentStates(statuses []v1alpha1.ComponentStatus) map[string]v1alpha1.ComponentState {
+	states := map[string]v1alpha1.ComponentState{}
+	for _, status := range statuses {
+		states[status.Name] = status.State
+	}
+	return states
+}
+
+func TestApplyComponentGraph(t *testing.T) {
+	graph := bundles.NewComponentGraph(testGraphComponents())
+
+	var mu sync.Mutex
+	applied := map[string]time.Time{}
+	running, maxRunning := 0, 0
+	statuses, doNext, _, err := applyComponentGraph(graph, func(component *bundles.Component) (bool, ctrl.Result, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		applied[component.Name] = time.Now()
+		mu.Unlock()
+		return true, ctrl.Result{}, nil
+	})
+	if err != nil || !doNext {
+		t.Fatalf("Expected all components ready, got %v %v", doNext, err)
+	}
+	if maxRunning != 2 {
+		t.Fatalf("Expected db and cache applied in parallel, max parallel applies %d", maxRunning)
+	}
+	if _, ok := applied["migrate"]; ok {
+		t.Fatal("JOB components must not be applied with the graph")
+	}
+	if !applied["api"].After(applied["db"]) || !applied["api"].After(applied["cache"]) || !applied["ui"].After(applied["api"]) {
+		t.Fatalf("Components applied before their dependencies: %v", applied)
+	}
+	if len(statuses) != 4 || statuses[2].Name != "api" || len(statuses[2].DependsOn) != 2 {
+		t.Fatalf("Invalid component statuses %+v", statuses)
+	}
+	for _, status := range statuses {
+		if status.State != v1alpha1.ComponentStateReady {
+			t.Fatalf("Expected component ready, got %+v", status)
+		}
+	}
+}
+
+func TestApplyComponentGraphNotReady(t *testing.T) {
+	graph := bundles.NewComponentGraph(testGraphComponents())
+
+	statuses, doNext, res, err := applyComponentGraph(graph, func(component *bundles.Component) (bool, ctrl.Result, error) {
+		switch component.Name {
+		case "db":
+			return false, ctrl.Result{Requeue: true, RequeueAfter: 10 * time.Second}, nil
+		case "cache":
+			return false, ctrl.Result{Requeue: true, RequeueAfter: 5 * time.Second}, nil
+		}
+		t.Fatalf("Component %s applied before its dependencies", component.Name)
+		return false, ctrl.Result{}, nil
+	})
+	if err != nil || doNext {
+		t.Fatalf("Expected components not ready, got %v %v", doNext, err)
+	}
+	if res.RequeueAfter != 5*time.Second {
+		t.Fatalf("Expected requeue after the shortest delay, got %+v", res)
+	}
+	states := componentStates(statuses)
+	if states["db"] != v1alpha1.ComponentStateInstalling || states["api"] != v1alpha1.ComponentStatePending ||
+		states["ui"] != v1alpha1.ComponentStatePending {
+		t.Fatalf("Invalid component states %v", states)
+	}
+	if statuses[2].Message != "waiting for db, cache" {
+		t.Fatalf("Invalid pending message %q", statuses[2].Message)
+	}
+}
+
+func TestApplyComponentGraphFailed(t *testing.T) {
+	graph := bundles.NewComponentGraph(testGraphComponents())
+
+	statuses, doNext, _, err := applyComponentGraph(graph, func(component *bundles.Component) (bool, ctrl.Result, error) {
+		if component.Name == "cache" {
+			return false, ctrl.Result{}, errors.New("apply failed")
+		}
+		return true, ctrl.Result{}, nil
+	})
+	if err == nil || doNext {
+		t.Fatalf("Expected error, got %v %v", doNext, err)
+	}
+	states := componentStates(statuses)
+	if states["db"] != v1alpha1.ComponentStateReady || states["cache"] != v1alpha1.ComponentStateFailed ||
+		states["api"] != v1alpha1.ComponentStatePending {
+		t.Fatalf("Invalid component states %v", states)
+	}
+}
+
+func TestNotReadyComponentsMessage(t *testing.T) {
+	message := notReadyComponentsMessage([]v1alpha1.ComponentStatus{
+		{Name: "db", State: v1alpha1.ComponentStateReady},
+		{Name: "api", State: v1alpha1.ComponentStateInstalling, Message: "waiting for the component to be ready"},
+		{Name: "ui", State: v1alpha1.ComponentStatePending, Message: "waiting for api"},
+	})
+	expected := "Components not ready: api (Installing: waiting for the component to be ready), ui (Pending: waiting for api)"
+	if message != expected {
+		t.Fatalf("Expected %q, got %q", expected, message)
+	}
+}
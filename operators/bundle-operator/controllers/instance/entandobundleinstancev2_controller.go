@@ -20,6 +20,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"context"
+	"time"
 
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
@@ -31,6 +32,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	bundlev1alpha1 "github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
 )
 
 const (
@@ -43,17 +45,27 @@ type EntandoBundleInstanceV2Reconciler struct {
 	Base     common.BaseK8sStructure
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// BundleCache stores the extracted bundles shared by the reconciles
+	BundleCache *bundles.Cache
 }
 
 //+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundleinstancev2s,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundleinstancev2s/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=bundle.entando.org,resources=entandobundleinstancev2s/finalizers,verbs=update
-
-func NewEntandoBundleInstanceV2Reconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder) *EntandoBundleInstanceV2Reconciler {
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=plugin.entando.org,resources=entandopluginv2s,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func NewEntandoBundleInstanceV2Reconciler(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder,
+	bundleCache *bundles.Cache) *EntandoBundleInstanceV2Reconciler {
 	return &EntandoBundleInstanceV2Reconciler{
-		Base:     common.BaseK8sStructure{Client: client, Log: log},
-		Scheme:   scheme,
-		Recorder: recorder,
+		Base:        common.BaseK8sStructure{Client: client, Log: log},
+		Scheme:      scheme,
+		Recorder:    recorder,
+		BundleCache: bundleCache,
 	}
 }
 
@@ -71,10 +83,7 @@ func (r *EntandoBundleInstanceV2Reconciler) Reconcile(ctx context.Context, req c
 	// indicated by the deletion timestamp being set.
 	isEntandoAppV2MarkedToBeDeleted := cr.GetDeletionTimestamp() != nil
 	if isEntandoAppV2MarkedToBeDeleted {
-		if err := r.removeFinalizer(ctx, cr, log); err != nil {
-			return ctrl.Result{}, err
-		}
-		return ctrl.Result{}, nil
+		return r.removeFinalizer(ctx, cr, log)
 	}
 
 	// Add finalizer for this CR
@@ -83,7 +92,7 @@ func (r *EntandoBundleInstanceV2Reconciler) Reconcile(ctx context.Context, req c
 		return ctrl.Result{}, err
 	}
 
-	recoInstanceManager := NewReconcileInstanceManager(r.Base.Client, r.Base.Log, r.Scheme, r.Recorder)
+	recoInstanceManager := NewReconcileInstanceManager(r.Base.Client, r.Base.Log, r.Scheme, r.Recorder, r.BundleCache)
 	res, err := recoInstanceManager.MainReconcile(ctx, req, cr)
 
 	log.Info("Reconciled EntandoBundleInstanceV2 custom resources")
@@ -94,7 +103,9 @@ func (r *EntandoBundleInstanceV2Reconciler) Reconcile(ctx context.Context, req c
 func (r *EntandoBundleInstanceV2Reconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&bundlev1alpha1.EntandoBundleInstanceV2{}).
-		WithEventFilter(predicate.GenerationChangedPredicate{}). //solo modifiche a spec
+		// the spec and the annotations, as the scaled down mark of the
+		// revocations
+		WithEventFilter(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{})).
 		Complete(r)
 }
 
@@ -104,9 +115,14 @@ func (r *EntandoBundleInstanceV2Reconciler) SetupWithManager(mgr ctrl.Manager) e
 // of finalizers include performing backups and deleting
 // resources that are not owned by this CR, like a PVC.
 // =====================================================================
-func (r *EntandoBundleInstanceV2Reconciler) finalizeEntandoApp(log logr.Logger, m *bundlev1alpha1.EntandoBundleInstanceV2) error {
+func (r *EntandoBundleInstanceV2Reconciler) finalizeEntandoApp(ctx context.Context, log logr.Logger, m *bundlev1alpha1.EntandoBundleInstanceV2) (bool, error) {
+	recoInstanceManager := NewReconcileInstanceManager(r.Base.Client, r.Base.Log, r.Scheme, r.Recorder, r.BundleCache)
+	done, err := recoInstanceManager.MainFinalize(ctx, m)
+	if err != nil || !done {
+		return done, err
+	}
 	log.Info("Successfully finalized entandoApp")
-	return nil
+	return true, nil
 }
 
 func (r *EntandoBundleInstanceV2Reconciler) addFinalizer(ctx context.Context, cr *bundlev1alpha1.EntandoBundleInstanceV2) error {
@@ -117,22 +133,27 @@ func (r *EntandoBundleInstanceV2Reconciler) addFinalizer(ctx context.Context, cr
 	return nil
 }
 
-func (r *EntandoBundleInstanceV2Reconciler) removeFinalizer(ctx context.Context, cr *bundlev1alpha1.EntandoBundleInstanceV2, log logr.Logger) error {
+func (r *EntandoBundleInstanceV2Reconciler) removeFinalizer(ctx context.Context, cr *bundlev1alpha1.EntandoBundleInstanceV2, log logr.Logger) (ctrl.Result, error) {
 	if controllerutil.ContainsFinalizer(cr, entandoBundleFinalizer) {
 		// Run finalization logic for entandoAppFinalizer. If the
 		// finalization logic fails, don't remove the finalizer so
 		// that we can retry during the next reconciliation.
-		if err := r.finalizeEntandoApp(log, cr); err != nil {
-			return err
+		done, err := r.finalizeEntandoApp(ctx, log, cr)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			// wait for the pre-delete jobs
+			return ctrl.Result{Requeue: true, RequeueAfter: 10 * time.Second}, nil
 		}
 
 		// Remove entandoAppFinalizer. Once all finalizers have been
 		// removed, the object will be deleted.
 		controllerutil.RemoveFinalizer(cr, entandoBundleFinalizer)
-		err := r.Base.Update(ctx, cr)
+		err = r.Base.Update(ctx, cr)
 		if err != nil {
-			return err
+			return ctrl.Result{}, err
 		}
 	}
-	return nil
+	return ctrl.Result{}, nil
 }
@@ -0,0 +1,233 @@
+package instance
+
+import (
+	"context"
+	"io/fs"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/applyer"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/renderer"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
+
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+type HelmManager struct {
+	Base       *common.BaseK8sStructure
+	Conditions *services.ConditionService
+	Inventory  *services.InventoryService
+}
+
+func NewHelmManager(base *common.BaseK8sStructure, conditions *services.ConditionService, inventory *services.InventoryService) *HelmManager {
+	return &HelmManager{
+		Base:       base,
+		Conditions: conditions,
+		Inventory:  inventory,
+	}
+}
+
+func (h *HelmManager) IsReleaseApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, component *bundles.Component) bool {
+	return h.Conditions.IsHelmReleaseApplied(ctx, cr, services.GenComponentId(component.Name))
+}
+
+// ApplyRelease renders the chart of the component and applies the result, the
+// objects rendered by the previous revision and not by this one are deleted
+func (h *HelmManager) ApplyRelease(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	scheme *runtime.Scheme,
+	bundle fs.FS,
+	component *bundles.Component) error {
+	log := h.Base.Log
+	componentId := services.GenComponentId(component.Name)
+	_, helm := component.GetIfIsHelm()
+
+	previous, err := h.Inventory.GetInventory(ctx, cr, component.Name)
+	if err != nil {
+		return err
+	}
+	var previousObjects []applyer.ObjectReference
+	previousRevision := 0
+	if previous != nil {
+		previousObjects = previous.Objects
+		previousRevision = previous.Revision
+	}
+
+	dynamicClient, discoveryClient, err := newClients(log)
+	if err != nil {
+		return err
+	}
+	applyOptions := applyer.NewApplyOptions(dynamicClient, discoveryClient)
+	kubeVersion, apiVersions, err := applyOptions.ServerCapabilities()
+	if err != nil {
+		return err
+	}
+
+	options := renderer.ReleaseOptions{
+		Name:        component.GetReleaseName(),
+		Namespace:   cr.GetNamespace(),
+		Revision:    previousRevision + 1,
+		IsUpgrade:   previousRevision > 0,
+		KubeVersion: kubeVersion,
+		APIVersions: apiVersions,
+		Lookup: releaseLookup(cr.GetNamespace(), func(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+			return applyOptions.Lookup(ctx, apiVersion, kind, namespace, name)
+		}),
+	}
+	rendered, err := renderRelease(bundle, helm, options)
+	if err != nil {
+		h.Conditions.SetConditionHelmReleaseRenderFailed(ctx, cr, componentId, err)
+		return err
+	}
+	h.Conditions.SetConditionHelmReleaseRendered(ctx, cr, componentId, options.Name)
+
+	applied, err := applyOptions.ApplyWithInventory(ctx, cr.GetNamespace(), rendered)
+	// track every object that may exist before pruning, so that nothing is
+	// left behind if the operator stops in the middle
+	inventory := &services.Inventory{
+		Component: component.Name,
+		Revision:  previousRevision,
+		Objects:   applyer.InventoryUnion(previousObjects, applied),
+	}
+	if saveErr := h.Inventory.SaveInventory(ctx, cr, inventory, scheme); saveErr != nil {
+		return saveErr
+	}
+	if err != nil {
+		h.Conditions.SetConditionHelmReleaseApplyFailed(ctx, cr, componentId, err)
+		return err
+	}
+
+	if err := applyOptions.Delete(ctx, applyer.InventoryDiff(previousObjects, applied)); err != nil {
+		h.Conditions.SetConditionHelmReleaseApplyFailed(ctx, cr, componentId, err)
+		return err
+	}
+	// the kept objects are left out of the inventory, they are never deleted
+	objects, err := releaseObjects(rendered, applied)
+	if err != nil {
+		return err
+	}
+	inventory.Revision = options.Revision
+	inventory.Objects = objects
+	if err := h.Inventory.SaveInventory(ctx, cr, inventory, scheme); err != nil {
+		return err
+	}
+	log.Info("helm release applied", "release", options.Name, "revision", options.Revision, "objects", len(objects))
+
+	return h.Conditions.SetConditionHelmReleaseApplied(ctx, cr, componentId, options.Name, options.Revision)
+}
+
+// UninstallRemovedReleases deletes the objects of the releases whose component
+// is no longer part of the bundle
+func (h *HelmManager) UninstallRemovedReleases(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	components []bundles.Component) error {
+	current := map[string]bool{}
+	for i := range components {
+		if isHelm, _ := components[i].GetIfIsHelm(); isHelm {
+			current[components[i].Name] = true
+		}
+	}
+
+	inventories, err := h.Inventory.ListInventories(ctx, cr)
+	if err != nil {
+		return err
+	}
+	for i := range inventories {
+		if current[inventories[i].Component] {
+			continue
+		}
+		componentId := services.GenComponentId(inventories[i].Component)
+		if err := h.uninstall(ctx, cr, &inventories[i]); err != nil {
+			h.Conditions.SetConditionHelmReleaseUninstallFailed(ctx, cr, componentId, err)
+			return err
+		}
+		h.Conditions.RemoveConditionsHelmRelease(ctx, cr, componentId)
+	}
+	return nil
+}
+
+// UninstallReleases deletes the objects of all the releases of the instance
+func (h *HelmManager) UninstallReleases(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	inventories, err := h.Inventory.ListInventories(ctx, cr)
+	if err != nil {
+		return err
+	}
+	for i := range inventories {
+		if err := h.uninstall(ctx, cr, &inventories[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *HelmManager) uninstall(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, inventory *services.Inventory) error {
+	dynamicClient, discoveryClient, err := newClients(h.Base.Log)
+	if err != nil {
+		return err
+	}
+	applyOptions := applyer.NewApplyOptions(dynamicClient, discoveryClient)
+	if err := applyOptions.Delete(ctx, inventory.Objects); err != nil {
+		return err
+	}
+	h.Base.Log.Info("helm release uninstalled", "component", inventory.Component, "objects", len(inventory.Objects))
+	return h.Inventory.DeleteInventory(ctx, cr, inventory.Component)
+}
+
+// renderRelease renders the chart with the values files, in order, and then
+// the inline values of the component
+func renderRelease(fsys fs.FS, helm *bundles.Helm, options renderer.ReleaseOptions) ([]byte, error) {
+	chart, err := renderer.LoadChart(fsys, bundles.FilePath(helm.ChartPath))
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	for _, valuesFile := range helm.ValuesFiles {
+		fileValues, err := renderer.ReadValuesFile(fsys, bundles.FilePath(valuesFile))
+		if err != nil {
+			return nil, err
+		}
+		values = renderer.MergeValues(values, fileValues)
+	}
+	inlineValues, err := renderer.NormalizeValues(helm.Values)
+	if err != nil {
+		return nil, err
+	}
+	values = renderer.MergeValues(values, inlineValues)
+
+	return renderer.RenderChart(chart, values, options)
+}
+
+// releaseObjects returns the applied objects without the ones annotated with
+// the keep resource policy
+func releaseObjects(rendered []byte, applied []applyer.ObjectReference) ([]applyer.ObjectReference, error) {
+	decoded, err := applyer.Decode(rendered)
+	if err != nil {
+		return nil, err
+	}
+	kept := map[string]bool{}
+	for _, object := range decoded {
+		if object.GetAnnotations()[renderer.ResourcePolicyAnnotation] == renderer.KeepPolicy {
+			kept[object.GroupVersionKind().GroupKind().String()+"/"+object.GetName()] = true
+		}
+	}
+	objects := make([]applyer.ObjectReference, 0, len(applied))
+	for _, ref := range applied {
+		if !kept[ref.GroupVersionKind().GroupKind().String()+"/"+ref.Name] {
+			objects = append(objects, ref)
+		}
+	}
+	return objects, nil
+}
+
+// releaseLookup restricts the lookup of the charts to the namespace of the
+// release. The operator can read the secrets of every namespace, so the
+// secrets and the objects of the other namespaces are missing for the charts,
+// an empty map like with helm template.
+func releaseLookup(namespace string, lookup renderer.LookupFunc) renderer.LookupFunc {
+	return func(apiVersion string, kind string, lookupNamespace string, name string) (map[string]interface{}, error) {
+		if lookupNamespace != namespace || kind == "Secret" {
+			return map[string]interface{}{}, nil
+		}
+		return lookup(apiVersion, kind, lookupNamespace, name)
+	}
+}
@@ -0,0 +1,67 @@
+package instance
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/applyer"
+)
+
+func TestReleaseObjects(t *testing.T) {
+	rendered := []byte(`---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+  annotations:
+    helm.sh/resource-policy: keep
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: data
+`)
+	service := applyer.ObjectReference{Version: "v1", Kind: "Service", Namespace: "entando", Name: "data"}
+	claim := applyer.ObjectReference{Version: "v1", Kind: "PersistentVolumeClaim", Namespace: "entando", Name: "data"}
+	objects, err := releaseObjects(rendered, []applyer.ObjectReference{claim, service})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(objects, []applyer.ObjectReference{service}) {
+		t.Fatalf("Expected the kept claim left out, got %v", objects)
+	}
+}
+
+func TestReleaseLookup(t *testing.T) {
+	lookups := []string{}
+	lookup := releaseLookup("entando", func(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+		lookups = append(lookups, strings.Join([]string{apiVersion, kind, namespace, name}, "/"))
+		return map[string]interface{}{"kind": kind}, nil
+	})
+
+	tests := []struct {
+		name      string
+		kind      string
+		namespace string
+		found     bool
+	}{
+		{name: "release namespace", kind: "ConfigMap", namespace: "entando", found: true},
+		{name: "secret", kind: "Secret", namespace: "entando"},
+		{name: "other namespace", kind: "ConfigMap", namespace: "kube-system"},
+		{name: "every namespace", kind: "ConfigMap"},
+		{name: "cluster scoped", kind: "Namespace"},
+	}
+	for _, test := range tests {
+		object, err := lookup("v1", test.kind, test.namespace, "")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if found := len(object) > 0; found != test.found {
+			t.Fatalf("%s: expected found %t, got %v", test.name, test.found, object)
+		}
+	}
+	if strings.Join(lookups, ",") != "v1/ConfigMap/entando/" {
+		t.Fatalf("Unexpected lookups %v", lookups)
+	}
+}
@@ -0,0 +1,211 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	utility "github.com/gigiozzz/depiy/common-libs/utilities"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const jobContainerName = "job"
+
+const (
+	// defaultJobBackoffLimit is the number of retries of a job whose
+	// descriptor doesn't set it
+	defaultJobBackoffLimit int32 = 3
+	// defaultJobActiveDeadlineSeconds bounds the duration of a job whose
+	// descriptor doesn't set it, a stuck job must not block the rollout
+	defaultJobActiveDeadlineSeconds int64 = 1800
+)
+
+type JobManager struct {
+	Base *common.BaseK8sStructure
+}
+
+func NewJobManager(base *common.BaseK8sStructure) *JobManager {
+	return &JobManager{
+		Base: base,
+	}
+}
+
+// RunPhase runs the JOB components of a phase one after the other, in
+// descriptor order, and returns the state of the phase: Succeeded when all
+// the jobs completed, Running while a job has to complete and Failed when a
+// job failed. The failed job is returned too.
+func (j *JobManager) RunPhase(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	scheme *runtime.Scheme,
+	components []bundles.Component,
+	phase bundles.JobPhase) (v1alpha1.JobState, *v1alpha1.JobStatus, error) {
+
+	for i := range components {
+		isJob, job := components[i].GetIfIsJob()
+		if !isJob || job.Phase != phase {
+			continue
+		}
+		state, status, err := j.runJob(ctx, cr, scheme, &components[i], job)
+		if err != nil || state != v1alpha1.JobStateSucceeded {
+			return state, status, err
+		}
+	}
+	return v1alpha1.JobStateSucceeded, nil, nil
+}
+
+func (j *JobManager) runJob(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	scheme *runtime.Scheme,
+	component *bundles.Component,
+	job *bundles.Job) (v1alpha1.JobState, *v1alpha1.JobStatus, error) {
+	log := j.Base.Log
+
+	status := findJobStatus(cr, component.Name, job.Phase, cr.Spec.Digest)
+	if status != nil && status.State != v1alpha1.JobStateRunning {
+		// the job already ran for this bundle digest
+		return status.State, status, nil
+	}
+
+	jobName := genJobName(cr, component, job.Phase)
+	k8sJob := &batchv1.Job{}
+	err := j.Base.Client.Get(ctx, types.NamespacedName{Name: jobName, Namespace: cr.GetNamespace()}, k8sJob)
+	if errors.IsNotFound(err) {
+		k8sJob = buildJob(cr, component, job, jobName)
+		if err := ctrl.SetControllerReference(cr, k8sJob, scheme); err != nil {
+			return "", nil, err
+		}
+		log.Info("Create job", "job", jobName, "phase", job.Phase)
+		if err := j.Base.Client.Create(ctx, k8sJob); err != nil {
+			return "", nil, err
+		}
+		status = &v1alpha1.JobStatus{
+			Component: component.Name,
+			Phase:     string(job.Phase),
+			Digest:    cr.Spec.Digest,
+			JobName:   jobName,
+			State:     v1alpha1.JobStateRunning,
+			StartTime: &metav1.Time{Time: k8sJob.CreationTimestamp.Time},
+			LogsHint:  fmt.Sprintf("kubectl logs --namespace %s job/%s", cr.GetNamespace(), jobName),
+		}
+		return v1alpha1.JobStateRunning, status, j.recordJobStatus(ctx, cr, status)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	state, message, completionTime := jobState(k8sJob)
+	if status == nil {
+		// the status update was lost after the job was created
+		status = &v1alpha1.JobStatus{
+			Component: component.Name,
+			Phase:     string(job.Phase),
+			Digest:    cr.Spec.Digest,
+			JobName:   jobName,
+			LogsHint:  fmt.Sprintf("kubectl logs --namespace %s job/%s", cr.GetNamespace(), jobName),
+		}
+	}
+	if status.State == state && state == v1alpha1.JobStateRunning {
+		return state, status, nil
+	}
+	status.State = state
+	status.StartTime = k8sJob.Status.StartTime
+	status.CompletionTime = completionTime
+	status.Message = message
+	log.Info("Job state changed", "job", jobName, "state", state)
+	return state, status, j.recordJobStatus(ctx, cr, status)
+}
+
+func (j *JobManager) recordJobStatus(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, status *v1alpha1.JobStatus) error {
+	jobs := make([]v1alpha1.JobStatus, 0, len(cr.Status.Jobs)+1)
+	for _, job := range cr.Status.Jobs {
+		// the executions for other digests are replaced by the new one
+		if job.Component != status.Component || job.Phase != status.Phase {
+			jobs = append(jobs, job)
+		}
+	}
+	cr.Status.Jobs = append(jobs, *status)
+	return j.Base.Client.Status().Update(ctx, cr)
+}
+
+// jobState maps the conditions of a job to the state of the execution
+func jobState(job *batchv1.Job) (v1alpha1.JobState, string, *metav1.Time) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return v1alpha1.JobStateSucceeded, condition.Message, job.Status.CompletionTime
+		case batchv1.JobFailed:
+			transitionTime := condition.LastTransitionTime
+			return v1alpha1.JobStateFailed, condition.Reason + ": " + condition.Message, &transitionTime
+		}
+	}
+	return v1alpha1.JobStateRunning, "", nil
+}
+
+func findJobStatus(cr *v1alpha1.EntandoBundleInstanceV2, component string, phase bundles.JobPhase, digest string) *v1alpha1.JobStatus {
+	for i := range cr.Status.Jobs {
+		job := &cr.Status.Jobs[i]
+		if job.Component == component && job.Phase == string(phase) && job.Digest == digest {
+			return job
+		}
+	}
+	return nil
+}
+
+func buildJob(cr *v1alpha1.EntandoBundleInstanceV2, component *bundles.Component, job *bundles.Job, jobName string) *batchv1.Job {
+	labels := map[string]string{
+		services.InventoryInstanceLabel:  services.InstanceId(cr),
+		services.InventoryComponentLabel: services.GenComponentId(component.Name),
+	}
+	backoffLimit := defaultJobBackoffLimit
+	if job.BackoffLimit != nil {
+		backoffLimit = *job.BackoffLimit
+	}
+	activeDeadlineSeconds := defaultJobActiveDeadlineSeconds
+	if job.ActiveDeadlineSeconds != nil {
+		activeDeadlineSeconds = *job.ActiveDeadlineSeconds
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        jobName,
+			Namespace:   cr.GetNamespace(),
+			Labels:      labels,
+			Annotations: map[string]string{services.InventoryInstanceAnnotation: cr.GetName()},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &activeDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:    jobContainerName,
+						Image:   job.Image,
+						Command: job.Command,
+						Env:     toEnvVars(job.Env),
+					}},
+				},
+			},
+		},
+	}
+}
+
+// genJobName returns a name that changes with the bundle digest, so that a
+// job runs again when the instance is upgraded
+func genJobName(cr *v1alpha1.EntandoBundleInstanceV2, component *bundles.Component, phase bundles.JobPhase) string {
+	jobId := services.GenComponentId(component.Name + "/" + string(phase) + "@" + cr.Spec.Digest)
+	return utility.TruncateString(cr.GetName(), 50) + "-job-" + jobId
+}
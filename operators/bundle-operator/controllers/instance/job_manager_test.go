@@ -0,0 +1,182 @@
+package instance
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestJobManager(t *testing.T) (*JobManager, *v1alpha1.EntandoBundleInstanceV2, *runtime.Scheme) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	cr := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "entando", UID: "uid"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Digest: "sha256:0123"},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cr).Build()
+	return NewJobManager(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()}), cr, scheme
+}
+
+func testJobComponents() []bundles.Component {
+	return []bundles.Component{
+		{Name: "migrate", Type: bundles.JobComponentType, Spec: &bundles.Job{
+			Phase: bundles.JobPhasePreInstall, Image: "flyway", Command: []string{"flyway", "migrate"},
+			Env: []bundles.EnvVar{{Name: "DB_HOST", Value: "db"}},
+		}},
+		{Name: "web", Type: bundles.PluginComponentType, Spec: &bundles.Plugin{Repository: "nginx", Tag: "latest"}},
+		{Name: "seed", Type: bundles.JobComponentType, Spec: &bundles.Job{Phase: bundles.JobPhasePreInstall, Image: "seed"}},
+		{Name: "warm-up", Type: bundles.JobComponentType, Spec: &bundles.Job{Phase: bundles.JobPhasePostInstall, Image: "curl"}},
+	}
+}
+
+func setJobCondition(t *testing.T, jobManager *JobManager, name string, conditionType batchv1.JobConditionType) {
+	job := &batchv1.Job{}
+	if err := jobManager.Base.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: "entando"}, job); err != nil {
+		t.Fatal(err.Error())
+	}
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type: conditionType, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", Message: "Job has reached the specified backoff limit",
+	})
+	if err := jobManager.Base.Client.Status().Update(context.TODO(), job); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRunPhase(t *testing.T) {
+	ctx := context.TODO()
+	jobManager, cr, scheme := newTestJobManager(t)
+	components := testJobComponents()
+
+	state, status, err := jobManager.RunPhase(ctx, cr, scheme, components, bundles.JobPhasePreInstall)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if state != v1alpha1.JobStateRunning || status.Component != "migrate" {
+		t.Fatalf("Expected migrate job running, got %s %+v", state, status)
+	}
+	if !strings.Contains(status.LogsHint, "job/"+status.JobName) {
+		t.Fatalf("Invalid logs hint %q", status.LogsHint)
+	}
+
+	job := &batchv1.Job{}
+	if err := jobManager.Base.Client.Get(ctx, types.NamespacedName{Name: status.JobName, Namespace: "entando"}, job); err != nil {
+		t.Fatal(err.Error())
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if container.Image != "flyway" || len(container.Command) != 2 || container.Env[0].Name != "DB_HOST" {
+		t.Fatalf("Invalid job container %+v", container)
+	}
+	if len(job.OwnerReferences) != 1 || job.OwnerReferences[0].Name != cr.Name {
+		t.Fatalf("Expected job owned by the instance, got %+v", job.OwnerReferences)
+	}
+
+	// the next job of the phase starts only when the previous one completed
+	setJobCondition(t, jobManager, status.JobName, batchv1.JobComplete)
+	state, status, err = jobManager.RunPhase(ctx, cr, scheme, components, bundles.JobPhasePreInstall)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if state != v1alpha1.JobStateRunning || status.Component != "seed" {
+		t.Fatalf("Expected seed job running, got %s %+v", state, status)
+	}
+
+	setJobCondition(t, jobManager, status.JobName, batchv1.JobComplete)
+	state, _, err = jobManager.RunPhase(ctx, cr, scheme, components, bundles.JobPhasePreInstall)
+	if err != nil || state != v1alpha1.JobStateSucceeded {
+		t.Fatalf("Expected phase succeeded, got %s %v", state, err)
+	}
+
+	stored := &v1alpha1.EntandoBundleInstanceV2{}
+	if err := jobManager.Base.Client.Get(ctx, client.ObjectKeyFromObject(cr), stored); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(stored.Status.Jobs) != 2 {
+		t.Fatalf("Expected 2 jobs in status, got %+v", stored.Status.Jobs)
+	}
+	for _, job := range stored.Status.Jobs {
+		if job.State != v1alpha1.JobStateSucceeded || job.Digest != cr.Spec.Digest {
+			t.Fatalf("Invalid job status %+v", job)
+		}
+	}
+
+	// a phase without jobs succeeds immediately
+	state, _, err = jobManager.RunPhase(ctx, cr, scheme, components, bundles.JobPhasePreUpgrade)
+	if err != nil || state != v1alpha1.JobStateSucceeded {
+		t.Fatalf("Expected empty phase succeeded, got %s %v", state, err)
+	}
+}
+
+func TestRunPhaseFailedJob(t *testing.T) {
+	ctx := context.TODO()
+	jobManager, cr, scheme := newTestJobManager(t)
+	components := testJobComponents()
+
+	_, status, err := jobManager.RunPhase(ctx, cr, scheme, components, bundles.JobPhasePreInstall)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	setJobCondition(t, jobManager, status.JobName, batchv1.JobFailed)
+
+	for i := 0; i < 2; i++ {
+		state, status, err := jobManager.RunPhase(ctx, cr, scheme, components, bundles.JobPhasePreInstall)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if state != v1alpha1.JobStateFailed || status.Component != "migrate" {
+			t.Fatalf("Expected migrate job failed, got %s %+v", state, status)
+		}
+		if !strings.Contains(status.Message, "BackoffLimitExceeded") {
+			t.Fatalf("Expected failure reason in message, got %q", status.Message)
+		}
+	}
+
+	// a new digest runs the job again
+	cr.Spec.Digest = "sha256:4567"
+	state, status, err := jobManager.RunPhase(ctx, cr, scheme, components, bundles.JobPhasePreInstall)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if state != v1alpha1.JobStateRunning || status.Digest != "sha256:4567" {
+		t.Fatalf("Expected job running for the new digest, got %s %+v", state, status)
+	}
+	if len(cr.Status.Jobs) != 1 {
+		t.Fatalf("Expected the execution of the previous digest to be replaced, got %+v", cr.Status.Jobs)
+	}
+}
+
+func TestBuildJobLimits(t *testing.T) {
+	cr := &v1alpha1.EntandoBundleInstanceV2{ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "entando"}}
+	component := &bundles.Component{Name: "migrate", Type: bundles.JobComponentType}
+
+	job := buildJob(cr, component, &bundles.Job{Phase: bundles.JobPhasePreInstall, Image: "flyway"}, "migrate")
+	if *job.Spec.BackoffLimit != defaultJobBackoffLimit || *job.Spec.ActiveDeadlineSeconds != defaultJobActiveDeadlineSeconds {
+		t.Fatalf("Expected the default limits, got %d %d", *job.Spec.BackoffLimit, *job.Spec.ActiveDeadlineSeconds)
+	}
+
+	backoffLimit := int32(0)
+	activeDeadlineSeconds := int64(60)
+	job = buildJob(cr, component, &bundles.Job{Phase: bundles.JobPhasePreInstall, Image: "flyway",
+		BackoffLimit: &backoffLimit, ActiveDeadlineSeconds: &activeDeadlineSeconds}, "migrate")
+	if *job.Spec.BackoffLimit != 0 || *job.Spec.ActiveDeadlineSeconds != 60 {
+		t.Fatalf("Expected the limits of the descriptor, got %d %d", *job.Spec.BackoffLimit, *job.Spec.ActiveDeadlineSeconds)
+	}
+}
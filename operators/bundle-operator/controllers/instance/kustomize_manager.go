@@ -0,0 +1,63 @@
+package instance
+
+import (
+	"context"
+	"io/fs"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/applyer"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/renderer"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
+)
+
+type KustomizeManager struct {
+	Base       *common.BaseK8sStructure
+	Conditions *services.ConditionService
+}
+
+func NewKustomizeManager(base *common.BaseK8sStructure, conditions *services.ConditionService) *KustomizeManager {
+	return &KustomizeManager{
+		Base:       base,
+		Conditions: conditions,
+	}
+}
+
+func (k *KustomizeManager) IsKustomizationApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, component *bundles.Component) bool {
+	return k.Conditions.IsKustomizationApplied(ctx, cr, services.GenComponentId(component.Name))
+}
+
+// ApplyKustomization builds the kustomization of the component and applies
+// the output in the namespace of the instance
+func (k *KustomizeManager) ApplyKustomization(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	bundle fs.FS,
+	component *bundles.Component) error {
+	componentId := services.GenComponentId(component.Name)
+	_, kustomize := component.GetIfIsKustomize()
+
+	options := renderer.KustomizeOptions{
+		CommonLabels: kustomize.CommonLabels,
+		NamePrefix:   kustomize.NamePrefix,
+	}
+	if kustomize.InjectNamespace {
+		options.Namespace = cr.GetNamespace()
+	}
+	output, err := renderer.BuildKustomization(bundle, bundles.FilePath(kustomize.Path), options)
+	if err != nil {
+		k.Conditions.SetConditionKustomizationApplyFailed(ctx, cr, componentId, err)
+		return err
+	}
+
+	dynamicClient, discoveryClient, err := newClients(k.Base.Log)
+	if err != nil {
+		return err
+	}
+	applyOptions := applyer.NewApplyOptions(dynamicClient, discoveryClient)
+	if err := applyOptions.Apply(ctx, cr.GetNamespace(), output); err != nil {
+		k.Conditions.SetConditionKustomizationApplyFailed(ctx, cr, componentId, err)
+		return err
+	}
+
+	return k.Conditions.SetConditionKustomizationApplied(ctx, cr, componentId, kustomize.Path)
+}
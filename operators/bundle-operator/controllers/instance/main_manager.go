@@ -2,7 +2,10 @@ package instance
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"sync"
 	"time"
 
 	common "github.com/gigiozzz/depiy/common-libs/commons"
@@ -10,100 +13,470 @@ import (
 	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// signatureRetryInterval is the interval of the verifications of a digest
+// refused by the enforce policy
+const signatureRetryInterval = time.Minute
+
 type ReconcileInstanceManager struct {
 	Base      *common.BaseK8sStructure
 	Scheme    *runtime.Scheme
 	Recorder  record.EventRecorder
 	Condition *services.ConditionService
+	Inventory *services.InventoryService
+	// BundleCache stores the extracted bundles, nil without cache
+	BundleCache *bundles.Cache
+
+	// pullSecrets are the image pull secrets of the instance, propagated to
+	// the plugins
+	pullSecrets []corev1.LocalObjectReference
+	// bundleService pulls the bundle of the instance, it resolves the images
+	// of the plugins with the same credentials and mirror rules
+	bundleService *services.BundleService
+	// pluginImages are the verifications of the plugin images of the
+	// reconcile by component, the components are applied in parallel
+	pluginImagesMu sync.Mutex
+	pluginImages   map[string]*v1alpha1.ImageStatus
 }
 
-func NewReconcileInstanceManager(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder) *ReconcileInstanceManager {
+func NewReconcileInstanceManager(client client.Client, log logr.Logger, scheme *runtime.Scheme, recorder record.EventRecorder,
+	bundleCache *bundles.Cache) *ReconcileInstanceManager {
 	base := &common.BaseK8sStructure{Client: client, Log: log}
 	return &ReconcileInstanceManager{
-		Base:      base,
-		Scheme:    scheme,
-		Recorder:  recorder,
-		Condition: services.NewConditionService(base),
+		Base:        base,
+		Scheme:      scheme,
+		Recorder:    recorder,
+		Condition:   services.NewConditionService(base),
+		Inventory:   services.NewInventoryService(base),
+		BundleCache: bundleCache,
 	}
 }
 
 func (r *ReconcileInstanceManager) MainReconcile(ctx context.Context, req ctrl.Request, cr *v1alpha1.EntandoBundleInstanceV2) (ctrl.Result, error) {
 
 	log := r.Base.Log
-	bundleService := services.NewBundleService()
+	bundleService := services.NewBundleService(r.BundleCache)
 
 	if err := r.Condition.SetConditionInstanceReadyUnknow(ctx, cr); err != nil {
 		log.Info("error on set instance ready unknow")
 		return ctrl.Result{}, err
 	}
 
+	// bundle reference
+	if doNext, res, err := r.resolveBundleRef(ctx, cr, bundleService); !doNext {
+		return res, err
+	}
+
+	// registry credentials
+	if err := r.setupRegistryAuth(ctx, cr, bundleService); err != nil {
+		log.Info("error resolve image pull secrets", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "PullSecretsInvalid", "Invalid image pull secrets: %s", err)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return ctrl.Result{}, err
+	}
+
+	// registry mirrors
+	if err := r.setupRegistryMirrors(ctx, bundleService); err != nil {
+		log.Info("error reading registry mirrors", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "MirrorsInvalid", "Invalid registry mirrors: %s", err)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return ctrl.Result{}, err
+	}
+	r.bundleService = bundleService
+
 	// verify signature
+	if doNext, res, err := r.verifySignature(ctx, cr, bundleService); !doNext {
+		return res, err
+	}
 
 	// retrieve components
-	components, dir, err := bundleService.GetComponents(ctx, cr)
+	components, bundle, release, err := bundleService.GetComponents(ctx, cr)
+	if err == nil {
+		defer release()
+	}
+	var descriptorErrors bundles.ValidationErrors
+	if errors.As(err, &descriptorErrors) {
+		// retrying doesn't help, the instance has to point to another digest
+		log.Info("invalid bundle descriptor", "errors", descriptorErrors.Error())
+		r.Recorder.Eventf(cr, "Warning", "DescriptorInvalid", "Invalid descriptor for %s", bundleService.BundleImage(cr))
+		r.Condition.SetConditionDescriptorInvalid(ctx, cr, descriptorErrors.Error())
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return ctrl.Result{}, nil
+	}
 	if err != nil {
 		log.Info("error retrieve components", "error", err)
 		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
 		return ctrl.Result{}, err
 	}
+	r.Condition.RemoveConditionDescriptorInvalid(ctx, cr)
+
+	// the bundle was pulled, the resolution is the one of GetComponents
+	if resolvedRef, err := bundleService.ResolveImage(bundleService.BundleImage(cr)); err == nil && cr.Status.ResolvedRef != resolvedRef {
+		cr.Status.ResolvedRef = resolvedRef
+		if err := r.Base.Client.Status().Update(ctx, cr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// apply the configuration of the instance to the components
+	configuration, err := bundles.ParseConfiguration(cr.Spec.Configuration)
+	if err == nil {
+		components, err = configuration.Apply(components)
+	}
+	if err != nil {
+		// retrying doesn't help, the configuration of the instance has to change
+		log.Info("invalid instance configuration", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "ConfigurationInvalid", "Invalid configuration: %s", err)
+		r.Condition.SetConditionInstanceNotReady(ctx, cr, "Invalid configuration: "+err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// run the jobs that precede the components
+	installing := !r.isInstalled(ctx, cr)
+	upgrading := !installing && cr.Status.InstalledDigest != "" && cr.Status.InstalledDigest != cr.Spec.Digest
+	if installing && r.Condition.InstanceInstalledStatus(ctx, cr) == metav1.ConditionUnknown {
+		if err := r.Condition.SetConditionInstanceInstalling(ctx, cr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if installing || upgrading {
+		phase := bundles.JobPhasePreInstall
+		if upgrading {
+			phase = bundles.JobPhasePreUpgrade
+		}
+		if doNext, res, err := r.manageJobs(ctx, cr, components, phase); !doNext {
+			return res, err
+		}
+	}
 
-	// manage components (plugins and manifests)
-	if doNext, res, err := r.manageComponents(ctx, req, cr, components, dir); !doNext {
+	// manage components following their dependencies
+	if doNext, res, err := r.manageComponents(ctx, req, cr, components, bundle); !doNext {
 		log.Info("error manage components", "error", err)
-		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		r.Condition.SetConditionInstanceNotReady(ctx, cr, notReadyComponentsMessage(cr.Status.Components))
 		return res, err
 	}
 
+	// uninstall the releases removed from the bundle
+	helmManager := NewHelmManager(r.Base, r.Condition, r.Inventory)
+	if err := helmManager.UninstallRemovedReleases(ctx, cr, components); err != nil {
+		log.Info("error uninstall removed releases", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "UninstallFailed", "Failed to uninstall removed helm releases: %s", err)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return ctrl.Result{}, err
+	}
+
+	// run the jobs that follow the components
+	if installing {
+		if doNext, res, err := r.manageJobs(ctx, cr, components, bundles.JobPhasePostInstall); !doNext {
+			return res, err
+		}
+		if err := r.Condition.SetConditionInstanceInstalled(ctx, cr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if cr.Status.InstalledDigest != cr.Spec.Digest {
+		if upgrading && !services.IsUpgradeRecorded(cr) {
+			// the digest was moved by hand, not by the update policy
+			services.RecordUpgrade(cr, v1alpha1.UpgradeRecord{
+				FromDigest:  cr.Status.InstalledDigest,
+				ToTag:       cr.Spec.Tag,
+				ToDigest:    cr.Spec.Digest,
+				Time:        metav1.Now(),
+				TriggeredBy: services.DigestManager(cr),
+			})
+		}
+		cr.Status.InstalledDigest = cr.Spec.Digest
+		if err := r.Base.Client.Status().Update(ctx, cr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// the workloads scaled down by a revocation are back
+	if services.IsScaledDown(cr) {
+		if err := services.NewRevocationService(r.Base).ClearScaledDown(ctx, cr); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(cr, "Normal", "InstanceRestored", "Workloads of %s installed again", cr.Spec.Digest)
+	}
+
 	r.Condition.SetConditionInstanceReadyTrue(ctx, cr)
 	return ctrl.Result{}, nil
 }
 
-func (r *ReconcileInstanceManager) manageComponents(ctx context.Context, req ctrl.Request,
-	cr *v1alpha1.EntandoBundleInstanceV2,
-	components []bundles.Component, dir string) (bool, ctrl.Result, error) {
+// isInstalled reports whether the first installation of the instance
+// completed, the instances installed before the installed condition was
+// introduced are recognized by their installed digest
+func (r *ReconcileInstanceManager) isInstalled(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) bool {
+	switch r.Condition.InstanceInstalledStatus(ctx, cr) {
+	case metav1.ConditionTrue:
+		return true
+	case metav1.ConditionFalse:
+		return false
+	}
+	return cr.Status.InstalledDigest != ""
+}
+
+// MainFinalize runs the pre-delete jobs and uninstalls the objects not owned
+// by the instance, it reports whether the instance can be deleted
+func (r *ReconcileInstanceManager) MainFinalize(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) (bool, error) {
 	log := r.Base.Log
+	bundleService := services.NewBundleService(r.BundleCache)
 
-	for _, component := range components {
-		log.Info("== component ==", "component", component)
-		isPlugin, plugin := component.GetIfIsPlugin()
-		if isPlugin {
-			doNext, res, err := r.managePlugin(ctx, req, cr, plugin)
-			if !doNext {
-				return doNext, res, err
-			}
-			continue
+	_, _, err := r.resolveBundleRef(ctx, cr, bundleService)
+	if err == nil {
+		err = r.setupRegistryAuth(ctx, cr, bundleService)
+	}
+	if err == nil {
+		err = r.setupRegistryMirrors(ctx, bundleService)
+	}
+	var components []bundles.Component
+	if err == nil {
+		var release func()
+		components, _, release, err = bundleService.GetComponents(ctx, cr)
+		if err == nil {
+			defer release()
 		}
-		isManifest, manifest := component.GetIfIsManifest()
-		if isManifest {
-			doNext, res, err := r.manageManifest(ctx, req, cr, manifest, dir)
-			if !doNext {
-				return doNext, res, err
-			}
-			continue
+	}
+	if err != nil {
+		// the bundle may be gone, the deletion must not be blocked by it
+		log.Info("error retrieve components, pre-delete jobs skipped", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "PreDeleteSkipped", "Pre-delete jobs skipped, bundle not available: %s", err)
+	} else {
+		jobManager := NewJobManager(r.Base)
+		state, status, err := jobManager.RunPhase(ctx, cr, r.Scheme, components, bundles.JobPhasePreDelete)
+		if err != nil {
+			return false, err
+		}
+		switch state {
+		case v1alpha1.JobStateRunning:
+			log.Info("Pre-delete job not completed", "job", status.JobName)
+			return false, nil
+		case v1alpha1.JobStateFailed:
+			// the instance is deleted anyway, the failure is only reported
+			r.Recorder.Eventf(cr, "Warning", "JobFailed", "Pre-delete job %s failed: %s, logs: %s", status.JobName, status.Message, status.LogsHint)
+		}
+	}
+
+	helmManager := NewHelmManager(r.Base, r.Condition, r.Inventory)
+	if err := helmManager.UninstallReleases(ctx, cr); err != nil {
+		log.Info("error uninstall helm releases", "error", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// resolveBundleRef reads the bundle referenced by the instance and sets its
+// repository on the bundle service, the spec is left untouched. The instance
+// waits until its update policy selects a digest.
+func (r *ReconcileInstanceManager) resolveBundleRef(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	bundleService *services.BundleService) (bool, ctrl.Result, error) {
+	if cr.Spec.BundleRef == "" {
+		return true, ctrl.Result{}, nil
+	}
+	bundle := &v1alpha1.EntandoBundleV2{}
+	if err := r.Base.Client.Get(ctx, types.NamespacedName{Name: cr.Spec.BundleRef, Namespace: cr.GetNamespace()}, bundle); err != nil {
+		r.Base.Log.Info("error reading the referenced bundle", "bundle", cr.Spec.BundleRef, "error", err)
+		r.Condition.SetConditionInstanceNotReady(ctx, cr, fmt.Sprintf("Bundle %s not available: %s", cr.Spec.BundleRef, err))
+		return false, ctrl.Result{}, err
+	}
+	bundleService.Repository = bundle.Spec.Repository
+	if cr.Spec.Digest == "" {
+		r.Condition.SetConditionInstanceNotReady(ctx, cr,
+			fmt.Sprintf("Waiting for the update policy of bundle %s to select a digest", cr.Spec.BundleRef))
+		return false, ctrl.Result{}, nil
+	}
+	return true, ctrl.Result{}, nil
+}
+
+// setupRegistryAuth resolves the image pull secrets of the instance and sets
+// the keychain used to pull the bundle
+func (r *ReconcileInstanceManager) setupRegistryAuth(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	bundleService *services.BundleService) error {
+	registryAuth := services.NewRegistryAuthService(r.Base)
+	refs, err := registryAuth.PullSecretReferences(ctx, cr)
+	if err != nil {
+		return err
+	}
+	keychain, err := registryAuth.Keychain(ctx, cr.GetNamespace(), refs)
+	if err != nil {
+		return err
+	}
+	bundleService.Keychain = keychain
+	r.pullSecrets = refs
+	return nil
+}
+
+// setupRegistryMirrors sets the mirror rules used to pull the bundle and the
+// images of the plugins
+func (r *ReconcileInstanceManager) setupRegistryMirrors(ctx context.Context, bundleService *services.BundleService) error {
+	mirrors, err := services.NewRegistryMirrorService(r.Base).Config(ctx)
+	if err != nil {
+		return err
+	}
+	bundleService.Mirrors = mirrors
+	return nil
+}
+
+// verifySignature verifies the digest of the instance under the signature
+// policy of its bundle, once by generation. With the enforce policy a digest
+// not verified is not installed.
+func (r *ReconcileInstanceManager) verifySignature(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	bundleService *services.BundleService) (bool, ctrl.Result, error) {
+	log := r.Base.Log
+	if r.Condition.IsSignatureVerified(ctx, cr) {
+		return true, ctrl.Result{}, nil
+	}
+
+	result, err := services.NewSignaturePolicyService(r.Base).VerifyInstance(ctx, cr, bundleService)
+	var keyErr *services.SignatureKeyError
+	if err != nil && !errors.As(err, &keyErr) {
+		// the bundles or the signatures can't be read, the policy of the
+		// bundle is unknown and nothing is installed until they can
+		log.Info("signature verification failed", "digest", cr.Spec.Digest, "error", err.Error())
+		r.Condition.SetConditionSignatureNotVerified(ctx, cr, services.CONDITION_SIGNATURE_VERIFICATION_ERROR_REASON, err.Error())
+		r.Condition.SetConditionInstanceNotReady(ctx, cr, "Signature not verified: "+err.Error())
+		return false, ctrl.Result{}, err
+	}
+	if result.Policy == v1alpha1.SignaturePolicyOff {
+		r.Condition.RemoveConditionSignatureVerified(ctx, cr)
+		return true, ctrl.Result{}, nil
+	}
+	reason := services.CONDITION_SIGNATURE_NOT_VERIFIED_REASON
+	message := result.Message
+	if err != nil {
+		reason = keyErr.Reason
+		message = err.Error()
+	} else if result.Verified {
+		r.Condition.SetConditionSignatureVerified(ctx, cr)
+		return true, ctrl.Result{}, nil
+	}
+
+	log.Info("signature not verified", "digest", cr.Spec.Digest, "policy", result.Policy, "reason", reason, "message", message)
+	r.Recorder.Eventf(cr, "Warning", reason, "Signature of %s not verified: %s", bundleService.BundleImage(cr), message)
+	r.Condition.SetConditionSignatureNotVerified(ctx, cr, reason, message)
+	if result.Policy != v1alpha1.SignaturePolicyEnforce {
+		return true, ctrl.Result{}, nil
+	}
+	r.Condition.SetConditionInstanceNotReady(ctx, cr, "Signature not verified: "+message)
+	if err != nil {
+		return false, ctrl.Result{}, err
+	}
+	// the keys or the signatures may be fixed without changing the instance
+	return false, ctrl.Result{RequeueAfter: signatureRetryInterval}, nil
+}
+
+func (r *ReconcileInstanceManager) manageJobs(ctx context.Context,
+	cr *v1alpha1.EntandoBundleInstanceV2,
+	components []bundles.Component,
+	phase bundles.JobPhase) (bool, ctrl.Result, error) {
+	log := r.Base.Log
+	jobManager := NewJobManager(r.Base)
+
+	state, status, err := jobManager.RunPhase(ctx, cr, r.Scheme, components, phase)
+	if err != nil {
+		log.Info("error RunPhase reschedule reconcile", "phase", phase, "error", err)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return false, ctrl.Result{}, err
+	}
+
+	switch state {
+	case v1alpha1.JobStateRunning:
+		log.Info("Job not completed reschedule operator", "job", status.JobName, "seconds", 10)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return false, ctrl.Result{Requeue: true, RequeueAfter: 10 * time.Second}, nil
+	case v1alpha1.JobStateFailed:
+		// the rollout is blocked until the instance points to another digest
+		log.Info("Job failed", "job", status.JobName, "phase", phase)
+		r.Recorder.Eventf(cr, "Warning", "JobFailed", "Job %s of phase %s failed: %s, logs: %s", status.JobName, phase, status.Message, status.LogsHint)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return false, ctrl.Result{}, nil
+	}
+	return true, ctrl.Result{}, nil
+}
+
+// manageComponents applies the components following their dependsOn, the
+// components with satisfied dependencies are applied in parallel, and records
+// the state of each component in the status
+func (r *ReconcileInstanceManager) manageComponents(ctx context.Context, req ctrl.Request,
+	cr *v1alpha1.EntandoBundleInstanceV2,
+	components []bundles.Component, bundle fs.FS) (bool, ctrl.Result, error) {
+
+	graph := bundles.NewComponentGraph(components)
+	statuses, doNext, res, err := applyComponentGraph(graph, func(component *bundles.Component) (bool, ctrl.Result, error) {
+		return r.manageComponent(ctx, req, cr, component, bundle)
+	})
+	r.setPluginImageStatuses(cr, statuses)
+
+	if !equality.Semantic.DeepEqual(cr.Status.Components, statuses) {
+		cr.Status.Components = statuses
+		if updateErr := r.Base.Client.Status().Update(ctx, cr); updateErr != nil && err == nil {
+			return false, ctrl.Result{}, updateErr
 		}
 	}
+	return doNext, res, err
+}
+
+func (r *ReconcileInstanceManager) manageComponent(ctx context.Context, req ctrl.Request,
+	cr *v1alpha1.EntandoBundleInstanceV2,
+	component *bundles.Component, bundle fs.FS) (bool, ctrl.Result, error) {
+	log := r.Base.Log
+	log.Info("== component ==", "component", component)
 
+	if isPlugin, plugin := component.GetIfIsPlugin(); isPlugin {
+		return r.managePlugin(ctx, req, cr, component.Name, plugin)
+	}
+	if isManifest, manifest := component.GetIfIsManifest(); isManifest {
+		return r.manageManifest(ctx, req, cr, manifest, bundle)
+	}
+	if isHelm, _ := component.GetIfIsHelm(); isHelm {
+		return r.manageHelm(ctx, req, cr, component, bundle)
+	}
+	if isKustomize, _ := component.GetIfIsKustomize(); isKustomize {
+		return r.manageKustomize(ctx, req, cr, component, bundle)
+	}
 	return true, ctrl.Result{}, nil
 }
 
 func (r *ReconcileInstanceManager) managePlugin(ctx context.Context, req ctrl.Request,
 	cr *v1alpha1.EntandoBundleInstanceV2,
-	plugin *bundles.Plugin) (bool, ctrl.Result, error) {
+	name string, plugin *bundles.Plugin) (bool, ctrl.Result, error) {
 	log := r.Base.Log
 
 	pluginManager := NewPluginManager(r.Base, r.Condition)
 
-	// plugin done
+	// the image is verified at every reconcile, its signatures again when its
+	// digest or the policy changed
+	image, err := r.bundleService.ResolveImage(plugin.ImageRef())
+	if err != nil {
+		log.Info("error resolve plugin image reschedule reconcile", "error", err)
+		r.Recorder.Eventf(cr, "Warning", "MirrorsUnavailable", "No registry serves the plugin image %s: %s", plugin.ImageRef(), err)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return false, ctrl.Result{}, err
+	}
+	previous := previousPluginImage(cr, name)
+	result, err := r.verifyPluginImage(ctx, cr, name, plugin, image, previous)
+	if err != nil {
+		log.Info("plugin image not verified reschedule reconcile", "error", err)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return false, ctrl.Result{}, err
+	}
+
+	// plugin done, applied again when the tag of its image moved
 	applied := pluginManager.IsPluginApplied(ctx, cr, plugin)
+	moved := previous != nil && previous.Digest != "" && result.Status != nil && previous.Digest != result.Status.Digest
 
-	if !applied {
-		if err := pluginManager.ApplyPlugin(ctx, cr, plugin, r.Scheme); err != nil {
+	if !applied || moved {
+		if err := pluginManager.ApplyPlugin(ctx, cr, plugin, result.Image, r.pullSecrets, r.Scheme); err != nil {
 			log.Info("error ApplyPlugin reschedule reconcile", "error", err)
 			r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
 			return false, ctrl.Result{}, err
@@ -111,31 +484,92 @@ func (r *ReconcileInstanceManager) managePlugin(ctx context.Context, req ctrl.Re
 	}
 	r.Recorder.Eventf(cr, "Normal", "Updated", fmt.Sprintf("Updated plugin cr %s/%s", req.Namespace, req.Name))
 
-	// plugin ready
-	var err error
-	ready := pluginManager.IsPluginReady(ctx, cr)
-
+	// plugin ready, checked at every reconcile to report plugins that turn unhealthy
+	ready, message, err := pluginManager.CheckPluginCr(ctx, cr, plugin)
+	if err != nil {
+		log.Info("error CheckPluginCr reschedule reconcile", "error", err)
+		r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+		return false, ctrl.Result{}, err
+	}
 	if !ready {
-		if ready, err = pluginManager.CheckPluginCr(ctx, cr); err != nil {
-			log.Info("error CheckPluginCr reschedule reconcile", "error", err)
-			r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
-			return false, ctrl.Result{}, err
+		log.Info("Plugin cr not ready reschedule operator", "seconds", 10, "reason", message)
+		r.Recorder.Eventf(cr, "Warning", "NotReady", fmt.Sprintf("Plugin cr not ready %s/%s: %s", req.Namespace, req.Name, message))
+		return false, ctrl.Result{Requeue: true, RequeueAfter: 10 * time.Second}, nil
+	}
+
+	return true, ctrl.Result{}, nil
+}
+
+// verifyPluginImage verifies the image of the plugin under the plugin image
+// policy of the bundle before its plugin cr is applied, a rejected image is
+// an error. previous is the verification of the previous reconcile, nil when
+// none.
+func (r *ReconcileInstanceManager) verifyPluginImage(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	name string, plugin *bundles.Plugin, image string, previous *v1alpha1.ImageStatus) (services.PluginImageResult, error) {
+	result, err := services.NewSignaturePolicyService(r.Base).VerifyPluginImage(ctx, cr, plugin, name, image, previous, r.bundleService)
+	if err != nil {
+		reason := services.CONDITION_SIGNATURE_VERIFICATION_ERROR_REASON
+		var keyErr *services.SignatureKeyError
+		if errors.As(err, &keyErr) {
+			reason = keyErr.Reason
 		}
-		if !ready {
-			log.Info("Plugin cr not ready reschedule operator", "seconds", 10)
-			r.Recorder.Eventf(cr, "Warning", "NotReady", fmt.Sprintf("Plugin cr not ready %s/%s", req.Namespace, req.Name))
-			r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
-			return false, ctrl.Result{Requeue: true, RequeueAfter: 10 * time.Second}, nil
+		r.Recorder.Eventf(cr, "Warning", reason, "Verification of the plugin image %s failed: %s", plugin.ImageRef(), err)
+		return result, err
+	}
+	if result.Status == nil {
+		return result, nil
+	}
+	r.pluginImagesMu.Lock()
+	if r.pluginImages == nil {
+		r.pluginImages = map[string]*v1alpha1.ImageStatus{}
+	}
+	r.pluginImages[name] = result.Status
+	r.pluginImagesMu.Unlock()
+
+	if result.Rejected {
+		r.Recorder.Eventf(cr, "Warning", "PluginImageRejected", "Plugin image %s rejected: %s", plugin.ImageRef(), result.Status.Message)
+		return result, fmt.Errorf("plugin image %s rejected: %s", plugin.ImageRef(), result.Status.Message)
+	}
+	if !result.Status.Verified && result.Status.Message != "" && !equality.Semantic.DeepEqual(previous, result.Status) {
+		r.Recorder.Eventf(cr, "Warning", "PluginImageNotVerified", "Plugin image %s not verified: %s", plugin.ImageRef(), result.Status.Message)
+	}
+	return result, nil
+}
+
+// previousPluginImage returns the verification of the image of the plugin
+// in the status of the instance, nil when none
+func previousPluginImage(cr *v1alpha1.EntandoBundleInstanceV2, name string) *v1alpha1.ImageStatus {
+	for _, previous := range cr.Status.Components {
+		if previous.Name == name && previous.Type == string(bundles.PluginComponentType) {
+			return previous.Image
 		}
 	}
+	return nil
+}
 
-	return true, ctrl.Result{}, nil
+// setPluginImageStatuses reports the verifications of the plugin images in
+// the statuses of the components, the plugins applied by a previous reconcile
+// keep their verification
+func (r *ReconcileInstanceManager) setPluginImageStatuses(cr *v1alpha1.EntandoBundleInstanceV2, statuses []v1alpha1.ComponentStatus) {
+	r.pluginImagesMu.Lock()
+	defer r.pluginImagesMu.Unlock()
+	for i := range statuses {
+		if image, ok := r.pluginImages[statuses[i].Name]; ok {
+			statuses[i].Image = image
+			continue
+		}
+		for _, previous := range cr.Status.Components {
+			if previous.Name == statuses[i].Name && previous.Type == statuses[i].Type {
+				statuses[i].Image = previous.Image
+			}
+		}
+	}
 }
 
 func (r *ReconcileInstanceManager) manageManifest(ctx context.Context, req ctrl.Request,
 	cr *v1alpha1.EntandoBundleInstanceV2,
 	manifest *bundles.Manifest,
-	dir string) (bool, ctrl.Result, error) {
+	bundle fs.FS) (bool, ctrl.Result, error) {
 	log := r.Base.Log
 	log.Info("======== manage manifest ========", "manifest", manifest)
 	manifestManager := NewManifestManager(r.Base, r.Condition)
@@ -144,7 +578,7 @@ func (r *ReconcileInstanceManager) manageManifest(ctx context.Context, req ctrl.
 	applied := manifestManager.IsManifestApplied(ctx, cr, manifest.FilePath)
 
 	if !applied {
-		if err := manifestManager.ApplyManifest(ctx, cr, r.Scheme, dir, manifest.FilePath); err != nil {
+		if err := manifestManager.ApplyManifest(ctx, cr, r.Scheme, bundle, manifest.FilePath); err != nil {
 			log.Info("error ApplyManifest reschedule reconcile", "error", err)
 			r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
 			return false, ctrl.Result{}, err
@@ -154,3 +588,48 @@ func (r *ReconcileInstanceManager) manageManifest(ctx context.Context, req ctrl.
 	return true, ctrl.Result{}, nil
 
 }
+
+func (r *ReconcileInstanceManager) manageHelm(ctx context.Context, req ctrl.Request,
+	cr *v1alpha1.EntandoBundleInstanceV2,
+	component *bundles.Component,
+	bundle fs.FS) (bool, ctrl.Result, error) {
+	log := r.Base.Log
+	log.Info("======== manage helm ========", "release", component.GetReleaseName())
+	helmManager := NewHelmManager(r.Base, r.Condition, r.Inventory)
+
+	applied := helmManager.IsReleaseApplied(ctx, cr, component)
+
+	if !applied {
+		if err := helmManager.ApplyRelease(ctx, cr, r.Scheme, bundle, component); err != nil {
+			log.Info("error ApplyRelease reschedule reconcile", "error", err)
+			r.Recorder.Eventf(cr, "Warning", "HelmReleaseFailed", "Failed to apply helm release %s: %s", component.GetReleaseName(), err)
+			r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+			return false, ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(cr, "Normal", "HelmReleaseApplied", "Applied helm release %s", component.GetReleaseName())
+	}
+
+	return true, ctrl.Result{}, nil
+}
+
+func (r *ReconcileInstanceManager) manageKustomize(ctx context.Context, req ctrl.Request,
+	cr *v1alpha1.EntandoBundleInstanceV2,
+	component *bundles.Component,
+	bundle fs.FS) (bool, ctrl.Result, error) {
+	log := r.Base.Log
+	log.Info("======== manage kustomize ========", "component", component.Name)
+	kustomizeManager := NewKustomizeManager(r.Base, r.Condition)
+
+	applied := kustomizeManager.IsKustomizationApplied(ctx, cr, component)
+
+	if !applied {
+		if err := kustomizeManager.ApplyKustomization(ctx, cr, bundle, component); err != nil {
+			log.Info("error ApplyKustomization reschedule reconcile", "error", err)
+			r.Recorder.Eventf(cr, "Warning", "KustomizationFailed", "Failed to apply kustomization %s: %s", component.Name, err)
+			r.Condition.SetConditionInstanceReadyFalse(ctx, cr)
+			return false, ctrl.Result{}, err
+		}
+	}
+
+	return true, ctrl.Result{}, nil
+}
@@ -0,0 +1,95 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
+	"github.com/go-logr/logr"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// failingListClient fails to list the bundles
+type failingListClient struct {
+	client.Client
+}
+
+func (c *failingListClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*v1alpha1.EntandoBundleV2List); ok {
+		return errors.New("connection refused")
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestVerifySignatureError(t *testing.T) {
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	cr := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "entando"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Repository: "docker.io/entando/bundle", Digest: "sha256:" + strings.Repeat("0", 64)},
+	}
+	k8sClient := &failingListClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(cr).Build()}
+	manager := NewReconcileInstanceManager(k8sClient, logr.Discard(), scheme, record.NewFakeRecorder(10), nil)
+
+	// the operator policy is off, but the one of the bundle can't be read
+	defer func(policy v1alpha1.SignaturePolicy) { services.DefaultSignaturePolicy = policy }(services.DefaultSignaturePolicy)
+	services.DefaultSignaturePolicy = v1alpha1.SignaturePolicyOff
+	verified, _, err := manager.verifySignature(context.TODO(), cr, &services.BundleService{})
+	if verified || err == nil {
+		t.Fatalf("Expected the install blocked by the error, got %t %v", verified, err)
+	}
+	if manager.Condition.IsSignatureVerified(context.TODO(), cr) {
+		t.Fatal("Expected the signature not verified")
+	}
+}
+
+func TestResolveBundleRef(t *testing.T) {
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	digest := "sha256:" + strings.Repeat("0", 64)
+	bundle := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "entando"},
+		Spec:       v1alpha1.EntandoBundleV2Spec{Repository: "docker.io/entando/bundle"},
+	}
+	cr := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "entando"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{BundleRef: "bundle-1234", Digest: digest},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(bundle, cr).Build()
+	manager := NewReconcileInstanceManager(k8sClient, logr.Discard(), scheme, record.NewFakeRecorder(10), nil)
+
+	bundleService := &services.BundleService{}
+	resolved, _, err := manager.resolveBundleRef(context.TODO(), cr, bundleService)
+	if !resolved || err != nil {
+		t.Fatalf("Expected the bundleRef resolved, got %t %v", resolved, err)
+	}
+	if cr.Spec.Repository != "" {
+		t.Fatalf("Expected the spec untouched, got the repository %s", cr.Spec.Repository)
+	}
+	if image := bundleService.BundleImage(cr); image != "docker.io/entando/bundle@"+digest {
+		t.Fatalf("Expected the image of the referenced bundle, got %s", image)
+	}
+
+	// a missing bundle is an error
+	cr.Spec.BundleRef = "bundle-5678"
+	if resolved, _, err := manager.resolveBundleRef(context.TODO(), cr, &services.BundleService{}); resolved || err == nil {
+		t.Fatalf("Expected the missing bundle reported, got %t %v", resolved, err)
+	}
+}
@@ -2,7 +2,6 @@ package instance
 
 import (
 	"context"
-	"io/ioutil"
 
 	"path/filepath"
 
@@ -11,6 +10,7 @@ import (
 	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/applyer"
 
 	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/go-logr/logr"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
@@ -31,15 +31,26 @@ func NewManifest(base *common.BaseK8sStructure) *Manifest {
 
 func (d *Manifest) ApplyManifest(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
 	scheme *runtime.Scheme,
-	manifestPath string) error {
+	yfile []byte) error {
 	log := d.Base.Log
-	// read yaml
-	yfile, err := ioutil.ReadFile(manifestPath)
+	dynamicClient, discoveryClient, err := newClients(log)
 	if err != nil {
 		return err
 	}
-	var config *rest.Config
-	config, err = rest.InClusterConfig()
+	// apply yaml
+	ns, _ := utility.GetWatchNamespace()
+	applyOptions := applyer.NewApplyOptions(dynamicClient, discoveryClient)
+	if err := applyOptions.Apply(context.TODO(), ns, []byte(yfile)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newClients creates the clients used to apply objects, using the in cluster
+// config or the local kube config when running outside of a cluster
+func newClients(log logr.Logger) (dynamic.Interface, discovery.DiscoveryInterface, error) {
+	config, err := rest.InClusterConfig()
 	if err != nil {
 		if err == rest.ErrNotInCluster {
 			var kubeconfig string
@@ -50,7 +61,7 @@ func (d *Manifest) ApplyManifest(ctx context.Context, cr *v1alpha1.EntandoBundle
 			var internalError error
 			config, internalError = clientcmd.BuildConfigFromFlags("", kubeconfig)
 			if internalError != nil {
-				return err
+				return nil, nil, err
 			}
 			log.Info("Use kube config")
 		}
@@ -60,19 +71,12 @@ func (d *Manifest) ApplyManifest(ctx context.Context, cr *v1alpha1.EntandoBundle
 
 	dynamicClient, err := dynamic.NewForConfig(config)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		return nil, nil, err
 	}
-	// apply yaml
-	ns, _ := utility.GetWatchNamespace()
-	applyOptions := applyer.NewApplyOptions(dynamicClient, discoveryClient)
-	if err := applyOptions.Apply(context.TODO(), ns, []byte(yfile)); err != nil {
-		return err
-	}
-
-	return nil
+	return dynamicClient, discoveryClient, nil
 }
@@ -2,9 +2,11 @@ package instance
 
 import (
 	"context"
+	"io/fs"
 
 	utility "github.com/gigiozzz/depiy/common-libs/utilities"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
 
 	common "github.com/gigiozzz/depiy/common-libs/commons"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
@@ -31,15 +33,17 @@ func (d *ManifestManager) IsManifestApplied(ctx context.Context, cr *v1alpha1.En
 
 func (d *ManifestManager) ApplyManifest(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
 	scheme *runtime.Scheme,
-	dir string,
+	bundle fs.FS,
 	manifestPath string) error {
 
-	manifestService := NewManifest(d.Base)
-
-	err := manifestService.ApplyManifest(ctx, cr, scheme, dir+manifestPath)
+	data, err := fs.ReadFile(bundle, bundles.FilePath(manifestPath))
 	if err != nil {
 		return err
 	}
+	manifestService := NewManifest(d.Base)
+	if err := manifestService.ApplyManifest(ctx, cr, scheme, data); err != nil {
+		return err
+	}
 	manifestId := genManifestId(cr, manifestPath)
 
 	return d.Conditions.SetConditionManifestApplied(ctx, cr, manifestId, manifestPath)
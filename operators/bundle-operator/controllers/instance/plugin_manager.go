@@ -2,8 +2,8 @@ package instance
 
 import (
 	"context"
+	"fmt"
 	"strings"
-	"time"
 
 	common "github.com/gigiozzz/depiy/common-libs/commons"
 	utility "github.com/gigiozzz/depiy/common-libs/utilities"
@@ -13,13 +13,23 @@ import (
 
 	pluginapi "github.com/gigiozzz/depiy/operators/plugin-operator/api/v1alpha1"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
+// pluginReadyCondition is the condition set by the plugin operator on the
+// plugin cr when all its resources are ready
+const pluginReadyCondition = "Ready"
+
+// pluginSourceImageAnnotation records the image of the descriptor on the
+// plugin cr when it is pulled from a mirror
+const pluginSourceImageAnnotation = "bundle.entando.org/source-image"
+
 type PluginManager struct {
 	Base       *common.BaseK8sStructure
 	Conditions *services.ConditionService
@@ -38,15 +48,12 @@ func (d *PluginManager) IsPluginApplied(ctx context.Context, cr *v1alpha1.Entand
 	return d.Conditions.IsPluginCrApplied(ctx, cr, d.GenPluginCode(cr, plugin))
 }
 
-func (d *PluginManager) IsPluginReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) bool {
-
-	return d.Conditions.IsPluginCrReady(ctx, cr)
-}
-
+// ApplyPlugin creates or updates the plugin cr, image is the image of the
+// plugin after the mirror rules
 func (d *PluginManager) ApplyPlugin(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, plugin *bundles.Plugin,
-	scheme *runtime.Scheme) error {
+	image string, pullSecrets []corev1.LocalObjectReference, scheme *runtime.Scheme) error {
 	log := d.Base.Log
-	basePluginCr := d.buildPluginCr(cr, plugin, scheme)
+	basePluginCr := d.buildPluginCr(cr, plugin, image, pullSecrets, scheme)
 	log.Info("generated plugin", "pluginCR", basePluginCr)
 	pluginCr := &pluginapi.EntandoPluginV2{}
 
@@ -58,6 +65,16 @@ func (d *PluginManager) ApplyPlugin(ctx context.Context, cr *v1alpha1.EntandoBun
 	var applyError error
 	if isUpgrade {
 		pluginCr.Spec = basePluginCr.Spec
+		annotations := pluginCr.GetAnnotations()
+		if source, ok := basePluginCr.GetAnnotations()[pluginSourceImageAnnotation]; ok {
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			annotations[pluginSourceImageAnnotation] = source
+		} else {
+			delete(annotations, pluginSourceImageAnnotation)
+		}
+		pluginCr.SetAnnotations(annotations)
 		log.Info("Update plugin cr", "pluginCR", pluginCr)
 		applyError = d.Base.Client.Update(ctx, pluginCr)
 
@@ -73,16 +90,42 @@ func (d *PluginManager) ApplyPlugin(ctx context.Context, cr *v1alpha1.EntandoBun
 	return d.Conditions.SetConditionPluginCrApplied(ctx, cr, d.GenPluginCode(cr, plugin))
 }
 
-func (d *PluginManager) CheckPluginCr(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) (bool, error) {
-	time.Sleep(time.Second * 10)
-	ready := true
-	// check condition "Available" is "True"
-	if ready {
-		return ready, d.Conditions.SetConditionPluginCrReady(ctx, cr)
+// CheckPluginCr reads the readiness of the plugin from its cr and records it
+// in the per plugin condition of the instance, it returns the reason when the
+// plugin is not ready
+func (d *PluginManager) CheckPluginCr(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	plugin *bundles.Plugin) (bool, string, error) {
+	pluginCode := d.GenPluginCode(cr, plugin)
+	pluginCr := &pluginapi.EntandoPluginV2{}
+	if err := d.Base.Client.Get(ctx, types.NamespacedName{Name: pluginCode, Namespace: cr.GetNamespace()}, pluginCr); err != nil {
+		return false, "", err
 	}
 
-	return ready, nil
+	ready, message := pluginCrReady(pluginCr)
+	if !ready {
+		return false, message, d.Conditions.SetConditionPluginCrNotReady(ctx, cr, pluginCode, message)
+	}
+	if d.Conditions.IsPluginCrReady(ctx, cr, pluginCode) {
+		return true, "", nil
+	}
+	return true, "", d.Conditions.SetConditionPluginCrReady(ctx, cr, pluginCode)
+}
 
+// pluginCrReady reports whether the plugin operator reconciled the current
+// spec of the plugin cr and reported it ready, with the reason when not
+func pluginCrReady(pluginCr *pluginapi.EntandoPluginV2) (bool, string) {
+	condition := meta.FindStatusCondition(pluginCr.Status.Conditions, pluginReadyCondition)
+	if condition == nil {
+		return false, "plugin not reconciled yet"
+	}
+	if condition.ObservedGeneration < pluginCr.Generation {
+		return false, fmt.Sprintf("plugin generation %d not reconciled yet, last reconciled %d",
+			pluginCr.Generation, condition.ObservedGeneration)
+	}
+	if condition.Status != metav1.ConditionTrue {
+		return false, fmt.Sprintf("plugin not ready: %s %s", condition.Reason, condition.Message)
+	}
+	return true, ""
 }
 
 func (d *PluginManager) isCrUpgrade(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
@@ -111,24 +154,85 @@ func (d *PluginManager) GenPluginCode(cr *v1alpha1.EntandoBundleInstanceV2, plug
 	return pluginCode
 }
 
-func (d *PluginManager) buildPluginCr(cr *v1alpha1.EntandoBundleInstanceV2, plugin *bundles.Plugin, scheme *runtime.Scheme) *pluginapi.EntandoPluginV2 {
+func (d *PluginManager) buildPluginCr(cr *v1alpha1.EntandoBundleInstanceV2, plugin *bundles.Plugin,
+	image string, pullSecrets []corev1.LocalObjectReference, scheme *runtime.Scheme) *pluginapi.EntandoPluginV2 {
 	pluginCode := d.GenPluginCode(cr, plugin)
 	pluginCr := &pluginapi.EntandoPluginV2{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      pluginCode,
 			Namespace: cr.GetNamespace(),
 		},
-		Spec: pluginapi.EntandoPluginV2Spec{
-			Replicas:        1,
-			Image:           plugin.Repository + "@" + plugin.Digest,
-			HealthCheckPath: plugin.HealthCheckPath,
-			Port:            int32(plugin.Port),
-			IngressName:     plugin.IngressName,
-			IngressHost:     plugin.IngressHost,
-			IngressPath:     plugin.IngressPath,
-		},
+		Spec: pluginSpec(plugin),
+	}
+	pluginCr.Spec.Image = image
+	if image != plugin.ImageRef() {
+		pluginCr.SetAnnotations(map[string]string{pluginSourceImageAnnotation: plugin.ImageRef()})
 	}
+	pluginCr.Spec.ImagePullSecrets = pullSecrets
 	// set owner
 	ctrl.SetControllerReference(cr, pluginCr, scheme)
 	return pluginCr
 }
+
+// pluginSpec maps the plugin of the descriptor to the spec of the plugin cr
+func pluginSpec(plugin *bundles.Plugin) pluginapi.EntandoPluginV2Spec {
+	replicas := plugin.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+	spec := pluginapi.EntandoPluginV2Spec{
+		Replicas:             replicas,
+		Image:                plugin.ImageRef(),
+		HealthCheckPath:      plugin.HealthCheckPath,
+		Port:                 int32(plugin.Port),
+		IngressName:          plugin.IngressName,
+		IngressHost:          plugin.IngressHost,
+		IngressPath:          plugin.IngressPath,
+		Database:             plugin.Database,
+		EnvironmentVariables: toEnvVars(plugin.Env),
+	}
+	for _, secret := range plugin.Secrets {
+		spec.Secrets = append(spec.Secrets, pluginapi.EntandoPluginV2Secret{
+			SecretType: pluginapi.SecretType(secret.Type),
+			Name:       secret.Name,
+			Prefix:     secret.Prefix,
+			MountPath:  secret.MountPath,
+		})
+	}
+	for _, volume := range plugin.Volumes {
+		spec.Volumes = append(spec.Volumes, pluginapi.EntandoPluginV2Volume{
+			StorageClass: volume.StorageClass,
+			Size:         volume.Size,
+			MountPath:    volume.MountPath,
+		})
+	}
+	return spec
+}
+
+// toEnvVars maps the env vars of the descriptor to the ones of a container
+func toEnvVars(env []bundles.EnvVar) []corev1.EnvVar {
+	if len(env) == 0 {
+		return nil
+	}
+	envVars := make([]corev1.EnvVar, 0, len(env))
+	for _, envVar := range env {
+		k8sEnvVar := corev1.EnvVar{Name: envVar.Name, Value: envVar.Value}
+		if envVar.ValueFrom != nil {
+			k8sEnvVar.ValueFrom = &corev1.EnvVarSource{}
+			if ref := envVar.ValueFrom.SecretKeyRef; ref != nil {
+				k8sEnvVar.ValueFrom.SecretKeyRef = &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: ref.Name},
+					Key:                  ref.Key,
+				}
+			}
+			if ref := envVar.ValueFrom.ConfigMapKeyRef; ref != nil {
+				k8sEnvVar.ValueFrom.ConfigMapKeyRef = &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: ref.Name},
+					Key:                  ref.Key,
+				}
+			}
+		}
+		envVars = append(envVars, k8sEnvVar)
+	}
+	return envVars
+}
@@ -0,0 +1,270 @@
+package instance
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
+	pluginapi "github.com/gigiozzz/depiy/operators/plugin-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func readyCondition(status metav1.ConditionStatus, observedGeneration int64) []metav1.Condition {
+	return []metav1.Condition{{
+		Type: pluginReadyCondition, Status: status, Reason: "DeployIsNotReady", Message: "deployment unavailable",
+		ObservedGeneration: observedGeneration,
+	}}
+}
+
+func TestPluginCrReady(t *testing.T) {
+	tests := []struct {
+		name       string
+		generation int64
+		conditions []metav1.Condition
+		ready      bool
+		message    string
+	}{
+		{name: "not reconciled", generation: 1, message: "not reconciled yet"},
+		{name: "ready", generation: 2, conditions: readyCondition(metav1.ConditionTrue, 2), ready: true},
+		{name: "old generation", generation: 3, conditions: readyCondition(metav1.ConditionTrue, 2), message: "generation 3 not reconciled yet"},
+		{name: "not ready", generation: 2, conditions: readyCondition(metav1.ConditionFalse, 2), message: "DeployIsNotReady deployment unavailable"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pluginCr := &pluginapi.EntandoPluginV2{
+				ObjectMeta: metav1.ObjectMeta{Generation: test.generation},
+				Status:     pluginapi.EntandoPluginV2Status{Conditions: test.conditions},
+			}
+			ready, message := pluginCrReady(pluginCr)
+			if ready != test.ready || !strings.Contains(message, test.message) {
+				t.Fatalf("Expected %v %q, got %v %q", test.ready, test.message, ready, message)
+			}
+		})
+	}
+}
+
+func TestCheckPluginCr(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme, pluginapi.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	cr := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "entando", UID: "uid"},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cr).Build()
+	base := &common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()}
+	pluginManager := NewPluginManager(base, services.NewConditionService(base))
+
+	web := &bundles.Plugin{Repository: "nginx", Digest: "sha256:0123"}
+	api := &bundles.Plugin{Repository: "api", Digest: "sha256:4567"}
+	for _, plugin := range []*bundles.Plugin{web, api} {
+		if err := pluginManager.ApplyPlugin(ctx, cr, plugin, plugin.ImageRef(), nil, scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// the readiness of a plugin doesn't make the other ones ready
+	setPluginConditions(t, k8sClient, pluginManager.GenPluginCode(cr, web), readyCondition(metav1.ConditionTrue, 0))
+	ready, _, err := pluginManager.CheckPluginCr(ctx, cr, web)
+	if err != nil || !ready {
+		t.Fatalf("Expected web plugin ready, got %v %v", ready, err)
+	}
+	ready, message, err := pluginManager.CheckPluginCr(ctx, cr, api)
+	if err != nil || ready || message == "" {
+		t.Fatalf("Expected api plugin not ready with a reason, got %v %q %v", ready, message, err)
+	}
+	conditions := pluginManager.Conditions
+	if !conditions.IsPluginCrReady(ctx, cr, pluginManager.GenPluginCode(cr, web)) || conditions.IsPluginCrReady(ctx, cr, pluginManager.GenPluginCode(cr, api)) {
+		t.Fatal("Expected readiness recorded per plugin")
+	}
+
+	// a plugin turning unhealthy is reported
+	setPluginConditions(t, k8sClient, pluginManager.GenPluginCode(cr, web), readyCondition(metav1.ConditionFalse, 0))
+	if ready, _, _ := pluginManager.CheckPluginCr(ctx, cr, web); ready || conditions.IsPluginCrReady(ctx, cr, pluginManager.GenPluginCode(cr, web)) {
+		t.Fatal("Expected web plugin not ready")
+	}
+}
+
+func TestApplyPluginMirroredImage(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme, pluginapi.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	cr := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "entando", UID: "uid"},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cr).Build()
+	base := &common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()}
+	pluginManager := NewPluginManager(base, services.NewConditionService(base))
+
+	plugin := &bundles.Plugin{Repository: "docker.io/entando/web", Digest: "sha256:0123"}
+	mirrored := "mirror.example.com/entando/web@sha256:0123"
+	if err := pluginManager.ApplyPlugin(ctx, cr, plugin, mirrored, nil, scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	pluginCr := &pluginapi.EntandoPluginV2{}
+	key := client.ObjectKey{Name: pluginManager.GenPluginCode(cr, plugin), Namespace: "entando"}
+	if err := k8sClient.Get(ctx, key, pluginCr); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pluginCr.Spec.Image != mirrored || pluginCr.GetAnnotations()[pluginSourceImageAnnotation] != plugin.ImageRef() {
+		t.Fatalf("Expected the mirrored image with its source, got %s %v", pluginCr.Spec.Image, pluginCr.GetAnnotations())
+	}
+
+	// pulled again from the source the annotation is removed
+	if err := pluginManager.ApplyPlugin(ctx, cr, plugin, plugin.ImageRef(), nil, scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k8sClient.Get(ctx, key, pluginCr); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := pluginCr.GetAnnotations()[pluginSourceImageAnnotation]; ok || pluginCr.Spec.Image != plugin.ImageRef() {
+		t.Fatalf("Expected the source image, got %s %v", pluginCr.Spec.Image, pluginCr.GetAnnotations())
+	}
+}
+
+func TestApplyPluginAfterScaleDown(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme, pluginapi.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	cr := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "entando", UID: "uid"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Digest: "sha256:0123"},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cr).Build()
+	base := &common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()}
+	pluginManager := NewPluginManager(base, services.NewConditionService(base))
+	plugin := &bundles.Plugin{Repository: "docker.io/entando/web", Digest: "sha256:4567", Replicas: 2}
+	key := client.ObjectKey{Name: pluginManager.GenPluginCode(cr, plugin), Namespace: "entando"}
+
+	if err := pluginManager.ApplyPlugin(ctx, cr, plugin, plugin.ImageRef(), nil, scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !pluginManager.IsPluginApplied(ctx, cr, plugin) {
+		t.Fatal("Expected the plugin applied")
+	}
+
+	// the digest is no longer verified
+	if err := services.NewRevocationService(base).ScaleDownInstance(ctx, cr); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k8sClient.Get(ctx, key, &pluginapi.EntandoPluginV2{}); err == nil {
+		t.Fatal("Expected the plugin removed")
+	}
+	if pluginManager.IsPluginApplied(ctx, cr, plugin) || !services.IsScaledDown(cr) {
+		t.Fatal("Expected the plugin to be applied again by the next install")
+	}
+
+	// verified again, the next install applies the plugin again
+	if err := pluginManager.ApplyPlugin(ctx, cr, plugin, plugin.ImageRef(), nil, scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	pluginCr := &pluginapi.EntandoPluginV2{}
+	if err := k8sClient.Get(ctx, key, pluginCr); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pluginCr.Spec.Replicas != 2 {
+		t.Fatalf("Expected the replicas of the plugin restored, got %d", pluginCr.Spec.Replicas)
+	}
+}
+
+func setPluginConditions(t *testing.T, k8sClient client.Client, name string, conditions []metav1.Condition) {
+	pluginCr := &pluginapi.EntandoPluginV2{}
+	if err := k8sClient.Get(context.TODO(), client.ObjectKey{Name: name, Namespace: "entando"}, pluginCr); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := range conditions {
+		conditions[i].ObservedGeneration = pluginCr.Generation
+	}
+	pluginCr.Status.Conditions = conditions
+	if err := k8sClient.Status().Update(context.TODO(), pluginCr); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestPluginSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		plugin   bundles.Plugin
+		expected pluginapi.EntandoPluginV2Spec
+	}{
+		{
+			name:   "defaults",
+			plugin: bundles.Plugin{Repository: "docker.io/nginx", Tag: "1.23.3"},
+			expected: pluginapi.EntandoPluginV2Spec{
+				Image: "docker.io/nginx:1.23.3", Replicas: 1,
+			},
+		},
+		{
+			name: "ingress and health check",
+			plugin: bundles.Plugin{
+				Repository: "docker.io/nginx", Digest: "sha256:0123", Port: 80, Replicas: 3, HealthCheckPath: "/health",
+				IngressName: "web", IngressHost: "web.example.com", IngressPath: "/web",
+			},
+			expected: pluginapi.EntandoPluginV2Spec{
+				Image: "docker.io/nginx@sha256:0123", Port: 80, Replicas: 3, HealthCheckPath: "/health",
+				IngressName: "web", IngressHost: "web.example.com", IngressPath: "/web",
+			},
+		},
+		{
+			name: "env secrets volumes and database",
+			plugin: bundles.Plugin{
+				Repository: "api", Tag: "1.0", Database: "postgresql",
+				Env: []bundles.EnvVar{
+					{Name: "MODE", Value: "production"},
+					{Name: "DB_PASSWORD", ValueFrom: &bundles.EnvVarSource{SecretKeyRef: &bundles.KeySelector{Name: "db", Key: "password"}}},
+					{Name: "LOG_LEVEL", ValueFrom: &bundles.EnvVarSource{ConfigMapKeyRef: &bundles.KeySelector{Name: "logs", Key: "level"}}},
+				},
+				Secrets: []bundles.PluginSecret{
+					{Type: bundles.PluginSecretTypeEnv, Name: "keycloak", Prefix: "KC_"},
+					{Type: bundles.PluginSecretTypeFile, Name: "certs", MountPath: "/etc/certs"},
+				},
+				Volumes: []bundles.PluginVolume{{StorageClass: "fast", Size: "1Gi", MountPath: "/data"}},
+			},
+			expected: pluginapi.EntandoPluginV2Spec{
+				Image: "api:1.0", Replicas: 1, Database: "postgresql",
+				EnvironmentVariables: []corev1.EnvVar{
+					{Name: "MODE", Value: "production"},
+					{Name: "DB_PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "db"}, Key: "password"}}},
+					{Name: "LOG_LEVEL", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "logs"}, Key: "level"}}},
+				},
+				Secrets: []pluginapi.EntandoPluginV2Secret{
+					{SecretType: pluginapi.SecretTypeEnv, Name: "keycloak", Prefix: "KC_"},
+					{SecretType: pluginapi.SecretTypeFile, Name: "certs", MountPath: "/etc/certs"},
+				},
+				Volumes: []pluginapi.EntandoPluginV2Volume{{StorageClass: "fast", Size: "1Gi", MountPath: "/data"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if spec := pluginSpec(&test.plugin); !reflect.DeepEqual(spec, test.expected) {
+				t.Fatalf("Expected %+v, got %+v", test.expected, spec)
+			}
+		})
+	}
+}
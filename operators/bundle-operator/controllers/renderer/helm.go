@@ -0,0 +1,910 @@
+package renderer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/Masterminds/sprig/v3"
+	"github.com/gobwas/glob"
+	"github.com/pelletier/go-toml/v2"
+	yamlv3 "gopkg.in/yaml.v3"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	chartFileName   = "Chart.yaml"
+	valuesFileName  = "values.yaml"
+	templatesDir    = "templates"
+	crdsDir         = "crds"
+	chartsDir       = "charts"
+	notesFileName   = "NOTES.txt"
+	libraryChart    = "library"
+	globalValues    = "global"
+	tagsValues      = "tags"
+	exportsValues   = "exports"
+	maxIncludeDepth = 1000
+
+	// maxChartArchiveSize is the max size of the files of a packaged subchart
+	maxChartArchiveSize = 64 << 20
+
+	// printValueFunc is appended to the printing actions of the templates,
+	// so that a missing value prints as an empty string
+	printValueFunc = "__printValue"
+
+	// hookAnnotation marks the hooks of a chart, as its tests and its pre and
+	// post install jobs. The hooks aren't objects of the release and are
+	// not rendered.
+	hookAnnotation = "helm.sh/hook"
+
+	// ResourcePolicyAnnotation set to KeepPolicy keeps the object when it is
+	// removed from the release or the release is uninstalled
+	ResourcePolicyAnnotation = "helm.sh/resource-policy"
+	KeepPolicy               = "keep"
+)
+
+// documentSeparator splits the documents of a rendered template
+var documentSeparator = regexp.MustCompile(`(?:^|\s*\n)---\s*`)
+
+// ChartMetadata is the content of Chart.yaml, exposed to templates as .Chart
+type ChartMetadata struct {
+	APIVersion   string            `json:"apiVersion,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Home         string            `json:"home,omitempty"`
+	Sources      []string          `json:"sources,omitempty"`
+	Version      string            `json:"version,omitempty"`
+	AppVersion   string            `json:"appVersion,omitempty"`
+	Description  string            `json:"description,omitempty"`
+	Keywords     []string          `json:"keywords,omitempty"`
+	Maintainers  []*Maintainer     `json:"maintainers,omitempty"`
+	Icon         string            `json:"icon,omitempty"`
+	Deprecated   bool              `json:"deprecated,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	KubeVersion  string            `json:"kubeVersion,omitempty"`
+	Type         string            `json:"type,omitempty"`
+	Dependencies []*Dependency     `json:"dependencies,omitempty"`
+}
+
+// Maintainer is a maintainer of the chart declared in Chart.yaml
+type Maintainer struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// Dependency is a subchart declared in Chart.yaml, the subchart has to be
+// vendored in the charts directory of the chart
+type Dependency struct {
+	Name         string        `json:"name"`
+	Version      string        `json:"version,omitempty"`
+	Repository   string        `json:"repository,omitempty"`
+	Condition    string        `json:"condition,omitempty"`
+	Tags         []string      `json:"tags,omitempty"`
+	Alias        string        `json:"alias,omitempty"`
+	ImportValues []interface{} `json:"import-values,omitempty"`
+}
+
+// Chart is a helm chart loaded from a directory of the bundle
+type Chart struct {
+	Metadata ChartMetadata
+	Values   map[string]interface{}
+	// Templates and CRDs are indexed by their path relative to the chart
+	Templates map[string]string
+	CRDs      map[string]string
+	Files     Files
+	// Subcharts are the charts of the charts directory
+	Subcharts []*Chart
+}
+
+// LookupFunc returns the object, or the list of the objects when name is
+// empty, read from the cluster. A missing object is an empty map.
+type LookupFunc func(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error)
+
+// ReleaseOptions describes the release the chart is rendered for
+type ReleaseOptions struct {
+	Name      string
+	Namespace string
+	Revision  int
+	IsUpgrade bool
+	// KubeVersion is the git version of the cluster, as v1.26.3
+	KubeVersion string
+	// APIVersions are the group versions, and the group version kinds, served
+	// by the cluster
+	APIVersions []string
+	// Lookup reads the objects of the cluster, lookup returns empty maps when
+	// nil like with helm template
+	Lookup LookupFunc
+}
+
+// LoadChart reads the chart found in dir with the subcharts of its charts
+// directory, unpacked or archived. Every dependency declared in Chart.yaml
+// must be vendored, the repositories are never contacted.
+func LoadChart(fsys fs.FS, dir string) (*Chart, error) {
+	files := map[string][]byte{}
+	err := fs.WalkDir(fsys, dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		content, err := fs.ReadFile(fsys, filePath)
+		if err != nil {
+			return err
+		}
+		files[strings.TrimPrefix(strings.TrimPrefix(filePath, dir), "/")] = content
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	chart, err := loadChartFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	if chart.Metadata.Type == libraryChart {
+		return nil, fmt.Errorf("chart %s is a library chart and can't be installed", chart.Metadata.Name)
+	}
+	return chart, nil
+}
+
+// loadChartFiles builds the chart of the files, indexed by their path
+// relative to the chart
+func loadChartFiles(files map[string][]byte) (*Chart, error) {
+	chart := &Chart{
+		Values:    map[string]interface{}{},
+		Templates: map[string]string{},
+		CRDs:      map[string]string{},
+		Files:     Files{},
+	}
+
+	data, ok := files[chartFileName]
+	if !ok {
+		return nil, fmt.Errorf("reading %s: %w", chartFileName, fs.ErrNotExist)
+	}
+	if err := yaml.Unmarshal(data, &chart.Metadata); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", chartFileName, err)
+	}
+	if chart.Metadata.Name == "" {
+		return nil, fmt.Errorf("%s: chart name is required", chartFileName)
+	}
+
+	subchartFiles := map[string]map[string][]byte{}
+	for relPath, content := range files {
+		switch {
+		case relPath == chartFileName:
+		case relPath == valuesFileName:
+			if err := yaml.Unmarshal(content, &chart.Values); err != nil {
+				return nil, fmt.Errorf("chart %s: parsing %s: %w", chart.Metadata.Name, valuesFileName, err)
+			}
+		case strings.HasPrefix(relPath, templatesDir+"/"):
+			chart.Templates[relPath] = string(content)
+		case strings.HasPrefix(relPath, crdsDir+"/"):
+			chart.CRDs[relPath] = string(content)
+		case strings.HasPrefix(relPath, chartsDir+"/"):
+			parts := strings.SplitN(strings.TrimPrefix(relPath, chartsDir+"/"), "/", 2)
+			if len(parts) == 1 {
+				if strings.HasSuffix(parts[0], ".tgz") {
+					archived, err := readChartArchive(content)
+					if err != nil {
+						return nil, fmt.Errorf("chart %s: reading %s: %w", chart.Metadata.Name, relPath, err)
+					}
+					subchartFiles[relPath] = archived
+				}
+				continue
+			}
+			if subchartFiles[parts[0]] == nil {
+				subchartFiles[parts[0]] = map[string][]byte{}
+			}
+			subchartFiles[parts[0]][parts[1]] = content
+		default:
+			chart.Files[relPath] = content
+		}
+	}
+	if chart.Values == nil {
+		chart.Values = map[string]interface{}{}
+	}
+
+	subchartNames := make([]string, 0, len(subchartFiles))
+	for name := range subchartFiles {
+		subchartNames = append(subchartNames, name)
+	}
+	sort.Strings(subchartNames)
+	for _, name := range subchartNames {
+		subchart, err := loadChartFiles(subchartFiles[name])
+		if err != nil {
+			return nil, fmt.Errorf("chart %s: subchart %s: %w", chart.Metadata.Name, name, err)
+		}
+		chart.Subcharts = append(chart.Subcharts, subchart)
+	}
+	for _, dependency := range chart.Metadata.Dependencies {
+		if _, err := chart.dependencyChart(dependency); err != nil {
+			return nil, err
+		}
+	}
+	return chart, nil
+}
+
+// readChartArchive returns the files of a packaged chart, indexed by their
+// path relative to the chart directory of the archive
+func readChartArchive(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	size := int64(0)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		parts := strings.SplitN(path.Clean(strings.TrimPrefix(header.Name, "/")), "/", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[1], "../") {
+			continue
+		}
+		if size += header.Size; size > maxChartArchiveSize {
+			return nil, fmt.Errorf("chart archive exceeds %d bytes", maxChartArchiveSize)
+		}
+		if files[parts[1]], err = io.ReadAll(io.LimitReader(tr, header.Size)); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// dependencyChart returns the vendored subchart of the dependency, renamed
+// by its alias
+func (c *Chart) dependencyChart(dependency *Dependency) (*Chart, error) {
+	for _, subchart := range c.Subcharts {
+		if subchart.Metadata.Name != dependency.Name {
+			continue
+		}
+		if dependency.Version != "" {
+			constraint, err := semver.NewConstraint(dependency.Version)
+			if err != nil {
+				return nil, fmt.Errorf("chart %s: dependency %s: invalid version %q: %w", c.Metadata.Name, dependency.Name, dependency.Version, err)
+			}
+			version, err := semver.NewVersion(subchart.Metadata.Version)
+			if err != nil || !constraint.Check(version) {
+				return nil, fmt.Errorf("chart %s: dependency %s: vendored version %s doesn't match %s", c.Metadata.Name,
+					dependency.Name, subchart.Metadata.Version, dependency.Version)
+			}
+		}
+		if dependency.Alias == "" {
+			return subchart, nil
+		}
+		aliased := *subchart
+		aliased.Metadata.Name = dependency.Alias
+		return &aliased, nil
+	}
+	return nil, fmt.Errorf("chart %s: dependency %s is declared in %s but missing in the %s directory", c.Metadata.Name,
+		dependency.Name, chartFileName, chartsDir)
+}
+
+// renderedChart is a chart enabled in the release with its values
+type renderedChart struct {
+	chart *Chart
+	// prefix is the path of the chart in the templates names, as
+	// app/charts/db for the db subchart of app
+	prefix string
+	values map[string]interface{}
+}
+
+// RenderChart renders the chart templates with the given values merged over
+// the chart defaults, the CRDs of the chart are returned first. The values of
+// the subcharts are scoped by their name and share the global values. The
+// hooks are left out, they are never run.
+func RenderChart(chart *Chart, values map[string]interface{}, options ReleaseOptions) ([]byte, error) {
+	if options.KubeVersion == "" {
+		return nil, fmt.Errorf("the kubernetes version of the cluster is required")
+	}
+	kubeVersion := newKubeVersion(options.KubeVersion)
+	release := map[string]interface{}{
+		"Name":      options.Name,
+		"Namespace": options.Namespace,
+		"Revision":  options.Revision,
+		"IsInstall": !options.IsUpgrade,
+		"IsUpgrade": options.IsUpgrade,
+		"Service":   "Helm",
+	}
+	capabilities := map[string]interface{}{
+		"KubeVersion": kubeVersion,
+		"APIVersions": VersionSet(options.APIVersions),
+	}
+
+	charts := []renderedChart{}
+	chartValues := MergeValues(MergeValues(map[string]interface{}{}, chart.Values), values)
+	if _, err := collectCharts(chart, chartValues, chart.Metadata.Name, &charts); err != nil {
+		return nil, err
+	}
+
+	t := template.New(chart.Metadata.Name).Option("missingkey=zero")
+	t.Funcs(funcMap(t, charts, options.Lookup))
+	if err := parseTemplates(t, charts); err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	for _, c := range charts {
+		if err := checkKubeVersion(c.chart, kubeVersion); err != nil {
+			return nil, err
+		}
+		for _, name := range sortedKeys(c.chart.CRDs) {
+			writeDocument(&output, path.Join(c.prefix, name), c.chart.CRDs[name])
+		}
+	}
+	for _, c := range charts {
+		if c.chart.Metadata.Type == libraryChart {
+			continue
+		}
+		for _, name := range sortedKeys(c.chart.Templates) {
+			base := path.Base(name)
+			if strings.HasPrefix(base, "_") || base == notesFileName {
+				continue
+			}
+			data := map[string]interface{}{
+				"Values":       c.values,
+				"Release":      release,
+				"Chart":        c.chart.Metadata,
+				"Capabilities": capabilities,
+				"Files":        c.chart.Files,
+				"Template": map[string]interface{}{
+					"Name":     path.Join(c.prefix, name),
+					"BasePath": path.Join(c.prefix, templatesDir),
+				},
+			}
+			var rendered strings.Builder
+			if err := t.ExecuteTemplate(&rendered, path.Join(c.prefix, name), data); err != nil {
+				return nil, fmt.Errorf("rendering template %s: %w", path.Join(c.prefix, name), err)
+			}
+			content, err := withoutHooks(rendered.String())
+			if err != nil {
+				return nil, fmt.Errorf("rendering template %s: %w", path.Join(c.prefix, name), err)
+			}
+			writeDocument(&output, path.Join(c.prefix, name), content)
+		}
+	}
+	return output.Bytes(), nil
+}
+
+// withoutHooks removes the documents of the hooks from the rendered template
+func withoutHooks(content string) (string, error) {
+	if !strings.Contains(content, hookAnnotation) {
+		return content, nil
+	}
+	documents := documentSeparator.Split(content, -1)
+	kept := make([]string, 0, len(documents))
+	for _, document := range documents {
+		object := struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}{}
+		if err := yaml.Unmarshal([]byte(document), &object); err != nil {
+			return "", err
+		}
+		if _, ok := object.Metadata.Annotations[hookAnnotation]; ok {
+			continue
+		}
+		kept = append(kept, document)
+	}
+	if len(kept) == len(documents) {
+		return content, nil
+	}
+	return strings.Join(kept, "\n---\n"), nil
+}
+
+// collectCharts appends the chart and its enabled subcharts, values are the
+// values of the chart merged over its defaults. The values of the enabled
+// subcharts are written back in values, like helm does, and the values they
+// export are imported.
+func collectCharts(chart *Chart, values map[string]interface{}, prefix string, charts *[]renderedChart) (map[string]interface{}, error) {
+	*charts = append(*charts, renderedChart{chart: chart, prefix: prefix, values: values})
+
+	dependencies := chart.Metadata.Dependencies
+	declared := map[string]bool{}
+	for _, dependency := range dependencies {
+		declared[dependency.Name] = true
+	}
+	// the subcharts vendored without being declared are always enabled
+	for _, subchart := range chart.Subcharts {
+		if !declared[subchart.Metadata.Name] {
+			dependencies = append(dependencies, &Dependency{Name: subchart.Metadata.Name})
+		}
+	}
+
+	for _, dependency := range dependencies {
+		if !dependencyEnabled(dependency, values) {
+			continue
+		}
+		subchart, err := chart.dependencyChart(dependency)
+		if err != nil {
+			return nil, err
+		}
+		name := subchart.Metadata.Name
+		subValues := MergeValues(map[string]interface{}{}, subchart.Values)
+		if scoped, ok := values[name].(map[string]interface{}); ok {
+			subValues = MergeValues(subValues, scoped)
+		}
+		globals := map[string]interface{}{}
+		if subGlobals, ok := subValues[globalValues].(map[string]interface{}); ok {
+			globals = MergeValues(globals, subGlobals)
+		}
+		if parentGlobals, ok := values[globalValues].(map[string]interface{}); ok {
+			globals = MergeValues(globals, parentGlobals)
+		}
+		subValues[globalValues] = globals
+
+		subValues, err = collectCharts(subchart, subValues, path.Join(prefix, chartsDir, name), charts)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = subValues
+		if err := importValues(dependency, subValues, values); err != nil {
+			return nil, fmt.Errorf("chart %s: dependency %s: %w", chart.Metadata.Name, dependency.Name, err)
+		}
+	}
+	return values, nil
+}
+
+// dependencyEnabled evaluates the tags and then the condition of the
+// dependency, the first condition path found in the values wins over tags
+func dependencyEnabled(dependency *Dependency, values map[string]interface{}) bool {
+	enabled := true
+	if tags, ok := values[tagsValues].(map[string]interface{}); ok && len(dependency.Tags) > 0 {
+		found := false
+		anyTrue := false
+		for _, tag := range dependency.Tags {
+			if value, ok := tags[tag].(bool); ok {
+				found = true
+				anyTrue = anyTrue || value
+			}
+		}
+		if found {
+			enabled = anyTrue
+		}
+	}
+	for _, condition := range strings.Split(dependency.Condition, ",") {
+		condition = strings.TrimSpace(condition)
+		if condition == "" {
+			continue
+		}
+		if value, ok := lookupValue(values, condition).(bool); ok {
+			return value
+		}
+	}
+	return enabled
+}
+
+// importValues copies the values exported by the subchart in the values of
+// the parent, the values of the parent win. An import is the name of an
+// exports value or a map of a child and a parent path.
+func importValues(dependency *Dependency, subValues map[string]interface{}, values map[string]interface{}) error {
+	for _, imported := range dependency.ImportValues {
+		var childPath, parentPath string
+		switch i := imported.(type) {
+		case string:
+			childPath = exportsValues + "." + i
+		case map[string]interface{}:
+			child, _ := i["child"].(string)
+			parent, _ := i["parent"].(string)
+			if child == "" || parent == "" {
+				return fmt.Errorf("invalid import-values %v, child and parent are required", i)
+			}
+			childPath, parentPath = child, parent
+		default:
+			return fmt.Errorf("invalid import-values %v", imported)
+		}
+		exported, ok := lookupValue(subValues, childPath).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		target := values
+		for _, key := range strings.Split(parentPath, ".") {
+			if key == "" {
+				continue
+			}
+			next, ok := target[key].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				target[key] = next
+			}
+			target = next
+		}
+		merged := MergeValues(MergeValues(map[string]interface{}{}, exported), target)
+		for k, v := range merged {
+			target[k] = v
+		}
+	}
+	return nil
+}
+
+// lookupValue returns the value at the dotted path, nil when missing
+func lookupValue(values map[string]interface{}, valuePath string) interface{} {
+	var current interface{} = values
+	for _, key := range strings.Split(valuePath, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[key]
+	}
+	return current
+}
+
+// checkKubeVersion checks the kubeVersion constraint of the chart against
+// the version of the cluster
+func checkKubeVersion(chart *Chart, kubeVersion KubeVersion) error {
+	if chart.Metadata.KubeVersion == "" {
+		return nil
+	}
+	constraint, err := semver.NewConstraint(chart.Metadata.KubeVersion)
+	if err != nil {
+		return fmt.Errorf("chart %s: invalid kubeVersion %q: %w", chart.Metadata.Name, chart.Metadata.KubeVersion, err)
+	}
+	version, err := semver.NewVersion(kubeVersion.Version)
+	if err != nil {
+		return fmt.Errorf("invalid kubernetes version %q: %w", kubeVersion.Version, err)
+	}
+	if !constraint.Check(version) {
+		return fmt.Errorf("chart %s requires kubeVersion %s which is incompatible with kubernetes %s", chart.Metadata.Name,
+			chart.Metadata.KubeVersion, kubeVersion.Version)
+	}
+	return nil
+}
+
+// parseTemplates parses the templates of every chart in t, named by their
+// path in the release, and makes the missing values print as empty
+func parseTemplates(t *template.Template, charts []renderedChart) error {
+	for _, c := range charts {
+		for _, name := range sortedKeys(c.chart.Templates) {
+			if _, err := t.New(path.Join(c.prefix, name)).Parse(c.chart.Templates[name]); err != nil {
+				return fmt.Errorf("parsing template %s: %w", path.Join(c.prefix, name), err)
+			}
+		}
+	}
+	printMissingAsEmpty(t)
+	return nil
+}
+
+// printMissingAsEmpty appends printValueFunc to the pipelines of the actions
+// printing a value. A missing value of a map is printed as "<no value>" by
+// text/template, helm prints it as an empty string.
+func printMissingAsEmpty(t *template.Template) {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil && tmpl.Tree.Root != nil {
+			printMissingAsEmptyNode(tmpl.Tree, tmpl.Tree.Root)
+		}
+	}
+}
+
+func printMissingAsEmptyNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			printMissingAsEmptyNode(tree, child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		for _, cmd := range n.Pipe.Cmds {
+			if len(cmd.Args) == 1 {
+				if identifier, ok := cmd.Args[0].(*parse.IdentifierNode); ok && identifier.Ident == printValueFunc {
+					return
+				}
+			}
+		}
+		identifier := parse.NewIdentifier(printValueFunc).SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{identifier}})
+	case *parse.IfNode:
+		printMissingAsEmptyNode(tree, n.List)
+		printMissingAsEmptyNode(tree, n.ElseList)
+	case *parse.RangeNode:
+		printMissingAsEmptyNode(tree, n.List)
+		printMissingAsEmptyNode(tree, n.ElseList)
+	case *parse.WithNode:
+		printMissingAsEmptyNode(tree, n.List)
+		printMissingAsEmptyNode(tree, n.ElseList)
+	}
+}
+
+// MergeValues merges src into dst, nested maps are merged while any other
+// value of src replaces the one in dst
+func MergeValues(dst map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			dst[k] = MergeValues(copyValues(dstMap), srcMap)
+			continue
+		}
+		if srcIsMap {
+			v = MergeValues(map[string]interface{}{}, srcMap)
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	return copied
+}
+
+func writeDocument(output *bytes.Buffer, source string, content string) {
+	if strings.TrimSpace(content) == "" {
+		return
+	}
+	fmt.Fprintf(output, "---\n# Source: %s\n%s\n", source, strings.TrimRight(content, "\n"))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// funcMap returns the template functions available to charts, sprig plus the
+// helm specific ones. Functions reading the operator environment are removed.
+func funcMap(t *template.Template, charts []renderedChart, lookup LookupFunc) template.FuncMap {
+	f := sprig.TxtFuncMap()
+	delete(f, "env")
+	delete(f, "expandenv")
+
+	f[printValueFunc] = func(value interface{}) interface{} {
+		if value == nil {
+			return ""
+		}
+		return value
+	}
+	includeDepth := map[string]int{}
+	f["include"] = func(name string, data interface{}) (string, error) {
+		if includeDepth[name] > maxIncludeDepth {
+			return "", fmt.Errorf("rendering template has a nested reference name: %s", name)
+		}
+		includeDepth[name]++
+		defer func() { includeDepth[name]-- }()
+		var buf strings.Builder
+		err := t.ExecuteTemplate(&buf, name, data)
+		return buf.String(), err
+	}
+	f["tpl"] = func(text string, data interface{}) (string, error) {
+		// a template can't be extended once executed, parse a new set
+		tt := template.New("tpl").Option("missingkey=zero")
+		tt.Funcs(funcMap(tt, charts, lookup))
+		if err := parseTemplates(tt, charts); err != nil {
+			return "", err
+		}
+		if _, err := tt.New("tpl").Parse(text); err != nil {
+			return "", err
+		}
+		printMissingAsEmpty(tt)
+		var buf strings.Builder
+		if err := tt.ExecuteTemplate(&buf, "tpl", data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	f["required"] = func(message string, value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, errors.New(message)
+		}
+		if s, ok := value.(string); ok && s == "" {
+			return nil, errors.New(message)
+		}
+		return value, nil
+	}
+	f["toYaml"] = toYaml
+	f["fromYaml"] = func(s string) map[string]interface{} {
+		m := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(s), &m); err != nil {
+			m["Error"] = err.Error()
+		}
+		return m
+	}
+	f["fromYamlArray"] = func(s string) []interface{} {
+		a := []interface{}{}
+		if err := yaml.Unmarshal([]byte(s), &a); err != nil {
+			a = []interface{}{err.Error()}
+		}
+		return a
+	}
+	f["toToml"] = func(v interface{}) string {
+		data, err := toml.Marshal(v)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	}
+	f["toJson"] = func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	f["fromJson"] = func(s string) map[string]interface{} {
+		m := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			m["Error"] = err.Error()
+		}
+		return m
+	}
+	f["fromJsonArray"] = func(s string) []interface{} {
+		a := []interface{}{}
+		if err := json.Unmarshal([]byte(s), &a); err != nil {
+			a = []interface{}{err.Error()}
+		}
+		return a
+	}
+	f["lookup"] = func(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+		if lookup == nil {
+			return map[string]interface{}{}, nil
+		}
+		return lookup(apiVersion, kind, namespace, name)
+	}
+	return f
+}
+
+func toYaml(v interface{}) string {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+// Files gives templates access to the non template files of the chart
+type Files map[string][]byte
+
+func (f Files) Get(name string) string {
+	return string(f[name])
+}
+
+func (f Files) GetBytes(name string) []byte {
+	return f[name]
+}
+
+// Glob returns the files matching the pattern, as "files/*.conf" or
+// "config/**"
+func (f Files) Glob(pattern string) Files {
+	g, err := glob.Compile(pattern, '/')
+	if err != nil {
+		g, _ = glob.Compile("**")
+	}
+	matching := Files{}
+	for name, content := range f {
+		if g.Match(name) {
+			matching[name] = content
+		}
+	}
+	return matching
+}
+
+// AsConfig returns the files as the YAML data of a ConfigMap, keyed by their
+// base name
+func (f Files) AsConfig() string {
+	data := map[string]string{}
+	for name, content := range f {
+		data[path.Base(name)] = string(content)
+	}
+	return toYaml(data)
+}
+
+// AsSecrets returns the files as the base64 YAML data of a Secret, keyed by
+// their base name
+func (f Files) AsSecrets() string {
+	data := map[string]string{}
+	for name, content := range f {
+		data[path.Base(name)] = base64.StdEncoding.EncodeToString(content)
+	}
+	return toYaml(data)
+}
+
+// Lines returns the lines of the file
+func (f Files) Lines(name string) []string {
+	content := strings.TrimSuffix(string(f[name]), "\n")
+	if content == "" {
+		return []string{}
+	}
+	return strings.Split(content, "\n")
+}
+
+// VersionSet is the list of api versions available in the cluster
+type VersionSet []string
+
+func (v VersionSet) Has(apiVersion string) bool {
+	for _, version := range v {
+		if version == apiVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// KubeVersion is the version of the cluster, exposed to templates as
+// .Capabilities.KubeVersion
+type KubeVersion struct {
+	Version string
+	Major   string
+	Minor   string
+	// GitVersion is the same as Version, kept for the charts of helm 2
+	GitVersion string
+}
+
+func (k KubeVersion) String() string {
+	return k.Version
+}
+
+func newKubeVersion(version string) KubeVersion {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	k := KubeVersion{Version: version, GitVersion: version}
+	if len(parts) > 1 {
+		k.Major, k.Minor = parts[0], strings.TrimRight(parts[1], "+")
+	}
+	return k
+}
+
+// ReadValuesFile parses a values file of the bundle
+func ReadValuesFile(fsys fs.FS, name string) (map[string]interface{}, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("parsing values file %s: %w", name, err)
+	}
+	return values, nil
+}
+
+// NormalizeValues converts values decoded by yaml.v3, as the ones inline in the
+// descriptor, to the json compatible types used by the templates
+func NormalizeValues(values map[string]interface{}) (map[string]interface{}, error) {
+	if values == nil {
+		return map[string]interface{}{}, nil
+	}
+	data, err := yamlv3.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	normalized := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
@@ -0,0 +1,367 @@
+package renderer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func testChart() fstest.MapFS {
+	return fstest.MapFS{
+		"chart/Chart.yaml": {Data: []byte("apiVersion: v2\nname: db\nversion: 1.2.0\nappVersion: \"15\"\n")},
+		"chart/values.yaml": {Data: []byte(`image: postgres
+service:
+  port: 5432
+  type: ClusterIP
+password: ""
+annotation: "{{ .Release.Name }}-note"
+`)},
+		"chart/templates/_helpers.tpl": {Data: []byte(`{{- define "db.fullname" -}}
+{{ .Release.Name }}-{{ .Chart.Name }}
+{{- end -}}`)},
+		"chart/templates/service.yaml": {Data: []byte(`apiVersion: v1
+kind: Service
+metadata:
+  name: {{ include "db.fullname" . }}
+  namespace: {{ .Release.Namespace }}
+  annotations:
+    note: {{ tpl .Values.annotation . | quote }}
+spec:
+  type: {{ .Values.service.type }}
+  ports:
+    - port: {{ .Values.service.port }}
+`)},
+		"chart/templates/secret.yaml": {Data: []byte(`{{- if .Release.IsInstall }}
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ include "db.fullname" . }}
+stringData:
+  password: {{ required "password is required" .Values.password | quote }}
+  config: {{ .Files.Get "files/config.conf" | quote }}
+{{- end }}
+`)},
+		"chart/templates/NOTES.txt":     {Data: []byte("Installed {{ .Release.Name }}")},
+		"chart/crds/crd.yaml":           {Data: []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: dbs.example.org\n")},
+		"chart/files/config.conf":       {Data: []byte("max_connections=10")},
+		"values/production.yaml":        {Data: []byte("service:\n  type: LoadBalancer\npassword: from-file\n")},
+		"library/Chart.yaml":            {Data: []byte("apiVersion: v2\nname: common\ntype: library\nversion: 1.0.0\n")},
+		"dependencies/Chart.yaml":       {Data: []byte("apiVersion: v2\nname: app\nversion: 1.0.0\ndependencies:\n  - name: db\n")},
+		"versions/Chart.yaml":           {Data: []byte("apiVersion: v2\nname: app\nversion: 1.0.0\ndependencies:\n  - name: db\n    version: ^2.0.0\n")},
+		"versions/charts/db/Chart.yaml": {Data: []byte("apiVersion: v2\nname: db\nversion: 1.0.0\n")},
+	}
+}
+
+func TestRenderChart(t *testing.T) {
+	fsys := testChart()
+	chart, err := LoadChart(fsys, "chart")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fileValues, err := ReadValuesFile(fsys, "values/production.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	values := MergeValues(map[string]interface{}{}, fileValues)
+	values = MergeValues(values, map[string]interface{}{"service": map[string]interface{}{"port": 6432}})
+
+	output, err := RenderChart(chart, values, ReleaseOptions{Name: "orders", Namespace: "entando", Revision: 1, KubeVersion: "v1.27.3"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered := string(output)
+
+	for _, expected := range []string{
+		"# Source: db/crds/crd.yaml\n",
+		"name: orders-db\n",
+		"namespace: entando\n",
+		"note: \"orders-note\"\n",
+		"type: LoadBalancer\n",
+		"port: 6432\n",
+		"password: \"from-file\"\n",
+		"config: \"max_connections=10\"\n",
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("Expected %q in rendered chart:\n%s", expected, rendered)
+		}
+	}
+	if strings.Index(rendered, "CustomResourceDefinition") > strings.Index(rendered, "kind: Secret") {
+		t.Fatalf("Expected CRDs before templates:\n%s", rendered)
+	}
+	if strings.Contains(rendered, "_helpers.tpl") || strings.Contains(rendered, "Installed orders") {
+		t.Fatalf("Helpers and notes must not be rendered:\n%s", rendered)
+	}
+	if chart.Values["service"].(map[string]interface{})["type"] != "ClusterIP" {
+		t.Fatal("Chart default values must not be modified by rendering")
+	}
+}
+
+func TestRenderChartUpgrade(t *testing.T) {
+	chart, err := LoadChart(testChart(), "chart")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := RenderChart(chart, nil, ReleaseOptions{Name: "orders", Revision: 2, IsUpgrade: true, KubeVersion: "v1.27.3"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Contains(string(output), "kind: Secret") {
+		t.Fatalf("Expected secret to be rendered only on install:\n%s", output)
+	}
+}
+
+func TestRenderChartRequiredValue(t *testing.T) {
+	chart, err := LoadChart(testChart(), "chart")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = RenderChart(chart, nil, ReleaseOptions{Name: "orders", Revision: 1, KubeVersion: "v1.27.3"})
+	if err == nil || !strings.Contains(err.Error(), "password is required") {
+		t.Fatalf("Expected required value error, got %v", err)
+	}
+}
+
+func TestLoadChartUnsupported(t *testing.T) {
+	tests := []struct {
+		dir      string
+		expected string
+	}{
+		{dir: "library", expected: "library chart"},
+		{dir: "dependencies", expected: "missing in the charts directory"},
+		{dir: "versions", expected: "doesn't match ^2.0.0"},
+		{dir: "missing", expected: "reading Chart.yaml"},
+	}
+	for _, test := range tests {
+		_, err := LoadChart(testChart(), test.dir)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Expected error containing %q for %s, got %v", test.expected, test.dir, err)
+		}
+	}
+}
+
+// chartArchive packages the files in a chart archive, as helm package
+func chartArchive(t *testing.T, name string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, file := range sortedKeys(files) {
+		header := &tar.Header{Name: name + "/" + file, Mode: 0644, Size: int64(len(files[file])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := tw.Write([]byte(files[file])); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func TestRenderChartSubcharts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/Chart.yaml": {Data: []byte(`apiVersion: v2
+name: app
+version: 1.0.0
+kubeVersion: ">=1.25.0-0"
+dependencies:
+  - name: db
+    version: ~1.2.0
+    condition: db.enabled
+    import-values:
+      - settings
+  - name: db
+    alias: replica
+    condition: replica.enabled
+  - name: cache
+    tags: [optional]
+  - name: common
+`)},
+		"app/values.yaml": {Data: []byte("global:\n  domain: example.org\ndb:\n  port: 6432\nreplica:\n  enabled: false\ntags:\n  optional: false\n")},
+		"app/templates/config.yaml": {Data: []byte(`kind: ConfigMap
+metadata:
+  name: {{ include "common.name" . }}
+data:
+  dbHost: {{ .Values.host }}
+  missing: "{{ .Values.missing }}"
+  literal: "<no value>"
+  kube: {{ .Capabilities.KubeVersion.GitVersion }} {{ .Capabilities.KubeVersion.Major }}.{{ .Capabilities.KubeVersion.Minor }}
+  apps: "{{ .Capabilities.APIVersions.Has "apps/v1/Deployment" }}"
+  existing: {{ (lookup "v1" "ConfigMap" "entando" "existing").data.key }}
+`)},
+		"app/charts/db/Chart.yaml":               {Data: []byte("apiVersion: v2\nname: db\nversion: 1.2.3\n")},
+		"app/charts/db/values.yaml":              {Data: []byte("enabled: true\nport: 5432\nexports:\n  settings:\n    host: db\n")},
+		"app/charts/db/templates/service.yaml":   {Data: []byte("kind: Service\nmetadata:\n  name: {{ .Chart.Name }}\nspec:\n  port: {{ .Values.port }}\n  domain: {{ .Values.global.domain }}\n")},
+		"app/charts/db/crds/crd.yaml":            {Data: []byte("kind: CustomResourceDefinition\n")},
+		"app/charts/common/Chart.yaml":           {Data: []byte("apiVersion: v2\nname: common\nversion: 1.0.0\ntype: library\n")},
+		"app/charts/common/templates/_names.tpl": {Data: []byte(`{{- define "common.name" -}}{{ .Release.Name }}-config{{- end -}}`)},
+		"app/charts/common/templates/page.yaml":  {Data: []byte("kind: Library\n")},
+		"app/charts/cache-1.0.0.tgz": {Data: chartArchive(t, "cache", map[string]string{
+			"Chart.yaml":         "apiVersion: v2\nname: cache\nversion: 1.0.0\n",
+			"templates/pod.yaml": "kind: Pod\n",
+		})},
+	}
+	chart, err := LoadChart(fsys, "app")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lookups := []string{}
+	options := ReleaseOptions{Name: "orders", Namespace: "entando", Revision: 1, KubeVersion: "v1.27.3",
+		APIVersions: []string{"v1", "apps/v1", "apps/v1/Deployment"},
+		Lookup: func(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+			lookups = append(lookups, strings.Join([]string{apiVersion, kind, namespace, name}, "/"))
+			return map[string]interface{}{"data": map[string]interface{}{"key": "from-cluster"}}, nil
+		},
+	}
+	output, err := RenderChart(chart, map[string]interface{}{"tags": map[string]interface{}{"optional": true}}, options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered := string(output)
+
+	for _, expected := range []string{
+		"# Source: app/charts/db/crds/crd.yaml\n",
+		"# Source: app/charts/db/templates/service.yaml\n",
+		"name: db\n",
+		"port: 6432\n",
+		"domain: example.org\n",
+		"# Source: app/charts/cache/templates/pod.yaml\n",
+		"name: orders-config\n",
+		"dbHost: db\n",
+		"missing: \"\"\n",
+		"literal: \"<no value>\"\n",
+		"kube: v1.27.3 1.27\n",
+		"apps: \"true\"\n",
+		"existing: from-cluster\n",
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("Expected %q in rendered chart:\n%s", expected, rendered)
+		}
+	}
+	if strings.Contains(rendered, "replica") || strings.Contains(rendered, "kind: Library") {
+		t.Fatalf("Disabled and library subcharts must not be rendered:\n%s", rendered)
+	}
+	if strings.Join(lookups, ",") != "v1/ConfigMap/entando/existing" {
+		t.Fatalf("Unexpected lookups %v", lookups)
+	}
+
+	// the kubeVersion of the chart
+	options.KubeVersion = "v1.24.0"
+	if _, err := RenderChart(chart, nil, options); err == nil || !strings.Contains(err.Error(), "incompatible with kubernetes v1.24.0") {
+		t.Fatalf("Expected incompatible kubernetes version, got %v", err)
+	}
+	options.KubeVersion = ""
+	if _, err := RenderChart(chart, nil, options); err == nil {
+		t.Fatal("Expected kubernetes version required")
+	}
+}
+
+func TestRenderChartHooks(t *testing.T) {
+	fsys := fstest.MapFS{
+		"chart/Chart.yaml": {Data: []byte("apiVersion: v2\nname: app\nversion: 1.0.0\n")},
+		"chart/templates/tests/test-connection.yaml": {Data: []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: {{ .Release.Name }}-test
+  annotations:
+    "helm.sh/hook": test
+`)},
+		"chart/templates/migrations.yaml": {Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}-migrations
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Release.Name }}-migrate
+  annotations:
+    helm.sh/hook: pre-install,pre-upgrade
+`)},
+	}
+	chart, err := LoadChart(fsys, "chart")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := RenderChart(chart, nil, ReleaseOptions{Name: "orders", Revision: 1, KubeVersion: "v1.27.3"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered := string(output)
+	if strings.Contains(rendered, "kind: Pod") || strings.Contains(rendered, "kind: Job") {
+		t.Fatalf("Expected the hooks left out:\n%s", rendered)
+	}
+	if !strings.Contains(rendered, "name: orders-migrations") {
+		t.Fatalf("Expected the objects of the release rendered:\n%s", rendered)
+	}
+}
+
+func TestRenderChartFunctions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"chart/Chart.yaml":       {Data: []byte("apiVersion: v2\nname: app\nversion: 1.0.0\nhome: https://example.org\nkeywords: [orders]\n")},
+		"chart/config/app.conf":  {Data: []byte("port=8080\n")},
+		"chart/config/log.conf":  {Data: []byte("level=info\nformat=json\n")},
+		"chart/files/readme.txt": {Data: []byte("readme")},
+		"chart/templates/app.yaml": {Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  annotations:
+    home: {{ .Chart.Home }}
+    keywords: {{ join "," .Chart.Keywords }}
+data:
+  {{- (.Files.Glob "config/*.conf").AsConfig | nindent 2 }}
+  secrets: {{ (.Files.Glob "files/**").AsSecrets | quote }}
+  lines: {{ len (.Files.Lines "config/log.conf") | quote }}
+  array: {{ index (fromJsonArray "[\"a\", \"b\"]") 1 | quote }}
+  toml: {{ toToml (dict "port" 8080) | quote }}
+`)},
+	}
+	chart, err := LoadChart(fsys, "chart")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := RenderChart(chart, nil, ReleaseOptions{Name: "orders", Revision: 1, KubeVersion: "v1.27.3"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered := string(output)
+	for _, expected := range []string{
+		"home: https://example.org\n",
+		"keywords: orders\n",
+		"app.conf: |\n    port=8080\n",
+		"log.conf: |\n    level=info\n",
+		"secrets: \"readme.txt: cmVhZG1l\"\n",
+		"lines: \"2\"\n",
+		"array: \"b\"\n",
+		"toml: \"port = 8080\\n\"\n",
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("Expected %q in rendered chart:\n%s", expected, rendered)
+		}
+	}
+}
+
+func TestNormalizeValues(t *testing.T) {
+	values, err := NormalizeValues(map[string]interface{}{
+		"replicas":  2,
+		"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "1"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := values["replicas"].(float64); !ok {
+		t.Fatalf("Expected json number, got %T", values["replicas"])
+	}
+	if _, ok := values["resources"].(map[string]interface{})["limits"].(map[string]interface{}); !ok {
+		t.Fatalf("Expected nested map, got %T", values["resources"])
+	}
+}
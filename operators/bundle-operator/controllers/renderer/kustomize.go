@@ -0,0 +1,242 @@
+package renderer
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
+)
+
+const overlayResourcesFileName = "resources.yaml"
+
+// KustomizeOptions are the changes applied on top of the kustomization output
+type KustomizeOptions struct {
+	// Namespace, when set, is injected in every namespaced object and in
+	// the references to them
+	Namespace    string
+	CommonLabels map[string]string
+	NamePrefix   string
+}
+
+// BuildKustomization builds the kustomization found in dir. The build runs on
+// an in memory copy of the kustomization directory and of the paths it
+// references in fsys, so a kustomization can reference other directories of
+// the bundle but can't read anything outside of it.
+func BuildKustomization(fsys fs.FS, dir string, options KustomizeOptions) ([]byte, error) {
+	bundleFs := filesys.MakeFsInMemory()
+	if err := copyKustomization(fsys, bundleFs, path.Clean(dir), map[string]bool{}); err != nil {
+		return nil, err
+	}
+
+	output, err := runKustomizer(bundleFs, path.Join("/", dir))
+	if err != nil {
+		return nil, fmt.Errorf("building kustomization %s: %w", dir, err)
+	}
+	if options.Namespace == "" && len(options.CommonLabels) == 0 && options.NamePrefix == "" {
+		return output, nil
+	}
+
+	// the options are applied by an overlay, so that kustomize also updates
+	// the references between the objects
+	overlay := types.Kustomization{
+		TypeMeta: types.TypeMeta{
+			APIVersion: types.KustomizationVersion,
+			Kind:       types.KustomizationKind,
+		},
+		Resources:    []string{overlayResourcesFileName},
+		Namespace:    options.Namespace,
+		CommonLabels: options.CommonLabels,
+		NamePrefix:   options.NamePrefix,
+	}
+	kustomization, err := yaml.Marshal(overlay)
+	if err != nil {
+		return nil, err
+	}
+	overlayFs := filesys.MakeFsInMemory()
+	if err := overlayFs.WriteFile("/kustomization.yaml", kustomization); err != nil {
+		return nil, err
+	}
+	if err := overlayFs.WriteFile("/"+overlayResourcesFileName, output); err != nil {
+		return nil, err
+	}
+	output, err = runKustomizer(overlayFs, "/")
+	if err != nil {
+		return nil, fmt.Errorf("applying options to kustomization %s: %w", dir, err)
+	}
+	return output, nil
+}
+
+// KustomizationFiles returns the directories and the files of fsys read by
+// BuildKustomization for the kustomization found in dir, sorted
+func KustomizationFiles(fsys fs.FS, dir string) ([]string, error) {
+	bundleFs := filesys.MakeFsInMemory()
+	if err := copyKustomization(fsys, bundleFs, path.Clean(dir), map[string]bool{}); err != nil {
+		return nil, err
+	}
+	files := []string{}
+	err := bundleFs.Walk("/", func(filePath string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath != "/" {
+			files = append(files, strings.TrimPrefix(filePath, "/"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// copyKustomization copies the files of the kustomization directory and the
+// paths referenced by its kustomization, recursively. The references outside
+// of fsys or missing are not copied, kustomize reports them.
+func copyKustomization(fsys fs.FS, bundleFs filesys.FileSystem, dir string, copied map[string]bool) error {
+	if copied[dir] {
+		return nil
+	}
+	copied[dir] = true
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	if err := bundleFs.MkdirAll(path.Join("/", dir)); err != nil {
+		return err
+	}
+
+	var kustomization *types.Kustomization
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := copyFile(fsys, bundleFs, path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if kustomization == nil && isKustomizationFileName(entry.Name()) {
+			kustomization = &types.Kustomization{}
+			if err := yaml.Unmarshal(content, kustomization); err != nil {
+				return fmt.Errorf("parsing %s: %w", path.Join(dir, entry.Name()), err)
+			}
+		}
+	}
+	if kustomization == nil {
+		return nil
+	}
+
+	for _, ref := range kustomizationPaths(kustomization) {
+		refPath := path.Join(dir, ref)
+		if path.IsAbs(ref) || refPath == ".." || strings.HasPrefix(refPath, "../") || copied[refPath] {
+			continue
+		}
+		info, err := fs.Stat(fsys, refPath)
+		if err != nil {
+			// a remote resource or a missing path
+			continue
+		}
+		if info.IsDir() {
+			err = copyKustomization(fsys, bundleFs, refPath, copied)
+		} else {
+			copied[refPath] = true
+			_, err = copyFile(fsys, bundleFs, refPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(fsys fs.FS, bundleFs filesys.FileSystem, filePath string) ([]byte, error) {
+	content, err := fs.ReadFile(fsys, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := bundleFs.MkdirAll(path.Join("/", path.Dir(filePath))); err != nil {
+		return nil, err
+	}
+	return content, bundleFs.WriteFile(path.Join("/", filePath), content)
+}
+
+func isKustomizationFileName(name string) bool {
+	for _, fileName := range konfig.RecognizedKustomizationFileNames() {
+		if name == fileName {
+			return true
+		}
+	}
+	return false
+}
+
+// kustomizationPaths returns the files and the directories referenced by the
+// kustomization, the inline patches and plugin configs are skipped
+func kustomizationPaths(k *types.Kustomization) []string {
+	paths := []string{}
+	paths = append(paths, k.Resources...)
+	paths = append(paths, k.Components...)
+	paths = append(paths, k.Bases...)
+	paths = append(paths, k.Crds...)
+	paths = append(paths, k.Configurations...)
+	for _, inline := range [][]string{k.Generators, k.Transformers, k.Validators} {
+		for _, ref := range inline {
+			if !strings.Contains(ref, "\n") {
+				paths = append(paths, ref)
+			}
+		}
+	}
+	for _, patch := range k.PatchesStrategicMerge {
+		if !strings.Contains(string(patch), "\n") {
+			paths = append(paths, string(patch))
+		}
+	}
+	for _, patches := range [][]types.Patch{k.Patches, k.PatchesJson6902} {
+		for _, patch := range patches {
+			if patch.Path != "" {
+				paths = append(paths, patch.Path)
+			}
+		}
+	}
+	for _, replacement := range k.Replacements {
+		if replacement.Path != "" {
+			paths = append(paths, replacement.Path)
+		}
+	}
+	if openAPI, ok := k.OpenAPI["path"]; ok {
+		paths = append(paths, openAPI)
+	}
+	generators := []types.GeneratorArgs{}
+	for _, generator := range k.ConfigMapGenerator {
+		generators = append(generators, generator.GeneratorArgs)
+	}
+	for _, generator := range k.SecretGenerator {
+		generators = append(generators, generator.GeneratorArgs)
+	}
+	for _, generator := range generators {
+		for _, file := range generator.FileSources {
+			// [{key}=]{path}
+			paths = append(paths, file[strings.Index(file, "=")+1:])
+		}
+		paths = append(paths, generator.EnvSources...)
+		if generator.EnvSource != "" {
+			paths = append(paths, generator.EnvSource)
+		}
+	}
+	return paths
+}
+
+func runKustomizer(fSys filesys.FileSystem, dir string) ([]byte, error) {
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resources, err := kustomizer.Run(fSys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return resources.AsYaml()
+}
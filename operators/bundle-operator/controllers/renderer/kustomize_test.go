@@ -0,0 +1,149 @@
+package renderer
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func testKustomization() fstest.MapFS {
+	return fstest.MapFS{
+		"kustomize/base/kustomization.yaml": {Data: []byte("resources:\n  - deployment.yaml\n  - configmap.yaml\n")},
+		"kustomize/base/deployment.yaml": {Data: []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+        - name: web
+          image: nginx
+          envFrom:
+            - configMapRef:
+                name: web-config
+`)},
+		"kustomize/base/configmap.yaml": {Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web-config\ndata:\n  mode: base\n")},
+		"kustomize/overlays/production/kustomization.yaml": {Data: []byte(`resources:
+  - ../../base
+patches:
+  - target:
+      kind: ConfigMap
+    patch: |-
+      - op: replace
+        path: /data/mode
+        value: production
+`)},
+		"kustomize/outside/kustomization.yaml": {Data: []byte("resources:\n  - ../../../etc\n")},
+	}
+}
+
+func TestBuildKustomization(t *testing.T) {
+	output, err := BuildKustomization(testKustomization(), "kustomize/overlays/production", KustomizeOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered := string(output)
+	for _, expected := range []string{"name: web\n", "name: web-config\n", "mode: production\n"} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("Expected %q in kustomization output:\n%s", expected, rendered)
+		}
+	}
+	if strings.Contains(rendered, "namespace:") {
+		t.Fatalf("Namespace must not be injected when not requested:\n%s", rendered)
+	}
+}
+
+func TestBuildKustomizationOptions(t *testing.T) {
+	options := KustomizeOptions{
+		Namespace:    "entando",
+		CommonLabels: map[string]string{"app.kubernetes.io/part-of": "orders"},
+		NamePrefix:   "orders-",
+	}
+	output, err := BuildKustomization(testKustomization(), "kustomize/overlays/production", options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rendered := string(output)
+	for _, expected := range []string{
+		"namespace: entando\n",
+		"app.kubernetes.io/part-of: orders\n",
+		"name: orders-web\n",
+		// references are updated together with the names
+		"name: orders-web-config\n",
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Fatalf("Expected %q in kustomization output:\n%s", expected, rendered)
+		}
+	}
+	if strings.Contains(rendered, "name: web-config\n") {
+		t.Fatalf("Expected config map reference to be prefixed:\n%s", rendered)
+	}
+}
+
+func TestBuildKustomizationOutsideBundle(t *testing.T) {
+	if _, err := BuildKustomization(testKustomization(), "kustomize/outside", KustomizeOptions{}); err == nil {
+		t.Fatal("Expected error building a kustomization referencing files outside the bundle")
+	}
+	if _, err := BuildKustomization(testKustomization(), "kustomize/missing", KustomizeOptions{}); err == nil {
+		t.Fatal("Expected error building a missing kustomization")
+	}
+}
+
+func TestCopyKustomization(t *testing.T) {
+	fsys := testKustomization()
+	fsys["kustomize/base/kustomization.yaml"] = &fstest.MapFile{Data: []byte(`resources:
+  - deployment.yaml
+  - configmap.yaml
+configMapGenerator:
+  - name: settings
+    files:
+      - app.properties=config/app.properties
+`)}
+	fsys["kustomize/base/config/app.properties"] = &fstest.MapFile{Data: []byte("mode=base\n")}
+	fsys["kustomize/base/config/unused.properties"] = &fstest.MapFile{Data: []byte("mode=unused\n")}
+	fsys["plugins/large.bin"] = &fstest.MapFile{Data: []byte("not part of the kustomization")}
+
+	bundleFs := filesys.MakeFsInMemory()
+	if err := copyKustomization(fsys, bundleFs, "kustomize/overlays/production", map[string]bool{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, expected := range []string{
+		"/kustomize/overlays/production/kustomization.yaml",
+		"/kustomize/base/kustomization.yaml",
+		"/kustomize/base/deployment.yaml",
+		"/kustomize/base/config/app.properties",
+	} {
+		if !bundleFs.Exists(expected) {
+			t.Fatalf("Expected %s to be copied", expected)
+		}
+	}
+	for _, unexpected := range []string{"/plugins/large.bin", "/kustomize/outside/kustomization.yaml", "/kustomize/base/config/unused.properties"} {
+		if bundleFs.Exists(unexpected) {
+			t.Fatalf("Expected %s not to be copied", unexpected)
+		}
+	}
+
+	files, err := KustomizationFiles(fsys, "kustomize/overlays/production")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listed := map[string]bool{}
+	for _, file := range files {
+		listed[file] = true
+	}
+	if !listed["kustomize/base/config/app.properties"] || !listed["kustomize/overlays/production/kustomization.yaml"] ||
+		listed["plugins/large.bin"] || listed["kustomize/base/config/unused.properties"] {
+		t.Fatalf("Unexpected files of the kustomization %v", files)
+	}
+
+	output, err := BuildKustomization(fsys, "kustomize/overlays/production", KustomizeOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(output), "app.properties: |\n    mode=base\n") {
+		t.Fatalf("Expected the generated config map:\n%s", output)
+	}
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+)
+
+const (
+	// predicateSLSAProvenance is the prefix of the predicate types of the
+	// SLSA provenances, v0.2 and v1
+	predicateSLSAProvenance = "https://slsa.dev/provenance/"
+	predicateSPDX           = "https://spdx.dev/Document"
+	predicateCycloneDX      = "https://cyclonedx.org/bom"
+)
+
+// inTotoStatement is the part of the in-toto statement of an attestation
+// read by the attestation policy
+type inTotoStatement struct {
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+type provenanceURI struct {
+	URI string `json:"uri"`
+}
+
+type provenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+// slsaProvenance is the part of a SLSA provenance, v0.2 or v1, read by the
+// attestation policy
+type slsaProvenance struct {
+	// v0.2
+	Builder    provenanceBuilder `json:"builder"`
+	Invocation struct {
+		ConfigSource provenanceURI `json:"configSource"`
+	} `json:"invocation"`
+	Materials []provenanceURI `json:"materials"`
+
+	// v1
+	RunDetails struct {
+		Builder provenanceBuilder `json:"builder"`
+	} `json:"runDetails"`
+	BuildDefinition struct {
+		ExternalParameters struct {
+			Workflow struct {
+				Repository string `json:"repository"`
+			} `json:"workflow"`
+		} `json:"externalParameters"`
+		ResolvedDependencies []provenanceURI `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+}
+
+func (p *slsaProvenance) builderID() string {
+	if p.RunDetails.Builder.ID != "" {
+		return p.RunDetails.Builder.ID
+	}
+	return p.Builder.ID
+}
+
+// sourceRepo returns the repository the bundle is built from, the source of
+// the build configuration or its first material
+func (p *slsaProvenance) sourceRepo() string {
+	for _, uri := range []string{p.BuildDefinition.ExternalParameters.Workflow.Repository, p.Invocation.ConfigSource.URI} {
+		if uri != "" {
+			return uri
+		}
+	}
+	for _, materials := range [][]provenanceURI{p.BuildDefinition.ResolvedDependencies, p.Materials} {
+		if len(materials) > 0 {
+			return materials[0].URI
+		}
+	}
+	return ""
+}
+
+// attestationSummary reads the summary of the in-toto statement of an
+// attestation, only the provenance and the SBOM attestations are summarized
+func attestationSummary(statement []byte, signer string) (v1alpha1.AttestationSummary, bool, error) {
+	parsed := inTotoStatement{}
+	if err := json.Unmarshal(statement, &parsed); err != nil {
+		return v1alpha1.AttestationSummary{}, false, fmt.Errorf("invalid in-toto statement: %w", err)
+	}
+	summary := v1alpha1.AttestationSummary{PredicateType: parsed.PredicateType, Signer: signer}
+	switch {
+	case strings.HasPrefix(parsed.PredicateType, predicateSLSAProvenance):
+		provenance := slsaProvenance{}
+		if err := json.Unmarshal(parsed.Predicate, &provenance); err != nil {
+			return summary, false, fmt.Errorf("invalid provenance: %w", err)
+		}
+		summary.BuilderID, summary.SourceRepo = provenance.builderID(), provenance.sourceRepo()
+	case strings.HasPrefix(parsed.PredicateType, predicateSPDX):
+		summary.SBOMFormat = v1alpha1.SBOMFormatSPDX
+	case strings.HasPrefix(parsed.PredicateType, predicateCycloneDX):
+		summary.SBOMFormat = v1alpha1.SBOMFormatCycloneDX
+	default:
+		return summary, false, nil
+	}
+	return summary, true, nil
+}
+
+// attestationStatement returns the in-toto statement of the DSSE envelope
+// of a cosign attestation
+func attestationStatement(attestation oci.Signature) ([]byte, error) {
+	payload, err := attestation.Payload()
+	if err != nil {
+		return nil, err
+	}
+	envelope := struct {
+		Payload string `json:"payload"`
+	}{}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid attestation envelope: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(envelope.Payload)
+}
+
+// attestationRules are the compiled rules of an attestation policy
+type attestationRules struct {
+	policy     *v1alpha1.AttestationPolicy
+	builderID  *regexp.Regexp
+	sourceRepo *regexp.Regexp
+}
+
+func newAttestationRules(policy *v1alpha1.AttestationPolicy) (*attestationRules, error) {
+	rules := &attestationRules{policy: policy}
+	if policy.Provenance == nil {
+		return rules, nil
+	}
+	var err error
+	if rules.builderID, err = regexp.Compile(policy.Provenance.BuilderIDRegexp); err != nil {
+		return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_ATTESTATION_POLICY_INVALID_REASON,
+			Err: fmt.Errorf("invalid builderIdRegexp %q: %w", policy.Provenance.BuilderIDRegexp, err)}
+	}
+	if rules.sourceRepo, err = regexp.Compile(policy.Provenance.SourceRepoRegexp); err != nil {
+		return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_ATTESTATION_POLICY_INVALID_REASON,
+			Err: fmt.Errorf("invalid sourceRepoRegexp %q: %w", policy.Provenance.SourceRepoRegexp, err)}
+	}
+	return rules, nil
+}
+
+// evaluate tells if the attestations satisfy the rules, when not it returns
+// the rules not satisfied
+func (r *attestationRules) evaluate(attestations []v1alpha1.AttestationSummary) (bool, string) {
+	failures := []string{}
+	if r.policy.Provenance != nil {
+		compliant := false
+		for _, attestation := range attestations {
+			if strings.HasPrefix(attestation.PredicateType, predicateSLSAProvenance) &&
+				r.builderID.MatchString(attestation.BuilderID) && r.sourceRepo.MatchString(attestation.SourceRepo) {
+				compliant = true
+				break
+			}
+		}
+		if !compliant {
+			failures = append(failures, fmt.Sprintf("no provenance of a builder matching %q from a source matching %q",
+				r.policy.Provenance.BuilderIDRegexp, r.policy.Provenance.SourceRepoRegexp))
+		}
+	}
+	if r.policy.SBOM != nil {
+		formats := r.policy.SBOM.Formats
+		if len(formats) == 0 {
+			formats = []v1alpha1.SBOMFormat{v1alpha1.SBOMFormatSPDX, v1alpha1.SBOMFormatCycloneDX}
+		}
+		compliant := false
+		for _, attestation := range attestations {
+			for _, format := range formats {
+				if attestation.SBOMFormat == format {
+					compliant = true
+				}
+			}
+		}
+		if !compliant {
+			names := make([]string, 0, len(formats))
+			for _, format := range formats {
+				names = append(names, string(format))
+			}
+			failures = append(failures, fmt.Sprintf("no %s SBOM", strings.Join(names, " or ")))
+		}
+	}
+	return len(failures) == 0, strings.Join(failures, "; ")
+}
+
+// VerifyAttestations verifies the cosign attestations of the digest of the
+// tag with the signers of the tag and of the signer groups, and evaluates the
+// rules of the attestation policy on the verified ones. The errors are the
+// ones loading the keys and the policies or resolving the image.
+func (bs *BundleService) VerifyAttestations(ctx context.Context, namespace string, repository string,
+	tag v1alpha1.EntandoBundleTag, signerPolicy *v1alpha1.SignerPolicy, policy *v1alpha1.AttestationPolicy,
+	keys *SignatureKeyService, log logr.Logger) (*v1alpha1.AttestationStatus, error) {
+	rules, err := newAttestationRules(policy)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := keys.Signers(ctx, namespace, tag, signerPolicy)
+	if err != nil {
+		return nil, err
+	}
+	imageRef, err := bs.ResolveImage(repository + "@" + tag.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &v1alpha1.AttestationStatus{}
+	for _, signer := range signers {
+		co, err := keys.CheckOpts(ctx, signer.Namespace, signer.Info)
+		if isKeyError(err) {
+			log.Info("attestations of a revoked or invalid key", "tag", tag.Tag, "digest", tag.Digest, "signer", signer.Name, "error", err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		attestations, err := bs.verifyAttestations(ctx, imageRef, co)
+		if err != nil {
+			log.Info("no attestation verified", "tag", tag.Tag, "digest", tag.Digest, "signer", signer.Name, "error", err.Error())
+			continue
+		}
+		for _, attestation := range attestations {
+			statement, err := attestationStatement(attestation)
+			if err != nil {
+				log.Info("invalid attestation", "digest", tag.Digest, "signer", signer.Name, "error", err.Error())
+				continue
+			}
+			summary, ok, err := attestationSummary(statement, signer.Name)
+			if err != nil {
+				log.Info("invalid attestation", "digest", tag.Digest, "signer", signer.Name, "error", err.Error())
+				continue
+			}
+			if ok {
+				status.Attestations = append(status.Attestations, summary)
+			}
+		}
+	}
+	status.Compliant, status.Message = rules.evaluate(status.Attestations)
+	return status, nil
+}
+
+// verifyAttestations returns the cosign attestations of the image verified
+// with the options of the key or of the keyless trust
+func (bs *BundleService) verifyAttestations(ctx context.Context, imageRef string, co *cosign.CheckOpts) ([]oci.Signature, error) {
+	ref, err := bs.setupCheckOpts(ctx, imageRef, co)
+	if err != nil {
+		return nil, err
+	}
+	co.ClaimVerifier = cosign.IntotoSubjectClaimVerifier
+	attestations, _, err := cosign.VerifyImageAttestations(ctx, ref, co)
+	return attestations, err
+}
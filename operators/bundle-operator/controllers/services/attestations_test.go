@@ -0,0 +1,204 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+	"github.com/sigstore/cosign/v2/pkg/oci/static"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/dsse"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	testBuilderID  = "https://github.com/slsa-framework/slsa-github-generator/.github/workflows/generator_container_slsa3.yml@refs/tags/v1.5.0"
+	testSourceRepo = "git+https://github.com/entando/example-bundle@refs/heads/main"
+)
+
+// testAttestation signs an in-toto statement of the predicate about the
+// digest, it returns the cosign attestation
+func testAttestation(t *testing.T, signer signature.Signer, digest string, predicateType string, predicate interface{}) oci.Signature {
+	statement, err := json.Marshal(map[string]interface{}{
+		"_type":         "https://in-toto.io/Statement/v0.1",
+		"predicateType": predicateType,
+		"subject": []map[string]interface{}{{
+			"name":   "registry.example.com/entando/bundle",
+			"digest": map[string]string{"sha256": strings.TrimPrefix(digest, "sha256:")},
+		}},
+		"predicate": predicate,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	envelope, err := dsse.WrapSigner(signer, "application/vnd.in-toto+json").SignMessage(bytes.NewReader(statement))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	att, err := static.NewAttestation(envelope)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return att
+}
+
+func TestVerifyAttestations(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+
+	// a provenance and a CycloneDX SBOM signed by the key of the bundle, an
+	// SPDX SBOM signed by another key
+	img := testBundleImage(t)
+	hash, err := img.Digest()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	digest := hash.String()
+	signer, publicKey := testSigner(t)
+	other, _ := testSigner(t)
+	sig := signDigest(t, signer, digest)
+	provenance := map[string]interface{}{
+		"builder":    map[string]string{"id": testBuilderID},
+		"invocation": map[string]interface{}{"configSource": map[string]string{"uri": testSourceRepo}},
+	}
+	writeAttestedLayout(t, dir, img, []oci.Signature{sig}, []oci.Signature{
+		testAttestation(t, signer, digest, "https://slsa.dev/provenance/v0.2", provenance),
+		testAttestation(t, signer, digest, predicateCycloneDX, map[string]string{"bomFormat": "CycloneDX"}),
+		testAttestation(t, other, digest, predicateSPDX, map[string]string{"spdxVersion": "SPDX-2.3"}),
+	})
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	base := &common.BaseK8sStructure{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Log: logr.Discard()}
+	tag := v1alpha1.EntandoBundleTag{Tag: "v1.0.0", Digest: digest,
+		SignatureInfo: []v1alpha1.SignatureInfo{{Name: "release", PubKey: string(publicKey)}}}
+
+	tests := []struct {
+		name      string
+		policy    *v1alpha1.AttestationPolicy
+		compliant bool
+		message   string
+		reason    string
+	}{
+		{name: "provenance", policy: &v1alpha1.AttestationPolicy{Provenance: &v1alpha1.ProvenancePolicy{
+			BuilderIDRegexp: `^https://github\.com/slsa-framework/slsa-github-generator/`, SourceRepoRegexp: `github\.com/entando/`}}, compliant: true},
+		{name: "provenance of another builder", policy: &v1alpha1.AttestationPolicy{Provenance: &v1alpha1.ProvenancePolicy{
+			BuilderIDRegexp: `^https://builder\.example\.com/`}}, message: "no provenance of a builder matching"},
+		{name: "provenance of another source", policy: &v1alpha1.AttestationPolicy{Provenance: &v1alpha1.ProvenancePolicy{
+			SourceRepoRegexp: `github\.com/other/`}}, message: "from a source matching"},
+		{name: "any sbom", policy: &v1alpha1.AttestationPolicy{SBOM: &v1alpha1.SBOMPolicy{}}, compliant: true},
+		{name: "spdx sbom of another key", policy: &v1alpha1.AttestationPolicy{SBOM: &v1alpha1.SBOMPolicy{
+			Formats: []v1alpha1.SBOMFormat{v1alpha1.SBOMFormatSPDX}}}, message: "no spdx SBOM"},
+		{name: "invalid rule", policy: &v1alpha1.AttestationPolicy{Provenance: &v1alpha1.ProvenancePolicy{BuilderIDRegexp: "("}},
+			reason: CONDITION_BUNDLE_ATTESTATION_POLICY_INVALID_REASON},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bs := &BundleService{}
+			status, err := bs.VerifyAttestations(ctx, "test", bundles.OCILayoutScheme+dir, tag, nil, test.policy,
+				NewSignatureKeyService(base), logr.Discard())
+			if test.reason != "" {
+				var keyErr *SignatureKeyError
+				if !errors.As(err, &keyErr) || keyErr.Reason != test.reason {
+					t.Fatalf("Expected %s error, got %v", test.reason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if status.Compliant != test.compliant || !strings.Contains(status.Message, test.message) {
+				t.Fatalf("Expected compliant %v %q, got %+v", test.compliant, test.message, status)
+			}
+			// only the attestations of the signers are summarized
+			if len(status.Attestations) != 2 || status.Attestations[0].Signer != "release" ||
+				status.Attestations[0].BuilderID != testBuilderID || status.Attestations[0].SourceRepo != testSourceRepo ||
+				status.Attestations[1].SBOMFormat != v1alpha1.SBOMFormatCycloneDX {
+				t.Fatalf("Unexpected attestations %+v", status.Attestations)
+			}
+		})
+	}
+
+	// the digests not compliant are not verified
+	bundle := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+		Spec: v1alpha1.EntandoBundleV2Spec{
+			Repository:        bundles.OCILayoutScheme + dir,
+			SignerPolicy:      &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementAnyOf},
+			AttestationPolicy: &v1alpha1.AttestationPolicy{SBOM: &v1alpha1.SBOMPolicy{Formats: []v1alpha1.SBOMFormat{v1alpha1.SBOMFormatSPDX}}},
+		},
+	}
+	bs := &BundleService{}
+	verification, err := bs.VerifyBundleTag(ctx, bundle, tag, NewSignatureKeyService(base), logr.Discard())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if verification.Verified || verification.Attestations == nil || !strings.Contains(verification.Message, "attestations not compliant") {
+		t.Fatalf("Expected digest not verified, got %+v", verification)
+	}
+}
+
+func TestAttestationSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		statement string
+		summary   v1alpha1.AttestationSummary
+		ok        bool
+	}{
+		{
+			name: "provenance v0.2",
+			statement: `{"predicateType":"https://slsa.dev/provenance/v0.2","predicate":{"builder":{"id":"builder"},` +
+				`"materials":[{"uri":"git+https://github.com/entando/example-bundle"}]}}`,
+			summary: v1alpha1.AttestationSummary{PredicateType: "https://slsa.dev/provenance/v0.2", Signer: "release",
+				BuilderID: "builder", SourceRepo: "git+https://github.com/entando/example-bundle"},
+			ok: true,
+		},
+		{
+			name: "provenance v1",
+			statement: `{"predicateType":"https://slsa.dev/provenance/v1","predicate":{"runDetails":{"builder":{"id":"builder"}},` +
+				`"buildDefinition":{"externalParameters":{"workflow":{"repository":"https://github.com/entando/example-bundle"}},` +
+				`"resolvedDependencies":[{"uri":"git+https://github.com/entando/other"}]}}}`,
+			summary: v1alpha1.AttestationSummary{PredicateType: "https://slsa.dev/provenance/v1", Signer: "release",
+				BuilderID: "builder", SourceRepo: "https://github.com/entando/example-bundle"},
+			ok: true,
+		},
+		{
+			name:      "spdx",
+			statement: `{"predicateType":"https://spdx.dev/Document","predicate":{}}`,
+			summary:   v1alpha1.AttestationSummary{PredicateType: predicateSPDX, Signer: "release", SBOMFormat: v1alpha1.SBOMFormatSPDX},
+			ok:        true,
+		},
+		{
+			name:      "vulnerability scan",
+			statement: `{"predicateType":"https://cosign.sigstore.dev/attestation/vuln/v1","predicate":{}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			summary, ok, err := attestationSummary([]byte(test.statement), "release")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if ok != test.ok || (ok && summary != test.summary) {
+				t.Fatalf("Expected %v %+v, got %v %+v", test.ok, test.summary, ok, summary)
+			}
+		})
+	}
+
+	if _, _, err := attestationSummary([]byte("not a statement"), "release"); err == nil {
+		t.Fatal("Expected invalid statement error")
+	}
+}
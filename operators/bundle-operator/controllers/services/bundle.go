@@ -2,55 +2,234 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	utility "github.com/gigiozzz/depiy/common-libs/utilities"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/renderer"
 	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/sigstore/cosign/v2/cmd/cosign/cli/verify"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
 	ociremote "github.com/sigstore/cosign/v2/pkg/oci/remote"
 )
 
 type BundleService struct {
+	// Cache stores the extracted bundles by digest
+	Cache *bundles.Cache
+	// Keychain resolves the credentials of the registries, when nil the
+	// bundles are pulled anonymously
+	Keychain authn.Keychain
+	// Mirrors are the mirror rules of the pulls, nil without rules
+	Mirrors *bundles.MirrorConfig
+	// Repository is the repository of the bundle referenced by the instance,
+	// when empty the one of the instance spec
+	Repository string
+
+	mu       sync.Mutex
+	resolved map[string]string
 }
 
-func NewBundleService() *BundleService {
-	return &BundleService{}
+// NewBundleService returns a service that stores the extracted bundles in
+// cache, when cache is nil the files of the bundles are read from the registry
+func NewBundleService(cache *bundles.Cache) *BundleService {
+	return &BundleService{Cache: cache}
 }
 
-func (bs *BundleService) CheckBundleSignature(ctx context.Context, cr *v1alpha1.EntandoBundleV2, log logr.Logger) (map[string]string, error) {
+// CheckBundleSignature verifies the signatures of the tags of the bundle
+// under its signer policy with the public keys loaded by keys, it returns the
+// annotations of the verified tags and the verification of each tag. A public
+// key or a policy that can't be loaded is a *SignatureKeyError, returned with
+// the verifications where the tags of the key are not verified.
+func (bs *BundleService) CheckBundleSignature(ctx context.Context, cr *v1alpha1.EntandoBundleV2, keys *SignatureKeyService,
+	log logr.Logger) (map[string]string, []TagVerification, error) {
 	m := make(map[string]string, len(cr.Spec.TagList))
+	verifications := make([]TagVerification, 0, len(cr.Spec.TagList))
+	var keyErr error
 	for _, tag := range cr.Spec.TagList {
-		if len(tag.SignatureInfo) <= 0 {
-			return nil, fmt.Errorf("error signature info empty")
-		}
-		verifyOk := true
-		for _, signature := range tag.SignatureInfo {
-			err := bs.verifySignature(cr.Spec.Repository+"@"+tag.Digest, signature.PubKeySecret)
-			if err != nil {
-				verifyOk = false
-				log.Error(err, "error verify signature ",
-					"tag", tag.Tag, "digest", tag.Digest, "signType", signature.Type)
+		verification, err := bs.VerifyBundleTag(ctx, cr, tag, keys, log)
+		var tagKeyErr *SignatureKeyError
+		if errors.As(err, &tagKeyErr) {
+			// a key removed from its secret no longer verifies the tag
+			verification = TagVerification{Tag: tag.Tag, Digest: tag.Digest, Message: err.Error()}
+			if keyErr == nil {
+				keyErr = err
 			}
+		} else if err != nil {
+			return nil, nil, err
+		}
+		verifications = append(verifications, verification)
+		if verification.Verified {
+			m[SignatureAnnotation(tag.Digest)] = "Verified"
+		}
+	}
+	return m, verifications, keyErr
+}
+
+// SignatureAnnotation returns the annotation of the bundle that marks the
+// digest as verified
+func SignatureAnnotation(digest string) string {
+	return utility.TruncateString("signature-"+strings.Split(digest, ":")[1], 63)
+}
+
+// VerifyBundleTag verifies the digest of the tag under the signer policy of
+// the bundle and, with an attestation policy, its attestations. A digest with
+// attestations not compliant is not verified.
+func (bs *BundleService) VerifyBundleTag(ctx context.Context, cr *v1alpha1.EntandoBundleV2, tag v1alpha1.EntandoBundleTag,
+	keys *SignatureKeyService, log logr.Logger) (TagVerification, error) {
+	verification, err := bs.VerifyTag(ctx, cr.GetNamespace(), cr.Spec.Repository, tag, cr.Spec.SignerPolicy, keys, log)
+	if err != nil || cr.Spec.AttestationPolicy == nil {
+		return verification, err
+	}
+	attestations, err := bs.VerifyAttestations(ctx, cr.GetNamespace(), cr.Spec.Repository, tag,
+		cr.Spec.SignerPolicy, cr.Spec.AttestationPolicy, keys, log)
+	if err != nil {
+		return verification, err
+	}
+	verification.Attestations = attestations
+	if verification.Verified && !attestations.Compliant {
+		verification.Verified = false
+		verification.Message = "attestations not compliant: " + attestations.Message
+	}
+	return verification, nil
+}
+
+// VerifyTag verifies the digest of the tag with its signers and the ones of
+// the signer groups of the policy, the digest is verified when the signers
+// required by the policy verify it. The errors are the ones loading the keys
+// and the policy or resolving the image, not the failed verifications.
+func (bs *BundleService) VerifyTag(ctx context.Context, namespace string, repository string,
+	tag v1alpha1.EntandoBundleTag, policy *v1alpha1.SignerPolicy, keys *SignatureKeyService, log logr.Logger) (TagVerification, error) {
+	verification := TagVerification{Tag: tag.Tag, Digest: tag.Digest}
+	signers, err := keys.Signers(ctx, namespace, tag, policy)
+	if err != nil {
+		return verification, err
+	}
+	if len(signers) == 0 {
+		verification.Message = fmt.Sprintf("digest %s has no signatures", tag.Digest)
+		return verification, nil
+	}
+	required, err := requiredSigners(policy, len(signers))
+	if err != nil {
+		return verification, err
+	}
+	imageRef, err := bs.ResolveImage(repository + "@" + tag.Digest)
+	if err != nil {
+		return verification, err
+	}
+
+	verification.Verified, verification.Signers, verification.Message, err = bs.verifySigners(ctx, imageRef, signers, required, keys, log)
+	return verification, err
+}
 
+// verifySigners verifies the signatures of the image with the signers, the
+// image is verified by the required number of signers, each counted once. A
+// signer whose key can't be loaded doesn't verify the image, its error is
+// returned only when the image is not verified. When not verified it returns
+// the failures.
+func (bs *BundleService) verifySigners(ctx context.Context, imageRef string, signers []Signer, required int,
+	keys *SignatureKeyService, log logr.Logger) (bool, []v1alpha1.SignerStatus, string, error) {
+	verified := map[string]bool{}
+	statuses := []v1alpha1.SignerStatus{}
+	failures := []string{}
+	var keyErr error
+	for _, signer := range signers {
+		status := v1alpha1.SignerStatus{Name: signer.Name, Group: signer.Group}
+		co, err := keys.CheckOpts(ctx, signer.Namespace, signer.Info)
+		if isKeyError(err) {
+			var revokedErr *RevokedKeyError
+			if keyErr == nil && !errors.As(err, &revokedErr) {
+				keyErr = err
+			}
+			status.Message = err.Error()
+			failures = append(failures, fmt.Sprintf("%s: %s", signer.Name, err))
+			statuses = append(statuses, status)
+			continue
 		}
-		if verifyOk {
-			key := utility.TruncateString("signature-"+strings.Split(tag.Digest, ":")[1], 63)
-			m[key] = "Verified"
+		if err != nil {
+			return false, nil, "", err
 		}
-		/*
-			ref, err := bs.retrieveSignatureImageRef(cr.Spec.Repository + "@" + tag.Digest)
-			if err != nil {
-				return nil, err
+		if err := bs.verifySignature(ctx, imageRef, co); err != nil {
+			status.Message = err.Error()
+			failures = append(failures, fmt.Sprintf("%s: %s", signer.Name, err))
+			log.Error(err, "error verify signature ",
+				"image", imageRef, "signer", signer.Name, "group", signer.Group, "signType", signer.Info.Type)
+		} else {
+			status.Verified = true
+			identity := keylessIdentityKey(signer.Info)
+			if co.SigVerifier != nil {
+				if identity, err = verifierIdentity(co.SigVerifier); err != nil {
+					return false, nil, "", err
+				}
 			}
-			fmt.Println("ref signature: " + ref)
-		*/
+			verified[identity] = true
+		}
+		statuses = append(statuses, status)
+	}
+	if len(verified) >= required {
+		return true, statuses, "", nil
+	}
+	return false, statuses, fmt.Sprintf("verified by %d of %d signers, %d required: %s",
+		len(verified), len(signers), required, strings.Join(failures, "; ")), keyErr
+}
+
+// isKeyError tells if the error is the one of a key that can't be loaded or
+// is revoked, the signer doesn't verify anything
+func isKeyError(err error) bool {
+	var keyErr *SignatureKeyError
+	var revokedErr *RevokedKeyError
+	return errors.As(err, &keyErr) || errors.As(err, &revokedErr)
+}
+
+// signatureTypeOrDefault returns the type of the signature, KEY_PAIR when
+// not set
+func signatureTypeOrDefault(signatureType v1alpha1.SignatureType) v1alpha1.SignatureType {
+	if signatureType == "" {
+		return v1alpha1.SignatureKeyPair
+	}
+	return signatureType
+}
+
+// ResolveImage returns the reference the image is pulled from, after the
+// mirror rules. The resolutions are kept for the life of the service, so
+// that the pulls of a reconcile use the same mirror.
+func (bs *BundleService) ResolveImage(image string) (string, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if resolved, ok := bs.resolved[image]; ok {
+		return resolved, nil
+	}
+	resolved, err := bs.Mirrors.Resolve(image, bs.craneOptions()...)
+	if err != nil {
+		return "", err
+	}
+	if bs.resolved == nil {
+		bs.resolved = map[string]string{}
+	}
+	bs.resolved[image] = resolved
+	return resolved, nil
+}
+
+// BundleRepository returns the repository of the bundle of the instance
+func (bs *BundleService) BundleRepository(cr *v1alpha1.EntandoBundleInstanceV2) string {
+	if bs.Repository != "" {
+		return bs.Repository
 	}
-	return m, nil
+	return cr.Spec.Repository
+}
+
+// BundleImage returns the reference of the bundle of the instance
+func (bs *BundleService) BundleImage(cr *v1alpha1.EntandoBundleInstanceV2) string {
+	return bs.BundleRepository(cr) + "@" + cr.Spec.Digest
 }
 
 func (bs *BundleService) GenerateBundleCode(cr *v1alpha1.EntandoBundleV2) string {
@@ -58,29 +237,97 @@ func (bs *BundleService) GenerateBundleCode(cr *v1alpha1.EntandoBundleV2) string
 	return "bundle-" + strings.ToLower(utility.TruncateString(s, 8))
 }
 
-func (bs *BundleService) GetComponents(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) ([]bundles.Component, string, error) {
-	/*
-		repository := "docker.io/gigiozzz/bundle-test-op"
-		concat := "@"
-		digest := "sha256:70ba938d4e11f219fc9dc0424e3e55173419a1da51598b341bb2162ea088a8a4"
-	*/
-	dir, err := ioutil.TempDir("/tmp", "crane-"+cr.Spec.Digest+"-")
+// GetComponents reads the components of the bundle of the instance and
+// returns the files of the bundle, release must be called when they are no
+// longer used. The descriptor and the files read by the components are
+// extracted in the cache, without cache the files are read from the registry
+// when needed.
+func (bs *BundleService) GetComponents(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) ([]bundles.Component, fs.FS, func(), error) {
+	imageRef, err := bs.ResolveImage(bs.BundleImage(cr))
 	if err != nil {
-		return nil, dir, err
+		return nil, nil, nil, err
 	}
 
-	err = bundles.ExtractImageTo(cr.Spec.Repository+"@"+cr.Spec.Digest, dir)
-	if err != nil {
-		return nil, dir, err
+	var bundle fs.FS
+	release := func() {}
+	if bs.Cache != nil {
+		dir, cacheRelease, err := bs.Cache.Get(cr.Spec.Digest, func(dir string) error {
+			imageFS, err := bundles.OpenImageFS(imageRef, bs.craneOptions()...)
+			if err != nil {
+				return err
+			}
+			return extractBundleFiles(imageFS, dir)
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bundle, release = os.DirFS(dir), cacheRelease
+	} else {
+		imageFS, err := bundles.OpenImageFS(imageRef, bs.craneOptions()...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bundle = imageFS
 	}
 
-	bundleDescriptor, err := bundles.ReadBundleDescriptor(dir + "/descriptor.yaml")
+	bundleDescriptor, err := bundles.ReadBundleDescriptor(bundle)
 	if err != nil {
-		return nil, dir, err
+		release()
+		return nil, nil, nil, err
 	}
 
-	return bundleDescriptor.Components, dir, nil
+	return bundleDescriptor.Components, bundle, release, nil
+}
+
+// extractBundleFiles extracts to dir the descriptor of the bundle and the
+// files read by its components, the other files of the image are not written
+func extractBundleFiles(bundle fs.FS, dir string) error {
+	descriptor, err := bundles.ReadBundleDescriptor(bundle)
+	if err != nil {
+		return err
+	}
+	names := []string{bundles.DescriptorFileName}
+	for i := range descriptor.Components {
+		component := &descriptor.Components[i]
+		if isManifest, manifest := component.GetIfIsManifest(); isManifest {
+			names = append(names, bundles.FilePath(manifest.FilePath))
+		}
+		if isHelm, helm := component.GetIfIsHelm(); isHelm {
+			// the chart is loaded with its subcharts and templates
+			err := fs.WalkDir(bundle, bundles.FilePath(helm.ChartPath), func(name string, _ fs.DirEntry, err error) error {
+				names = append(names, name)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, valuesFile := range helm.ValuesFiles {
+				names = append(names, bundles.FilePath(valuesFile))
+			}
+		}
+		if isKustomize, kustomize := component.GetIfIsKustomize(); isKustomize {
+			files, err := renderer.KustomizationFiles(bundle, bundles.FilePath(kustomize.Path))
+			if err != nil {
+				return err
+			}
+			names = append(names, files...)
+		}
+	}
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return bundles.ExtractFiles(bundle, dir, unique, bundles.DefaultExtractLimits)
+}
 
+func (bs *BundleService) craneOptions() []crane.Option {
+	if bs.Keychain == nil {
+		return nil
+	}
+	return []crane.Option{crane.WithAuthFromKeychain(bs.Keychain)}
 }
 
 func (bs *BundleService) retrieveSignatureImageRef(imageRef string) (string, error) {
@@ -98,27 +345,33 @@ func (bs *BundleService) retrieveSignatureImageRef(imageRef string) (string, err
 	return tag.Name(), nil
 }
 
-func (bs *BundleService) verifySignature(imageRef string, key string) error {
-	/*
-		o := &options.VerifyOptions{}
-
-		annotations, err := o.AnnotationsMap()
-		if err != nil {
-			return err
-		}
-
-		hashAlgorithm, err := o.SignatureDigest.HashAlgorithm()
-		if err != nil {
-			return err
-		}
-	*/
-
-	v := verify.VerifyCommand{
-		KeyRef:         key,
-		SkipTlogVerify: true,
+// verifySignature verifies the cosign signature of the image, of a registry
+// or a local source, with the options of the key or of the keyless trust
+func (bs *BundleService) verifySignature(ctx context.Context, imageRef string, co *cosign.CheckOpts) error {
+	ref, err := bs.setupCheckOpts(ctx, imageRef, co)
+	if err != nil {
+		return err
 	}
-
-	err := v.Exec(context.TODO(), []string{imageRef})
-
+	co.ClaimVerifier = cosign.SimpleClaimVerifier
+	_, _, err = cosign.VerifyImageSignatures(ctx, ref, co)
 	return err
 }
+
+// setupCheckOpts sets the registry options of the image, of a registry or a
+// local source, and returns its reference
+func (bs *BundleService) setupCheckOpts(ctx context.Context, imageRef string, co *cosign.CheckOpts) (name.Reference, error) {
+	source, err := bundles.ParseSource(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := name.ParseReference(source.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("parsing reference: %w", err)
+	}
+	remoteOpts := []remote.Option{remote.WithContext(ctx)}
+	if bs.Keychain != nil {
+		remoteOpts = append(remoteOpts, remote.WithAuthFromKeychain(bs.Keychain))
+	}
+	co.RegistryClientOpts = []ociremote.Option{ociremote.WithRemoteOptions(source.RemoteOptions(remoteOpts...)...)}
+	return ref, nil
+}
@@ -1,10 +1,51 @@
 package services
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+	cosignmutate "github.com/sigstore/cosign/v2/pkg/oci/mutate"
+	"github.com/sigstore/cosign/v2/pkg/oci/signed"
+	"github.com/sigstore/cosign/v2/pkg/oci/static"
+	sigs "github.com/sigstore/cosign/v2/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
+func TestMain(m *testing.M) {
+	// the local sources of the tests are written in temporary directories
+	bundles.LocalSourceRoots = []string{os.TempDir()}
+	os.Exit(m.Run())
+}
+
 func TestRetrieveSignatureImageRef(t *testing.T) {
 	bs := &BundleService{}
 
@@ -16,25 +57,256 @@ func TestRetrieveSignatureImageRef(t *testing.T) {
 	}
 }
 
-func TestVerifySignature(t *testing.T) {
-	bs := &BundleService{}
+// signedLayout writes a signed bundle image and its cosign signature to an
+// OCI image layout, it returns the digest of the image and the public key
+func signedLayout(t *testing.T, dir string) (string, []byte) {
+	img := testBundleImage(t)
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sig, publicKey := testSignature(t, digest.String())
+	writeSignedLayout(t, dir, img, sig)
+	return digest.String(), publicKey
+}
+
+// testBundleImage returns the image of a bundle
+func testBundleImage(t *testing.T) v1.Image {
+	img, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte("name: example\n")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return img
+}
+
+// testSigner returns a new signer and its public key
+func testSigner(t *testing.T) (signature.SignerVerifier, []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := signature.LoadECDSASignerVerifier(priv, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	publicKey, err := cryptoutils.MarshalPublicKeyToPEM(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signer, publicKey
+}
 
-	image := "docker.io/gigiozzz/bundle-test-op@sha256:a41dbb9b16f052f1d26a22a5de34671e831cfb6fd327726f89bed5f8798dfd23"
-	k8sKeySecret := "k8s://bundle-operator/bundle-a4e2c0a3-key-secret"
-	err := bs.verifySignature(image, k8sKeySecret)
+// testSignature signs the digest with a new key, it returns the cosign
+// signature and the public key
+func testSignature(t *testing.T, digest string) (oci.Signature, []byte) {
+	signer, publicKey := testSigner(t)
+	return signDigest(t, signer, digest), publicKey
+}
+
+// signDigest returns the cosign signature of the digest
+func signDigest(t *testing.T, signer signature.Signer, digest string) oci.Signature {
+	imageRef, err := name.NewDigest("registry.example.com/entando/bundle@" + digest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	claims, err := payload.Cosign{Image: imageRef}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rawSignature, err := signer.SignMessage(bytes.NewReader(claims))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sig, err := static.NewSignature(claims, base64.StdEncoding.EncodeToString(rawSignature))
 	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return sig
+}
+
+// writeSignedLayout writes the image, tagged v1.0.0, and its cosign
+// signatures to an OCI image layout
+func writeSignedLayout(t *testing.T, dir string, img v1.Image, sigs ...oci.Signature) {
+	writeAttestedLayout(t, dir, img, sigs, nil)
+}
+
+// writeAttestedLayout writes the image, tagged v1.0.0, its cosign signatures
+// and its cosign attestations to an OCI image layout
+func writeAttestedLayout(t *testing.T, dir string, img v1.Image, sigs []oci.Signature, atts []oci.Signature) {
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signedImage := signed.Image(img)
+	for _, sig := range sigs {
+		if signedImage, err = cosignmutate.AttachSignatureToImage(signedImage, sig); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, att := range atts {
+		if signedImage, err = cosignmutate.AttachAttestationToImage(signedImage, att); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	signatures, err := signedImage.Signatures()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	refName := "org.opencontainers.image.ref.name"
+	if err := path.AppendImage(img, layout.WithAnnotations(map[string]string{refName: "v1.0.0"})); err != nil {
+		t.Fatal(err.Error())
+	}
+	signatureTag := digest.Algorithm + "-" + digest.Hex + ".sig"
+	if err := path.AppendImage(signatures, layout.WithAnnotations(map[string]string{refName: signatureTag})); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(atts) == 0 {
+		return
+	}
+	attestations, err := signedImage.Attestations()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	attestationTag := digest.Algorithm + "-" + digest.Hex + ".att"
+	if err := path.AppendImage(attestations, layout.WithAnnotations(map[string]string{refName: attestationTag})); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestVerifySignatureLocalSource(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	digest, publicKey := signedLayout(t, filepath.Join(dir, "layout"))
+	verifier, err := sigs.LoadPublicKeyRaw(publicKey, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	bs := &BundleService{}
+	image := bundles.OCILayoutScheme + filepath.Join(dir, "layout") + "@" + digest
+	if err := bs.verifySignature(ctx, image, &cosign.CheckOpts{SigVerifier: verifier, SkipTlogVerify: true}); err != nil {
 		t.Fatalf("Invalid signature for %q. error %s", image, err)
 	}
+
+	// a signature of another key
+	_, otherKey := signedLayout(t, filepath.Join(dir, "other"))
+	otherVerifier, err := sigs.LoadPublicKeyRaw(otherKey, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := bs.verifySignature(ctx, image, &cosign.CheckOpts{SigVerifier: otherVerifier, SkipTlogVerify: true}); err == nil {
+		t.Fatalf("Expected signature of %q not verified by another key", image)
+	}
 }
 
-func TestVerifySignatureError(t *testing.T) {
+func TestCheckBundleSignature(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	digest, publicKey := signedLayout(t, filepath.Join(dir, "layout"))
+	_, otherKey := signedLayout(t, filepath.Join(dir, "other"))
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-key", Namespace: "test"},
+		Data:       map[string][]byte{DefaultPubKeySecretKey: publicKey, "other.pub": otherKey},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+	keys := NewSignatureKeyService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+
+	bundle := func(signatureInfo ...v1alpha1.SignatureInfo) *v1alpha1.EntandoBundleV2 {
+		return &v1alpha1.EntandoBundleV2{
+			ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+			Spec: v1alpha1.EntandoBundleV2Spec{
+				Repository: bundles.OCILayoutScheme + filepath.Join(dir, "layout"),
+				TagList:    []v1alpha1.EntandoBundleTag{{Tag: "v1.0.0", Digest: digest, SignatureInfo: signatureInfo}},
+			},
+		}
+	}
+	verifiedKey := "signature-" + strings.TrimPrefix(digest, "sha256:")[:53]
+
 	bs := &BundleService{}
+	for _, info := range []v1alpha1.SignatureInfo{
+		{Type: v1alpha1.SignatureKeyPair, PubKeySecret: "bundle-key"},
+		{Type: v1alpha1.SignatureKeyPair, PubKey: string(publicKey)},
+	} {
+		verified, _, err := bs.CheckBundleSignature(ctx, bundle(info), keys, logr.Discard())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if verified[verifiedKey] != "Verified" {
+			t.Fatalf("Expected tag verified, got %v", verified)
+		}
+	}
 
-	image := "docker.io/gigiozzz/bundle-test-op@sha256:a41dbb9b16f052f1d26a22a5de34671e831cfb6fd327726f89bed5f8798dfd23"
-	k8sKeySecret := "k8s://bundle-operator/bundle-a4e2c0a3-key-secretssss"
-	err := bs.verifySignature(image, k8sKeySecret)
-	if err == nil {
-		t.Fatalf("Invalid signature for %q. error %s", image, err)
+	// a tag signed by another key is not verified
+	verified, _, err := bs.CheckBundleSignature(ctx, bundle(v1alpha1.SignatureInfo{PubKeySecret: "bundle-key", PubKeySecretKey: "other.pub"}), keys, logr.Discard())
+	if err != nil || len(verified) != 0 {
+		t.Fatalf("Expected tag not verified, got %v error %v", verified, err)
+	}
+
+	// a key that can't be loaded is reported with its reason
+	_, _, err = bs.CheckBundleSignature(ctx, bundle(v1alpha1.SignatureInfo{PubKeySecret: "missing"}), keys, logr.Discard())
+	var keyErr *SignatureKeyError
+	if !errors.As(err, &keyErr) || keyErr.Reason != CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON {
+		t.Fatalf("Expected %s error, got %v", CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON, err)
+	}
+}
+
+func TestExtractBundleFiles(t *testing.T) {
+	bundle := fstest.MapFS{
+		"descriptor.yaml": {Data: []byte(`version: v1.0.0
+name: example
+components:
+  - name: service
+    type: MANIFEST
+    spec:
+      filePath: manifests/service.yaml
+  - name: db
+    type: HELM
+    spec:
+      chartPath: charts/db
+      valuesFiles:
+        - values/db.yaml
+  - name: app
+    type: KUSTOMIZE
+    spec:
+      path: kustomize/overlay
+`)},
+		"manifests/service.yaml":               {Data: []byte("kind: Service")},
+		"manifests/unused.yaml":                {Data: []byte("kind: Secret")},
+		"charts/db/Chart.yaml":                 {Data: []byte("name: db")},
+		"charts/db/templates/service.yaml":     {Data: []byte("kind: Service")},
+		"values/db.yaml":                       {Data: []byte("replicas: 1")},
+		"kustomize/overlay/kustomization.yaml": {Data: []byte("resources:\n  - ../base\n")},
+		"kustomize/base/kustomization.yaml":    {Data: []byte("resources:\n  - deployment.yaml\n")},
+		"kustomize/base/deployment.yaml":       {Data: []byte("kind: Deployment")},
+		"plugins/large.bin":                    {Data: []byte("not read by the components")},
+	}
+
+	dir := t.TempDir()
+	if err := extractBundleFiles(bundle, dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, expected := range []string{"descriptor.yaml", "manifests/service.yaml", "charts/db/templates/service.yaml",
+		"values/db.yaml", "kustomize/overlay/kustomization.yaml", "kustomize/base/deployment.yaml"} {
+		if _, err := os.Stat(filepath.Join(dir, expected)); err != nil {
+			t.Fatalf("Expected %s extracted: %v", expected, err)
+		}
+	}
+	for _, unexpected := range []string{"manifests/unused.yaml", "plugins/large.bin"} {
+		if _, err := os.Stat(filepath.Join(dir, unexpected)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s not extracted, got %v", unexpected, err)
+		}
+	}
+	if _, err := bundles.ReadBundleDescriptor(os.DirFS(dir)); err != nil {
+		t.Fatalf("Expected the extracted bundle valid: %v", err)
 	}
-	fmt.Println("the error is: " + err.Error())
 }
@@ -2,7 +2,10 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
 	common "github.com/gigiozzz/depiy/common-libs/commons"
 	utility "github.com/gigiozzz/depiy/common-libs/utilities"
@@ -22,13 +25,46 @@ const (
 	CONDITION_PLUGIN_CR_APPLIED_REASON = "PluginCrIsApplied"
 	CONDITION_PLUGIN_CR_APPLIED_MSG    = "Your Plugin cr was applied"
 
-	CONDITION_PLUGIN_CR_READY        = "PluginCrReady"
-	CONDITION_PLUGIN_CR_READY_REASON = "PluginCrIsReady"
-	CONDITION_PLUGIN_CR_READY_MSG    = "Your Plugin cr is ready"
-
-	CONDITION_INSTANCE_READY        = "InstanceReady"
-	CONDITION_INSTANCE_READY_REASON = "InstanceIsReady"
-	CONDITION_INSTANCE_READY_MSG    = "Your Instance is ready"
+	CONDITION_PLUGIN_CR_READY            = "PluginCrReady"
+	CONDITION_PLUGIN_CR_READY_REASON     = "PluginCrIsReady"
+	CONDITION_PLUGIN_CR_NOT_READY_REASON = "PluginCrIsNotReady"
+	CONDITION_PLUGIN_CR_READY_MSG        = "Your Plugin cr is ready"
+
+	CONDITION_HELM_RELEASE_RENDERED               = "HelmReleaseRendered"
+	CONDITION_HELM_RELEASE_RENDERED_REASON        = "HelmReleaseIsRendered"
+	CONDITION_HELM_RELEASE_RENDERED_FAILED_REASON = "HelmReleaseRenderFailed"
+	CONDITION_HELM_RELEASE_RENDERED_MSG           = "Your Helm chart was rendered for release"
+
+	CONDITION_HELM_RELEASE_APPLIED                 = "HelmReleaseApplied"
+	CONDITION_HELM_RELEASE_APPLIED_REASON          = "HelmReleaseIsApplied"
+	CONDITION_HELM_RELEASE_APPLIED_FAILED_REASON   = "HelmReleaseApplyFailed"
+	CONDITION_HELM_RELEASE_UNINSTALL_FAILED_REASON = "HelmReleaseUninstallFailed"
+	CONDITION_HELM_RELEASE_APPLIED_MSG             = "Your Helm release was applied"
+
+	CONDITION_KUSTOMIZATION_APPLIED               = "KustomizationApplied"
+	CONDITION_KUSTOMIZATION_APPLIED_REASON        = "KustomizationIsApplied"
+	CONDITION_KUSTOMIZATION_APPLIED_FAILED_REASON = "KustomizationApplyFailed"
+	CONDITION_KUSTOMIZATION_APPLIED_MSG           = "Your Kustomization was applied"
+
+	CONDITION_DESCRIPTOR_INVALID        = "DescriptorInvalid"
+	CONDITION_DESCRIPTOR_INVALID_REASON = "DescriptorIsInvalid"
+
+	CONDITION_SIGNATURE_VERIFIED                  = "SignatureVerified"
+	CONDITION_SIGNATURE_VERIFIED_REASON           = "SignatureIsVerified"
+	CONDITION_SIGNATURE_NOT_VERIFIED_REASON       = "SignatureNotVerified"
+	CONDITION_SIGNATURE_VERIFICATION_ERROR_REASON = "SignatureVerificationError"
+	CONDITION_SIGNATURE_VERIFIED_MSG              = "The signature of the bundle digest is verified"
+
+	CONDITION_INSTANCE_READY            = "InstanceReady"
+	CONDITION_INSTANCE_READY_REASON     = "InstanceIsReady"
+	CONDITION_INSTANCE_NOT_READY_REASON = "ComponentsNotReady"
+	CONDITION_INSTANCE_READY_MSG        = "Your Instance is ready"
+
+	CONDITION_INSTANCE_INSTALLED         = "InstanceInstalled"
+	CONDITION_INSTANCE_INSTALLED_REASON  = "InstanceIsInstalled"
+	CONDITION_INSTANCE_INSTALLING_REASON = "InstanceIsInstalling"
+	CONDITION_INSTANCE_INSTALLED_MSG     = "Your Instance was installed"
+	CONDITION_INSTANCE_INSTALLING_MSG    = "Your Instance is being installed"
 
 	// Bundle CR condition
 	CONDITION_INSTANCE_CR_APPLIED        = "InstanceCrApplied"
@@ -42,10 +78,30 @@ const (
 	CONDITION_BUNDLE_READY        = "BundleReady"
 	CONDITION_BUNDLE_READY_REASON = "BundleIsReady"
 	CONDITION_BUNDLE_READY_MSG    = "Your Bundle is ready"
+
+	CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON = "PubKeySecretNotFound"
+	CONDITION_BUNDLE_PUB_KEY_INVALID_REASON          = "PubKeyInvalid"
+	CONDITION_BUNDLE_KEYLESS_IDENTITY_INVALID_REASON = "KeylessIdentityInvalid"
+	CONDITION_BUNDLE_TRUST_ROOTS_INVALID_REASON      = "TrustRootsInvalid"
+	CONDITION_BUNDLE_SIGNER_GROUP_NOT_FOUND_REASON   = "SignerGroupNotFound"
+	CONDITION_BUNDLE_SIGNER_POLICY_INVALID_REASON    = "SignerPolicyInvalid"
+
+	CONDITION_BUNDLE_ATTESTATION_POLICY_INVALID_REASON = "AttestationPolicyInvalid"
+
+	CONDITION_BUNDLE_REVOKED_KEYS_INVALID_REASON = "RevokedKeysInvalid"
+	CONDITION_SIGNATURE_REVOKED_REASON           = "SignatureRevoked"
+
+	CONDITION_BUNDLE_TAG_DISCOVERY_INVALID_REASON = "TagDiscoveryInvalid"
 )
 
+// conditionMessageMaxLength is the max length of a condition message accepted by the api server
+const conditionMessageMaxLength = 32768
+
 type ConditionService struct {
 	Base *common.BaseK8sStructure
+	// mu serializes the updates of the status, the components of an
+	// instance are applied in parallel
+	mu sync.Mutex
 }
 
 func NewConditionService(base *common.BaseK8sStructure) *ConditionService {
@@ -54,22 +110,22 @@ func NewConditionService(base *common.BaseK8sStructure) *ConditionService {
 	}
 }
 
-func (cs *ConditionService) IsPluginCrReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) bool {
+func (cs *ConditionService) IsPluginCrReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, pluginCode string) bool {
 
-	condition, observedGeneration := cs.getConditionStatus(ctx, cr, CONDITION_PLUGIN_CR_READY)
+	condition, observedGeneration := cs.getConditionStatus(ctx, cr, CONDITION_PLUGIN_CR_READY+"-"+pluginCode)
 
 	return metav1.ConditionTrue == condition && observedGeneration == cr.Generation
 }
 
-func (cs *ConditionService) SetConditionPluginCrReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+func (cs *ConditionService) SetConditionPluginCrReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, pluginCode string) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_PLUGIN_CR_READY+"-"+pluginCode, metav1.ConditionTrue,
+		CONDITION_PLUGIN_CR_READY_REASON, CONDITION_PLUGIN_CR_READY_MSG)
+}
 
-	cs.deleteCondition(ctx, cr, CONDITION_PLUGIN_CR_READY)
-	return utility.AppendCondition(ctx, cs.Base.Client, cr,
-		CONDITION_PLUGIN_CR_READY,
-		metav1.ConditionTrue,
-		CONDITION_PLUGIN_CR_READY_REASON,
-		CONDITION_PLUGIN_CR_READY_MSG,
-		cr.Generation)
+func (cs *ConditionService) SetConditionPluginCrNotReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	pluginCode string, message string) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_PLUGIN_CR_READY+"-"+pluginCode, metav1.ConditionFalse,
+		CONDITION_PLUGIN_CR_NOT_READY_REASON, message)
 }
 
 func (cs *ConditionService) IsManifestApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, manifestId string) bool {
@@ -83,7 +139,7 @@ func (cs *ConditionService) SetConditionManifestApplied(ctx context.Context, cr
 	manifestId string, manifestPath string) error {
 
 	cs.deleteCondition(ctx, cr, CONDITION_MANIFEST_APPLIED+"-"+manifestId)
-	return utility.AppendCondition(ctx, cs.Base.Client, cr,
+	return cs.appendCondition(ctx, cr,
 		CONDITION_MANIFEST_APPLIED+"-"+manifestId,
 		metav1.ConditionTrue,
 		CONDITION_MANIFEST_APPLIED_REASON,
@@ -101,7 +157,7 @@ func (cs *ConditionService) IsPluginCrApplied(ctx context.Context, cr *v1alpha1.
 func (cs *ConditionService) SetConditionPluginCrApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, pluginCode string) error {
 
 	cs.deleteCondition(ctx, cr, CONDITION_PLUGIN_CR_APPLIED+"-"+pluginCode)
-	return utility.AppendCondition(ctx, cs.Base.Client, cr,
+	return cs.appendCondition(ctx, cr,
 		CONDITION_PLUGIN_CR_APPLIED+"-"+pluginCode,
 		metav1.ConditionTrue,
 		CONDITION_PLUGIN_CR_APPLIED_REASON,
@@ -109,6 +165,101 @@ func (cs *ConditionService) SetConditionPluginCrApplied(ctx context.Context, cr
 		cr.Generation)
 }
 
+func (cs *ConditionService) IsHelmReleaseApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, componentId string) bool {
+
+	condition, observedGeneration := cs.getConditionStatus(ctx, cr, CONDITION_HELM_RELEASE_APPLIED+"-"+componentId)
+
+	return metav1.ConditionTrue == condition && observedGeneration == cr.Generation
+}
+
+func (cs *ConditionService) SetConditionHelmReleaseRendered(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	componentId string, releaseName string) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_HELM_RELEASE_RENDERED+"-"+componentId, metav1.ConditionTrue,
+		CONDITION_HELM_RELEASE_RENDERED_REASON, CONDITION_HELM_RELEASE_RENDERED_MSG+" "+releaseName)
+}
+
+func (cs *ConditionService) SetConditionHelmReleaseRenderFailed(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	componentId string, err error) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_HELM_RELEASE_RENDERED+"-"+componentId, metav1.ConditionFalse,
+		CONDITION_HELM_RELEASE_RENDERED_FAILED_REASON, err.Error())
+}
+
+func (cs *ConditionService) SetConditionHelmReleaseApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	componentId string, releaseName string, revision int) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_HELM_RELEASE_APPLIED+"-"+componentId, metav1.ConditionTrue,
+		CONDITION_HELM_RELEASE_APPLIED_REASON, fmt.Sprintf("%s %s revision %d", CONDITION_HELM_RELEASE_APPLIED_MSG, releaseName, revision))
+}
+
+func (cs *ConditionService) SetConditionHelmReleaseApplyFailed(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	componentId string, err error) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_HELM_RELEASE_APPLIED+"-"+componentId, metav1.ConditionFalse,
+		CONDITION_HELM_RELEASE_APPLIED_FAILED_REASON, err.Error())
+}
+
+func (cs *ConditionService) SetConditionHelmReleaseUninstallFailed(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	componentId string, err error) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_HELM_RELEASE_APPLIED+"-"+componentId, metav1.ConditionFalse,
+		CONDITION_HELM_RELEASE_UNINSTALL_FAILED_REASON, err.Error())
+}
+
+func (cs *ConditionService) IsKustomizationApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, componentId string) bool {
+
+	condition, observedGeneration := cs.getConditionStatus(ctx, cr, CONDITION_KUSTOMIZATION_APPLIED+"-"+componentId)
+
+	return metav1.ConditionTrue == condition && observedGeneration == cr.Generation
+}
+
+func (cs *ConditionService) SetConditionKustomizationApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	componentId string, kustomizationPath string) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_KUSTOMIZATION_APPLIED+"-"+componentId, metav1.ConditionTrue,
+		CONDITION_KUSTOMIZATION_APPLIED_REASON, CONDITION_KUSTOMIZATION_APPLIED_MSG+" "+kustomizationPath)
+}
+
+func (cs *ConditionService) SetConditionKustomizationApplyFailed(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	componentId string, err error) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_KUSTOMIZATION_APPLIED+"-"+componentId, metav1.ConditionFalse,
+		CONDITION_KUSTOMIZATION_APPLIED_FAILED_REASON, err.Error())
+}
+
+// RemoveConditionsHelmRelease removes the conditions of a release that was uninstalled
+func (cs *ConditionService) RemoveConditionsHelmRelease(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, componentId string) error {
+	for _, typeName := range []string{CONDITION_HELM_RELEASE_RENDERED, CONDITION_HELM_RELEASE_APPLIED} {
+		if condition, _ := cs.getConditionStatus(ctx, cr, typeName+"-"+componentId); condition == metav1.ConditionUnknown {
+			continue
+		}
+		if err := cs.deleteCondition(ctx, cr, typeName+"-"+componentId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveConditionsApplied removes the applied and the ready conditions of the
+// components, so that the next install of the instance applies them again
+func (cs *ConditionService) RemoveConditionsApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	return cs.deleteConditions(ctx, cr, func(typeName string) bool {
+		for _, prefix := range []string{CONDITION_MANIFEST_APPLIED, CONDITION_PLUGIN_CR_APPLIED, CONDITION_PLUGIN_CR_READY,
+			CONDITION_HELM_RELEASE_APPLIED, CONDITION_KUSTOMIZATION_APPLIED} {
+			if strings.HasPrefix(typeName, prefix+"-") {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (cs *ConditionService) setComponentCondition(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	typeName string, status metav1.ConditionStatus, reason string, message string) error {
+
+	cs.deleteCondition(ctx, cr, typeName)
+	return cs.appendCondition(ctx, cr,
+		typeName,
+		status,
+		reason,
+		utility.TruncateString(message, conditionMessageMaxLength),
+		cr.Generation)
+}
+
 func (cs *ConditionService) IsInstanceCrReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) bool {
 
 	condition, observedGeneration := cs.getConditionStatus(ctx, cr, CONDITION_INSTANCE_CR_READY)
@@ -119,7 +270,7 @@ func (cs *ConditionService) IsInstanceCrReady(ctx context.Context, cr *v1alpha1.
 func (cs *ConditionService) SetConditionInstanceCrReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
 
 	cs.deleteCondition(ctx, cr, CONDITION_INSTANCE_CR_READY)
-	return utility.AppendCondition(ctx, cs.Base.Client, cr,
+	return cs.appendCondition(ctx, cr,
 		CONDITION_INSTANCE_CR_READY,
 		metav1.ConditionTrue,
 		CONDITION_INSTANCE_CR_READY_REASON,
@@ -137,7 +288,7 @@ func (cs *ConditionService) IsInstanceCrApplied(ctx context.Context, cr *v1alpha
 func (cs *ConditionService) SetConditionInstanceCrApplied(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
 
 	cs.deleteCondition(ctx, cr, CONDITION_INSTANCE_CR_APPLIED)
-	return utility.AppendCondition(ctx, cs.Base.Client, cr,
+	return cs.appendCondition(ctx, cr,
 		CONDITION_INSTANCE_CR_APPLIED,
 		metav1.ConditionTrue,
 		CONDITION_INSTANCE_CR_APPLIED_REASON,
@@ -145,53 +296,143 @@ func (cs *ConditionService) SetConditionInstanceCrApplied(ctx context.Context, c
 		cr.Generation)
 }
 
+func (cs *ConditionService) SetConditionDescriptorInvalid(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, message string) error {
+
+	cs.deleteCondition(ctx, cr, CONDITION_DESCRIPTOR_INVALID)
+	return cs.appendCondition(ctx, cr,
+		CONDITION_DESCRIPTOR_INVALID,
+		metav1.ConditionTrue,
+		CONDITION_DESCRIPTOR_INVALID_REASON,
+		utility.TruncateString(message, conditionMessageMaxLength),
+		cr.Generation)
+}
+
+func (cs *ConditionService) RemoveConditionDescriptorInvalid(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	if condition, _ := cs.getConditionStatus(ctx, cr, CONDITION_DESCRIPTOR_INVALID); condition == metav1.ConditionUnknown {
+		return nil
+	}
+	return cs.deleteCondition(ctx, cr, CONDITION_DESCRIPTOR_INVALID)
+}
+
+// IsSignatureVerified reports whether the signature of the digest of the
+// current generation of the instance was verified
+func (cs *ConditionService) IsSignatureVerified(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) bool {
+	condition, observedGeneration := cs.getConditionStatus(ctx, cr, CONDITION_SIGNATURE_VERIFIED)
+	return metav1.ConditionTrue == condition && observedGeneration == cr.Generation
+}
+
+func (cs *ConditionService) SetConditionSignatureVerified(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	return cs.setConditionSignature(ctx, cr, metav1.ConditionTrue, CONDITION_SIGNATURE_VERIFIED_REASON, CONDITION_SIGNATURE_VERIFIED_MSG)
+}
+
+// SetConditionSignatureNotVerified records why the signature of the digest
+// is not verified, reason tells a failed verification from an error
+func (cs *ConditionService) SetConditionSignatureNotVerified(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, reason string, message string) error {
+	return cs.setConditionSignature(ctx, cr, metav1.ConditionFalse, reason, message)
+}
+
+// RemoveConditionSignatureVerified removes the condition when the signatures
+// are not verified by policy
+func (cs *ConditionService) RemoveConditionSignatureVerified(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	if condition, _ := cs.getConditionStatus(ctx, cr, CONDITION_SIGNATURE_VERIFIED); condition == metav1.ConditionUnknown {
+		return nil
+	}
+	return cs.deleteCondition(ctx, cr, CONDITION_SIGNATURE_VERIFIED)
+}
+
+func (cs *ConditionService) setConditionSignature(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	status metav1.ConditionStatus, reason string, message string) error {
+
+	cs.deleteCondition(ctx, cr, CONDITION_SIGNATURE_VERIFIED)
+	return cs.appendCondition(ctx, cr,
+		CONDITION_SIGNATURE_VERIFIED,
+		status,
+		reason,
+		utility.TruncateString(message, conditionMessageMaxLength),
+		cr.Generation)
+}
+
+// InstanceInstalledStatus reports whether the first installation of the
+// instance completed, it is unknown for the instances installed before the
+// condition was introduced
+func (cs *ConditionService) InstanceInstalledStatus(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) metav1.ConditionStatus {
+	condition, _ := cs.getConditionStatus(ctx, cr, CONDITION_INSTANCE_INSTALLED)
+	return condition
+}
+
+func (cs *ConditionService) SetConditionInstanceInstalled(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_INSTANCE_INSTALLED, metav1.ConditionTrue,
+		CONDITION_INSTANCE_INSTALLED_REASON, CONDITION_INSTANCE_INSTALLED_MSG)
+}
+
+func (cs *ConditionService) SetConditionInstanceInstalling(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	return cs.setComponentCondition(ctx, cr, CONDITION_INSTANCE_INSTALLED, metav1.ConditionFalse,
+		CONDITION_INSTANCE_INSTALLING_REASON, CONDITION_INSTANCE_INSTALLING_MSG)
+}
+
 func (cs *ConditionService) SetConditionInstanceReadyTrue(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
-	return cs.setConditionInstanceReady(ctx, cr, metav1.ConditionTrue)
+	return cs.setConditionInstanceReady(ctx, cr, metav1.ConditionTrue, CONDITION_INSTANCE_READY_REASON, CONDITION_INSTANCE_READY_MSG)
 }
 
 func (cs *ConditionService) SetConditionInstanceReadyUnknow(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
-	return cs.setConditionInstanceReady(ctx, cr, metav1.ConditionUnknown)
+	return cs.setConditionInstanceReady(ctx, cr, metav1.ConditionUnknown, CONDITION_INSTANCE_READY_REASON, CONDITION_INSTANCE_READY_MSG)
 }
 
 func (cs *ConditionService) SetConditionInstanceReadyFalse(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
-	return cs.setConditionInstanceReady(ctx, cr, metav1.ConditionFalse)
+	return cs.setConditionInstanceReady(ctx, cr, metav1.ConditionFalse, CONDITION_INSTANCE_READY_REASON, CONDITION_INSTANCE_READY_MSG)
 }
 
-func (cs *ConditionService) setConditionInstanceReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, status metav1.ConditionStatus) error {
+// SetConditionInstanceNotReady sets the instance not ready, the message lists
+// the components that are not healthy
+func (cs *ConditionService) SetConditionInstanceNotReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, message string) error {
+	return cs.setConditionInstanceReady(ctx, cr, metav1.ConditionFalse, CONDITION_INSTANCE_NOT_READY_REASON, message)
+}
+
+func (cs *ConditionService) setConditionInstanceReady(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	status metav1.ConditionStatus, reason string, message string) error {
 
 	cs.deleteCondition(ctx, cr, CONDITION_INSTANCE_READY)
-	return utility.AppendCondition(ctx, cs.Base.Client, cr,
+	return cs.appendCondition(ctx, cr,
 		CONDITION_INSTANCE_READY,
 		status,
-		CONDITION_INSTANCE_READY_REASON,
-		CONDITION_INSTANCE_READY_MSG,
+		reason,
+		utility.TruncateString(message, conditionMessageMaxLength),
 		cr.Generation)
 }
 
 func (cs *ConditionService) SetConditionBundleReadyTrue(ctx context.Context, cr *v1alpha1.EntandoBundleV2) error {
-	return cs.setConditionBundleReady(ctx, cr, metav1.ConditionTrue)
+	return cs.setConditionBundleReady(ctx, cr, metav1.ConditionTrue, CONDITION_BUNDLE_READY_REASON, CONDITION_BUNDLE_READY_MSG)
 }
 
 func (cs *ConditionService) SetConditionBundleReadyUnknow(ctx context.Context, cr *v1alpha1.EntandoBundleV2) error {
-	return cs.setConditionBundleReady(ctx, cr, metav1.ConditionUnknown)
+	return cs.setConditionBundleReady(ctx, cr, metav1.ConditionUnknown, CONDITION_BUNDLE_READY_REASON, CONDITION_BUNDLE_READY_MSG)
 }
 
 func (cs *ConditionService) SetConditionBundleReadyFalse(ctx context.Context, cr *v1alpha1.EntandoBundleV2) error {
-	return cs.setConditionBundleReady(ctx, cr, metav1.ConditionFalse)
+	return cs.setConditionBundleReady(ctx, cr, metav1.ConditionFalse, CONDITION_BUNDLE_READY_REASON, CONDITION_BUNDLE_READY_MSG)
 }
 
-func (cs *ConditionService) setConditionBundleReady(ctx context.Context, cr *v1alpha1.EntandoBundleV2, status metav1.ConditionStatus) error {
+// SetConditionBundleNotReady sets the bundle not ready with the reason of
+// the failure
+func (cs *ConditionService) SetConditionBundleNotReady(ctx context.Context, cr *v1alpha1.EntandoBundleV2, reason string, message string) error {
+	return cs.setConditionBundleReady(ctx, cr, metav1.ConditionFalse, reason, message)
+}
+
+func (cs *ConditionService) setConditionBundleReady(ctx context.Context, cr *v1alpha1.EntandoBundleV2,
+	status metav1.ConditionStatus, reason string, message string) error {
 
 	cs.deleteCondition(ctx, cr, CONDITION_BUNDLE_READY)
-	return utility.AppendCondition(ctx, cs.Base.Client, cr,
+	return cs.appendCondition(ctx, cr,
 		CONDITION_BUNDLE_READY,
 		status,
-		CONDITION_BUNDLE_READY_REASON,
-		CONDITION_BUNDLE_READY_MSG,
+		reason,
+		utility.TruncateString(message, conditionMessageMaxLength),
 		cr.Generation)
 }
 
 func (cs *ConditionService) getConditionStatus(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, typeName string) (metav1.ConditionStatus, int64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 
 	var output metav1.ConditionStatus = metav1.ConditionUnknown
 	var observedGeneration int64
@@ -205,28 +446,66 @@ func (cs *ConditionService) getConditionStatus(ctx context.Context, cr *v1alpha1
 	return output, observedGeneration
 }
 
+func (cs *ConditionService) appendCondition(ctx context.Context, cr client.Object,
+	typeName string, status metav1.ConditionStatus, reason string, message string, observedGeneration int64) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.updateCopy(cr, func(obj client.Object) error {
+		return utility.AppendCondition(ctx, cs.Base.Client, obj, typeName, status, reason, message, observedGeneration)
+	})
+}
+
 func (cs *ConditionService) deleteCondition(ctx context.Context, cr client.Object, typeName string) error {
+	return cs.deleteConditions(ctx, cr, func(conditionType string) bool {
+		return conditionType == typeName
+	})
+}
+
+// deleteConditions deletes the conditions whose type matches, with a single
+// update of the status
+func (cs *ConditionService) deleteConditions(ctx context.Context, cr client.Object, match func(typeName string) bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 
 	log := log.FromContext(ctx)
-	var newConditions = make([]metav1.Condition, 0)
-	conditionsAware, conversionSuccessful := (cr).(utility.ConditionsAware)
-	if conversionSuccessful {
-		for _, condition := range conditionsAware.GetConditions() {
-			if condition.Type != typeName {
-				newConditions = append(newConditions, condition)
+	return cs.updateCopy(cr, func(obj client.Object) error {
+		var newConditions = make([]metav1.Condition, 0)
+		conditionsAware, conversionSuccessful := (obj).(utility.ConditionsAware)
+		if conversionSuccessful {
+			for _, condition := range conditionsAware.GetConditions() {
+				if !match(condition.Type) {
+					newConditions = append(newConditions, condition)
+				}
 			}
-		}
-		conditionsAware.SetConditions(newConditions)
+			conditionsAware.SetConditions(newConditions)
+
+			err := cs.Base.Client.Status().Update(ctx, obj)
+			if err != nil {
+				log.Info("Application resource status update failed.")
+			}
+			return nil
 
-		err := cs.Base.Client.Status().Update(ctx, cr)
-		if err != nil {
-			log.Info("Application resource status update failed.")
+		} else {
+			errMessage := "Status cannot be deleted, resource doesn't support conditions"
+			log.Info(errMessage)
+			return errors.New(errMessage)
 		}
-		return nil
+	})
+}
 
-	} else {
-		errMessage := "Status cannot be deleted, resource doesn't support conditions"
-		log.Info(errMessage)
-		return fmt.Errorf(errMessage)
+// updateCopy runs update on a copy of cr and then copies back the status and
+// the resource version only, the other fields of cr are read concurrently
+// and must not be rewritten by the decoding of the response
+func (cs *ConditionService) updateCopy(cr client.Object, update func(obj client.Object) error) error {
+	obj := cr.DeepCopyObject().(client.Object)
+	err := update(obj)
+	switch target := cr.(type) {
+	case *v1alpha1.EntandoBundleInstanceV2:
+		target.Status = obj.(*v1alpha1.EntandoBundleInstanceV2).Status
+	case *v1alpha1.EntandoBundleV2:
+		target.Status = obj.(*v1alpha1.EntandoBundleV2).Status
 	}
+	cr.SetResourceVersion(obj.GetResourceVersion())
+	return err
 }
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	utility "github.com/gigiozzz/depiy/common-libs/utilities"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/applyer"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// InventoryInstanceLabel is the id of the instance, InstanceId, the name
+	// of the instance is in the InventoryInstanceAnnotation
+	InventoryInstanceLabel      = "bundle.entando.org/instance"
+	InventoryInstanceAnnotation = "bundle.entando.org/instance"
+	InventoryComponentLabel     = "bundle.entando.org/component"
+
+	inventoryComponentKey = "component"
+	inventoryObjectsKey   = "objects"
+	inventoryRevisionKey  = "revision"
+)
+
+// Inventory is the list of the objects applied for a component of an
+// instance, it is used to prune objects on upgrade and to uninstall them
+type Inventory struct {
+	Component string
+	Revision  int
+	Objects   []applyer.ObjectReference
+}
+
+// InventoryService stores the inventories in config maps owned by the instance
+type InventoryService struct {
+	Base *common.BaseK8sStructure
+}
+
+func NewInventoryService(base *common.BaseK8sStructure) *InventoryService {
+	return &InventoryService{
+		Base: base,
+	}
+}
+
+// GetInventory returns the inventory of the component, nil if the component
+// was never applied
+func (s *InventoryService) GetInventory(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, component string) (*Inventory, error) {
+	configMap := &corev1.ConfigMap{}
+	err := s.Base.Client.Get(ctx, types.NamespacedName{Name: inventoryName(cr, component), Namespace: cr.GetNamespace()}, configMap)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toInventory(configMap)
+}
+
+// ListInventories returns the inventories of all the components of the instance
+func (s *InventoryService) ListInventories(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) ([]Inventory, error) {
+	configMaps := &corev1.ConfigMapList{}
+	err := s.Base.Client.List(ctx, configMaps,
+		client.InNamespace(cr.GetNamespace()),
+		client.MatchingLabels{InventoryInstanceLabel: InstanceId(cr)})
+	if err != nil {
+		return nil, err
+	}
+
+	inventories := make([]Inventory, 0, len(configMaps.Items))
+	for i := range configMaps.Items {
+		inventory, err := toInventory(&configMaps.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		inventories = append(inventories, *inventory)
+	}
+	return inventories, nil
+}
+
+func (s *InventoryService) SaveInventory(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, inventory *Inventory, scheme *runtime.Scheme) error {
+	objects, err := json.Marshal(inventory.Objects)
+	if err != nil {
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      inventoryName(cr, inventory.Component),
+			Namespace: cr.GetNamespace(),
+		},
+	}
+	_, err = ctrl.CreateOrUpdate(ctx, s.Base.Client, configMap, func() error {
+		configMap.Labels = map[string]string{
+			InventoryInstanceLabel:  InstanceId(cr),
+			InventoryComponentLabel: GenComponentId(inventory.Component),
+		}
+		configMap.Annotations = map[string]string{
+			InventoryInstanceAnnotation: cr.GetName(),
+		}
+		configMap.Data = map[string]string{
+			inventoryComponentKey: inventory.Component,
+			inventoryObjectsKey:   string(objects),
+			inventoryRevisionKey:  strconv.Itoa(inventory.Revision),
+		}
+		return ctrl.SetControllerReference(cr, configMap, scheme)
+	})
+	return err
+}
+
+func (s *InventoryService) DeleteInventory(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2, component string) error {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      inventoryName(cr, component),
+			Namespace: cr.GetNamespace(),
+		},
+	}
+	return client.IgnoreNotFound(s.Base.Client.Delete(ctx, configMap))
+}
+
+func toInventory(configMap *corev1.ConfigMap) (*Inventory, error) {
+	inventory := &Inventory{Component: configMap.Data[inventoryComponentKey]}
+	if revision, ok := configMap.Data[inventoryRevisionKey]; ok {
+		var err error
+		if inventory.Revision, err = strconv.Atoi(revision); err != nil {
+			return nil, err
+		}
+	}
+	if objects, ok := configMap.Data[inventoryObjectsKey]; ok {
+		if err := json.Unmarshal([]byte(objects), &inventory.Objects); err != nil {
+			return nil, err
+		}
+	}
+	return inventory, nil
+}
+
+func inventoryName(cr *v1alpha1.EntandoBundleInstanceV2, component string) string {
+	return utility.TruncateString(cr.GetName(), 200) + "-inv-" + GenComponentId(component)
+}
+
+// InstanceId returns the id of the instance used as label value, the name of
+// the instance may exceed the 63 characters of a label value
+func InstanceId(cr *v1alpha1.EntandoBundleInstanceV2) string {
+	return utility.TruncateString(utility.GenerateSha256(cr.GetName()), 16)
+}
+
+// GenComponentId returns a short id of a component, usable in object names
+// and condition types
+func GenComponentId(component string) string {
+	s := utility.GenerateSha256(component)
+	return utility.TruncateString(s, 8)
+}
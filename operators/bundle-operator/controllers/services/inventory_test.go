@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/applyer"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestInventoryLongInstanceName(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	service := NewInventoryService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+
+	cr := &v1alpha1.EntandoBundleInstanceV2{ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("instance", 10), Namespace: "test", UID: "uid"}}
+	inventory := &Inventory{Component: "db", Revision: 1, Objects: []applyer.ObjectReference{{Kind: "Service", Name: "db"}}}
+	if err := service.SaveInventory(ctx, cr, inventory, scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	configMaps := &corev1.ConfigMapList{}
+	if err := k8sClient.List(ctx, configMaps); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(configMaps.Items) != 1 {
+		t.Fatalf("Expected an inventory, got %d", len(configMaps.Items))
+	}
+	configMap := configMaps.Items[0]
+	if errs := validation.IsValidLabelValue(configMap.Labels[InventoryInstanceLabel]); len(errs) > 0 {
+		t.Fatalf("Invalid instance label: %v", errs)
+	}
+	if configMap.Annotations[InventoryInstanceAnnotation] != cr.Name {
+		t.Fatalf("Expected the instance name annotation, got %v", configMap.Annotations)
+	}
+
+	inventories, err := service.ListInventories(ctx, cr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(inventories) != 1 || inventories[0].Component != "db" || len(inventories[0].Objects) != 1 {
+		t.Fatalf("Unexpected inventories %+v", inventories)
+	}
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/google/go-containerregistry/pkg/authn"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// OperatorNamespaceEnv and OperatorServiceAccountEnv locate the service
+	// account of the operator, whose image pull secrets are used for every pull
+	OperatorNamespaceEnv      = "OPERATOR_NAMESPACE"
+	OperatorServiceAccountEnv = "OPERATOR_SERVICE_ACCOUNT"
+)
+
+// RegistryAuthService resolves the credentials used to pull bundles and to
+// verify their signatures from Kubernetes image pull secrets
+type RegistryAuthService struct {
+	Base *common.BaseK8sStructure
+}
+
+func NewRegistryAuthService(base *common.BaseK8sStructure) *RegistryAuthService {
+	return &RegistryAuthService{Base: base}
+}
+
+// PullSecretReferences returns the image pull secrets of the instance followed
+// by the ones of its referenced bundle and of the bundles of its repository
+func (s *RegistryAuthService) PullSecretReferences(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) ([]corev1.LocalObjectReference, error) {
+	refs := append([]corev1.LocalObjectReference{}, cr.Spec.ImagePullSecrets...)
+
+	bundleList := &v1alpha1.EntandoBundleV2List{}
+	if err := s.Base.Client.List(ctx, bundleList, client.InNamespace(cr.GetNamespace())); err != nil {
+		return nil, err
+	}
+	for i, bundle := range bundleList.Items {
+		if IsInstanceOf(cr, &bundleList.Items[i]) || bundles.SameRepository(bundle.Spec.Repository, cr.Spec.Repository) {
+			refs = append(refs, bundle.Spec.ImagePullSecrets...)
+		}
+	}
+	return uniqueReferences(refs), nil
+}
+
+// Keychain builds the keychain of the referenced secrets of the namespace and
+// of the image pull secrets of the operator service account. A missing
+// referenced secret is an error, while the missing secrets of the service
+// account are skipped like the kubelet does.
+func (s *RegistryAuthService) Keychain(ctx context.Context, namespace string, refs []corev1.LocalObjectReference) (authn.Keychain, error) {
+	secrets := []corev1.Secret{}
+	for _, ref := range uniqueReferences(refs) {
+		secret := corev1.Secret{}
+		if err := s.Base.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: namespace}, &secret); err != nil {
+			return nil, fmt.Errorf("image pull secret %s/%s: %w", namespace, ref.Name, err)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	serviceAccountSecrets, err := s.serviceAccountSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secrets = append(secrets, serviceAccountSecrets...)
+
+	return bundles.NewPullSecretsKeychain(secrets)
+}
+
+func (s *RegistryAuthService) serviceAccountSecrets(ctx context.Context) ([]corev1.Secret, error) {
+	namespace := os.Getenv(OperatorNamespaceEnv)
+	name := os.Getenv(OperatorServiceAccountEnv)
+	if namespace == "" || name == "" {
+		return nil, nil
+	}
+
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := s.Base.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, serviceAccount); err != nil {
+		return nil, fmt.Errorf("operator service account %s/%s: %w", namespace, name, err)
+	}
+
+	secrets := []corev1.Secret{}
+	for _, ref := range serviceAccount.ImagePullSecrets {
+		secret := corev1.Secret{}
+		err := s.Base.Client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: namespace}, &secret)
+		if errors.IsNotFound(err) {
+			s.Base.Log.Info("image pull secret of the operator service account not found", "secret", ref.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+func uniqueReferences(refs []corev1.LocalObjectReference) []corev1.LocalObjectReference {
+	seen := map[string]bool{}
+	unique := []corev1.LocalObjectReference{}
+	for _, ref := range refs {
+		if ref.Name == "" || seen[ref.Name] {
+			continue
+		}
+		seen[ref.Name] = true
+		unique = append(unique, ref)
+	}
+	return unique
+}
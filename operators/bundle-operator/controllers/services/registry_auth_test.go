@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRegistryAuth(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	bundle := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+		Spec: v1alpha1.EntandoBundleV2Spec{
+			Repository:       "registry.example.com/entando/bundle",
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "bundle-registry"}, {Name: "shared"}},
+		},
+	}
+	other := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-5678", Namespace: "test"},
+		Spec: v1alpha1.EntandoBundleV2Spec{
+			Repository:       "registry.example.com/entando/other",
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "other-registry"}},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "test"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+			`{"auths":{"registry.example.com":{"username":"entando","password":"secret"}}}`)},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(bundle, other, secret).Build()
+	registryAuth := NewRegistryAuthService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+
+	cr := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "test"},
+		Spec: v1alpha1.EntandoBundleInstanceV2Spec{
+			Repository:       "registry.example.com/entando/bundle",
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "shared"}},
+		},
+	}
+	refs, err := registryAuth.PullSecretReferences(ctx, cr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []corev1.LocalObjectReference{{Name: "shared"}, {Name: "bundle-registry"}}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Fatalf("Expected references %v, got %v", expected, refs)
+	}
+
+	if _, err := registryAuth.Keychain(ctx, "test", refs); err == nil || !strings.Contains(err.Error(), "bundle-registry") {
+		t.Fatalf("Expected error for the missing secret, got %v", err)
+	}
+
+	keychain, err := registryAuth.Keychain(ctx, "test", cr.Spec.ImagePullSecrets)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	repository, err := name.NewRepository(cr.Spec.Repository)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	authenticator, err := keychain.Resolve(repository)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config, err := authenticator.Authorization()
+	if err != nil || config.Username != "entando" {
+		t.Fatalf("Expected credentials of entando, got %v error %v", config, err)
+	}
+}
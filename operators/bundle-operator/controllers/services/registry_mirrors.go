@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RegistryMirrorsKey is the key of the mirror rules in the ConfigMap
+const RegistryMirrorsKey = "mirrors.yaml"
+
+// RegistryMirrorsConfigMap is the ConfigMap with the mirror rules in the
+// namespace of the operator, it can be changed with the flags of the operator
+var RegistryMirrorsConfigMap = "bundle-operator-registry-mirrors"
+
+// RegistryMirrorService reads the mirror rules applied to the pulls of the
+// bundles and to the images of the plugins
+type RegistryMirrorService struct {
+	Base *common.BaseK8sStructure
+}
+
+func NewRegistryMirrorService(base *common.BaseK8sStructure) *RegistryMirrorService {
+	return &RegistryMirrorService{Base: base}
+}
+
+// Config reads the mirror rules, they are read at every reconcile so that a
+// change of the ConfigMap applies without restarting the operator. Without
+// ConfigMap there are no rules.
+func (s *RegistryMirrorService) Config(ctx context.Context) (*bundles.MirrorConfig, error) {
+	namespace := os.Getenv(OperatorNamespaceEnv)
+	if namespace == "" || RegistryMirrorsConfigMap == "" {
+		return nil, nil
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := s.Base.Client.Get(ctx, types.NamespacedName{Name: RegistryMirrorsConfigMap, Namespace: namespace}, configMap)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config, err := bundles.ParseMirrorConfig([]byte(configMap.Data[RegistryMirrorsKey]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror rules in %s/%s: %w", namespace, RegistryMirrorsConfigMap, err)
+	}
+	return config, nil
+}
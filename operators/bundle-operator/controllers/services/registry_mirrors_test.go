@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRegistryMirrors(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: RegistryMirrorsConfigMap, Namespace: "operator"},
+		Data: map[string]string{RegistryMirrorsKey: "rules:\n" +
+			"- prefix: docker.io/entando\n" +
+			"  mirrors: [mirror.example.com/entando]\n"},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(configMap).Build()
+	mirrorService := NewRegistryMirrorService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+
+	// outside the cluster there are no rules
+	t.Setenv(OperatorNamespaceEnv, "")
+	if config, err := mirrorService.Config(ctx); err != nil || config != nil {
+		t.Fatalf("Expected no rules, got %v error %v", config, err)
+	}
+
+	t.Setenv(OperatorNamespaceEnv, "operator")
+	config, err := mirrorService.Config(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	candidates, err := config.Candidates("docker.io/entando/bundle:v1.0.0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{"mirror.example.com/entando/bundle:v1.0.0", "docker.io/entando/bundle:v1.0.0"}
+	if !reflect.DeepEqual(candidates, expected) {
+		t.Fatalf("Expected candidates %v, got %v", expected, candidates)
+	}
+
+	configMap.Data[RegistryMirrorsKey] = "rules:\n- prefix: docker.io\n  mirror: [mirror.example.com]\n"
+	if err := k8sClient.Update(ctx, configMap); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := mirrorService.Config(ctx); err == nil {
+		t.Fatalf("Expected invalid rules error")
+	}
+
+	if err := k8sClient.Delete(ctx, configMap); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config, err := mirrorService.Config(ctx); err != nil || config != nil {
+		t.Fatalf("Expected no rules without ConfigMap, got %v error %v", config, err)
+	}
+}
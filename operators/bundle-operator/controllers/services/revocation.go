@@ -0,0 +1,283 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	pluginapi "github.com/gigiozzz/depiy/operators/plugin-operator/api/v1alpha1"
+	"github.com/sigstore/sigstore/pkg/signature"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// RevokedKeysPEMKey is the key of the PEM encoded revoked public keys in
+	// the revoked keys ConfigMap
+	RevokedKeysPEMKey = "keys.pem"
+	// RevokedKeysFingerprintsKey is the key of the fingerprints of the revoked
+	// public keys, one sha256:<hex> of the DER encoded key by line
+	RevokedKeysFingerprintsKey = "fingerprints"
+)
+
+// ScaledDownAnnotation marks the instances whose workloads were scaled down
+// because their digest is no longer verified, the value is the digest. The
+// instance is installed again when the digest is verified again.
+const ScaledDownAnnotation = "bundle.entando.org/scaled-down"
+
+// RevokedKeysConfigMap is the ConfigMap with the revoked public keys in the
+// namespace of the operator, it can be changed with the flags of the operator
+var RevokedKeysConfigMap = "bundle-operator-revoked-keys"
+
+// SignatureReverifyInterval is the interval the signatures of the bundles are
+// verified again, so that the revoked and the removed keys reach the digests
+// already verified. Zero verifies them only when the bundle changes.
+var SignatureReverifyInterval = time.Hour
+
+// ScaleDownRevokedInstances scales down the workloads of the instances whose
+// digest is no longer verified under the enforce policy
+var ScaleDownRevokedInstances = false
+
+// RevokedKeyError is a public key that is revoked, the signatures it
+// verifies are not trusted
+type RevokedKeyError struct {
+	Fingerprint string
+}
+
+func (e *RevokedKeyError) Error() string {
+	return fmt.Sprintf("public key %s is revoked", e.Fingerprint)
+}
+
+// RevokedKeys are the fingerprints of the revoked public keys
+type RevokedKeys struct {
+	fingerprints map[string]bool
+}
+
+// IsRevoked tells if the key of the fingerprint is revoked, no key is revoked
+// by nil keys
+func (k *RevokedKeys) IsRevoked(fingerprint string) bool {
+	return k != nil && k.fingerprints[fingerprint]
+}
+
+// KeyFingerprint returns the sha256:<hex> fingerprint of the DER encoded
+// public key
+func KeyFingerprint(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// parseRevokedKeys reads the revoked keys of the ConfigMap, the PEM encoded
+// public keys and the fingerprints
+func parseRevokedKeys(data map[string]string) (*RevokedKeys, error) {
+	keys := &RevokedKeys{fingerprints: map[string]bool{}}
+	rest := []byte(data[RevokedKeysPEMKey])
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key in %s: %w", RevokedKeysPEMKey, err)
+		}
+		fingerprint, err := KeyFingerprint(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key in %s: %w", RevokedKeysPEMKey, err)
+		}
+		keys.fingerprints[fingerprint] = true
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(data[RevokedKeysFingerprintsKey]))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hexSum := strings.TrimPrefix(strings.ToLower(line), "sha256:")
+		if sum, err := hex.DecodeString(hexSum); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid fingerprint %q in %s, sha256:<hex> expected", line, RevokedKeysFingerprintsKey)
+		}
+		keys.fingerprints["sha256:"+hexSum] = true
+	}
+	return keys, nil
+}
+
+// RevocationService reads the revoked keys and acts on the instances whose
+// digest is no longer verified
+type RevocationService struct {
+	Base *common.BaseK8sStructure
+}
+
+func NewRevocationService(base *common.BaseK8sStructure) *RevocationService {
+	return &RevocationService{Base: base}
+}
+
+// RevokedKeys reads the revoked keys, they are read at every reconcile so
+// that a revocation applies without restarting the operator. Without
+// ConfigMap no key is revoked.
+func (s *RevocationService) RevokedKeys(ctx context.Context) (*RevokedKeys, error) {
+	namespace := os.Getenv(OperatorNamespaceEnv)
+	if namespace == "" || RevokedKeysConfigMap == "" {
+		return nil, nil
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := s.Base.Client.Get(ctx, types.NamespacedName{Name: RevokedKeysConfigMap, Namespace: namespace}, configMap)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseRevokedKeys(configMap.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revoked keys in %s/%s: %w", namespace, RevokedKeysConfigMap, err)
+	}
+	return keys, nil
+}
+
+// UnverifiedInstances returns the instances of the bundle installing a digest
+// that the verifications don't verify, with the reason of each digest
+func (s *RevocationService) UnverifiedInstances(ctx context.Context, bundle *v1alpha1.EntandoBundleV2,
+	verifications []TagVerification) ([]v1alpha1.EntandoBundleInstanceV2, map[string]string, error) {
+	unverified := map[string]string{}
+	for _, verification := range verifications {
+		if !verification.Verified {
+			unverified[verification.Digest] = verification.Message
+		}
+	}
+	if len(unverified) == 0 {
+		return nil, unverified, nil
+	}
+
+	instanceList := &v1alpha1.EntandoBundleInstanceV2List{}
+	if err := s.Base.Client.List(ctx, instanceList, client.InNamespace(bundle.GetNamespace())); err != nil {
+		return nil, nil, err
+	}
+	instances := []v1alpha1.EntandoBundleInstanceV2{}
+	for _, instance := range instanceList.Items {
+		if _, ok := unverified[instance.Spec.Digest]; ok && IsInstanceOf(&instance, bundle) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, unverified, nil
+}
+
+// ScaleDownInstance removes the plugins of the instance, their workloads go
+// with them, and scales to zero the deployments and the statefulsets of its
+// components. The applied conditions of the components are removed and the
+// instance is marked as scaled down, so that it is reconciled and installed
+// again once its digest is verified.
+func (s *RevocationService) ScaleDownInstance(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	pluginList := &pluginapi.EntandoPluginV2List{}
+	if err := s.Base.Client.List(ctx, pluginList, client.InNamespace(cr.GetNamespace())); err != nil {
+		return err
+	}
+	for i := range pluginList.Items {
+		plugin := &pluginList.Items[i]
+		if !metav1.IsControlledBy(plugin, cr) {
+			continue
+		}
+		if err := s.Base.Client.Delete(ctx, plugin); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	inventories, err := NewInventoryService(s.Base).ListInventories(ctx, cr)
+	if err != nil {
+		return err
+	}
+	scaleDown := client.RawPatch(types.MergePatchType, []byte(`{"spec":{"replicas":0}}`))
+	for _, inventory := range inventories {
+		for _, ref := range inventory.Objects {
+			if ref.Group != "apps" || (ref.Kind != "Deployment" && ref.Kind != "StatefulSet") {
+				continue
+			}
+			obj := &unstructured.Unstructured{}
+			obj.SetGroupVersionKind(ref.GroupVersionKind())
+			obj.SetNamespace(ref.Namespace)
+			obj.SetName(ref.Name)
+			if err := s.Base.Client.Patch(ctx, obj, scaleDown); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+		}
+	}
+
+	if err := NewConditionService(s.Base).RemoveConditionsApplied(ctx, cr); err != nil {
+		return err
+	}
+	patch := client.MergeFrom(cr.DeepCopy())
+	annotations := cr.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[ScaledDownAnnotation] = cr.Spec.Digest
+	cr.SetAnnotations(annotations)
+	return s.Base.Client.Patch(ctx, cr, patch)
+}
+
+// IsScaledDown reports whether the workloads of the instance were scaled down
+// and not installed again yet
+func IsScaledDown(cr *v1alpha1.EntandoBundleInstanceV2) bool {
+	_, ok := cr.GetAnnotations()[ScaledDownAnnotation]
+	return ok
+}
+
+// ClearScaledDown removes the scaled down mark of the instance, once its
+// components are installed again
+func (s *RevocationService) ClearScaledDown(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2) error {
+	if !IsScaledDown(cr) {
+		return nil
+	}
+	patch := client.MergeFrom(cr.DeepCopy())
+	annotations := cr.GetAnnotations()
+	delete(annotations, ScaledDownAnnotation)
+	cr.SetAnnotations(annotations)
+	return s.Base.Client.Patch(ctx, cr, patch)
+}
+
+// checkRevoked returns a *RevokedKeyError when the key of the verifier is
+// revoked, the revoked keys are read once by service
+func (s *SignatureKeyService) checkRevoked(ctx context.Context, verifier signature.Verifier) error {
+	if !s.revokedRead {
+		revoked, err := NewRevocationService(s.Base).RevokedKeys(ctx)
+		if err != nil {
+			return &SignatureKeyError{Reason: CONDITION_BUNDLE_REVOKED_KEYS_INVALID_REASON, Err: err}
+		}
+		s.revoked, s.revokedRead = revoked, true
+	}
+	if s.revoked == nil {
+		return nil
+	}
+	key, err := verifier.PublicKey()
+	if err != nil {
+		return err
+	}
+	fingerprint, err := KeyFingerprint(key)
+	if err != nil {
+		return err
+	}
+	if s.revoked.IsRevoked(fingerprint) {
+		return &RevokedKeyError{Fingerprint: fingerprint}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/applyer"
+	pluginapi "github.com/gigiozzz/depiy/operators/plugin-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testFingerprint returns the fingerprint of the PEM encoded public key
+func testFingerprint(t *testing.T, publicKey []byte) string {
+	key, err := cryptoutils.UnmarshalPEMToPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fingerprint, err := KeyFingerprint(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return fingerprint
+}
+
+func TestRevokedKeys(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	t.Setenv(OperatorNamespaceEnv, "operator")
+	digest, publicKey := signedLayout(t, filepath.Join(dir, "layout"))
+	_, otherKey := signedLayout(t, filepath.Join(dir, "other"))
+	repository := bundles.OCILayoutScheme + filepath.Join(dir, "layout")
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	revokedKeys := func(data map[string]string) *SignatureKeyService {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: RevokedKeysConfigMap, Namespace: "operator"},
+			Data:       data,
+		}
+		k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(configMap).Build()
+		return NewSignatureKeyService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+	}
+	tag := v1alpha1.EntandoBundleTag{Tag: "v1.0.0", Digest: digest,
+		SignatureInfo: []v1alpha1.SignatureInfo{{Name: "release", PubKey: string(publicKey)}}}
+
+	tests := []struct {
+		name     string
+		data     map[string]string
+		verified bool
+		reason   string
+	}{
+		{name: "no revocation", data: map[string]string{RevokedKeysPEMKey: string(otherKey)}, verified: true},
+		{name: "revoked pem", data: map[string]string{RevokedKeysPEMKey: string(otherKey) + string(publicKey)}},
+		{name: "revoked fingerprint", data: map[string]string{RevokedKeysFingerprintsKey: "# release key\n" +
+			strings.ToUpper(testFingerprint(t, publicKey)) + "\n"}},
+		{name: "invalid fingerprint", data: map[string]string{RevokedKeysFingerprintsKey: "sha256:1234"},
+			reason: CONDITION_BUNDLE_REVOKED_KEYS_INVALID_REASON},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bs := &BundleService{}
+			verification, err := bs.VerifyTag(ctx, "test", repository, tag, nil, revokedKeys(test.data), logr.Discard())
+			if test.reason != "" {
+				var keyErr *SignatureKeyError
+				if !errors.As(err, &keyErr) || keyErr.Reason != test.reason {
+					t.Fatalf("Expected %s error, got %v", test.reason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if verification.Verified != test.verified {
+				t.Fatalf("Expected verified %v, got %+v", test.verified, verification)
+			}
+			if !test.verified && !strings.Contains(verification.Message, "release: public key sha256:") {
+				t.Fatalf("Expected revoked signer, got %+v", verification)
+			}
+		})
+	}
+
+	// a key removed from its secret no longer verifies the tags of the key
+	bundle := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+		Spec: v1alpha1.EntandoBundleV2Spec{
+			Repository: repository,
+			TagList: []v1alpha1.EntandoBundleTag{
+				{Tag: "v1.0.0", Digest: digest, SignatureInfo: []v1alpha1.SignatureInfo{{PubKeySecret: "removed"}}},
+				tag,
+			},
+		},
+	}
+	bs := &BundleService{}
+	verified, verifications, err := bs.CheckBundleSignature(ctx, bundle, revokedKeys(nil), logr.Discard())
+	var keyErr *SignatureKeyError
+	if !errors.As(err, &keyErr) || keyErr.Reason != CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON {
+		t.Fatalf("Expected %s error, got %v", CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON, err)
+	}
+	if len(verifications) != 2 || verifications[0].Verified || !verifications[1].Verified || len(verified) != 1 {
+		t.Fatalf("Expected only the second tag verified, got %+v", verifications)
+	}
+}
+
+func TestParseRevokedKeys(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	fingerprint := "sha256:" + hex.EncodeToString(sum[:])
+	keys, err := parseRevokedKeys(map[string]string{RevokedKeysFingerprintsKey: "\n" + hex.EncodeToString(sum[:]) + "\n"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !keys.IsRevoked(fingerprint) || keys.IsRevoked("sha256:"+strings.Repeat("0", 64)) {
+		t.Fatalf("Expected only %s revoked", fingerprint)
+	}
+	var none *RevokedKeys
+	if none.IsRevoked(fingerprint) {
+		t.Fatal("Expected no key revoked without revoked keys")
+	}
+	if _, err := parseRevokedKeys(map[string]string{RevokedKeysPEMKey: "-----BEGIN PUBLIC KEY-----\naW52YWxpZA==\n-----END PUBLIC KEY-----\n"}); err == nil {
+		t.Fatal("Expected invalid public key error")
+	}
+}
+
+func TestUnverifiedInstances(t *testing.T) {
+	ctx := context.TODO()
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme, pluginapi.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	revokedDigest := "sha256:" + strings.Repeat("1", 64)
+	verifiedDigest := "sha256:" + strings.Repeat("2", 64)
+	instance := func(name string, repository string, digest string) *v1alpha1.EntandoBundleInstanceV2 {
+		return &v1alpha1.EntandoBundleInstanceV2{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test", UID: types.UID(name)},
+			Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Repository: repository, Digest: digest},
+		}
+	}
+	revoked := instance("bundle-1234-abcd", "registry.example.com/bundle", revokedDigest)
+	bundle := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+		Spec:       v1alpha1.EntandoBundleV2Spec{Repository: "registry.example.com/bundle"},
+	}
+	plugin := &pluginapi.EntandoPluginV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-pn-1234abcd", Namespace: "test"},
+		Spec:       pluginapi.EntandoPluginV2Spec{Replicas: 2},
+	}
+	if err := ctrl.SetControllerReference(revoked, plugin, scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	replicas := int32(3)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "test"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		revoked, instance("bundle-1234-efgh", "registry.example.com/bundle", verifiedDigest),
+		instance("other-5678-abcd", "registry.example.com/other", revokedDigest), plugin, deployment).Build()
+	base := &common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()}
+	if err := NewInventoryService(base).SaveInventory(ctx, revoked, &Inventory{Component: "backend", Objects: []applyer.ObjectReference{
+		{Group: "apps", Version: "v1", Kind: "Deployment", Namespace: "test", Name: "backend"},
+		{Version: "v1", Kind: "Service", Namespace: "test", Name: "backend"},
+	}}, scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	revocation := NewRevocationService(base)
+	conditions := NewConditionService(base)
+	if err := conditions.SetConditionPluginCrApplied(ctx, revoked, "pn-1234abcd"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := conditions.SetConditionHelmReleaseApplied(ctx, revoked, "backend", "backend", 1); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// only the instances of the bundle installing a digest not verified
+	instances, messages, err := revocation.UnverifiedInstances(ctx, bundle, []TagVerification{
+		{Tag: "v1.0.0", Digest: revokedDigest, Message: "public key revoked"},
+		{Tag: "v1.1.0", Digest: verifiedDigest, Verified: true},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(instances) != 1 || instances[0].Name != revoked.Name || messages[revokedDigest] != "public key revoked" {
+		t.Fatalf("Expected instance %s, got %+v", revoked.Name, instances)
+	}
+
+	// the plugins of the instance are removed and its deployments scaled down
+	if err := revocation.ScaleDownInstance(ctx, &instances[0]); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: plugin.Name, Namespace: "test"}, plugin); !apierrors.IsNotFound(err) {
+		t.Fatalf("Expected the plugin removed, got %v", err)
+	}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: deployment.Name, Namespace: "test"}, deployment); err != nil {
+		t.Fatal(err.Error())
+	}
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != 0 {
+		t.Fatalf("Expected the deployment scaled down, got %v", deployment.Spec.Replicas)
+	}
+
+	// the components are applied again by the next install of the instance
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: revoked.Name, Namespace: "test"}, revoked); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !IsScaledDown(revoked) || revoked.GetAnnotations()[ScaledDownAnnotation] != revokedDigest {
+		t.Fatalf("Expected the instance marked as scaled down, got %v", revoked.GetAnnotations())
+	}
+	if conditions.IsPluginCrApplied(ctx, revoked, "pn-1234abcd") || conditions.IsHelmReleaseApplied(ctx, revoked, "backend") {
+		t.Fatalf("Expected the applied conditions removed, got %+v", revoked.Status.Conditions)
+	}
+	if err := revocation.ClearScaledDown(ctx, revoked); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Name: revoked.Name, Namespace: "test"}, revoked); err != nil {
+		t.Fatal(err.Error())
+	}
+	if IsScaledDown(revoked) {
+		t.Fatalf("Expected the scaled down mark removed, got %v", revoked.GetAnnotations())
+	}
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"regexp"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	sigs "github.com/sigstore/cosign/v2/pkg/signature"
+	rekor "github.com/sigstore/rekor/pkg/client"
+	"github.com/sigstore/sigstore/pkg/signature"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultPubKeySecretKey is the key of the public key in the secrets, the
+// one of the secrets generated by cosign
+const DefaultPubKeySecretKey = "cosign.pub"
+
+// SignatureKeyError is an error loading the public key of a signature, the
+// reason is the one of the condition of the bundle
+type SignatureKeyError struct {
+	Reason string
+	Err    error
+}
+
+func (e *SignatureKeyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SignatureKeyError) Unwrap() error {
+	return e.Err
+}
+
+// SignatureKeyService loads the public keys and the keyless trust roots that
+// verify the signatures of the bundles
+type SignatureKeyService struct {
+	Base *common.BaseK8sStructure
+
+	// trust are the keyless trust roots, read once by service
+	trust *SigstoreTrust
+	// groups are the signer groups read by the service
+	groups map[string]*v1alpha1.EntandoSignerGroup
+	// revoked are the revoked keys, read once by service
+	revoked     *RevokedKeys
+	revokedRead bool
+}
+
+func NewSignatureKeyService(base *common.BaseK8sStructure) *SignatureKeyService {
+	return &SignatureKeyService{Base: base}
+}
+
+// CheckOpts returns the cosign options that verify the signature, with a
+// public key or, for the KEY_LESS signatures, with a Fulcio certificate
+// matching the identity and logged in Rekor
+func (s *SignatureKeyService) CheckOpts(ctx context.Context, namespace string, info v1alpha1.SignatureInfo) (*cosign.CheckOpts, error) {
+	if info.Type != v1alpha1.SignatureKeyLess {
+		verifier, err := s.Verifier(ctx, namespace, info)
+		if err != nil {
+			return nil, err
+		}
+		return &cosign.CheckOpts{SigVerifier: verifier, SkipTlogVerify: true}, nil
+	}
+
+	identity, err := keylessIdentity(info)
+	if err != nil {
+		return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_KEYLESS_IDENTITY_INVALID_REASON, Err: err}
+	}
+	if s.trust == nil {
+		trust, err := NewSigstoreTrustService(s.Base).Trust(ctx)
+		if err != nil {
+			return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_TRUST_ROOTS_INVALID_REASON, Err: err}
+		}
+		s.trust = trust
+	}
+
+	co := &cosign.CheckOpts{
+		RootCerts:         s.trust.Roots,
+		IntermediateCerts: s.trust.Intermediates,
+		Identities:        []cosign.Identity{identity},
+		RekorPubKeys:      s.trust.RekorPubKeys,
+		IgnoreSCT:         s.trust.IgnoreSCT,
+		// without Rekor only the log entries bundled with the signatures
+		Offline: s.trust.RekorURL == "",
+	}
+	if s.trust.RekorURL != "" {
+		if co.RekorClient, err = rekor.GetRekorClient(s.trust.RekorURL); err != nil {
+			return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_TRUST_ROOTS_INVALID_REASON, Err: err}
+		}
+	}
+	return co, nil
+}
+
+// keylessIdentity returns the matcher of the certificate of a KEY_LESS
+// signature, both the identity and the issuer are required
+func keylessIdentity(info v1alpha1.SignatureInfo) (cosign.Identity, error) {
+	identity := cosign.Identity{
+		Subject:       info.CertificateIdentity,
+		SubjectRegExp: info.CertificateIdentityRegexp,
+		Issuer:        info.CertificateOidcIssuer,
+		IssuerRegExp:  info.CertificateOidcIssuerRegexp,
+	}
+	if identity.Subject == "" && identity.SubjectRegExp == "" {
+		return identity, fmt.Errorf("certificateIdentity or certificateIdentityRegexp is required")
+	}
+	if identity.Issuer == "" && identity.IssuerRegExp == "" {
+		return identity, fmt.Errorf("certificateOidcIssuer or certificateOidcIssuerRegexp is required")
+	}
+	for _, expression := range []string{identity.SubjectRegExp, identity.IssuerRegExp} {
+		if _, err := regexp.Compile(expression); err != nil {
+			return identity, fmt.Errorf("invalid regular expression %q: %w", expression, err)
+		}
+	}
+	return identity, nil
+}
+
+// Verifier returns the verifier of the public key of the signature, inline
+// or read from a secret in the namespace of the bundle. A revoked key is a
+// *RevokedKeyError.
+func (s *SignatureKeyService) Verifier(ctx context.Context, namespace string, info v1alpha1.SignatureInfo) (signature.Verifier, error) {
+	if info.PubKey != "" && info.PubKeySecret != "" {
+		return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON,
+			Err: fmt.Errorf("pubKey and pubKeySecret are exclusive")}
+	}
+
+	source := "pubKey"
+	pem := []byte(info.PubKey)
+	if info.PubKeySecret != "" {
+		key := info.PubKeySecretKey
+		if key == "" {
+			key = DefaultPubKeySecretKey
+		}
+		source = fmt.Sprintf("secret %s/%s key %s", namespace, info.PubKeySecret, key)
+
+		secret := &corev1.Secret{}
+		err := s.Base.Client.Get(ctx, types.NamespacedName{Name: info.PubKeySecret, Namespace: namespace}, secret)
+		if errors.IsNotFound(err) {
+			return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON,
+				Err: fmt.Errorf("secret %s/%s not found", namespace, info.PubKeySecret)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, ok := secret.Data[key]
+		if !ok {
+			return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON,
+				Err: fmt.Errorf("key %s not found in secret %s/%s", key, namespace, info.PubKeySecret)}
+		}
+		pem = data
+	}
+	if len(pem) == 0 {
+		return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON,
+			Err: fmt.Errorf("no public key, pubKey or pubKeySecret is required")}
+	}
+
+	verifier, err := sigs.LoadPublicKeyRaw(pem, crypto.SHA256)
+	if err != nil {
+		return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON,
+			Err: fmt.Errorf("invalid public key in %s: %w", source, err)}
+	}
+	if err := s.checkRevoked(ctx, verifier); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
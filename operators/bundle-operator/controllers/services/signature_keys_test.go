@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testPublicKey returns a PEM encoded ECDSA public key
+func testPublicKey(t *testing.T) string {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	publicKey, err := cryptoutils.MarshalPublicKeyToPEM(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return string(publicKey)
+}
+
+func TestSignatureKeyVerifier(t *testing.T) {
+	ctx := context.TODO()
+	publicKey := testPublicKey(t)
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-key", Namespace: "test"},
+		Data: map[string][]byte{
+			DefaultPubKeySecretKey: []byte(publicKey),
+			"invalid.pub":          []byte("not a key"),
+		},
+	}
+	// the secrets of other namespaces are not read
+	other := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-key", Namespace: "other"},
+		Data:       map[string][]byte{DefaultPubKeySecretKey: []byte(publicKey)},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, other).Build()
+	keys := NewSignatureKeyService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+
+	for _, info := range []v1alpha1.SignatureInfo{
+		{PubKeySecret: "bundle-key"},
+		{PubKeySecret: "bundle-key", PubKeySecretKey: DefaultPubKeySecretKey},
+		{PubKey: publicKey},
+	} {
+		if _, err := keys.Verifier(ctx, "test", info); err != nil {
+			t.Fatalf("Invalid public key of %+v. error %s", info, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		info   v1alpha1.SignatureInfo
+		reason string
+	}{
+		{name: "missing secret", info: v1alpha1.SignatureInfo{PubKeySecret: "missing"}, reason: CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON},
+		{name: "other namespace", info: v1alpha1.SignatureInfo{PubKeySecret: "other-key"}, reason: CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON},
+		{name: "missing key", info: v1alpha1.SignatureInfo{PubKeySecret: "bundle-key", PubKeySecretKey: "missing.pub"}, reason: CONDITION_BUNDLE_PUB_KEY_SECRET_NOT_FOUND_REASON},
+		{name: "malformed secret key", info: v1alpha1.SignatureInfo{PubKeySecret: "bundle-key", PubKeySecretKey: "invalid.pub"}, reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON},
+		{name: "malformed inline key", info: v1alpha1.SignatureInfo{PubKey: "not a key"}, reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON},
+		{name: "no key", info: v1alpha1.SignatureInfo{}, reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON},
+		{name: "both keys", info: v1alpha1.SignatureInfo{PubKey: publicKey, PubKeySecret: "bundle-key"}, reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := keys.Verifier(ctx, "test", test.info)
+			var keyErr *SignatureKeyError
+			if !errors.As(err, &keyErr) || keyErr.Reason != test.reason {
+				t.Fatalf("Expected %s error, got %v", test.reason, err)
+			}
+		})
+	}
+}
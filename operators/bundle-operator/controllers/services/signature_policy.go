@@ -0,0 +1,267 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	utility "github.com/gigiozzz/depiy/common-libs/utilities"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultSignaturePolicy is the policy of the bundles without one and the
+// least strict policy of the bundles with one, it can be changed with the
+// flags of the operator
+var DefaultSignaturePolicy = v1alpha1.SignaturePolicyOff
+
+// SignatureResult is the verification of the digest of an instance
+type SignatureResult struct {
+	Policy   v1alpha1.SignaturePolicy
+	Verified bool
+	// Message tells why the digest is not verified
+	Message string
+}
+
+// SignaturePolicyService verifies the digests of the instances under the
+// signature policy of their bundle
+type SignaturePolicyService struct {
+	Base *common.BaseK8sStructure
+}
+
+func NewSignaturePolicyService(base *common.BaseK8sStructure) *SignaturePolicyService {
+	return &SignaturePolicyService{Base: base}
+}
+
+// VerifyInstance verifies the digest of the instance with the signatures
+// listed for it by the bundles of its repository, the annotations of the
+// bundles are not trusted. Without policy nothing is verified. The errors are
+// the ones loading the keys, a *SignatureKeyError, or reading the bundles,
+// when the bundles can't be read the policy is the one of the operator.
+func (s *SignaturePolicyService) VerifyInstance(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	bundleService *BundleService) (SignatureResult, error) {
+	bundle, tag, err := s.instanceBundle(ctx, cr)
+	if err != nil {
+		return SignatureResult{Policy: DefaultSignaturePolicy}, err
+	}
+
+	result := SignatureResult{Policy: BundlePolicy(bundle)}
+	if result.Policy == v1alpha1.SignaturePolicyOff {
+		return result, nil
+	}
+	if tag == nil {
+		result.Message = fmt.Sprintf("no bundle of %s lists the digest %s", bundleService.BundleRepository(cr), cr.Spec.Digest)
+		return result, nil
+	}
+
+	verification, err := bundleService.VerifyBundleTag(ctx, bundle, *tag, NewSignatureKeyService(s.Base), s.Base.Log)
+	if err != nil {
+		return result, err
+	}
+	result.Verified, result.Message = verification.Verified, verification.Message
+	return result, nil
+}
+
+// PluginImageResult is the verification of the image of a plugin
+type PluginImageResult struct {
+	Policy v1alpha1.SignaturePolicy
+	// Image is the image to deploy, an image not pinned by digest is pinned
+	// by the digest of its tag under a plugin image policy
+	Image string
+	// Status is the verification of the image, nil when the bundle has no
+	// plugin image policy
+	Status *v1alpha1.ImageStatus
+	// Rejected tells that the plugin must not be deployed
+	Rejected bool
+}
+
+// VerifyPluginImage verifies the image of a plugin of the instance under the
+// plugin image policy of its bundle, image is the image of the plugin after
+// the mirror rules. The images not pinned by digest are rejected by the strict
+// policy, the ones not verified by the enforce policy. The signatures are
+// verified again only when the digest of the image or the policy changed
+// since the previous verification, nil when none. The errors are the ones
+// loading the keys, a *SignatureKeyError, reading the bundles, when the
+// bundles can't be read the policy is the one of the operator, or resolving
+// the digest of the image.
+func (s *SignaturePolicyService) VerifyPluginImage(ctx context.Context, cr *v1alpha1.EntandoBundleInstanceV2,
+	plugin *bundles.Plugin, name string, image string, previous *v1alpha1.ImageStatus,
+	bundleService *BundleService) (PluginImageResult, error) {
+	bundle, tag, err := s.instanceBundle(ctx, cr)
+	if err != nil {
+		return PluginImageResult{Policy: DefaultSignaturePolicy, Image: image}, err
+	}
+	result := PluginImageResult{Policy: BundlePolicy(bundle), Image: image}
+	if bundle == nil || bundle.Spec.PluginImagePolicy == nil {
+		return result, nil
+	}
+	policy := bundle.Spec.PluginImagePolicy
+
+	result.Status = &v1alpha1.ImageStatus{Image: plugin.ImageRef(), Pinned: plugin.Digest != "", Digest: plugin.Digest}
+	if policy.Strict && !result.Status.Pinned {
+		result.Status.Message = "image not pinned by digest"
+		result.Rejected = true
+		return result, nil
+	}
+	if !result.Status.Pinned {
+		// the tag can move, the digest verified is the one deployed
+		if result.Status.Digest, err = bundles.Digest(image, bundleService.craneOptions()...); err != nil {
+			return result, err
+		}
+		result.Image = pinnedImage(image, result.Status.Digest)
+	}
+
+	if !policy.Verify || result.Policy == v1alpha1.SignaturePolicyOff {
+		return result, nil
+	}
+
+	// the signers of the plugin replace the ones of the tag
+	signersTag := v1alpha1.EntandoBundleTag{}
+	if tag != nil {
+		signersTag.SignatureInfo = tag.SignatureInfo
+	}
+	for _, pluginSigner := range policy.Plugins {
+		if pluginSigner.Name == name {
+			signersTag.SignatureInfo = pluginSigner.SignatureInfo
+		}
+	}
+	keys := NewSignatureKeyService(s.Base)
+	signers, err := keys.Signers(ctx, cr.GetNamespace(), signersTag, bundle.Spec.SignerPolicy)
+	if err != nil {
+		return result, err
+	}
+	if result.Status.PolicyHash, err = pluginImagePolicyHash(result.Policy, bundle, signers); err != nil {
+		return result, err
+	}
+	switch {
+	case previous != nil && previous.Image == result.Status.Image && previous.Digest == result.Status.Digest &&
+		previous.PolicyHash == result.Status.PolicyHash:
+		result.Status.Verified, result.Status.Signers, result.Status.Message = previous.Verified, previous.Signers, previous.Message
+	case len(signers) == 0:
+		result.Status.Message = "no signers for the image"
+	default:
+		required, err := requiredSigners(bundle.Spec.SignerPolicy, len(signers))
+		if err != nil {
+			return result, err
+		}
+		result.Status.Verified, result.Status.Signers, result.Status.Message, err =
+			bundleService.verifySigners(ctx, result.Image, signers, required, keys, s.Base.Log)
+		if err != nil {
+			return result, err
+		}
+	}
+	result.Rejected = !result.Status.Verified && result.Policy == v1alpha1.SignaturePolicyEnforce
+	return result, nil
+}
+
+// pinnedImage returns the image pinned by the digest in place of its tag
+func pinnedImage(image string, digest string) string {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + "@" + digest
+}
+
+// pluginImagePolicyHash returns the hash of what the verification of a
+// plugin image depends on, the policies of the bundle and the signers with
+// their keys
+func pluginImagePolicyHash(policy v1alpha1.SignaturePolicy, bundle *v1alpha1.EntandoBundleV2, signers []Signer) (string, error) {
+	type hashedSigner struct {
+		Signer
+		Identity string
+	}
+	hashed := make([]hashedSigner, 0, len(signers))
+	for _, signer := range signers {
+		hashed = append(hashed, hashedSigner{Signer: signer, Identity: signer.identity})
+	}
+	data, err := json.Marshal(struct {
+		Policy            v1alpha1.SignaturePolicy
+		PluginImagePolicy *v1alpha1.PluginImagePolicy
+		SignerPolicy      *v1alpha1.SignerPolicy
+		Signers           []hashedSigner
+	}{policy, bundle.Spec.PluginImagePolicy, bundle.Spec.SignerPolicy, hashed})
+	if err != nil {
+		return "", err
+	}
+	return utility.GenerateSha256(string(data)), nil
+}
+
+// instanceBundle returns the bundle of the repository of the instance, the
+// one listing or discovering its digest when available, and the tag of the
+// digest. The discovered digests have the signers of the tag discovery. An
+// instance with bundleRef has only the bundle it references.
+func (s *SignaturePolicyService) instanceBundle(ctx context.Context,
+	cr *v1alpha1.EntandoBundleInstanceV2) (*v1alpha1.EntandoBundleV2, *v1alpha1.EntandoBundleTag, error) {
+	if cr.Spec.BundleRef != "" {
+		bundle := &v1alpha1.EntandoBundleV2{}
+		if err := s.Base.Client.Get(ctx, types.NamespacedName{Name: cr.Spec.BundleRef, Namespace: cr.GetNamespace()}, bundle); err != nil {
+			return nil, nil, client.IgnoreNotFound(err)
+		}
+		for j := range bundle.Spec.TagList {
+			if bundle.Spec.TagList[j].Digest == cr.Spec.Digest {
+				return bundle, &bundle.Spec.TagList[j], nil
+			}
+		}
+		return bundle, discoveredTag(bundle, cr.Spec.Digest), nil
+	}
+
+	bundleList := &v1alpha1.EntandoBundleV2List{}
+	if err := s.Base.Client.List(ctx, bundleList, client.InNamespace(cr.GetNamespace())); err != nil {
+		return nil, nil, err
+	}
+
+	var bundle *v1alpha1.EntandoBundleV2
+	for i := range bundleList.Items {
+		if !bundles.SameRepository(bundleList.Items[i].Spec.Repository, cr.Spec.Repository) {
+			continue
+		}
+		if bundle == nil {
+			bundle = &bundleList.Items[i]
+		}
+		for j := range bundleList.Items[i].Spec.TagList {
+			if bundleList.Items[i].Spec.TagList[j].Digest == cr.Spec.Digest {
+				return &bundleList.Items[i], &bundleList.Items[i].Spec.TagList[j], nil
+			}
+		}
+		if tag := discoveredTag(&bundleList.Items[i], cr.Spec.Digest); tag != nil {
+			return &bundleList.Items[i], tag, nil
+		}
+	}
+	return bundle, nil, nil
+}
+
+// discoveredTag returns the tag of the digest discovered by the tag
+// discovery of the bundle, nil when not discovered
+func discoveredTag(bundle *v1alpha1.EntandoBundleV2, digest string) *v1alpha1.EntandoBundleTag {
+	if bundle.Spec.TagDiscovery == nil || bundle.Status.Discovery == nil {
+		return nil
+	}
+	for _, version := range bundle.Status.Discovery.Versions {
+		if version.Digest == digest {
+			return &v1alpha1.EntandoBundleTag{Tag: version.Tag, Digest: version.Digest,
+				SignatureInfo: bundle.Spec.TagDiscovery.SignatureInfo}
+		}
+	}
+	return nil
+}
+
+// BundlePolicy returns the signature policy of the bundle, the one of the
+// operator when not set or less strict, a bundle can't loosen the policy of
+// the operator
+func BundlePolicy(bundle *v1alpha1.EntandoBundleV2) v1alpha1.SignaturePolicy {
+	if bundle != nil && policyStrictness[bundle.Spec.SignaturePolicy] > policyStrictness[DefaultSignaturePolicy] {
+		return bundle.Spec.SignaturePolicy
+	}
+	return DefaultSignaturePolicy
+}
+
+// policyStrictness orders the signature policies from the least strict
+var policyStrictness = map[v1alpha1.SignaturePolicy]int{
+	v1alpha1.SignaturePolicyOff:     1,
+	v1alpha1.SignaturePolicyWarn:    2,
+	v1alpha1.SignaturePolicyEnforce: 3,
+}
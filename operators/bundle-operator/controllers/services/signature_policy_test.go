@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestVerifyInstance(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	digest, publicKey := signedLayout(t, filepath.Join(dir, "layout"))
+	_, otherKey := signedLayout(t, filepath.Join(dir, "other"))
+	repository := bundles.OCILayoutScheme + filepath.Join(dir, "layout")
+
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	instance := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "test"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Repository: repository, Digest: digest},
+	}
+	bundle := func(policy v1alpha1.SignaturePolicy, digest string, key []byte) *v1alpha1.EntandoBundleV2 {
+		return &v1alpha1.EntandoBundleV2{
+			ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+			Spec: v1alpha1.EntandoBundleV2Spec{
+				Repository:      repository,
+				SignaturePolicy: policy,
+				TagList: []v1alpha1.EntandoBundleTag{{Tag: "v1.0.0", Digest: digest,
+					SignatureInfo: []v1alpha1.SignatureInfo{{Type: v1alpha1.SignatureKeyPair, PubKey: string(key)}}}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		bundle        *v1alpha1.EntandoBundleV2
+		defaultPolicy v1alpha1.SignaturePolicy
+		policy        v1alpha1.SignaturePolicy
+		verified      bool
+		message       string
+	}{
+		{name: "verified", bundle: bundle(v1alpha1.SignaturePolicyEnforce, digest, publicKey), policy: v1alpha1.SignaturePolicyEnforce, verified: true},
+		{name: "other key", bundle: bundle(v1alpha1.SignaturePolicyWarn, digest, otherKey), policy: v1alpha1.SignaturePolicyWarn, message: "KEY_PAIR-0"},
+		{name: "digest not listed", bundle: bundle(v1alpha1.SignaturePolicyEnforce, "sha256:"+strings.Repeat("0", 64), publicKey), policy: v1alpha1.SignaturePolicyEnforce, message: "lists the digest"},
+		{name: "policy of the operator", bundle: bundle("", digest, otherKey), defaultPolicy: v1alpha1.SignaturePolicyEnforce, policy: v1alpha1.SignaturePolicyEnforce, message: "KEY_PAIR-0"},
+		{name: "off", bundle: bundle(v1alpha1.SignaturePolicyOff, digest, otherKey), defaultPolicy: v1alpha1.SignaturePolicyOff, policy: v1alpha1.SignaturePolicyOff},
+		{name: "off under the operator policy", bundle: bundle(v1alpha1.SignaturePolicyOff, digest, otherKey), defaultPolicy: v1alpha1.SignaturePolicyEnforce, policy: v1alpha1.SignaturePolicyEnforce, message: "KEY_PAIR-0"},
+		{name: "stricter than the operator policy", bundle: bundle(v1alpha1.SignaturePolicyEnforce, digest, otherKey), defaultPolicy: v1alpha1.SignaturePolicyWarn, policy: v1alpha1.SignaturePolicyEnforce, message: "KEY_PAIR-0"},
+		{name: "no bundle", defaultPolicy: v1alpha1.SignaturePolicyWarn, policy: v1alpha1.SignaturePolicyWarn, message: "lists the digest"},
+	}
+	defer func(policy v1alpha1.SignaturePolicy) { DefaultSignaturePolicy = policy }(DefaultSignaturePolicy)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			DefaultSignaturePolicy = test.defaultPolicy
+			builder := fake.NewClientBuilder().WithScheme(scheme).WithObjects(instance)
+			if test.bundle != nil {
+				builder = builder.WithObjects(test.bundle)
+			}
+			policyService := NewSignaturePolicyService(&common.BaseK8sStructure{Client: builder.Build(), Log: logr.Discard()})
+
+			result, err := policyService.VerifyInstance(ctx, instance, &BundleService{})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if result.Policy != test.policy || result.Verified != test.verified || !strings.Contains(result.Message, test.message) {
+				t.Fatalf("Expected %s %v %q, got %+v", test.policy, test.verified, test.message, result)
+			}
+		})
+	}
+}
+
+func TestVerifyInstanceError(t *testing.T) {
+	ctx := context.TODO()
+	// the bundles can't be listed without their types in the scheme
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	instance := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "test"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Repository: "docker.io/entando/bundle", Digest: "sha256:" + strings.Repeat("0", 64)},
+	}
+	policyService := NewSignaturePolicyService(&common.BaseK8sStructure{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Log: logr.Discard()})
+
+	defer func(policy v1alpha1.SignaturePolicy) { DefaultSignaturePolicy = policy }(DefaultSignaturePolicy)
+	DefaultSignaturePolicy = v1alpha1.SignaturePolicyEnforce
+	result, err := policyService.VerifyInstance(ctx, instance, &BundleService{})
+	if err == nil || result.Policy != v1alpha1.SignaturePolicyEnforce || result.Verified {
+		t.Fatalf("Expected the error under the operator policy, got %+v %v", result, err)
+	}
+	image, err := policyService.VerifyPluginImage(ctx, instance, &bundles.Plugin{Repository: "nginx"}, "web", "nginx", nil, &BundleService{})
+	if err == nil || image.Policy != v1alpha1.SignaturePolicyEnforce {
+		t.Fatalf("Expected the error under the operator policy, got %+v %v", image, err)
+	}
+}
+
+func TestVerifyInstanceRepository(t *testing.T) {
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// the same repository spelled differently
+	instance := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "test"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Repository: "entando/bundle", Digest: "sha256:" + strings.Repeat("0", 64)},
+	}
+	bundle := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+		Spec:       v1alpha1.EntandoBundleV2Spec{Repository: "docker.io/entando/bundle", SignaturePolicy: v1alpha1.SignaturePolicyEnforce},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(instance, bundle).Build()
+	policyService := NewSignaturePolicyService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+
+	defer func(policy v1alpha1.SignaturePolicy) { DefaultSignaturePolicy = policy }(DefaultSignaturePolicy)
+	DefaultSignaturePolicy = v1alpha1.SignaturePolicyOff
+	result, err := policyService.VerifyInstance(context.TODO(), instance, &BundleService{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Policy != v1alpha1.SignaturePolicyEnforce || result.Verified {
+		t.Fatalf("Expected the policy of the bundle, got %+v", result)
+	}
+}
+
+func TestVerifyPluginImage(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	digest, bundleKey := signedLayout(t, filepath.Join(dir, "bundle"))
+	pluginDigest, pluginKey := signedLayout(t, filepath.Join(dir, "plugin"))
+	repository := bundles.OCILayoutScheme + filepath.Join(dir, "bundle")
+	pluginRepository := bundles.OCILayoutScheme + filepath.Join(dir, "plugin")
+
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	instance := &v1alpha1.EntandoBundleInstanceV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234-abcd", Namespace: "test"},
+		Spec:       v1alpha1.EntandoBundleInstanceV2Spec{Repository: repository, Digest: digest},
+	}
+	bundle := func(policy v1alpha1.SignaturePolicy, imagePolicy *v1alpha1.PluginImagePolicy) *v1alpha1.EntandoBundleV2 {
+		return &v1alpha1.EntandoBundleV2{
+			ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+			Spec: v1alpha1.EntandoBundleV2Spec{
+				Repository:        repository,
+				SignaturePolicy:   policy,
+				PluginImagePolicy: imagePolicy,
+				TagList: []v1alpha1.EntandoBundleTag{{Tag: "v1.0.0", Digest: digest,
+					SignatureInfo: []v1alpha1.SignatureInfo{{Type: v1alpha1.SignatureKeyPair, PubKey: string(bundleKey)}}}},
+			},
+		}
+	}
+	pluginKeyPolicy := &v1alpha1.PluginImagePolicy{Verify: true, Strict: true, Plugins: []v1alpha1.PluginSigner{
+		{Name: "plugin-a", SignatureInfo: []v1alpha1.SignatureInfo{{Name: "plugin", PubKey: string(pluginKey)}}},
+	}}
+	pinned := &bundles.Plugin{Repository: pluginRepository, Digest: pluginDigest}
+
+	tests := []struct {
+		name     string
+		bundle   *v1alpha1.EntandoBundleV2
+		plugin   *bundles.Plugin
+		verified bool
+		rejected bool
+		message  string
+		noStatus bool
+		image    string
+	}{
+		{name: "no policy", bundle: bundle(v1alpha1.SignaturePolicyEnforce, nil), plugin: pinned, noStatus: true},
+		{name: "tag only in strict mode", bundle: bundle(v1alpha1.SignaturePolicyEnforce, &v1alpha1.PluginImagePolicy{Strict: true}),
+			plugin: &bundles.Plugin{Repository: pluginRepository, Tag: "v1.0.0"}, rejected: true, message: "not pinned by digest"},
+		{name: "pinned without verification", bundle: bundle(v1alpha1.SignaturePolicyEnforce, &v1alpha1.PluginImagePolicy{Strict: true}), plugin: pinned},
+		{name: "key of the plugin", bundle: bundle(v1alpha1.SignaturePolicyEnforce, pluginKeyPolicy), plugin: pinned, verified: true},
+		{name: "keys of the bundle", bundle: bundle(v1alpha1.SignaturePolicyEnforce, &v1alpha1.PluginImagePolicy{Verify: true}),
+			plugin: pinned, rejected: true, message: "KEY_PAIR-0"},
+		{name: "keys of the bundle warn", bundle: bundle(v1alpha1.SignaturePolicyWarn, &v1alpha1.PluginImagePolicy{Verify: true}),
+			plugin: pinned, message: "KEY_PAIR-0"},
+		{name: "policy off", bundle: bundle(v1alpha1.SignaturePolicyOff, &v1alpha1.PluginImagePolicy{Verify: true}), plugin: pinned},
+		{name: "tag pinned by its digest", bundle: bundle(v1alpha1.SignaturePolicyEnforce, &v1alpha1.PluginImagePolicy{Verify: true, Plugins: pluginKeyPolicy.Plugins}),
+			plugin: &bundles.Plugin{Repository: pluginRepository, Tag: "v1.0.0"}, verified: true, image: pluginRepository + "@" + pluginDigest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(instance, test.bundle).Build()
+			policyService := NewSignaturePolicyService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+
+			result, err := policyService.VerifyPluginImage(ctx, instance, test.plugin, "plugin-a",
+				test.plugin.ImageRef(), nil, &BundleService{})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if test.noStatus {
+				if result.Status != nil || result.Rejected {
+					t.Fatalf("Expected no verification, got %+v", result)
+				}
+				return
+			}
+			if result.Status == nil || result.Status.Verified != test.verified || result.Rejected != test.rejected ||
+				!strings.Contains(result.Status.Message, test.message) {
+				t.Fatalf("Expected verified %v rejected %v %q, got %+v", test.verified, test.rejected, test.message, result)
+			}
+			if test.image != "" && (result.Image != test.image || result.Status.Digest != pluginDigest) {
+				t.Fatalf("Expected image %s, got %+v", test.image, result)
+			}
+		})
+	}
+
+	// the signatures are verified again only when the digest or the policy
+	// changed
+	imagePolicy := &v1alpha1.PluginImagePolicy{Verify: true}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(instance, bundle(v1alpha1.SignaturePolicyEnforce, imagePolicy)).Build()
+	policyService := NewSignaturePolicyService(&common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()})
+	previous := &v1alpha1.ImageStatus{}
+	result, err := policyService.VerifyPluginImage(ctx, instance, pinned, "plugin-a", pinned.ImageRef(), nil, &BundleService{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	result.Status.DeepCopyInto(previous)
+	previous.Verified, previous.Message = true, ""
+	result, err = policyService.VerifyPluginImage(ctx, instance, pinned, "plugin-a", pinned.ImageRef(), previous, &BundleService{})
+	if err != nil || !result.Status.Verified || result.Rejected {
+		t.Fatalf("Expected the previous verification, got %+v error %v", result, err)
+	}
+	previous.PolicyHash = "changed"
+	result, err = policyService.VerifyPluginImage(ctx, instance, pinned, "plugin-a", pinned.ImageRef(), previous, &BundleService{})
+	if err != nil || result.Status.Verified || !result.Rejected {
+		t.Fatalf("Expected a new verification, got %+v error %v", result, err)
+	}
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Signer is a signer that can verify the digests of a bundle
+type Signer struct {
+	Name string
+	// Group is the EntandoSignerGroup of the signer, empty for the signers
+	// of the tag
+	Group string
+	// Namespace is the namespace of the secret of the public key
+	Namespace string
+	Info      v1alpha1.SignatureInfo
+
+	// identity is the fingerprint of the public key or the Fulcio identity
+	// of the signer, empty when its key can't be loaded
+	identity string
+}
+
+// TagVerification is the verification of the digest of a tag under the
+// signer policy of the bundle
+type TagVerification struct {
+	Tag      string
+	Digest   string
+	Verified bool
+	Signers  []v1alpha1.SignerStatus
+	// Attestations is the summary of the attestations, nil without
+	// attestation policy
+	Attestations *v1alpha1.AttestationStatus
+	// Message tells why the digest is not verified
+	Message string
+}
+
+// Signers returns the signers of the tag, followed by the ones of the signer
+// groups of the policy. The secrets of the signers of a group are read in
+// the namespace of the operator, or of the bundle when it is unknown. A
+// signer with the public key or the Fulcio identity of a previous one is
+// left out, so that it counts once toward the policy.
+func (s *SignatureKeyService) Signers(ctx context.Context, namespace string, tag v1alpha1.EntandoBundleTag,
+	policy *v1alpha1.SignerPolicy) ([]Signer, error) {
+	signers := make([]Signer, 0, len(tag.SignatureInfo))
+	identities := map[string]bool{}
+	add := func(signer Signer) error {
+		identity, err := s.signerIdentity(ctx, signer.Namespace, signer.Info)
+		if err != nil {
+			return err
+		}
+		if identity != "" {
+			if identities[identity] {
+				return nil
+			}
+			identities[identity] = true
+		}
+		signer.identity = identity
+		signers = append(signers, signer)
+		return nil
+	}
+	for i, info := range tag.SignatureInfo {
+		if err := add(Signer{Name: signerName(info, i), Namespace: namespace, Info: info}); err != nil {
+			return nil, err
+		}
+	}
+	if policy == nil {
+		return signers, nil
+	}
+
+	groupNamespace := os.Getenv(OperatorNamespaceEnv)
+	if groupNamespace == "" {
+		groupNamespace = namespace
+	}
+	seen := map[string]bool{}
+	for _, groupName := range policy.SignerGroups {
+		if seen[groupName] {
+			continue
+		}
+		seen[groupName] = true
+		group, err := s.signerGroup(ctx, groupName)
+		if err != nil {
+			return nil, err
+		}
+		for i, info := range group.Spec.Signers {
+			if err := add(Signer{Name: signerName(info, i), Group: groupName, Namespace: groupNamespace, Info: info}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return signers, nil
+}
+
+// signerIdentity returns what identifies the signer whatever its name, the
+// fingerprint of its public key or the matcher of its Fulcio certificate.
+// It is empty for a key that can't be loaded, the signer doesn't verify
+// anything and is not a duplicate.
+func (s *SignatureKeyService) signerIdentity(ctx context.Context, namespace string, info v1alpha1.SignatureInfo) (string, error) {
+	if info.Type == v1alpha1.SignatureKeyLess {
+		return keylessIdentityKey(info), nil
+	}
+	verifier, err := s.Verifier(ctx, namespace, info)
+	if isKeyError(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return verifierIdentity(verifier)
+}
+
+// verifierIdentity returns the identity of the signer of a public key
+func verifierIdentity(verifier signature.Verifier) (string, error) {
+	key, err := verifier.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	fingerprint, err := KeyFingerprint(key)
+	if err != nil {
+		return "", err
+	}
+	return "key:" + fingerprint, nil
+}
+
+// keylessIdentityKey returns the identity of a KEY_LESS signer, its issuer
+// and subject
+func keylessIdentityKey(info v1alpha1.SignatureInfo) string {
+	return strings.Join([]string{"keyless", info.CertificateOidcIssuer, info.CertificateOidcIssuerRegexp,
+		info.CertificateIdentity, info.CertificateIdentityRegexp}, "\x00")
+}
+
+// signerGroup reads the signer group, once by service
+func (s *SignatureKeyService) signerGroup(ctx context.Context, name string) (*v1alpha1.EntandoSignerGroup, error) {
+	if group, ok := s.groups[name]; ok {
+		return group, nil
+	}
+	group := &v1alpha1.EntandoSignerGroup{}
+	err := s.Base.Client.Get(ctx, types.NamespacedName{Name: name}, group)
+	if errors.IsNotFound(err) {
+		return nil, &SignatureKeyError{Reason: CONDITION_BUNDLE_SIGNER_GROUP_NOT_FOUND_REASON,
+			Err: fmt.Errorf("signer group %s not found", name)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.groups == nil {
+		s.groups = map[string]*v1alpha1.EntandoSignerGroup{}
+	}
+	s.groups[name] = group
+	return group, nil
+}
+
+// signerName returns the name of the signer, by default its type and its
+// position
+func signerName(info v1alpha1.SignatureInfo, i int) string {
+	if info.Name != "" {
+		return info.Name
+	}
+	return fmt.Sprintf("%s-%d", signatureTypeOrDefault(info.Type), i)
+}
+
+// requiredSigners returns how many of the signers must verify a digest
+// under the policy, by default all of them
+func requiredSigners(policy *v1alpha1.SignerPolicy, signers int) (int, error) {
+	if policy == nil {
+		return signers, nil
+	}
+	switch policy.Require {
+	case "", v1alpha1.SignerRequirementAllOf:
+		return signers, nil
+	case v1alpha1.SignerRequirementAnyOf:
+		return 1, nil
+	case v1alpha1.SignerRequirementThreshold:
+		if policy.Threshold < 1 || policy.Threshold > signers {
+			return 0, &SignatureKeyError{Reason: CONDITION_BUNDLE_SIGNER_POLICY_INVALID_REASON,
+				Err: fmt.Errorf("threshold %d is not between 1 and the %d signers", policy.Threshold, signers)}
+		}
+		return policy.Threshold, nil
+	}
+	return 0, &SignatureKeyError{Reason: CONDITION_BUNDLE_SIGNER_POLICY_INVALID_REASON,
+		Err: fmt.Errorf("unknown requirement %q", policy.Require)}
+}
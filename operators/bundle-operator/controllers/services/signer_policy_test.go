@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSignerPolicy(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	t.Setenv(OperatorNamespaceEnv, "operator")
+
+	// an image signed by the first two keys of three
+	img := testBundleImage(t)
+	hash, err := img.Digest()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	digest := hash.String()
+	sigA, keyA := testSignature(t, digest)
+	sigB, keyB := testSignature(t, digest)
+	_, keyC := testSignature(t, digest)
+	writeSignedLayout(t, dir, img, sigA, sigB)
+
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "release-key", Namespace: "operator"},
+		Data:       map[string][]byte{DefaultPubKeySecretKey: keyB},
+	}
+	group := &v1alpha1.EntandoSignerGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "release-team"},
+		Spec: v1alpha1.EntandoSignerGroupSpec{Signers: []v1alpha1.SignatureInfo{
+			{Name: "release", PubKeySecret: "release-key"},
+			{PubKey: string(keyC)},
+		}},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, group).Build()
+	base := &common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()}
+
+	tagOf := func(keys ...[]byte) v1alpha1.EntandoBundleTag {
+		tag := v1alpha1.EntandoBundleTag{Tag: "v1.0.0", Digest: digest}
+		for _, key := range keys {
+			tag.SignatureInfo = append(tag.SignatureInfo, v1alpha1.SignatureInfo{Type: v1alpha1.SignatureKeyPair, PubKey: string(key)})
+		}
+		return tag
+	}
+	tests := []struct {
+		name     string
+		tag      v1alpha1.EntandoBundleTag
+		policy   *v1alpha1.SignerPolicy
+		verified bool
+		message  string
+		reason   string
+	}{
+		{name: "all of by default", tag: tagOf(keyA, keyB, keyC), message: "verified by 2 of 3 signers, 3 required: KEY_PAIR-2"},
+		{name: "all of", tag: tagOf(keyA, keyB), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementAllOf}, verified: true},
+		{name: "any of", tag: tagOf(keyC, keyA), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementAnyOf}, verified: true},
+		{name: "any of none", tag: tagOf(keyC), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementAnyOf}, message: "0 of 1 signers"},
+		{name: "threshold", tag: tagOf(keyA, keyB, keyC), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementThreshold, Threshold: 2}, verified: true},
+		{name: "threshold not reached", tag: tagOf(keyA, keyC), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementThreshold, Threshold: 2}, message: "1 of 2 signers, 2 required"},
+		{name: "threshold over the signers", tag: tagOf(keyA), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementThreshold, Threshold: 2}, reason: CONDITION_BUNDLE_SIGNER_POLICY_INVALID_REASON},
+		{name: "signer group", tag: tagOf(keyA), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementThreshold, Threshold: 2, SignerGroups: []string{"release-team"}}, verified: true},
+		{name: "signer group all of", tag: tagOf(), policy: &v1alpha1.SignerPolicy{SignerGroups: []string{"release-team", "release-team"}}, message: "1 of 2 signers"},
+		{name: "signer group not found", tag: tagOf(keyA), policy: &v1alpha1.SignerPolicy{SignerGroups: []string{"missing"}}, reason: CONDITION_BUNDLE_SIGNER_GROUP_NOT_FOUND_REASON},
+		{name: "duplicate keys", tag: tagOf(keyA, keyA, keyC), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementThreshold, Threshold: 2}, message: "1 of 2 signers, 2 required"},
+		{name: "duplicate key of a group", tag: tagOf(keyB), policy: &v1alpha1.SignerPolicy{SignerGroups: []string{"release-team"}}, message: "1 of 2 signers, 2 required"},
+		{name: "any of with an invalid key", tag: tagOf([]byte("not a key"), keyA), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementAnyOf}, verified: true},
+		{name: "all of with an invalid key", tag: tagOf([]byte("not a key"), keyA), reason: CONDITION_BUNDLE_PUB_KEY_INVALID_REASON},
+		{name: "no signers", tag: tagOf(), policy: &v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementAnyOf}, message: "has no signatures"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bs := &BundleService{}
+			verification, err := bs.VerifyTag(ctx, "test", bundles.OCILayoutScheme+dir, test.tag, test.policy,
+				NewSignatureKeyService(base), logr.Discard())
+			if test.reason != "" {
+				var keyErr *SignatureKeyError
+				if !errors.As(err, &keyErr) || keyErr.Reason != test.reason {
+					t.Fatalf("Expected %s error, got %v", test.reason, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if verification.Verified != test.verified || !strings.Contains(verification.Message, test.message) {
+				t.Fatalf("Expected verified %v %q, got %+v", test.verified, test.message, verification)
+			}
+		})
+	}
+
+	// the status tells which signer verified the digest
+	bs := &BundleService{}
+	verification, err := bs.VerifyTag(ctx, "test", bundles.OCILayoutScheme+dir, tagOf(keyA),
+		&v1alpha1.SignerPolicy{Require: v1alpha1.SignerRequirementAnyOf, SignerGroups: []string{"release-team"}},
+		NewSignatureKeyService(base), logr.Discard())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []v1alpha1.SignerStatus{
+		{Name: "KEY_PAIR-0", Verified: true},
+		{Name: "release", Group: "release-team", Verified: true},
+		{Name: "KEY_PAIR-1", Group: "release-team"},
+	}
+	if len(verification.Signers) != len(expected) {
+		t.Fatalf("Expected signers %+v, got %+v", expected, verification.Signers)
+	}
+	for i, status := range verification.Signers {
+		if status.Name != expected[i].Name || status.Group != expected[i].Group || status.Verified != expected[i].Verified ||
+			status.Verified != (status.Message == "") {
+			t.Fatalf("Expected signers %+v, got %+v", expected, verification.Signers)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strconv"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/fulcioroots"
+	"github.com/sigstore/sigstore/pkg/tuf"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// SigstoreFulcioKey is the key of the PEM encoded Fulcio root and
+	// intermediate certificates in the trust ConfigMap
+	SigstoreFulcioKey = "fulcio.pem"
+	// SigstoreRekorKey is the key of the PEM encoded Rekor public keys
+	SigstoreRekorKey = "rekor.pub"
+	// SigstoreRekorURLKey is the key of the URL of Rekor, used to look up the
+	// log entries of the signatures without a bundle
+	SigstoreRekorURLKey = "rekorURL"
+	// SigstoreIgnoreSCTKey skips the check of the certificate transparency
+	// log when "true", for the Sigstore stacks without one
+	SigstoreIgnoreSCTKey = "ignoreSCT"
+
+	// PublicRekorURL is the Rekor of the public Sigstore instance
+	PublicRekorURL = "https://rekor.sigstore.dev"
+)
+
+// SigstoreTrustConfigMap is the ConfigMap with the trust roots of the keyless
+// signatures in the namespace of the operator, without it the roots of the
+// public Sigstore instance are used. It can be changed with the flags of the
+// operator.
+var SigstoreTrustConfigMap = "bundle-operator-sigstore-trust"
+
+// SigstoreTrust are the trust roots of the keyless signatures
+type SigstoreTrust struct {
+	Roots         *x509.CertPool
+	Intermediates *x509.CertPool
+	RekorPubKeys  *cosign.TrustedRekorPubKeys
+	// RekorURL is the Rekor looked up for the signatures without a bundle,
+	// when empty only the signatures with a bundle are verified
+	RekorURL  string
+	IgnoreSCT bool
+}
+
+// SigstoreTrustService reads the trust roots of the keyless signatures
+type SigstoreTrustService struct {
+	Base *common.BaseK8sStructure
+}
+
+func NewSigstoreTrustService(base *common.BaseK8sStructure) *SigstoreTrustService {
+	return &SigstoreTrustService{Base: base}
+}
+
+// Trust reads the trust roots from the ConfigMap or, without ConfigMap,
+// returns the ones of the public Sigstore instance
+func (s *SigstoreTrustService) Trust(ctx context.Context) (*SigstoreTrust, error) {
+	namespace := os.Getenv(OperatorNamespaceEnv)
+	if namespace == "" || SigstoreTrustConfigMap == "" {
+		return publicSigstoreTrust(ctx)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := s.Base.Client.Get(ctx, types.NamespacedName{Name: SigstoreTrustConfigMap, Namespace: namespace}, configMap)
+	if errors.IsNotFound(err) {
+		return publicSigstoreTrust(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	trust, err := parseSigstoreTrust(configMap.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust roots in %s/%s: %w", namespace, SigstoreTrustConfigMap, err)
+	}
+	return trust, nil
+}
+
+// parseSigstoreTrust parses the data of the trust ConfigMap, the self signed
+// certificates are the roots and the other ones the intermediates
+func parseSigstoreTrust(data map[string]string) (*SigstoreTrust, error) {
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM([]byte(data[SigstoreFulcioKey]))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", SigstoreFulcioKey, err)
+	}
+	trust := &SigstoreTrust{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		RekorURL:      data[SigstoreRekorURLKey],
+	}
+	roots := 0
+	for _, cert := range certs {
+		if cert.CheckSignatureFrom(cert) == nil {
+			trust.Roots.AddCert(cert)
+			roots++
+		} else {
+			trust.Intermediates.AddCert(cert)
+		}
+	}
+	if roots == 0 {
+		return nil, fmt.Errorf("%s: no root certificate", SigstoreFulcioKey)
+	}
+
+	rekorPubKeys := cosign.NewTrustedRekorPubKeys()
+	rest := []byte(data[SigstoreRekorKey])
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if err := rekorPubKeys.AddRekorPubKey(pem.EncodeToMemory(block), tuf.Active); err != nil {
+			return nil, fmt.Errorf("%s: %w", SigstoreRekorKey, err)
+		}
+	}
+	if len(rekorPubKeys.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no public key", SigstoreRekorKey)
+	}
+	trust.RekorPubKeys = &rekorPubKeys
+
+	if value, ok := data[SigstoreIgnoreSCTKey]; ok {
+		if trust.IgnoreSCT, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", SigstoreIgnoreSCTKey, err)
+		}
+	}
+	return trust, nil
+}
+
+// publicSigstoreTrust returns the trust roots of the public Sigstore
+// instance, read from its TUF repository
+func publicSigstoreTrust(ctx context.Context) (*SigstoreTrust, error) {
+	roots, err := fulcioroots.Get()
+	if err != nil {
+		return nil, fmt.Errorf("fulcio roots: %w", err)
+	}
+	intermediates, err := fulcioroots.GetIntermediates()
+	if err != nil {
+		return nil, fmt.Errorf("fulcio intermediates: %w", err)
+	}
+	rekorPubKeys, err := cosign.GetRekorPubs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("rekor public keys: %w", err)
+	}
+	return &SigstoreTrust{Roots: roots, Intermediates: intermediates, RekorPubKeys: rekorPubKeys, RekorURL: PublicRekorURL}, nil
+}
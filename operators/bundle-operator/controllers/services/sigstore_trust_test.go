@@ -0,0 +1,353 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/v2/pkg/cosign/bundle"
+	"github.com/sigstore/cosign/v2/pkg/oci"
+	"github.com/sigstore/cosign/v2/pkg/oci/static"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	testIdentity = "release@example.com"
+	testIssuer   = "https://issuer.example.com"
+)
+
+// testSigstore is a stand-in Sigstore stack, a Fulcio root and a Rekor key
+type testSigstore struct {
+	root      *x509.Certificate
+	rootKey   *ecdsa.PrivateKey
+	rootPEM   []byte
+	rekorKey  *ecdsa.PrivateKey
+	rekorPEM  []byte
+	serialNum int64
+}
+
+func newTestSigstore(t *testing.T) *testSigstore {
+	s := &testSigstore{rootKey: testECDSAKey(t), rekorKey: testECDSAKey(t)}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.rootKey.PublicKey, s.rootKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.root, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.rootPEM, err = cryptoutils.MarshalCertificateToPEM(s.root); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.rekorPEM, err = cryptoutils.MarshalPublicKeyToPEM(&s.rekorKey.PublicKey); err != nil {
+		t.Fatal(err.Error())
+	}
+	return s
+}
+
+func testECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return key
+}
+
+// trustData is the data of the trust ConfigMap of the stack
+func (s *testSigstore) trustData() map[string]string {
+	return map[string]string{
+		SigstoreFulcioKey:    string(s.rootPEM),
+		SigstoreRekorKey:     string(s.rekorPEM),
+		SigstoreIgnoreSCTKey: "true",
+	}
+}
+
+// sign returns the keyless signature of the image, with a short lived
+// certificate of the identity and the log entry bundled
+func (s *testSigstore) sign(t *testing.T, imageRef name.Digest, identity string, issuer string) oci.Signature {
+	key := testECDSAKey(t)
+	s.serialNum++
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(s.serialNum + 1),
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(10 * time.Minute),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses: []string{identity},
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}, Value: []byte(issuer)},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.root, &key.PublicKey, s.rootKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	certPEM := pemCertificate(t, der)
+
+	claims, err := payload.Cosign{Image: imageRef}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := signature.LoadECDSASignerVerifier(key, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rawSignature, err := signer.SignMessage(bytes.NewReader(claims))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b64Signature := base64.StdEncoding.EncodeToString(rawSignature)
+
+	// the hashedrekord entry of the signature and its signed entry timestamp
+	claimsHash := sha256.Sum256(claims)
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"data": map[string]interface{}{
+				"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(claimsHash[:])},
+			},
+			"signature": map[string]interface{}{
+				"content":   b64Signature,
+				"publicKey": map[string]string{"content": base64.StdEncoding.EncodeToString(certPEM)},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rekorPub, err := x509.MarshalPKIXPublicKey(&s.rekorKey.PublicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	logID := sha256.Sum256(rekorPub)
+	rekorPayload := bundle.RekorPayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: time.Now().Unix(),
+		LogIndex:       s.serialNum,
+		LogID:          hex.EncodeToString(logID[:]),
+	}
+	// the keys of a map are sorted, the canonical form of the payload
+	canonical, err := json.Marshal(map[string]interface{}{
+		"body":           rekorPayload.Body,
+		"integratedTime": rekorPayload.IntegratedTime,
+		"logIndex":       rekorPayload.LogIndex,
+		"logID":          rekorPayload.LogID,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	canonicalHash := sha256.Sum256(canonical)
+	set, err := ecdsa.SignASN1(rand.Reader, s.rekorKey, canonicalHash[:])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	sig, err := static.NewSignature(claims, b64Signature,
+		static.WithCertChain(certPEM, s.rootPEM),
+		static.WithBundle(&bundle.RekorBundle{SignedEntryTimestamp: set, Payload: rekorPayload}),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return sig
+}
+
+func pemCertificate(t *testing.T, der []byte) []byte {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	certPEM, err := cryptoutils.MarshalCertificateToPEM(cert)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return certPEM
+}
+
+// keylessLayout writes an image signed by the identity to an OCI image
+// layout, it returns the bundle of the image
+func keylessLayout(t *testing.T, dir string, sigstore *testSigstore, identity string, issuer string) *v1alpha1.EntandoBundleV2 {
+	img, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte("name: example\n")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	imageRef, err := name.NewDigest("registry.example.com/entando/bundle@" + digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writeSignedLayout(t, dir, img, sigstore.sign(t, imageRef, identity, issuer))
+	return &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+		Spec: v1alpha1.EntandoBundleV2Spec{
+			Repository: bundles.OCILayoutScheme + dir,
+			TagList:    []v1alpha1.EntandoBundleTag{{Tag: "v1.0.0", Digest: digest.String()}},
+		},
+	}
+}
+
+func TestKeylessSignature(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	sigstore := newTestSigstore(t)
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: SigstoreTrustConfigMap, Namespace: "operator"},
+		Data:       sigstore.trustData(),
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(configMap).Build()
+	base := &common.BaseK8sStructure{Client: k8sClient, Log: logr.Discard()}
+	t.Setenv(OperatorNamespaceEnv, "operator")
+
+	signedBundle := keylessLayout(t, filepath.Join(dir, "signed"), sigstore, testIdentity, testIssuer)
+	// a certificate of another Fulcio
+	untrustedBundle := keylessLayout(t, filepath.Join(dir, "untrusted"), newTestSigstore(t), testIdentity, testIssuer)
+	// a log entry of another Rekor
+	otherRekor := newTestSigstore(t)
+	otherRekor.root, otherRekor.rootKey, otherRekor.rootPEM = sigstore.root, sigstore.rootKey, sigstore.rootPEM
+	unloggedBundle := keylessLayout(t, filepath.Join(dir, "unlogged"), otherRekor, testIdentity, testIssuer)
+
+	keyless := func(cr *v1alpha1.EntandoBundleV2, info v1alpha1.SignatureInfo) *v1alpha1.EntandoBundleV2 {
+		cr = cr.DeepCopy()
+		info.Type = v1alpha1.SignatureKeyLess
+		cr.Spec.TagList[0].SignatureInfo = []v1alpha1.SignatureInfo{info}
+		return cr
+	}
+	tests := []struct {
+		name     string
+		cr       *v1alpha1.EntandoBundleV2
+		verified bool
+	}{
+		{
+			name:     "exact identity",
+			cr:       keyless(signedBundle, v1alpha1.SignatureInfo{CertificateIdentity: testIdentity, CertificateOidcIssuer: testIssuer}),
+			verified: true,
+		},
+		{
+			name:     "regexp identity",
+			cr:       keyless(signedBundle, v1alpha1.SignatureInfo{CertificateIdentityRegexp: `^.*@example\.com$`, CertificateOidcIssuerRegexp: `^https://issuer\.`}),
+			verified: true,
+		},
+		{
+			name: "other identity",
+			cr:   keyless(signedBundle, v1alpha1.SignatureInfo{CertificateIdentity: "other@example.com", CertificateOidcIssuer: testIssuer}),
+		},
+		{
+			name: "other issuer",
+			cr:   keyless(signedBundle, v1alpha1.SignatureInfo{CertificateIdentity: testIdentity, CertificateOidcIssuerRegexp: "^https://other"}),
+		},
+		{
+			name: "untrusted certificate",
+			cr:   keyless(untrustedBundle, v1alpha1.SignatureInfo{CertificateIdentity: testIdentity, CertificateOidcIssuer: testIssuer}),
+		},
+		{
+			name: "untrusted log entry",
+			cr:   keyless(unloggedBundle, v1alpha1.SignatureInfo{CertificateIdentity: testIdentity, CertificateOidcIssuer: testIssuer}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bs := &BundleService{}
+			verified, _, err := bs.CheckBundleSignature(ctx, test.cr, NewSignatureKeyService(base), logr.Discard())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if (len(verified) == 1) != test.verified {
+				t.Fatalf("Expected verified %v, got %v", test.verified, verified)
+			}
+		})
+	}
+
+	// the identity is required
+	bs := &BundleService{}
+	_, _, err := bs.CheckBundleSignature(ctx, keyless(signedBundle, v1alpha1.SignatureInfo{CertificateOidcIssuer: testIssuer}), NewSignatureKeyService(base), logr.Discard())
+	var keyErr *SignatureKeyError
+	if !errors.As(err, &keyErr) || keyErr.Reason != CONDITION_BUNDLE_KEYLESS_IDENTITY_INVALID_REASON {
+		t.Fatalf("Expected %s error, got %v", CONDITION_BUNDLE_KEYLESS_IDENTITY_INVALID_REASON, err)
+	}
+	_, _, err = bs.CheckBundleSignature(ctx, keyless(signedBundle, v1alpha1.SignatureInfo{CertificateIdentityRegexp: "(", CertificateOidcIssuer: testIssuer}), NewSignatureKeyService(base), logr.Discard())
+	if !errors.As(err, &keyErr) || keyErr.Reason != CONDITION_BUNDLE_KEYLESS_IDENTITY_INVALID_REASON {
+		t.Fatalf("Expected %s error, got %v", CONDITION_BUNDLE_KEYLESS_IDENTITY_INVALID_REASON, err)
+	}
+
+	// invalid trust roots
+	configMap.Data[SigstoreRekorKey] = "not a key"
+	if err := k8sClient.Update(ctx, configMap); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _, err = bs.CheckBundleSignature(ctx, tests[0].cr, NewSignatureKeyService(base), logr.Discard())
+	if !errors.As(err, &keyErr) || keyErr.Reason != CONDITION_BUNDLE_TRUST_ROOTS_INVALID_REASON {
+		t.Fatalf("Expected %s error, got %v", CONDITION_BUNDLE_TRUST_ROOTS_INVALID_REASON, err)
+	}
+}
+
+func TestParseSigstoreTrust(t *testing.T) {
+	sigstore := newTestSigstore(t)
+	other := newTestSigstore(t)
+
+	data := sigstore.trustData()
+	data[SigstoreRekorKey] += string(other.rekorPEM)
+	data[SigstoreRekorURLKey] = "https://rekor.example.com"
+	trust, err := parseSigstoreTrust(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(trust.RekorPubKeys.Keys) != 2 || !trust.IgnoreSCT || trust.RekorURL != "https://rekor.example.com" {
+		t.Fatalf("Invalid trust %+v", trust)
+	}
+
+	for _, invalid := range []map[string]string{
+		{SigstoreRekorKey: string(sigstore.rekorPEM)},
+		{SigstoreFulcioKey: string(sigstore.rootPEM)},
+		{SigstoreFulcioKey: string(sigstore.rootPEM), SigstoreRekorKey: string(sigstore.rekorPEM), SigstoreIgnoreSCTKey: "maybe"},
+	} {
+		if _, err := parseSigstoreTrust(invalid); err == nil || !strings.Contains(err.Error(), ":") {
+			t.Fatalf("Expected invalid trust %v", invalid)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	// defaultDiscoveryInterval is the interval the tags are listed when the
+	// tag discovery has none
+	defaultDiscoveryInterval = 10 * time.Minute
+	// discoveryMaxBackoff is the longest interval after consecutive failures,
+	// unless the interval of the discovery is longer
+	discoveryMaxBackoff = 6 * time.Hour
+	// discoveryRateLimitDelay is the shortest interval after the registry
+	// rate limited the listing
+	discoveryRateLimitDelay = 15 * time.Minute
+	// defaultMaxDiscoveredVersions is the number of versions kept when the
+	// tag discovery has no max
+	defaultMaxDiscoveredVersions = 10
+)
+
+// cosignTag matches the tags of the cosign signatures, attestations and
+// SBOMs, they are never discovered
+var cosignTag = regexp.MustCompile(`^sha256-[0-9a-f]{64}\.(sig|att|sbom)$`)
+
+// TagDiscoveryError is an invalid tag discovery, listing the tags again
+// doesn't help until the bundle changes
+type TagDiscoveryError struct {
+	Err error
+}
+
+func (e *TagDiscoveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TagDiscoveryError) Unwrap() error {
+	return e.Err
+}
+
+// tagFilter selects the discovered tags, by semver range and by regular
+// expression
+type tagFilter struct {
+	constraints *semver.Constraints
+	regexp      *regexp.Regexp
+	maxVersions int
+}
+
+func newTagFilter(discovery *v1alpha1.TagDiscovery) (*tagFilter, error) {
+	filter := &tagFilter{maxVersions: discovery.MaxVersions}
+	if filter.maxVersions <= 0 {
+		filter.maxVersions = defaultMaxDiscoveredVersions
+	}
+	var err error
+	if discovery.SemverRange != "" {
+		if filter.constraints, err = semver.NewConstraint(discovery.SemverRange); err != nil {
+			return nil, &TagDiscoveryError{Err: fmt.Errorf("invalid semverRange %q: %w", discovery.SemverRange, err)}
+		}
+	}
+	if discovery.TagRegexp != "" {
+		if filter.regexp, err = regexp.Compile(discovery.TagRegexp); err != nil {
+			return nil, &TagDiscoveryError{Err: fmt.Errorf("invalid tagRegexp %q: %w", discovery.TagRegexp, err)}
+		}
+	}
+	return filter, nil
+}
+
+// selectTags returns the tags matching the filter, the highest versions
+// first and then the other tags in reverse order, at most maxVersions
+func (f *tagFilter) selectTags(tags []string) []string {
+	type candidate struct {
+		tag     string
+		version *semver.Version
+	}
+	candidates := []candidate{}
+	for _, tag := range tags {
+		if cosignTag.MatchString(tag) || (f.regexp != nil && !f.regexp.MatchString(tag)) {
+			continue
+		}
+		version, err := semver.NewVersion(tag)
+		if err != nil {
+			version = nil
+		}
+		if f.constraints != nil && (version == nil || !f.constraints.Check(version)) {
+			continue
+		}
+		candidates = append(candidates, candidate{tag: tag, version: version})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if (a.version == nil) != (b.version == nil) {
+			return a.version != nil
+		}
+		if a.version != nil && !a.version.Equal(b.version) {
+			return a.version.GreaterThan(b.version)
+		}
+		return a.tag > b.tag
+	})
+	if len(candidates) > f.maxVersions {
+		candidates = candidates[:f.maxVersions]
+	}
+	selected := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		selected = append(selected, c.tag)
+	}
+	return selected
+}
+
+// DiscoverTags lists the tags of the repository of the bundle, through the
+// mirror rules, resolves the digests of the ones matching the tag discovery
+// and verifies them with the signers of the discovery. The digests of the
+// previous discovery of the same generation of the bundle keep their
+// verification. An invalid discovery is a *TagDiscoveryError, the other
+// errors are the ones of the registry.
+func (bs *BundleService) DiscoverTags(ctx context.Context, cr *v1alpha1.EntandoBundleV2, keys *SignatureKeyService,
+	log logr.Logger) ([]v1alpha1.DiscoveredVersion, error) {
+	discovery := cr.Spec.TagDiscovery
+	filter, err := newTagFilter(discovery)
+	if err != nil {
+		return nil, err
+	}
+	repository, tags, err := bs.Mirrors.ListTags(cr.Spec.Repository, bs.craneOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("listing the tags of %s: %w", cr.Spec.Repository, err)
+	}
+
+	previous := map[string]v1alpha1.DiscoveredVersion{}
+	if cr.Status.Discovery != nil && cr.Status.Discovery.ObservedGeneration == cr.Generation {
+		for _, version := range cr.Status.Discovery.Versions {
+			previous[version.Tag] = version
+		}
+	}
+	versions := []v1alpha1.DiscoveredVersion{}
+	for _, tag := range filter.selectTags(tags) {
+		digest, err := bundles.Digest(repository+":"+tag, bs.craneOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("resolving the digest of %s:%s: %w", repository, tag, err)
+		}
+		if version, ok := previous[tag]; ok && version.Digest == digest {
+			versions = append(versions, version)
+			continue
+		}
+		version := v1alpha1.DiscoveredVersion{Tag: tag, Digest: digest}
+		verification, err := bs.VerifyBundleTag(ctx, cr,
+			v1alpha1.EntandoBundleTag{Tag: tag, Digest: digest, SignatureInfo: discovery.SignatureInfo}, keys, log)
+		var keyErr *SignatureKeyError
+		if errors.As(err, &keyErr) {
+			version.Message = err.Error()
+		} else if err != nil {
+			return nil, err
+		} else {
+			version.Verified, version.Signers, version.Message = verification.Verified, verification.Signers, verification.Message
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// DiscoveryWait returns how long before the tags of the bundle are listed
+// again, zero when they are due
+func DiscoveryWait(cr *v1alpha1.EntandoBundleV2, now time.Time) time.Duration {
+	status := cr.Status.Discovery
+	if status == nil || status.NextTime == nil || status.ObservedGeneration != cr.Generation {
+		return 0
+	}
+	if wait := status.NextTime.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// DiscoveryInterval returns the interval before the next listing of the
+// tags, it doubles at each consecutive failure and it is longer after the
+// registry rate limited the listing
+func DiscoveryInterval(discovery *v1alpha1.TagDiscovery, failures int, rateLimited bool) time.Duration {
+	interval := defaultDiscoveryInterval
+	if discovery.Interval != nil && discovery.Interval.Duration > 0 {
+		interval = discovery.Interval.Duration
+	}
+	maxBackoff := discoveryMaxBackoff
+	if interval > maxBackoff {
+		maxBackoff = interval
+	}
+	for i := 0; i < failures && interval < maxBackoff; i++ {
+		interval *= 2
+	}
+	if interval > maxBackoff {
+		interval = maxBackoff
+	}
+	if rateLimited && interval < discoveryRateLimitDelay {
+		interval = discoveryRateLimitDelay
+	}
+	return interval
+}
+
+// IsRateLimited tells if the registry refused the request because of its
+// rate limits
+func IsRateLimited(err error) bool {
+	var transportErr *transport.Error
+	return errors.As(err, &transportErr) && transportErr.StatusCode == http.StatusTooManyRequests
+}
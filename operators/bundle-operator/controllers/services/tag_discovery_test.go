@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/gigiozzz/depiy/common-libs/commons"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	cosignmutate "github.com/sigstore/cosign/v2/pkg/oci/mutate"
+	"github.com/sigstore/cosign/v2/pkg/oci/signed"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// pushTags pushes a bundle image by tag to the repository, it returns the
+// digest of each tag
+func pushTags(t *testing.T, repository string, tags ...string) map[string]string {
+	digests := map[string]string{}
+	for _, tag := range tags {
+		img, err := crane.Image(map[string][]byte{"descriptor.yaml": []byte("name: example\nversion: " + tag + "\n")})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := crane.Push(img, repository+":"+tag); err != nil {
+			t.Fatal(err.Error())
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		digests[tag] = digest.String()
+	}
+	return digests
+}
+
+func TestDiscoverTags(t *testing.T) {
+	ctx := context.TODO()
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	repository := strings.TrimPrefix(server.URL, "http://") + "/entando/bundle"
+	digests := pushTags(t, repository, "v1.0.0", "v1.1.0", "v1.2.0-rc.1", "v2.0.0", "latest", "nightly-20221201")
+
+	// v1.1.0 is signed, its signature is pushed to the cosign tag
+	signer, publicKey := testSigner(t)
+	img, err := crane.Pull(repository + "@" + digests["v1.1.0"])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signedImage, err := cosignmutate.AttachSignatureToImage(signed.Image(img), signDigest(t, signer, digests["v1.1.0"]))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signatures, err := signedImage.Signatures()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signatureTag := strings.Replace(digests["v1.1.0"], ":", "-", 1) + ".sig"
+	if err := crane.Push(signatures, repository+":"+signatureTag); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err.Error())
+	}
+	base := &common.BaseK8sStructure{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Log: logr.Discard()}
+	bundle := func(discovery v1alpha1.TagDiscovery) *v1alpha1.EntandoBundleV2 {
+		discovery.SignatureInfo = []v1alpha1.SignatureInfo{{Name: "release", PubKey: string(publicKey)}}
+		return &v1alpha1.EntandoBundleV2{
+			ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+			Spec:       v1alpha1.EntandoBundleV2Spec{Repository: repository, TagDiscovery: &discovery},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		discovery v1alpha1.TagDiscovery
+		tags      []string
+	}{
+		{name: "semver range", discovery: v1alpha1.TagDiscovery{SemverRange: ">=1.0.0 <2.0.0"}, tags: []string{"v1.1.0", "v1.0.0"}},
+		{name: "prereleases", discovery: v1alpha1.TagDiscovery{SemverRange: ">=1.2.0-0"}, tags: []string{"v2.0.0", "v1.2.0-rc.1"}},
+		{name: "regexp", discovery: v1alpha1.TagDiscovery{TagRegexp: "^nightly-"}, tags: []string{"nightly-20221201"}},
+		{name: "semver range and regexp", discovery: v1alpha1.TagDiscovery{SemverRange: "<2.0.0", TagRegexp: `^v1\.[01]\.`}, tags: []string{"v1.1.0", "v1.0.0"}},
+		{name: "highest versions", discovery: v1alpha1.TagDiscovery{MaxVersions: 3}, tags: []string{"v2.0.0", "v1.2.0-rc.1", "v1.1.0"}},
+		{name: "all the tags", discovery: v1alpha1.TagDiscovery{},
+			tags: []string{"v2.0.0", "v1.2.0-rc.1", "v1.1.0", "v1.0.0", "nightly-20221201", "latest"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bs := &BundleService{}
+			versions, err := bs.DiscoverTags(ctx, bundle(test.discovery), NewSignatureKeyService(base), logr.Discard())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			tags := []string{}
+			for _, version := range versions {
+				tags = append(tags, version.Tag)
+				if version.Digest != digests[version.Tag] {
+					t.Fatalf("Expected digest %s of %s, got %s", digests[version.Tag], version.Tag, version.Digest)
+				}
+				if version.Verified != (version.Tag == "v1.1.0") {
+					t.Fatalf("Unexpected verification of %s: %+v", version.Tag, version)
+				}
+			}
+			if !reflect.DeepEqual(tags, test.tags) {
+				t.Fatalf("Expected tags %v, got %v", test.tags, tags)
+			}
+		})
+	}
+
+	// the tags are listed and resolved through the mirror rules
+	mirrors, err := bundles.ParseMirrorConfig([]byte("rules:\n- prefix: registry.invalid/entando\n" +
+		"  mirrors: [" + strings.TrimPrefix(server.URL, "http://") + "/entando]\n  rewrite: true\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mirrored := bundle(v1alpha1.TagDiscovery{SemverRange: ">=1.0.0 <2.0.0"})
+	mirrored.Spec.Repository = "registry.invalid/entando/bundle"
+	versions, err := (&BundleService{Mirrors: mirrors}).DiscoverTags(ctx, mirrored, NewSignatureKeyService(base), logr.Discard())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(versions) != 2 || versions[0].Digest != digests["v1.1.0"] || !versions[0].Verified || versions[1].Digest != digests["v1.0.0"] {
+		t.Fatalf("Expected the versions of the mirror, got %+v", versions)
+	}
+
+	// only the new and the changed digests are verified again
+	previous := bundle(v1alpha1.TagDiscovery{SemverRange: ">=1.0.0 <2.0.0"})
+	previous.Status.Discovery = &v1alpha1.TagDiscoveryStatus{Versions: []v1alpha1.DiscoveredVersion{
+		{Tag: "v1.1.0", Digest: digests["v1.0.0"], Message: "moved tag"},
+		{Tag: "v1.0.0", Digest: digests["v1.0.0"], Message: "previous verification"},
+	}}
+	versions, err = (&BundleService{}).DiscoverTags(ctx, previous, NewSignatureKeyService(base), logr.Discard())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(versions) != 2 || !versions[0].Verified || versions[1].Message != "previous verification" {
+		t.Fatalf("Expected the previous verification of v1.0.0 only, got %+v", versions)
+	}
+	previous.Generation++
+	versions, err = (&BundleService{}).DiscoverTags(ctx, previous, NewSignatureKeyService(base), logr.Discard())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(versions) != 2 || versions[1].Message == "previous verification" {
+		t.Fatalf("Expected the versions verified again after a change of the bundle, got %+v", versions)
+	}
+
+	// an invalid discovery is reported
+	bs := &BundleService{}
+	_, err = bs.DiscoverTags(ctx, bundle(v1alpha1.TagDiscovery{SemverRange: "not a range"}), NewSignatureKeyService(base), logr.Discard())
+	var discoveryErr *TagDiscoveryError
+	if !errors.As(err, &discoveryErr) {
+		t.Fatalf("Expected invalid tag discovery, got %v", err)
+	}
+
+	// the rate limits of the registry are recognized
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tags/list") {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		registry.New().ServeHTTP(w, r)
+	}))
+	defer limited.Close()
+	limitedBundle := bundle(v1alpha1.TagDiscovery{})
+	limitedBundle.Spec.Repository = strings.TrimPrefix(limited.URL, "http://") + "/entando/bundle"
+	if _, err := bs.DiscoverTags(ctx, limitedBundle, NewSignatureKeyService(base), logr.Discard()); !IsRateLimited(err) {
+		t.Fatalf("Expected rate limited, got %v", err)
+	}
+}
+
+func TestDiscoveryInterval(t *testing.T) {
+	interval := func(d time.Duration) *v1alpha1.TagDiscovery {
+		return &v1alpha1.TagDiscovery{Interval: &metav1.Duration{Duration: d}}
+	}
+	tests := []struct {
+		name        string
+		discovery   *v1alpha1.TagDiscovery
+		failures    int
+		rateLimited bool
+		expected    time.Duration
+	}{
+		{name: "default", discovery: &v1alpha1.TagDiscovery{}, expected: 10 * time.Minute},
+		{name: "interval", discovery: interval(time.Minute), expected: time.Minute},
+		{name: "backoff", discovery: interval(time.Minute), failures: 3, expected: 8 * time.Minute},
+		{name: "max backoff", discovery: &v1alpha1.TagDiscovery{}, failures: 20, expected: 6 * time.Hour},
+		{name: "interval over the max backoff", discovery: interval(12 * time.Hour), failures: 2, expected: 12 * time.Hour},
+		{name: "rate limited", discovery: interval(time.Minute), failures: 1, rateLimited: true, expected: 15 * time.Minute},
+	}
+	for _, test := range tests {
+		if actual := DiscoveryInterval(test.discovery, test.failures, test.rateLimited); actual != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.name, test.expected, actual)
+		}
+	}
+
+	now := time.Now()
+	cr := &v1alpha1.EntandoBundleV2{ObjectMeta: metav1.ObjectMeta{Generation: 2}}
+	if wait := DiscoveryWait(cr, now); wait != 0 {
+		t.Fatalf("Expected discovery due without status, got %s", wait)
+	}
+	cr.Status.Discovery = &v1alpha1.TagDiscoveryStatus{ObservedGeneration: 2, NextTime: &metav1.Time{Time: now.Add(time.Minute)}}
+	if wait := DiscoveryWait(cr, now); wait != time.Minute {
+		t.Fatalf("Expected discovery in a minute, got %s", wait)
+	}
+	// a change of the bundle lists the tags again
+	cr.Generation = 3
+	if wait := DiscoveryWait(cr, now); wait != 0 {
+		t.Fatalf("Expected discovery due after a change, got %s", wait)
+	}
+}
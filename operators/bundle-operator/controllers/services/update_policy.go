@@ -0,0 +1,201 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxUpgradeRecords is the number of upgrades kept in the status of an
+// instance
+const maxUpgradeRecords = 10
+
+// UpgradeCandidate is a verified version of a bundle an instance can move to
+type UpgradeCandidate struct {
+	Tag    string
+	Digest string
+}
+
+// IsInstanceOf tells if the instance is installed from the bundle, by
+// bundleRef or, without it, by repository
+func IsInstanceOf(instance *v1alpha1.EntandoBundleInstanceV2, bundle *v1alpha1.EntandoBundleV2) bool {
+	if instance.Spec.BundleRef != "" {
+		return instance.Spec.BundleRef == bundle.GetName()
+	}
+	return bundles.SameRepository(instance.Spec.Repository, bundle.Spec.Repository)
+}
+
+// VerifiedVersions returns the verified versions of the bundle, the ones of
+// the tag list and the discovered ones
+func VerifiedVersions(bundle *v1alpha1.EntandoBundleV2) []UpgradeCandidate {
+	versions := []UpgradeCandidate{}
+	seen := map[string]bool{}
+	for _, tag := range bundle.Status.Tags {
+		if tag.Verified && !seen[tag.Tag] {
+			seen[tag.Tag] = true
+			versions = append(versions, UpgradeCandidate{Tag: tag.Tag, Digest: tag.Digest})
+		}
+	}
+	if bundle.Spec.TagDiscovery != nil && bundle.Status.Discovery != nil {
+		for _, version := range bundle.Status.Discovery.Versions {
+			if version.Verified && !seen[version.Tag] {
+				seen[version.Tag] = true
+				versions = append(versions, UpgradeCandidate{Tag: version.Tag, Digest: version.Digest})
+			}
+		}
+	}
+	return versions
+}
+
+// UpdateStrategyOrDefault returns the strategy of the update policy, Pinned
+// when not set
+func UpdateStrategyOrDefault(policy *v1alpha1.UpdatePolicy) v1alpha1.UpdateStrategy {
+	if policy == nil || policy.Strategy == "" {
+		return v1alpha1.UpdateStrategyPinned
+	}
+	return policy.Strategy
+}
+
+// UpgradeTarget returns the verified version the instance moves to under its
+// update policy, nil when it stays on its digest. An instance without digest
+// gets the digest of its tag or, without tag, the highest version allowed by
+// the policy. The prereleases are never selected.
+func UpgradeTarget(instance *v1alpha1.EntandoBundleInstanceV2, bundle *v1alpha1.EntandoBundleV2) *UpgradeCandidate {
+	versions := VerifiedVersions(bundle)
+	strategy := UpdateStrategyOrDefault(instance.Spec.UpdatePolicy)
+	if instance.Spec.Digest == "" && instance.Spec.Tag != "" {
+		for i := range versions {
+			if versions[i].Tag == instance.Spec.Tag {
+				return &versions[i]
+			}
+		}
+		return nil
+	}
+	if strategy == v1alpha1.UpdateStrategyPinned && instance.Spec.Digest != "" {
+		return nil
+	}
+
+	current, err := semver.NewVersion(instance.Spec.Tag)
+	if err != nil {
+		current = nil
+	}
+	var target *UpgradeCandidate
+	var targetVersion *semver.Version
+	for i := range versions {
+		version, err := semver.NewVersion(versions[i].Tag)
+		if err != nil || version.Prerelease() != "" {
+			continue
+		}
+		if current != nil && instance.Spec.Digest != "" {
+			if !version.GreaterThan(current) {
+				continue
+			}
+			if strategy == v1alpha1.UpdateStrategyPatch && (version.Major() != current.Major() || version.Minor() != current.Minor()) {
+				continue
+			}
+			if strategy == v1alpha1.UpdateStrategyMinor && version.Major() != current.Major() {
+				continue
+			}
+		} else if instance.Spec.Digest != "" && strategy != v1alpha1.UpdateStrategyLatestVerified {
+			// the tag of the instance is not a version, only the latest verified is comparable
+			continue
+		}
+		if targetVersion == nil || version.GreaterThan(targetVersion) {
+			target, targetVersion = &versions[i], version
+		}
+	}
+	if target == nil || target.Digest == instance.Spec.Digest {
+		return nil
+	}
+	return target
+}
+
+// MaintenanceWindowAt tells if the time is in one of the maintenance
+// windows, when not it returns the start of the next window. Without
+// windows any time is in a window.
+func MaintenanceWindowAt(windows []v1alpha1.MaintenanceWindow, now time.Time) (bool, time.Time, error) {
+	var next time.Time
+	for _, window := range windows {
+		location := time.UTC
+		if window.TimeZone != "" {
+			var err error
+			if location, err = time.LoadLocation(window.TimeZone); err != nil {
+				return false, next, fmt.Errorf("invalid time zone %q: %w", window.TimeZone, err)
+			}
+		}
+		start, err := time.Parse("15:04", window.Start)
+		if err != nil {
+			return false, next, fmt.Errorf("invalid start %q, HH:MM expected", window.Start)
+		}
+		if window.Duration.Duration <= 0 {
+			return false, next, fmt.Errorf("invalid duration %s of the window starting at %s", window.Duration.Duration, window.Start)
+		}
+
+		// the window may have started in the previous week
+		local := now.In(location)
+		for day := -7; day <= 7; day++ {
+			date := local.AddDate(0, 0, day)
+			windowStart := time.Date(date.Year(), date.Month(), date.Day(), start.Hour(), start.Minute(), 0, 0, location)
+			if !windowOnDay(window, windowStart.Weekday()) {
+				continue
+			}
+			if !now.Before(windowStart) && now.Before(windowStart.Add(window.Duration.Duration)) {
+				return true, now, nil
+			}
+			if windowStart.After(now) && (next.IsZero() || windowStart.Before(next)) {
+				next = windowStart
+			}
+		}
+	}
+	return len(windows) == 0, next, nil
+}
+
+// windowOnDay tells if the window starts on the day of the week
+func windowOnDay(window v1alpha1.MaintenanceWindow, weekday time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, day := range window.Days {
+		if strings.EqualFold(string(day), weekday.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordUpgrade appends the upgrade to the status of the instance, only the
+// last upgrades are kept
+func RecordUpgrade(cr *v1alpha1.EntandoBundleInstanceV2, record v1alpha1.UpgradeRecord) {
+	cr.Status.Upgrades = append(cr.Status.Upgrades, record)
+	if len(cr.Status.Upgrades) > maxUpgradeRecords {
+		cr.Status.Upgrades = cr.Status.Upgrades[len(cr.Status.Upgrades)-maxUpgradeRecords:]
+	}
+}
+
+// IsUpgradeRecorded tells if the last upgrade recorded is the one to the
+// digest of the instance
+func IsUpgradeRecorded(cr *v1alpha1.EntandoBundleInstanceV2) bool {
+	upgrades := cr.Status.Upgrades
+	return len(upgrades) > 0 && upgrades[len(upgrades)-1].ToDigest == cr.Spec.Digest
+}
+
+// DigestManager returns the manager of the last change of the digest of the
+// instance, from the managed fields, empty when unknown
+func DigestManager(cr *v1alpha1.EntandoBundleInstanceV2) string {
+	manager := ""
+	var last *metav1.Time
+	for _, entry := range cr.GetManagedFields() {
+		if entry.FieldsV1 == nil || !strings.Contains(string(entry.FieldsV1.Raw), `"f:digest"`) {
+			continue
+		}
+		if last == nil || (entry.Time != nil && !entry.Time.Before(last)) {
+			manager, last = entry.Manager, entry.Time
+		}
+	}
+	return manager
+}
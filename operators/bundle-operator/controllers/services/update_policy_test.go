@@ -0,0 +1,130 @@
+package services
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpgradeTarget(t *testing.T) {
+	bundle := &v1alpha1.EntandoBundleV2{
+		ObjectMeta: metav1.ObjectMeta{Name: "bundle-1234", Namespace: "test"},
+		Spec:       v1alpha1.EntandoBundleV2Spec{TagDiscovery: &v1alpha1.TagDiscovery{}},
+		Status: v1alpha1.EntandoBundleV2Status{
+			Tags: []v1alpha1.EntandoBundleTagStatus{
+				{Tag: "v1.0.0", Digest: "sha256:100", Verified: true},
+				{Tag: "v1.0.1", Digest: "sha256:101", Verified: true},
+				{Tag: "v1.0.2", Digest: "sha256:102"},
+				{Tag: "latest", Digest: "sha256:200", Verified: true},
+			},
+			Discovery: &v1alpha1.TagDiscoveryStatus{Versions: []v1alpha1.DiscoveredVersion{
+				{Tag: "v1.1.0", Digest: "sha256:110", Verified: true},
+				{Tag: "v1.2.0-rc.1", Digest: "sha256:120", Verified: true},
+				{Tag: "v2.0.0", Digest: "sha256:200", Verified: true},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		tag      string
+		digest   string
+		strategy v1alpha1.UpdateStrategy
+		expected string
+	}{
+		{name: "pinned", tag: "v1.0.0", digest: "sha256:100", strategy: v1alpha1.UpdateStrategyPinned},
+		{name: "no policy", tag: "v1.0.0", digest: "sha256:100"},
+		{name: "patch", tag: "v1.0.0", digest: "sha256:100", strategy: v1alpha1.UpdateStrategyPatch, expected: "v1.0.1"},
+		{name: "minor", tag: "v1.0.0", digest: "sha256:100", strategy: v1alpha1.UpdateStrategyMinor, expected: "v1.1.0"},
+		{name: "latest verified", tag: "v1.0.0", digest: "sha256:100", strategy: v1alpha1.UpdateStrategyLatestVerified, expected: "v2.0.0"},
+		{name: "up to date", tag: "v1.1.0", digest: "sha256:110", strategy: v1alpha1.UpdateStrategyMinor},
+		{name: "tag not a version", tag: "latest", digest: "sha256:100", strategy: v1alpha1.UpdateStrategyMinor},
+		{name: "tag not a version latest verified", tag: "nightly", digest: "sha256:100",
+			strategy: v1alpha1.UpdateStrategyLatestVerified, expected: "v2.0.0"},
+		{name: "digest of the tag", tag: "v1.0.1", strategy: v1alpha1.UpdateStrategyPinned, expected: "v1.0.1"},
+		{name: "tag not verified", tag: "v1.0.2", strategy: v1alpha1.UpdateStrategyPatch},
+		{name: "first digest", strategy: v1alpha1.UpdateStrategyMinor, expected: "v2.0.0"},
+	}
+	for _, test := range tests {
+		instance := &v1alpha1.EntandoBundleInstanceV2{Spec: v1alpha1.EntandoBundleInstanceV2Spec{
+			BundleRef: "bundle-1234", Tag: test.tag, Digest: test.digest,
+			UpdatePolicy: &v1alpha1.UpdatePolicy{Strategy: test.strategy},
+		}}
+		target := UpgradeTarget(instance, bundle)
+		actual := ""
+		if target != nil {
+			actual = target.Tag
+		}
+		if actual != test.expected {
+			t.Fatalf("%s: expected target %q, got %q", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestMaintenanceWindowAt(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2022, time.December, 7, 10, 30, 0, 0, time.UTC)
+	window := func(days []v1alpha1.WeekDay, start string, duration time.Duration, timeZone string) v1alpha1.MaintenanceWindow {
+		return v1alpha1.MaintenanceWindow{Days: days, Start: start, Duration: metav1.Duration{Duration: duration}, TimeZone: timeZone}
+	}
+
+	tests := []struct {
+		name    string
+		windows []v1alpha1.MaintenanceWindow
+		open    bool
+		next    time.Time
+		invalid bool
+	}{
+		{name: "no windows", open: true},
+		{name: "every day open", windows: []v1alpha1.MaintenanceWindow{window(nil, "10:00", time.Hour, "")}, open: true},
+		{name: "every day closed", windows: []v1alpha1.MaintenanceWindow{window(nil, "22:00", 2*time.Hour, "")},
+			next: time.Date(2022, time.December, 7, 22, 0, 0, 0, time.UTC)},
+		{name: "started the day before", windows: []v1alpha1.MaintenanceWindow{window([]v1alpha1.WeekDay{"Tue"}, "22:00", 13*time.Hour, "")}, open: true},
+		{name: "next week", windows: []v1alpha1.MaintenanceWindow{window([]v1alpha1.WeekDay{"Wed"}, "02:00", time.Hour, "")},
+			next: time.Date(2022, time.December, 14, 2, 0, 0, 0, time.UTC)},
+		{name: "closest window", windows: []v1alpha1.MaintenanceWindow{
+			window([]v1alpha1.WeekDay{"Sat", "Sun"}, "01:00", time.Hour, ""),
+			window([]v1alpha1.WeekDay{"Fri"}, "20:00", time.Hour, ""),
+		}, next: time.Date(2022, time.December, 9, 20, 0, 0, 0, time.UTC)},
+		{name: "time zone", windows: []v1alpha1.MaintenanceWindow{window(nil, "11:00", time.Hour, "Europe/Rome")}, open: true},
+		{name: "invalid time zone", windows: []v1alpha1.MaintenanceWindow{window(nil, "11:00", time.Hour, "Nowhere/Town")}, invalid: true},
+		{name: "invalid start", windows: []v1alpha1.MaintenanceWindow{window(nil, "25:00", time.Hour, "")}, invalid: true},
+		{name: "invalid duration", windows: []v1alpha1.MaintenanceWindow{window(nil, "10:00", 0, "")}, invalid: true},
+	}
+	for _, test := range tests {
+		open, next, err := MaintenanceWindowAt(test.windows, now)
+		if test.invalid {
+			if err == nil {
+				t.Fatalf("%s: expected invalid window", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if open != test.open || (!open && !next.Equal(test.next)) {
+			t.Fatalf("%s: expected open %v next %s, got %v %s", test.name, test.open, test.next, open, next)
+		}
+	}
+}
+
+func TestRecordUpgrade(t *testing.T) {
+	cr := &v1alpha1.EntandoBundleInstanceV2{}
+	for i := 0; i < 15; i++ {
+		RecordUpgrade(cr, v1alpha1.UpgradeRecord{ToDigest: "sha256:" + strconv.Itoa(i), TriggeredBy: "update policy Patch"})
+	}
+	if len(cr.Status.Upgrades) != maxUpgradeRecords || cr.Status.Upgrades[0].ToDigest != "sha256:5" {
+		t.Fatalf("Expected the last %d upgrades, got %+v", maxUpgradeRecords, cr.Status.Upgrades)
+	}
+	cr.Spec.Digest = "sha256:14"
+	if !IsUpgradeRecorded(cr) {
+		t.Fatal("Expected the upgrade to the digest recorded")
+	}
+	cr.Spec.Digest = "sha256:15"
+	if IsUpgradeRecorded(cr) {
+		t.Fatal("Expected the upgrade to the digest not recorded")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// descriptor-schema writes the JSON Schema of every supported bundle
+// descriptor format into the output directory
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+)
+
+func main() {
+	var outputDir string
+	flag.StringVar(&outputDir, "output-dir", "config/bundle-spec/schema", "The directory where the schemas are written.")
+	flag.Parse()
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for _, apiVersion := range bundles.SupportedDescriptorAPIVersions() {
+		schema, err := bundles.DescriptorJSONSchema(apiVersion)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fileName := filepath.Join(outputDir, bundles.DescriptorJSONSchemaFileName(apiVersion))
+		if err := os.WriteFile(fileName, schema, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("written " + fileName)
+	}
+}
@@ -20,6 +20,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -35,8 +38,11 @@ import (
 
 	utility "github.com/gigiozzz/depiy/common-libs/utilities"
 	bundlev1alpha1 "github.com/gigiozzz/depiy/operators/bundle-operator/api/v1alpha1"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/bundles"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/catalog"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/bundle"
 	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/instance"
+	"github.com/gigiozzz/depiy/operators/bundle-operator/controllers/services"
 	pluginv1alpha1 "github.com/gigiozzz/depiy/operators/plugin-operator/api/v1alpha1"
 	//+kubebuilder:scaffold:imports
 )
@@ -59,11 +65,58 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var bundleCacheDir string
+	var bundleCacheMaxSize int64
+	var signaturePolicy string
+	var catalogAddr string
+	var catalogCertFile string
+	var catalogKeyFile string
+	var catalogInsecure bool
+	var catalogReviewTTL time.Duration
+	var catalogAudiences string
+	var localBundleRoots string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.Int64Var(&bundles.DefaultExtractLimits.MaxSize, "bundle-max-size", bundles.DefaultExtractLimits.MaxSize,
+		"The maximum total size in bytes of the files extracted from a bundle image.")
+	flag.IntVar(&bundles.DefaultExtractLimits.MaxFiles, "bundle-max-files", bundles.DefaultExtractLimits.MaxFiles,
+		"The maximum number of entries extracted from a bundle image.")
+	flag.StringVar(&localBundleRoots, "local-bundle-roots", "",
+		"The comma separated directories the oci-layout:// and tarball:// bundle sources must be in, "+
+			"the local sources are rejected when empty.")
+	flag.StringVar(&bundleCacheDir, "bundle-cache-dir", filepath.Join(os.TempDir(), "bundle-cache"),
+		"The directory of the cache of the extracted bundles, it can be a persistent volume. "+
+			"When empty the bundles are not extracted and their files are read from the registry when needed.")
+	flag.Int64Var(&bundleCacheMaxSize, "bundle-cache-max-size", 2<<30,
+		"The maximum size in bytes of the cache of the extracted bundles, 0 for no limit.")
+	flag.StringVar(&services.RegistryMirrorsConfigMap, "registry-mirrors-configmap", services.RegistryMirrorsConfigMap,
+		"The ConfigMap in the namespace of the operator with the mirror rules of the pulls, empty for no rules.")
+	flag.StringVar(&services.SigstoreTrustConfigMap, "sigstore-trust-configmap", services.SigstoreTrustConfigMap,
+		"The ConfigMap in the namespace of the operator with the trust roots of the keyless signatures. "+
+			"When missing the roots of the public Sigstore instance are used.")
+	flag.StringVar(&signaturePolicy, "signature-policy", string(services.DefaultSignaturePolicy),
+		"The signature policy of the bundles without one and the least strict policy of the bundles: Off, Warn or Enforce.")
+	flag.DurationVar(&services.SignatureReverifyInterval, "signature-reverify-interval", services.SignatureReverifyInterval,
+		"The interval the signatures of the bundles are verified again, so that revoked keys reach verified digests. "+
+			"0 verifies them only when a bundle changes.")
+	flag.StringVar(&services.RevokedKeysConfigMap, "revoked-keys-configmap", services.RevokedKeysConfigMap,
+		"The ConfigMap in the namespace of the operator with the revoked public keys, empty for no revocation.")
+	flag.BoolVar(&services.ScaleDownRevokedInstances, "scale-down-revoked-instances", services.ScaleDownRevokedInstances,
+		"Scale down the workloads of the instances whose digest is no longer verified under the Enforce policy.")
+	flag.StringVar(&catalogAddr, "catalog-bind-address", "",
+		"The address the read only API of the bundle catalog binds to, empty to disable the API.")
+	flag.StringVar(&catalogCertFile, "catalog-tls-cert-file", "",
+		"The TLS certificate of the catalog API, required unless --catalog-insecure is set.")
+	flag.StringVar(&catalogKeyFile, "catalog-tls-key-file", "", "The TLS key of the catalog API.")
+	flag.BoolVar(&catalogInsecure, "catalog-insecure", false,
+		"Serve the catalog API over plain HTTP without TLS certificate, the bearer tokens are sent in clear.")
+	flag.DurationVar(&catalogReviewTTL, "catalog-review-ttl", catalog.DefaultReviewTTL,
+		"How long the token and the access reviews of the catalog API are kept.")
+	flag.StringVar(&catalogAudiences, "catalog-token-audiences", "",
+		"The comma separated audiences the tokens of the catalog API must be issued for, the ones of the API server when empty.")
 	opts := zap.Options{
 		Development: true,
 		TimeEncoder: zapcore.ISO8601TimeEncoder,
@@ -81,6 +134,32 @@ func main() {
 	setupLog.Info(fmt.Sprintf("Watching namespace '%s'", namespace))
 	setupLog.Info(fmt.Sprintf("Operator deployment type '%s'", utility.GetOperatorDeploymentType()))
 
+	switch policy := bundlev1alpha1.SignaturePolicy(signaturePolicy); policy {
+	case bundlev1alpha1.SignaturePolicyOff, bundlev1alpha1.SignaturePolicyWarn, bundlev1alpha1.SignaturePolicyEnforce:
+		services.DefaultSignaturePolicy = policy
+	default:
+		setupLog.Error(fmt.Errorf("unknown policy %q", signaturePolicy), "invalid signature policy")
+		os.Exit(1)
+	}
+	if catalogAddr != "" && catalogCertFile == "" && !catalogInsecure {
+		setupLog.Error(fmt.Errorf("--catalog-tls-cert-file is required unless --catalog-insecure is set"), "invalid catalog API")
+		os.Exit(1)
+	}
+
+	var bundleCache *bundles.Cache
+	if bundleCacheDir != "" {
+		var err error
+		bundleCache, err = bundles.NewCache(bundleCacheDir, bundleCacheMaxSize)
+		if err != nil {
+			setupLog.Error(err, "unable to open the bundle cache", "dir", bundleCacheDir)
+			os.Exit(1)
+		}
+	}
+
+	if localBundleRoots != "" {
+		bundles.LocalSourceRoots = strings.Split(localBundleRoots, ",")
+	}
+
 	options := ctrl.Options{
 		Scheme:                 scheme,
 		Namespace:              namespace,
@@ -97,13 +176,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = bundle.NewEntandoBundleV2Reconciler(mgr.GetClient(), ctrl.Log, mgr.GetScheme(), mgr.GetEventRecorderFor("entandobundle-controller")).
+	if err = bundle.NewEntandoBundleV2Reconciler(mgr.GetClient(), ctrl.Log, mgr.GetScheme(), mgr.GetEventRecorderFor("entandobundle-controller"), bundleCache).
 		SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "EntandoBundleV2")
 		os.Exit(1)
 	}
 
-	if err = instance.NewEntandoBundleInstanceV2Reconciler(mgr.GetClient(), ctrl.Log, mgr.GetScheme(), mgr.GetEventRecorderFor("entandobundleinstance-controller")).
+	if err = instance.NewEntandoBundleInstanceV2Reconciler(mgr.GetClient(), ctrl.Log, mgr.GetScheme(), mgr.GetEventRecorderFor("entandobundleinstance-controller"), bundleCache).
 		SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "EntandoBundleV2")
 		os.Exit(1)
@@ -111,6 +190,25 @@ func main() {
 
 	//+kubebuilder:scaffold:builder
 
+	if catalogAddr != "" {
+		auth := &catalog.Authenticator{Client: mgr.GetClient(), TTL: catalogReviewTTL}
+		if catalogAudiences != "" {
+			auth.Audiences = strings.Split(catalogAudiences, ",")
+		}
+		if err := mgr.Add(&catalog.Server{
+			Addr:     catalogAddr,
+			CertFile: catalogCertFile,
+			KeyFile:  catalogKeyFile,
+			Insecure: catalogInsecure,
+			Catalog:  catalog.NewCatalog(mgr.GetClient(), bundleCache),
+			Auth:     auth,
+			Log:      ctrl.Log.WithName("catalog"),
+		}); err != nil {
+			setupLog.Error(err, "unable to set up the bundle catalog")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -57,6 +57,8 @@ type EntandoPluginV2Spec struct {
 	IngressHost          string                  `json:"ingressHost,omitempty"`
 	IngressPath          string                  `json:"ingressPath,omitempty"`
 	Image                string                  `json:"image,omitempty"`
+	// ImagePullSecrets are the secrets used to pull the image of the plugin
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 	// +kubebuilder:default:=1
 	Replicas int32 `json:"replicas,omitempty"`
 	// +kubebuilder:default:=8080
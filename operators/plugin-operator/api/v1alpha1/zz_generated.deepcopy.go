@@ -121,6 +121,11 @@ func (in *EntandoPluginV2Spec) DeepCopyInto(out *EntandoPluginV2Spec) {
 		*out = make([]EntandoPluginV2Volume, len(*in))
 		copy(*out, *in)
 	}
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]v1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EntandoPluginV2Spec.
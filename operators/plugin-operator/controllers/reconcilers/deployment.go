@@ -55,6 +55,7 @@ func (d *DeployManager) buildDeployment(cr *v1alpha1.EntandoPluginV2, scheme *ru
 					Labels: labels,
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets: cr.Spec.ImagePullSecrets,
 					Containers: []corev1.Container{{
 						Image:           cr.Spec.Image,
 						ImagePullPolicy: corev1.PullIfNotPresent,